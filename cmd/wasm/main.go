@@ -3,14 +3,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"strings"
 	"syscall/js"
+	"time"
 
 	parser "github.com/Saki-tw/go-tw-his-parser"
 )
 
 // parseHISData 解析 HIS 資料並返回 JSON
+// 參數: 內容字串, 檔名 (選填), 廠商代碼 (選填，空值為自動偵測)
 func parseHISData(this js.Value, args []js.Value) interface{} {
 	if len(args) < 1 {
 		return map[string]interface{}{
@@ -19,14 +21,92 @@ func parseHISData(this js.Value, args []js.Value) interface{} {
 		}
 	}
 
-	content := args[0].String()
+	return parseContent([]byte(args[0].String()), args[1:])
+}
+
+// parseHISDataBytes 解析原始位元組 (Uint8Array)，可處理 Big5 等非 UTF-8 檔案
+// 參數: Uint8Array, 檔名 (選填), 廠商代碼 (選填，空值為自動偵測)
+func parseHISDataBytes(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 || args[0].Type() != js.TypeObject {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "請提供要解析的資料 (Uint8Array)",
+		}
+	}
+
+	return parseContent(jsBytes(args[0]), args[1:])
+}
+
+const (
+	progressEvery = 200                  // 每處理幾筆記錄回報一次進度
+	progressYield = 4 * time.Millisecond // 回報後讓出執行權的時間 (瀏覽器 setTimeout 最小間隔)
+)
+
+// parseHISDataWithProgress 解析資料並以 callback 回報進度，回傳 Promise (resolve 值與 parseHISData 相同)
+// 參數: 內容 (字串或 Uint8Array), 進度回呼 function(percent, done, total), 檔名 (選填), 廠商代碼 (選填)
+// WASM 為單執行緒: 解析在 goroutine 中進行，每次回報後以 time.Sleep (setTimeout) 讓出，瀏覽器才能更新畫面
+func parseHISDataWithProgress(this js.Value, args []js.Value) interface{} {
+	if len(args) < 2 || args[1].Type() != js.TypeFunction {
+		return map[string]interface{}{
+			"success": false,
+			"error":   "請提供要解析的資料與進度回呼函數",
+		}
+	}
+
+	var content []byte
+	if args[0].Type() == js.TypeString {
+		content = []byte(args[0].String())
+	} else {
+		content = jsBytes(args[0])
+	}
+	callback := args[1]
+	rest := args[2:]
+
+	// Promise executor 同步執行，建立 Promise 後即可釋放
+	executor := js.FuncOf(func(this js.Value, p []js.Value) interface{} {
+		resolve := p[0]
+		go func() {
+			lastPercent := -1
+			progress := func(done, total int) {
+				percent := 100
+				if total > 0 && done < total {
+					percent = done * 100 / total
+				}
+				if percent == lastPercent {
+					return
+				}
+				lastPercent = percent
+				callback.Invoke(percent, done, total)
+				time.Sleep(progressYield)
+			}
+			resolve.Invoke(js.ValueOf(parseContent(content, rest, parser.WithProgress(progressEvery, progress))))
+		}()
+		return nil
+	})
+	defer executor.Release()
+	return js.Global().Get("Promise").New(executor)
+}
+
+// jsBytes 將 Uint8Array 複製為 Go 位元組
+func jsBytes(v js.Value) []byte {
+	content := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(content, v)
+	return content
+}
+
+// parseContent 依選填的檔名與廠商參數解析內容並組成回傳結構
+func parseContent(content []byte, args []js.Value, opts ...parser.ParseOption) interface{} {
 	filename := "input.txt"
-	if len(args) >= 2 {
-		filename = args[1].String()
+	if len(args) >= 1 && args[0].Type() == js.TypeString && args[0].String() != "" {
+		filename = args[0].String()
+	}
+	vendor := parser.VendorAuto
+	if len(args) >= 2 && args[1].Type() == js.TypeString && args[1].String() != "" {
+		vendor = parser.HISVendor(args[1].String())
 	}
 
 	// 解析資料
-	result, err := parser.ParseHISFileAuto(strings.NewReader(content), filename)
+	result, err := parser.ParseWithOptions(bytes.NewReader(content), filename, vendor, opts...)
 	if err != nil {
 		return map[string]interface{}{
 			"success": false,
@@ -46,15 +126,18 @@ func parseHISData(this js.Value, args []js.Value) interface{} {
 	return map[string]interface{}{
 		"success": true,
 		"data":    string(jsonBytes),
-		"summary": map[string]interface{}{
-			"patients":      len(result.Patients),
-			"prescriptions": len(result.Prescriptions),
-			"sourceType":    result.SourceType,
-			"sourceVendor":  result.SourceVendor,
-		},
+		"summary": summaryJSON(result),
 	}
 }
 
+// summaryJSON 將統計摘要轉為 JS 可直接使用的物件 (欄位與 Web /api/parse 的 summary 相同)
+func summaryJSON(result *parser.HISImportResult) map[string]interface{} {
+	var summary map[string]interface{}
+	jsonBytes, _ := json.Marshal(result.Summary())
+	json.Unmarshal(jsonBytes, &summary)
+	return summary
+}
+
 // getSupportedVendors 取得支援的廠商列表
 func getSupportedVendors(this js.Value, args []js.Value) interface{} {
 	vendors := parser.GetSupportedVendors()
@@ -62,12 +145,21 @@ func getSupportedVendors(this js.Value, args []js.Value) interface{} {
 	return string(jsonBytes)
 }
 
+// getVisitTypes 取得就醫類別對照表
+func getVisitTypes(this js.Value, args []js.Value) interface{} {
+	jsonBytes, _ := json.Marshal(parser.GetVisitTypes())
+	return string(jsonBytes)
+}
+
 func main() {
 	c := make(chan struct{}, 0)
 
 	// 註冊全域函數
 	js.Global().Set("parseHISData", js.FuncOf(parseHISData))
+	js.Global().Set("parseHISDataBytes", js.FuncOf(parseHISDataBytes))
+	js.Global().Set("parseHISDataWithProgress", js.FuncOf(parseHISDataWithProgress))
 	js.Global().Set("getSupportedVendors", js.FuncOf(getSupportedVendors))
+	js.Global().Set("getVisitTypes", js.FuncOf(getVisitTypes))
 
 	// 設定 ready 標誌
 	js.Global().Set("wasmReady", true)
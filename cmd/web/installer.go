@@ -163,9 +163,25 @@ func Install() error {
 		}
 	}
 
+	// 加入 PATH 供終端機直接執行
+	if err := addToPath(config); err != nil {
+		fmt.Printf("加入 PATH 失敗（可忽略）: %v\n", err)
+	}
+
 	return nil
 }
 
+// AddToPath 讓終端機可直接執行已安裝的程式
+// Linux/macOS 於 ~/.local/bin 建立 symlink；Windows 將安裝目錄加入使用者 PATH
+// 已加入時不重複處理
+func AddToPath() error {
+	config, err := GetInstallConfig()
+	if err != nil {
+		return err
+	}
+	return addToPath(config)
+}
+
 // copyFile 複製檔案
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
@@ -194,8 +210,9 @@ func Uninstall() error {
 		return err
 	}
 
-	// 移除捷徑
+	// 移除捷徑與 PATH 項目
 	removeShortcut(config)
+	removeFromPath(config)
 
 	// 移除安裝目錄
 	return os.RemoveAll(config.InstallPath)
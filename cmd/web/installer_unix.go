@@ -138,17 +138,60 @@ func removeShortcut(config *InstallConfig) {
 	}
 }
 
+// cliLinkPath 終端機用 symlink 路徑 (~/.local/bin/his-parser)
+func cliLinkPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "bin", AppID), nil
+}
+
+// addToPath 在 ~/.local/bin 建立指向執行檔的 symlink
+func addToPath(config *InstallConfig) error {
+	linkPath, err := cliLinkPath()
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Lstat(linkPath); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%s 已存在且不是 symlink", linkPath)
+		}
+		if target, err := os.Readlink(linkPath); err == nil && target == config.ExePath {
+			return nil // 已建立
+		}
+		os.Remove(linkPath)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(config.ExePath, linkPath)
+}
+
+// removeFromPath 移除指向執行檔的 symlink (僅移除本程式建立的連結)
+func removeFromPath(config *InstallConfig) {
+	linkPath, err := cliLinkPath()
+	if err != nil {
+		return
+	}
+	if target, err := os.Readlink(linkPath); err == nil && target == config.ExePath {
+		os.Remove(linkPath)
+	}
+}
+
 // launchInstalled 啟動已安裝的版本
 func launchInstalled(exePath string) error {
 	if runtime.GOOS == "darwin" {
 		// macOS: 使用 open 指令開啟 .app
 		home, _ := os.UserHomeDir()
 		appPath := filepath.Join(home, "Applications", "HIS Parser.app")
-		cmd := exec.Command("open", appPath)
+		cmd := exec.Command("open", append([]string{appPath, "--args"}, os.Args[1:]...)...)
 		return cmd.Start()
 	}
 
-	// Linux: 直接執行
-	cmd := exec.Command(exePath)
+	// Linux: 直接執行（沿用命令列旗標）
+	cmd := exec.Command(exePath, os.Args[1:]...)
 	return cmd.Start()
 }
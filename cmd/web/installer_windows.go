@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -24,6 +25,9 @@ var (
 	coInitializeEx  = ole32.NewProc("CoInitializeEx")
 	coUninitialize  = ole32.NewProc("CoUninitialize")
 	coCreateInstance = ole32.NewProc("CoCreateInstance")
+
+	user32              = syscall.NewLazyDLL("user32.dll")
+	sendMessageTimeoutW = user32.NewProc("SendMessageTimeoutW")
 )
 
 const (
@@ -109,6 +113,100 @@ func removeShortcut(config *InstallConfig) {
 	}
 }
 
+// getUserPath 讀取使用者 PATH (HKCU\Environment) 的原始值，不展開 %USERPROFILE% 等變數
+func getUserPath() (string, error) {
+	out, err := exec.Command("powershell", "-NoProfile", "-Command",
+		"(Get-Item -Path 'HKCU:\\Environment').GetValue('Path', '', 'DoNotExpandEnvironmentNames')").Output()
+	if err != nil {
+		return "", fmt.Errorf("讀取使用者 PATH 失敗: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// setUserPath 寫入使用者 PATH 並通知其他程式重新載入
+// 保留原本的登錄值類型 (預設為 REG_EXPAND_SZ)，避免含 % 變數的項目被改成 REG_SZ 後失效
+func setUserPath(path string) error {
+	psScript := fmt.Sprintf(`$k = [Microsoft.Win32.Registry]::CurrentUser.OpenSubKey('Environment', $true)
+$kind = [Microsoft.Win32.RegistryValueKind]::ExpandString
+if ($k.GetValueNames() -contains 'Path') { $kind = $k.GetValueKind('Path') }
+$k.SetValue('Path', '%s', $kind)
+$k.Close()`, strings.ReplaceAll(path, "'", "''"))
+	if err := exec.Command("powershell", "-NoProfile", "-Command", psScript).Run(); err != nil {
+		return fmt.Errorf("寫入使用者 PATH 失敗: %w", err)
+	}
+	broadcastEnvironmentChange()
+	return nil
+}
+
+// broadcastEnvironmentChange 廣播 WM_SETTINGCHANGE，讓檔案總管等程式重新讀取環境變數
+func broadcastEnvironmentChange() {
+	const (
+		hwndBroadcast   = 0xFFFF
+		wmSettingChange = 0x001A
+		smtoAbortIfHung = 0x0002
+	)
+	env, err := syscall.UTF16PtrFromString("Environment")
+	if err != nil {
+		return
+	}
+	var result uintptr
+	sendMessageTimeoutW.Call(hwndBroadcast, wmSettingChange, 0, uintptr(unsafe.Pointer(env)),
+		smtoAbortIfHung, 5000, uintptr(unsafe.Pointer(&result)))
+}
+
+// splitPathList 拆分 PATH 並去除空項目
+func splitPathList(path string) []string {
+	var dirs []string
+	for _, dir := range strings.Split(path, ";") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// samePath 不分大小寫比較路徑 (忽略結尾的反斜線)
+func samePath(a, b string) bool {
+	return strings.EqualFold(strings.TrimRight(a, `\`), strings.TrimRight(b, `\`))
+}
+
+// addToPath 將安裝目錄加入使用者 PATH
+func addToPath(config *InstallConfig) error {
+	current, err := getUserPath()
+	if err != nil {
+		return err
+	}
+
+	dirs := splitPathList(current)
+	for _, dir := range dirs {
+		if samePath(dir, config.InstallPath) {
+			return nil // 已在 PATH 中
+		}
+	}
+	return setUserPath(strings.Join(append(dirs, config.InstallPath), ";"))
+}
+
+// removeFromPath 從使用者 PATH 移除安裝目錄
+func removeFromPath(config *InstallConfig) {
+	current, err := getUserPath()
+	if err != nil {
+		return
+	}
+
+	var kept []string
+	removed := false
+	for _, dir := range splitPathList(current) {
+		if samePath(dir, config.InstallPath) {
+			removed = true
+			continue
+		}
+		kept = append(kept, dir)
+	}
+	if removed {
+		setUserPath(strings.Join(kept, ";"))
+	}
+}
+
 // createMacOSApp Windows 不需要（佔位）
 func createMacOSApp(config *InstallConfig) error {
 	return nil
@@ -116,6 +214,6 @@ func createMacOSApp(config *InstallConfig) error {
 
 // launchInstalled 啟動已安裝的版本
 func launchInstalled(exePath string) error {
-	cmd := exec.Command(exePath)
+	cmd := exec.Command(exePath, os.Args[1:]...)
 	return cmd.Start()
 }
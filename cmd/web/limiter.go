@@ -0,0 +1,144 @@
+// 解析並行數限制
+// 避免多人同時上傳大檔時記憶體耗盡
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConcurrentParses = 2
+	defaultMaxQueuedParses     = 8
+	defaultQueueWait           = 30 * time.Second
+)
+
+// ParseLimiter 限制同時進行的解析數量，超過時排隊等待
+type ParseLimiter struct {
+	slots    chan struct{}
+	maxQueue int
+	maxWait  time.Duration
+
+	mu          sync.Mutex
+	waiting     int
+	avgDuration time.Duration // 近期平均解析耗時 (用於估計等待時間)
+}
+
+// ErrParseQueueFull 排隊人數已滿或等待逾時
+type ErrParseQueueFull struct {
+	QueueLength int
+	RetryAfter  time.Duration
+}
+
+func (e *ErrParseQueueFull) Error() string {
+	return fmt.Sprintf("伺服器忙碌中，目前有 %d 個檔案等待解析，請約 %d 秒後再試",
+		e.QueueLength, int(e.RetryAfter.Seconds()))
+}
+
+// NewParseLimiter 建立解析限制器
+func NewParseLimiter(maxConcurrent, maxQueue int, maxWait time.Duration) *ParseLimiter {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	if maxQueue < 0 {
+		maxQueue = 0
+	}
+	return &ParseLimiter{
+		slots:       make(chan struct{}, maxConcurrent),
+		maxQueue:    maxQueue,
+		maxWait:     maxWait,
+		avgDuration: 2 * time.Second,
+	}
+}
+
+// NewParseLimiterFromEnv 由環境變數建立解析限制器
+// HIS_PARSER_MAX_PARSES: 同時解析上限, HIS_PARSER_MAX_QUEUE: 排隊上限
+func NewParseLimiterFromEnv() *ParseLimiter {
+	return NewParseLimiter(
+		envInt("HIS_PARSER_MAX_PARSES", defaultMaxConcurrentParses),
+		envInt("HIS_PARSER_MAX_QUEUE", defaultMaxQueuedParses),
+		defaultQueueWait,
+	)
+}
+
+// Acquire 取得解析名額，回傳的 release 必須在解析完成後呼叫
+// 排隊中 ctx 被取消 (如使用者關閉連線) 時立即離開佇列並回傳 ctx.Err()
+func (l *ParseLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	// 有空位時直接取得
+	select {
+	case l.slots <- struct{}{}:
+		return l.releaseFunc(time.Now()), nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.waiting >= l.maxQueue {
+		queueErr := &ErrParseQueueFull{QueueLength: l.waiting, RetryAfter: l.estimateWaitLocked(l.waiting + 1)}
+		l.mu.Unlock()
+		return nil, queueErr
+	}
+	l.waiting++
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.releaseFunc(time.Now()), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		l.mu.Lock()
+		queueErr := &ErrParseQueueFull{QueueLength: l.waiting, RetryAfter: l.estimateWaitLocked(l.waiting)}
+		l.mu.Unlock()
+		return nil, queueErr
+	}
+}
+
+// releaseFunc 釋放名額並更新平均耗時
+func (l *ParseLimiter) releaseFunc(start time.Time) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			elapsed := time.Since(start)
+			l.mu.Lock()
+			l.avgDuration = (l.avgDuration*4 + elapsed) / 5
+			l.mu.Unlock()
+			<-l.slots
+		})
+	}
+}
+
+// estimateWaitLocked 估計排在第 position 位時的等待時間 (呼叫端需持有鎖)
+func (l *ParseLimiter) estimateWaitLocked(position int) time.Duration {
+	rounds := (position + cap(l.slots) - 1) / cap(l.slots)
+	if rounds < 1 {
+		rounds = 1
+	}
+	wait := time.Duration(rounds) * l.avgDuration
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait.Round(time.Second)
+}
+
+// envInt 讀取整數環境變數，無效時使用預設值
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseLimiterAcquireCanceled(t *testing.T) {
+	l := NewParseLimiter(1, 1, time.Minute)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(ctx)
+		done <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Acquire error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Acquire did not return after cancel")
+	}
+
+	// 取消後應離開佇列，排隊名額可再使用
+	l.mu.Lock()
+	waiting := l.waiting
+	l.mu.Unlock()
+	if waiting != 0 {
+		t.Errorf("waiting = %d, want 0", waiting)
+	}
+}
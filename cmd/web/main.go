@@ -5,13 +5,19 @@ package main
 import (
 	"embed"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	parser "github.com/Saki-tw/go-tw-his-parser"
@@ -23,7 +29,75 @@ var indexHTML embed.FS
 // 全域更新管理器
 var updater *Updater
 
+// 全域解析並行限制
+var parseLimiter = NewParseLimiterFromEnv()
+
+// 全域解析結果快取 (供分頁請求使用)
+var resultCache = NewResultCacheFromEnv()
+
+// serverConfig 伺服器啟動設定 (命令列旗標優先於環境變數)
+type serverConfig struct {
+	Addr      string // 綁定位址，預設 127.0.0.1 (HIS_PARSER_ADDR)
+	Port      int    // 綁定埠，0 為自動尋找 (HIS_PARSER_PORT)
+	NoBrowser bool   // 不自動開啟瀏覽器
+}
+
+// loadServerConfig 讀取環境變數與命令列旗標
+func loadServerConfig(args []string) (serverConfig, error) {
+	cfg := serverConfig{
+		Addr: "127.0.0.1",
+		Port: envInt("HIS_PARSER_PORT", 0),
+	}
+	if v := strings.TrimSpace(os.Getenv("HIS_PARSER_ADDR")); v != "" {
+		cfg.Addr = v
+	}
+
+	fs := flag.NewFlagSet("his-parser", flag.ContinueOnError)
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "綁定位址 (0.0.0.0 監聽所有介面)，環境變數 HIS_PARSER_ADDR")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "綁定埠 (0 為自動尋找)，環境變數 HIS_PARSER_PORT")
+	fs.BoolVar(&cfg.NoBrowser, "no-browser", false, "啟動後不自動開啟瀏覽器")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return cfg, fmt.Errorf("埠號 %d 超出範圍 (0-65535)", cfg.Port)
+	}
+	return cfg, nil
+}
+
+// listen 依設定綁定位址與埠；指定埠被佔用時回傳錯誤，不會改用其他埠
+func listen(cfg serverConfig) (net.Listener, error) {
+	port := cfg.Port
+	if port == 0 {
+		port = findAvailablePort(cfg.Addr)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(cfg.Addr, strconv.Itoa(port)))
+	if err != nil && cfg.Port != 0 {
+		return nil, fmt.Errorf("無法綁定 %s:%d (埠可能已被佔用): %w", cfg.Addr, cfg.Port, err)
+	}
+	return listener, err
+}
+
+// browserURL 瀏覽器開啟的網址 (監聽所有介面時改用 127.0.0.1)
+func browserURL(listener net.Listener) string {
+	tcpAddr := listener.Addr().(*net.TCPAddr)
+	host := tcpAddr.IP.String()
+	if tcpAddr.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port))
+}
+
 func main() {
+	cfg, err := loadServerConfig(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Printf("參數錯誤: %v\n", err)
+		os.Exit(2)
+	}
+
 	// 一鍵安裝：首次執行時自動安裝到使用者目錄
 	if !CheckAndInstall() {
 		// 已啟動新安裝的版本，結束目前程式
@@ -34,63 +108,72 @@ func main() {
 	updater = NewUpdater(AppVersion)
 	updater.Start()
 
-	// 找到可用的埠
-	port := findAvailablePort()
-	addr := fmt.Sprintf("127.0.0.1:%d", port)
-	url := fmt.Sprintf("http://%s", addr)
+	// 綁定位址與埠 (未指定埠時自動尋找可用的埠)
+	listener, err := listen(cfg)
+	if err != nil {
+		fmt.Printf("啟動失敗: %v\n", err)
+		os.Exit(1)
+	}
+	url := browserURL(listener)
+
+	// 定期清除逾時的分頁快取
+	go resultCache.Run(defaultSessionSweepEvery, nil)
 
 	// 設定路由
 	http.HandleFunc("/", handleIndex)
 	http.HandleFunc("/api/parse", handleParse)
+	http.HandleFunc("/api/report", handleReport)
+	http.HandleFunc("/api/patients/vcard", handlePatientsVCard)
+	http.HandleFunc("/api/patient/", handlePatientTimeline)
+	http.HandleFunc("/api/export/sqlite", handleExportSQLite)
+	http.HandleFunc("/api/columns", handleColumns)
 	http.HandleFunc("/api/vendors", handleVendors)
+	http.HandleFunc("/api/schema", handleSchema)
+	http.HandleFunc("/metrics", handleMetrics)
 
 	// 更新 API
 	http.HandleFunc("/api/update/status", handleUpdateStatus)
-	http.HandleFunc("/api/update/check", handleUpdateCheck)
-	http.HandleFunc("/api/update/download", handleUpdateDownload)
-	http.HandleFunc("/api/update/apply", handleUpdateApply)
+	// 會下載或替換執行檔的操作只接受本機連線 (以 -addr 監聽其他介面時，區網使用者無法觸發)
+	http.HandleFunc("/api/update/check", loopbackOnly(handleUpdateCheck))
+	http.HandleFunc("/api/update/download", loopbackOnly(handleUpdateDownload))
+	http.HandleFunc("/api/update/apply", loopbackOnly(handleUpdateApply))
+	http.HandleFunc("/api/update/rollback", loopbackOnly(handleUpdateRollback))
 
 	// 啟動伺服器（非阻塞）
-	server := &http.Server{Addr: addr}
+	server := &http.Server{}
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			fmt.Printf("伺服器錯誤: %v\n", err)
 		}
 	}()
 
-	// 等待伺服器啟動
-	time.Sleep(100 * time.Millisecond)
-
 	// 自動開啟瀏覽器
 	fmt.Printf("台灣醫療資料解析器 v%s 已啟動\n", AppVersion)
 	fmt.Printf("請在瀏覽器開啟: %s\n", url)
 	fmt.Printf("按 Ctrl+C 關閉程式\n\n")
-	openBrowser(url)
+	if !cfg.NoBrowser {
+		openBrowser(url)
+	}
 
 	// 保持運行
 	select {}
 }
 
-// findAvailablePort 找到可用的埠
-func findAvailablePort() int {
+// findAvailablePort 在指定位址上找到可用的埠
+func findAvailablePort(addr string) int {
 	// 嘗試常用埠
 	ports := []int{8080, 8081, 8082, 3000, 3001, 5000}
 	for _, port := range ports {
-		if isPortAvailable(port) {
+		if isPortAvailable(addr, port) {
 			return port
 		}
 	}
 	// 讓系統分配
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		return 8080
-	}
-	defer listener.Close()
-	return listener.Addr().(*net.TCPAddr).Port
+	return 0
 }
 
-func isPortAvailable(port int) bool {
-	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+func isPortAvailable(addr string, port int) bool {
+	listener, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
 	if err != nil {
 		return false
 	}
@@ -126,22 +209,272 @@ func handleVendors(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(vendors)
 }
 
+// handleSchema 回傳解析結果的 JSON Schema (Draft-07)
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(parser.GetResultJSONSchema())
+}
+
 // handleParse 解析檔案
+// 預設回傳 JSON；?format=csv 或 xlsx 時回傳一列一藥品的明細附件 (CSV 含 UTF-8 BOM)，?format=txt 時回傳可列印的純文字報表
+// ?include=usage,prescriptions 時 JSON 僅輸出指定區段 (見 parser.ParseSections)，未指定時輸出全部
 func handleParse(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	query := r.URL.Query()
+	sections, err := parser.ParseSections(query.Get("include"))
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, size, paged, err := parsePagination(query)
+	if err != nil {
+		sendErrorStatus(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// 限制上傳大小 50MB
-	r.ParseMultipartForm(50 << 20)
+	// 帶 token 時取回先前快取的結果，不需重新上傳
+	token := query.Get("token")
+	var result *parser.HISImportResult
+	var expiresAt time.Time
+	if token != "" {
+		var ok bool
+		result, expiresAt, ok = resultCache.Get(token)
+		if !ok {
+			sendErrorStatus(w, http.StatusNotFound, "分頁 token 不存在或已逾時，請重新上傳檔案")
+			return
+		}
+	} else {
+		var ok bool
+		result, ok = parseUpload(w, r)
+		if !ok {
+			return
+		}
+
+		// 遮蔽身分證與電話
+		result.MaskAll(parser.MaskPartial)
+
+		if paged {
+			token, expiresAt, err = resultCache.Put(result)
+			if err != nil {
+				sendError(w, "建立分頁快取失敗: "+err.Error())
+				return
+			}
+		}
+	}
+
+	if strings.EqualFold(query.Get("format"), "csv") {
+		filename := fmt.Sprintf("his_%s_%s.csv", result.SourceVendor, time.Now().Format("20060102"))
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		if err := result.ToCSV(w); err != nil {
+			fmt.Printf("CSV 輸出失敗: %v\n", err)
+		}
+		return
+	}
+	if strings.EqualFold(query.Get("format"), "xlsx") {
+		filename := fmt.Sprintf("his_%s_%s.xlsx", result.SourceVendor, time.Now().Format("20060102"))
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		if err := result.ToXLSX(w); err != nil {
+			fmt.Printf("XLSX 輸出失敗: %v\n", err)
+		}
+		return
+	}
+	if strings.EqualFold(query.Get("format"), "txt") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := result.ToTextReport(w); err != nil {
+			fmt.Printf("文字報表輸出失敗: %v\n", err)
+		}
+		return
+	}
 
-	file, header, err := r.FormFile("file")
+	outOpts := parser.OutputOptions{Sections: sections}
+	if paged {
+		outOpts.Page, outOpts.PageSize = page, size
+	}
+	data, err := result.MarshalJSONWithOptions(outOpts)
+	if err == nil && paged {
+		data, err = withPageMeta(data, pageMeta{
+			PageInfo:  parser.NewPageInfo(len(result.Prescriptions), page, size),
+			Token:     token,
+			ExpiresAt: expiresAt,
+		})
+	}
 	if err != nil {
-		sendError(w, "無法讀取檔案: "+err.Error())
+		sendError(w, "輸出失敗: "+err.Error())
 		return
 	}
-	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// pageMeta 分頁回應的 meta 欄位
+type pageMeta struct {
+	parser.PageInfo
+	Token     string    `json:"token"`      // 後續分頁請求帶入 ?token=
+	ExpiresAt time.Time `json:"expires_at"` // 快取到期時間 (每次取用會延長)
+}
+
+// parsePagination 解析 ?page=&size=，兩者皆未指定且無 token 時不分頁
+func parsePagination(query url.Values) (page, size int, paged bool, err error) {
+	page, size = 1, defaultPageSize
+	paged = query.Get("token") != ""
+	if v := query.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, false, fmt.Errorf("page 必須為正整數: %s", v)
+		}
+		paged = true
+	}
+	if v := query.Get("size"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size < 1 || size > maxPageSize {
+			return 0, 0, false, fmt.Errorf("size 必須介於 1 至 %d: %s", maxPageSize, v)
+		}
+		paged = true
+	}
+	return page, size, paged, nil
+}
+
+// withPageMeta 在 JSON 物件中加入 meta 欄位
+func withPageMeta(data []byte, meta pageMeta) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	fields["meta"] = raw
+	return json.Marshal(fields)
+}
+
+// handleReport 解析檔案並回傳列印用 HTML 報表 (身分證已遮蔽)
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	result, ok := parseUpload(w, r)
+	if !ok {
+		return
+	}
+
+	html, err := parser.RenderReportHTML(result, parser.ReportOptions{
+		ClinicName: r.FormValue("clinic"),
+	})
+	if err != nil {
+		sendError(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(html)
+}
+
+// handlePatientsVCard 解析檔案並回傳所有病患的 vCard (.vcf) 附件
+func handlePatientsVCard(w http.ResponseWriter, r *http.Request) {
+	result, ok := parseUpload(w, r)
+	if !ok {
+		return
+	}
+	if len(result.Patients) == 0 {
+		sendError(w, "檔案中沒有病患資料")
+		return
+	}
+
+	filename := fmt.Sprintf("patients_%s.vcf", time.Now().Format("20060102"))
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	io.WriteString(w, parser.ExportPatientsVCard(result.Patients))
+}
+
+// handlePatientTimeline 回傳單一病患的用藥時間軸: /api/patient/{id}/timeline
+// 以 ?token= 查詢分頁快取中的結果 (已遮蔽，{id} 為病患的 key)，或以 POST 上傳檔案即時解析 ({id} 為身分證)
+func handlePatientTimeline(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/patient/"), "/")
+	if id == "" || action != "timeline" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var timeline []parser.TimelineEntry
+	if token := r.URL.Query().Get("token"); token != "" {
+		result, _, ok := resultCache.Get(token)
+		if !ok {
+			sendErrorStatus(w, http.StatusNotFound, "分頁 token 不存在或已逾時，請重新上傳檔案")
+			return
+		}
+		timeline = result.PatientTimeline(id)
+	} else {
+		result, ok := parseUpload(w, r)
+		if !ok {
+			return
+		}
+		timeline = result.PatientTimeline(id)
+		id = parser.MaskNationalID(id, parser.MaskPartial)
+	}
+
+	if len(timeline) == 0 {
+		sendErrorStatus(w, http.StatusNotFound, "查無此病患的處方")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"patient_id": id,
+		"count":      len(timeline),
+		"timeline":   timeline,
+	})
+}
+
+// handleExportSQLite 解析上傳檔案並回傳 SQLite 資料庫檔 (驅動程式需 cgo，CGO_ENABLED=0 編譯時回應 501)
+func handleExportSQLite(w http.ResponseWriter, r *http.Request) {
+	result, ok := parseUpload(w, r)
+	if !ok {
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "his-parser-*.db")
+	if err != nil {
+		sendError(w, "建立暫存檔失敗: "+err.Error())
+		return
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	if err := result.ExportSQLite(tmpPath); err != nil {
+		if errors.Is(err, parser.ErrNoSQLiteDriver) {
+			sendErrorStatus(w, http.StatusNotImplemented, "此版本未內建 SQLite 驅動程式，請以 CGO_ENABLED=1 重新編譯")
+			return
+		}
+		sendError(w, "匯出 SQLite 失敗: "+err.Error())
+		return
+	}
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		sendError(w, "讀取 SQLite 檔失敗: "+err.Error())
+		return
+	}
+	defer f.Close()
+
+	filename := fmt.Sprintf("his_%s_%s.db", result.SourceVendor, time.Now().Format("20060102"))
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	io.Copy(w, f)
+}
+
+// parseUpload 讀取上傳檔案並解析，失敗時已回應錯誤並回傳 false
+// 表單欄位: vendor (廠商)、encoding (編碼)、mapping (通用格式欄位對應 JSON，如 {"national_id":0})
+func parseUpload(w http.ResponseWriter, r *http.Request) (*parser.HISImportResult, bool) {
+	release, ok := acquireUpload(w, r)
+	if !ok {
+		return nil, false
+	}
+	defer release()
 
 	// 取得廠商選擇
 	vendorStr := r.FormValue("vendor")
@@ -150,56 +483,271 @@ func handleParse(w http.ResponseWriter, r *http.Request) {
 		vendor = parser.VendorAuto
 	}
 
-	// 讀取檔案內容
-	content, err := io.ReadAll(file)
+	// client 斷線時 r.Context() 會被取消，解析隨即中止
+	opts := []parser.ParseOption{
+		parser.WithContext(r.Context()),
+		parser.WithEncoding(r.FormValue("encoding")),
+	}
+	if mapping := r.FormValue("mapping"); mapping != "" {
+		var colMap map[string]int
+		if err := json.Unmarshal([]byte(mapping), &colMap); err != nil {
+			sendError(w, "欄位對應格式錯誤: "+err.Error())
+			return nil, false
+		}
+		if err := parser.ValidateColumnMapping(colMap); err != nil {
+			sendError(w, err.Error())
+			return nil, false
+		}
+		opts = append(opts, parser.WithColumnMapping(colMap))
+	}
+
+	// 多檔上傳 (files 欄位) 逐一解析後合併，單檔失敗記錄於結果中不影響其他檔案
+	if headers := r.MultipartForm.File[multiUploadFieldName]; len(headers) > 0 {
+		files, err := readUploadFiles(headers)
+		if err != nil {
+			sendError(w, err.Error())
+			return nil, false
+		}
+		start := time.Now()
+		result, err := parser.ParseHISFiles(files, vendor, opts...)
+		if err != nil {
+			parseMetrics.ObserveError(time.Since(start))
+			sendError(w, "解析失敗: "+err.Error())
+			return nil, false
+		}
+		var vendors []string
+		failed := 0
+		for _, stat := range result.Files {
+			if stat.Error != "" {
+				failed++
+			} else {
+				vendors = append(vendors, stat.SourceVendor)
+			}
+		}
+		parseMetrics.ObserveSuccess(time.Since(start), len(result.Prescriptions), vendors, failed)
+		return result, true
+	}
+
+	content, header, err := readUploadFile(r)
 	if err != nil {
-		sendError(w, "讀取檔案失敗: "+err.Error())
-		return
+		sendError(w, err.Error())
+		return nil, false
 	}
 
 	// 解析
-	result, err := parser.ParseHISFileByVendor(
+	start := time.Now()
+	result, err := parser.ParseWithOptions(
 		&byteReader{data: content, pos: 0},
 		header.Filename,
 		vendor,
+		opts...,
 	)
 	if err != nil {
+		parseMetrics.ObserveError(time.Since(start))
 		sendError(w, "解析失敗: "+err.Error())
-		return
+		return nil, false
 	}
+	parseMetrics.ObserveSuccess(time.Since(start), len(result.Prescriptions), []string{result.SourceVendor}, 0)
+
+	return result, true
+}
+
+// multiUploadFieldName 多檔上傳的欄位名稱
+const multiUploadFieldName = "files"
+
+// readUploadFiles 讀取多檔上傳的所有檔案 (key 為檔名，重複檔名加上序號區分)
+func readUploadFiles(headers []*multipart.FileHeader) (map[string]io.Reader, error) {
+	files := make(map[string]io.Reader, len(headers))
+	for i, header := range headers {
+		base := strings.TrimSpace(header.Filename)
+		if base == "" {
+			base = fmt.Sprintf("file%d", i+1)
+		}
+		name := base
+		for n := 2; files[name] != nil; n++ {
+			name = fmt.Sprintf("%s (%d)", base, n)
+		}
 
-	// 遮蔽身分證
-	for i := range result.Patients {
-		result.Patients[i].NationalID = maskID(result.Patients[i].NationalID)
+		file, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("無法讀取檔案 %s: %w", name, err)
+		}
+		content, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("讀取檔案 %s 失敗: %w", name, err)
+		}
+		files[name] = &byteReader{data: content, pos: 0}
 	}
-	for i := range result.Prescriptions {
-		result.Prescriptions[i].PatientID = maskID(result.Prescriptions[i].PatientID)
+	return files, nil
+}
+
+// handleColumns 回傳通用格式的標題列與自動偵測的欄位對應，供前端調整後以 mapping 欄位送出
+func handleColumns(w http.ResponseWriter, r *http.Request) {
+	content, _, release, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	headers, colMap, err := parser.DetectColumns(&byteReader{data: content, pos: 0})
+	if err != nil {
+		sendError(w, err.Error())
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"headers": headers,
+		"mapping": colMap,
+	})
+}
+
+// readUpload 取得解析名額並讀取上傳檔案，失敗時已回應錯誤並回傳 false
+// 成功時呼叫端需呼叫 release 釋放解析名額
+func readUpload(w http.ResponseWriter, r *http.Request) ([]byte, *multipart.FileHeader, func(), bool) {
+	release, ok := acquireUpload(w, r)
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	content, header, err := readUploadFile(r)
+	if err != nil {
+		release()
+		sendError(w, err.Error())
+		return nil, nil, nil, false
+	}
+	return content, header, release, true
+}
+
+// maxUploadSize 單次請求上傳的總量上限 (多檔上傳時為所有檔案合計)
+const maxUploadSize = 50 << 20
+
+// acquireUpload 取得解析名額並解析 multipart 表單，失敗時已回應錯誤並回傳 false
+// 成功時呼叫端需呼叫 release 釋放解析名額
+func acquireUpload(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	// 限制同時解析數量，避免大量上傳耗盡記憶體
+	release, err := parseLimiter.Acquire(r.Context())
+	if err != nil {
+		if r.Context().Err() != nil {
+			return nil, false // 使用者已離開，不需回應
+		}
+		var queueErr *ErrParseQueueFull
+		if errors.As(err, &queueErr) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(queueErr.RetryAfter.Seconds())))
+		}
+		sendErrorStatus(w, http.StatusServiceUnavailable, err.Error())
+		return nil, false
+	}
+
+	// 限制上傳總量 (含多檔上傳的所有檔案)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		release()
+		sendError(w, describeMultipartError(err))
+		return nil, false
+	}
+	return release, true
+}
+
+// readUploadFile 讀取單檔上傳的檔案內容
+func readUploadFile(r *http.Request) ([]byte, *multipart.FileHeader, error) {
+	file, header, err := getUploadFile(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("讀取檔案失敗: %w", err)
+	}
+	return content, header, nil
+}
+
+// uploadFieldNames 可接受的上傳欄位名稱 (依優先順序)
+var uploadFieldNames = []string{"file", "upload"}
+
+// getUploadFile 取得上傳檔案，並針對常見錯誤回傳具體說明
+func getUploadFile(r *http.Request) (multipart.File, *multipart.FileHeader, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File) == 0 {
+		return nil, nil, fmt.Errorf("找不到上傳檔案，請以 file 欄位上傳")
+	}
+
+	var header *multipart.FileHeader
+	for _, name := range uploadFieldNames {
+		if headers := r.MultipartForm.File[name]; len(headers) > 0 {
+			header = headers[0]
+			break
+		}
+	}
+
+	// 欄位名稱不符但只有一個檔案時，仍接受該檔案
+	if header == nil {
+		if len(r.MultipartForm.File) != 1 {
+			return nil, nil, fmt.Errorf("找不到 file 欄位，請確認上傳欄位名稱")
+		}
+		for _, headers := range r.MultipartForm.File {
+			if len(headers) > 0 {
+				header = headers[0]
+			}
+		}
+		if header == nil {
+			return nil, nil, fmt.Errorf("找不到上傳檔案，請以 file 欄位上傳")
+		}
+	}
+
+	if strings.TrimSpace(header.Filename) == "" {
+		return nil, nil, fmt.Errorf("上傳檔案缺少檔名，請重新選擇檔案")
+	}
+	if header.Size == 0 {
+		return nil, nil, fmt.Errorf("上傳的檔案是空的，請確認匯出是否完成")
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, nil, fmt.Errorf("無法讀取檔案: %w", err)
+	}
+	return file, header, nil
+}
+
+// describeMultipartError 將 multipart 解析錯誤轉為使用者看得懂的說明
+func describeMultipartError(err error) string {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, http.ErrNotMultipart):
+		return "請求格式錯誤，請以 multipart/form-data 上傳檔案"
+	case errors.Is(err, http.ErrMissingBoundary):
+		return "請求格式錯誤，multipart 缺少 boundary 設定"
+	case errors.As(err, &maxBytesErr), errors.Is(err, multipart.ErrMessageTooLarge):
+		return fmt.Sprintf("檔案過大，上傳總量上限為 %dMB", maxUploadSize>>20)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "上傳中斷，檔案內容不完整，請重新上傳"
+	default:
+		return "無法解析上傳內容: " + err.Error()
+	}
 }
 
 func sendError(w http.ResponseWriter, msg string) {
+	sendErrorStatus(w, http.StatusOK, msg)
+}
+
+// sendErrorStatus 以指定 HTTP 狀態碼回傳錯誤
+func sendErrorStatus(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": false,
 		"errors":  []string{msg},
 	})
 }
 
-// maskID 遮蔽身分證
-func maskID(id string) string {
-	if len(id) < 4 {
-		return id
-	}
-	runes := []rune(id)
-	if len(runes) >= 10 {
-		return string(runes[:3]) + "****" + string(runes[7:])
-	}
-	return string(runes[:2]) + "****"
-}
-
 // byteReader 實作 io.Reader
 type byteReader struct {
 	data []byte
@@ -219,6 +767,21 @@ func (r *byteReader) Read(p []byte) (n int, err error) {
 // 更新 API Handlers
 // =====================================================================
 
+// loopbackOnly 僅允許來源為本機 (127.0.0.0/8、::1) 的請求，其他來源回應 403
+func loopbackOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			sendErrorStatus(w, http.StatusForbidden, "更新操作僅限在本機執行")
+			return
+		}
+		h(w, r)
+	}
+}
+
 // handleUpdateStatus 取得更新狀態
 func handleUpdateStatus(w http.ResponseWriter, r *http.Request) {
 	status := updater.GetStatus()
@@ -227,12 +790,22 @@ func handleUpdateStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleUpdateCheck 手動觸發更新檢查
+// 可加 ?prerelease=true / false 切換是否允許預發佈版
 func handleUpdateCheck(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if v := r.URL.Query().Get("prerelease"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "prerelease 參數須為 true 或 false", http.StatusBadRequest)
+			return
+		}
+		updater.SetAllowPrerelease(allow)
+	}
+
 	go updater.CheckForUpdate()
 
 	w.Header().Set("Content-Type", "application/json")
@@ -283,6 +856,14 @@ func handleUpdateApply(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	if !status.Verified {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "下載檔未通過 SHA-256 驗證",
+		})
+		return
+	}
 
 	// 先回應成功
 	w.Header().Set("Content-Type", "application/json")
@@ -301,3 +882,24 @@ func handleUpdateApply(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 }
+
+// handleUpdateRollback 回滾到更新前的版本
+func handleUpdateRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := updater.Rollback(); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "已還原舊版本，請重新啟動程式",
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoopbackOnly(t *testing.T) {
+	h := loopbackOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"127.0.0.1:52000", http.StatusNoContent},
+		{"[::1]:52000", http.StatusNoContent},
+		{"192.168.1.20:52000", http.StatusForbidden},
+		{"[fe80::1]:52000", http.StatusForbidden},
+		{"garbage", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/update/apply", nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("RemoteAddr %s: status = %d, want %d", tt.remoteAddr, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// 解析統計 (Prometheus 格式)
+// 伺服器長跑時供維運監控解析量、錯誤與耗時
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// parseDurationBuckets 解析耗時 histogram 的上界 (秒)
+var parseDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// ParseMetrics 累計解析統計 (可同時由多個請求更新)
+type ParseMetrics struct {
+	mu            sync.Mutex
+	files         uint64
+	prescriptions uint64
+	errors        uint64
+	vendors       map[string]uint64
+	buckets       []uint64 // 與 parseDurationBuckets 對應的累積次數
+	durationSum   float64
+	durationCount uint64
+}
+
+// NewParseMetrics 建立空的解析統計
+func NewParseMetrics() *ParseMetrics {
+	return &ParseMetrics{
+		vendors: make(map[string]uint64),
+		buckets: make([]uint64, len(parseDurationBuckets)),
+	}
+}
+
+// 全域解析統計
+var parseMetrics = NewParseMetrics()
+
+// ObserveSuccess 記錄一次完成的解析
+// vendors 為各檔案的廠商 (多檔上傳時每檔一筆)，failedFiles 為多檔上傳中解析失敗的檔案數 (計入錯誤數)
+func (m *ParseMetrics) ObserveSuccess(elapsed time.Duration, prescriptions int, vendors []string, failedFiles int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files += uint64(len(vendors) + failedFiles)
+	m.errors += uint64(failedFiles)
+	m.prescriptions += uint64(prescriptions)
+	for _, vendor := range vendors {
+		if vendor == "" {
+			vendor = "unknown"
+		}
+		m.vendors[vendor]++
+	}
+	m.observeDurationLocked(elapsed)
+}
+
+// ObserveError 記錄一次失敗的解析
+func (m *ParseMetrics) ObserveError(elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors++
+	m.observeDurationLocked(elapsed)
+}
+
+// observeDurationLocked 累計耗時 histogram (呼叫端需持有鎖)
+func (m *ParseMetrics) observeDurationLocked(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	for i, le := range parseDurationBuckets {
+		if seconds <= le {
+			m.buckets[i]++
+		}
+	}
+	m.durationSum += seconds
+	m.durationCount++
+}
+
+// WritePrometheus 以 Prometheus text exposition format 輸出
+func (m *ParseMetrics) WritePrometheus(out io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w := bufio.NewWriter(out)
+
+	fmt.Fprintln(w, "# HELP his_parser_files_total 累計解析檔案數")
+	fmt.Fprintln(w, "# TYPE his_parser_files_total counter")
+	fmt.Fprintf(w, "his_parser_files_total %d\n", m.files)
+
+	fmt.Fprintln(w, "# HELP his_parser_prescriptions_total 累計解析處方數")
+	fmt.Fprintln(w, "# TYPE his_parser_prescriptions_total counter")
+	fmt.Fprintf(w, "his_parser_prescriptions_total %d\n", m.prescriptions)
+
+	fmt.Fprintln(w, "# HELP his_parser_vendor_parses_total 各廠商解析次數")
+	fmt.Fprintln(w, "# TYPE his_parser_vendor_parses_total counter")
+	vendors := make([]string, 0, len(m.vendors))
+	for vendor := range m.vendors {
+		vendors = append(vendors, vendor)
+	}
+	sort.Strings(vendors)
+	for _, vendor := range vendors {
+		fmt.Fprintf(w, "his_parser_vendor_parses_total{vendor=%q} %d\n", vendor, m.vendors[vendor])
+	}
+
+	fmt.Fprintln(w, "# HELP his_parser_errors_total 累計解析錯誤數")
+	fmt.Fprintln(w, "# TYPE his_parser_errors_total counter")
+	fmt.Fprintf(w, "his_parser_errors_total %d\n", m.errors)
+
+	fmt.Fprintln(w, "# HELP his_parser_parse_duration_seconds 解析耗時")
+	fmt.Fprintln(w, "# TYPE his_parser_parse_duration_seconds histogram")
+	for i, le := range parseDurationBuckets {
+		fmt.Fprintf(w, "his_parser_parse_duration_seconds_bucket{le=\"%s\"} %d\n",
+			strconv.FormatFloat(le, 'f', -1, 64), m.buckets[i])
+	}
+	fmt.Fprintf(w, "his_parser_parse_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(w, "his_parser_parse_duration_seconds_sum %s\n", strconv.FormatFloat(m.durationSum, 'f', -1, 64))
+	fmt.Fprintf(w, "his_parser_parse_duration_seconds_count %d\n", m.durationCount)
+
+	return w.Flush()
+}
+
+// handleMetrics 輸出 Prometheus 格式的解析統計
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	parseMetrics.WritePrometheus(w)
+}
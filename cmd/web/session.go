@@ -0,0 +1,129 @@
+// 解析結果快取
+// 分頁請求以 session token 取回已解析的完整結果，避免重複上傳與解析
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	parser "github.com/Saki-tw/go-tw-his-parser"
+)
+
+const (
+	defaultSessionTTL        = 15 * time.Minute
+	defaultMaxSessions       = 16
+	defaultSessionSweepEvery = time.Minute
+)
+
+// cachedResult 快取中的一筆解析結果
+type cachedResult struct {
+	result    *parser.HISImportResult
+	expiresAt time.Time
+}
+
+// ResultCache 以 token 保存解析結果，逾時或超過上限時清除
+type ResultCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*cachedResult
+}
+
+// NewResultCache 建立結果快取
+func NewResultCache(ttl time.Duration, maxEntries int) *ResultCache {
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &ResultCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*cachedResult),
+	}
+}
+
+// NewResultCacheFromEnv 由環境變數建立結果快取
+// HIS_PARSER_SESSION_TTL: 保存秒數, HIS_PARSER_MAX_SESSIONS: 同時保存的結果上限
+func NewResultCacheFromEnv() *ResultCache {
+	return NewResultCache(
+		time.Duration(envInt("HIS_PARSER_SESSION_TTL", int(defaultSessionTTL/time.Second)))*time.Second,
+		envInt("HIS_PARSER_MAX_SESSIONS", defaultMaxSessions),
+	)
+}
+
+// Put 保存解析結果，回傳 token 與到期時間
+func (c *ResultCache) Put(result *parser.HISImportResult) (string, time.Time, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweepLocked(now)
+	// 超過上限時移除最早到期的結果
+	for len(c.entries) >= c.maxEntries {
+		var oldest string
+		for t, e := range c.entries {
+			if oldest == "" || e.expiresAt.Before(c.entries[oldest].expiresAt) {
+				oldest = t
+			}
+		}
+		delete(c.entries, oldest)
+	}
+
+	expiresAt := now.Add(c.ttl)
+	c.entries[token] = &cachedResult{result: result, expiresAt: expiresAt}
+	return token, expiresAt, nil
+}
+
+// Get 取回解析結果並延長到期時間，token 不存在或已逾時回傳 false
+func (c *ResultCache) Get(token string) (*parser.HISImportResult, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := c.entries[token]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(c.entries, token)
+		return nil, time.Time{}, false
+	}
+	entry.expiresAt = now.Add(c.ttl)
+	return entry.result, entry.expiresAt, true
+}
+
+// Run 定期清除逾時的結果以釋放記憶體，直到 stop 關閉
+func (c *ResultCache) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.mu.Lock()
+			c.sweepLocked(now)
+			c.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweepLocked 移除逾時的結果 (呼叫端需持有鎖)
+func (c *ResultCache) sweepLocked(now time.Time) {
+	for token, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, token)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build cgo
+
+// SQLite 驅動程式 (github.com/mattn/go-sqlite3 需 cgo，供 /api/export/sqlite 使用)
+package main
+
+import (
+	parser "github.com/Saki-tw/go-tw-his-parser"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	parser.SQLiteDriverName = "sqlite3"
+}
@@ -3,6 +3,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,13 +30,23 @@ type Updater struct {
 	currentVersion string
 	latestRelease  *GitHubRelease
 	downloadURL    string
+	checksumURL    string // checksums.txt 或 <檔名>.sha256 的下載連結
 	downloadedPath string
+	verified       bool   // 下載檔已通過 SHA-256 驗證
 	checkTime      time.Time
 	isChecking     bool
 	isDownloading  bool
 	downloadProgress float64
 	lastError      error
 	mu             sync.RWMutex
+
+	// AllowPrerelease 為真時預發佈版也視為可用更新 (改查 /releases 列表)
+	AllowPrerelease bool
+}
+
+// UpdaterOptions 更新管理器選項
+type UpdaterOptions struct {
+	AllowPrerelease bool // 允許更新到預發佈版
 }
 
 // GitHubRelease GitHub Release 結構
@@ -64,19 +77,35 @@ type UpdateStatus struct {
 	IsDownloading    bool   `json:"is_downloading"`
 	DownloadProgress float64 `json:"download_progress,omitempty"`
 	DownloadReady    bool   `json:"download_ready"`
+	Verified         bool   `json:"verified"`              // 下載檔已通過 SHA-256 驗證
 	DownloadURL      string `json:"download_url,omitempty"`
 	ReleaseNotes     string `json:"release_notes,omitempty"`
 	ReleaseURL       string `json:"release_url,omitempty"`
+	Prerelease       bool   `json:"prerelease,omitempty"`      // 最新版本為預發佈版
+	AllowPrerelease  bool   `json:"allow_prerelease"`
 	Error            string `json:"error,omitempty"`
 }
 
 // NewUpdater 建立更新管理器
 func NewUpdater(version string) *Updater {
+	return NewUpdaterWithOptions(version, UpdaterOptions{})
+}
+
+// NewUpdaterWithOptions 依選項建立更新管理器
+func NewUpdaterWithOptions(version string, opts UpdaterOptions) *Updater {
 	return &Updater{
-		currentVersion: normalizeVersion(version),
+		currentVersion:  normalizeVersion(version),
+		AllowPrerelease: opts.AllowPrerelease,
 	}
 }
 
+// SetAllowPrerelease 切換是否允許預發佈版 (下次檢查時生效)
+func (u *Updater) SetAllowPrerelease(allow bool) {
+	u.mu.Lock()
+	u.AllowPrerelease = allow
+	u.mu.Unlock()
+}
+
 // Start 啟動背景更新檢查
 func (u *Updater) Start() {
 	go func() {
@@ -102,6 +131,7 @@ func (u *Updater) CheckForUpdate() error {
 	}
 	u.isChecking = true
 	u.lastError = nil
+	allowPrerelease := u.AllowPrerelease
 	u.mu.Unlock()
 
 	defer func() {
@@ -111,8 +141,13 @@ func (u *Updater) CheckForUpdate() error {
 		u.mu.Unlock()
 	}()
 
+	// /releases/latest 不含預發佈版；允許預發佈時改查完整列表
 	url := fmt.Sprintf("%s/repos/%s/%s/releases/latest",
 		GitHubAPIBase, UpdateRepoOwner, UpdateRepoName)
+	if allowPrerelease {
+		url = fmt.Sprintf("%s/repos/%s/%s/releases?per_page=30",
+			GitHubAPIBase, UpdateRepoOwner, UpdateRepoName)
+	}
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -142,28 +177,106 @@ func (u *Updater) CheckForUpdate() error {
 	}
 
 	var release GitHubRelease
-	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-		u.setError(err)
-		return err
+	if allowPrerelease {
+		var releases []GitHubRelease
+		if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+			u.setError(err)
+			return err
+		}
+		latest := latestRelease(releases)
+		if latest == nil {
+			return nil
+		}
+		release = *latest
+	} else {
+		if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+			u.setError(err)
+			return err
+		}
+		if release.Draft || release.Prerelease {
+			return nil
+		}
 	}
 
-	if release.Draft || release.Prerelease {
-		return nil
+	// 找到對應平台的下載連結與校驗檔
+	downloadURL := u.findAssetURL(release)
+	checksumURL := ""
+	if downloadURL != "" {
+		checksumURL = findChecksumURL(release.Assets, filepath.Base(downloadURL))
 	}
 
-	// 找到對應平台的下載連結
-	downloadURL := u.findAssetURL(release.Assets)
-
 	u.mu.Lock()
 	u.latestRelease = &release
 	u.downloadURL = downloadURL
+	u.checksumURL = checksumURL
 	u.mu.Unlock()
 
 	return nil
 }
 
+// findChecksumURL 找出執行檔對應的校驗檔，優先使用 <檔名>.sha256，其次為 checksums.txt
+func findChecksumURL(assets []GitHubAsset, assetName string) string {
+	fallback := ""
+	for _, asset := range assets {
+		name := strings.ToLower(asset.Name)
+		switch {
+		case name == strings.ToLower(assetName)+".sha256":
+			return asset.BrowserDownloadURL
+		case name == "checksums.txt" || name == "sha256sums" || name == "sha256sums.txt":
+			fallback = asset.BrowserDownloadURL
+		}
+	}
+	return fallback
+}
+
+// fetchChecksum 下載校驗檔並取出指定檔名的 SHA-256 (小寫十六進位)
+// 支援 sha256sum 格式 (「雜湊  檔名」，檔名前可有 *) 與只含雜湊的 .sha256 檔
+func fetchChecksum(checksumURL, assetName string) (string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(checksumURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("校驗檔下載失敗: HTTP %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+			continue
+		}
+		if len(fields) == 1 || strings.EqualFold(strings.TrimPrefix(fields[1], "*"), assetName) {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("校驗檔中找不到 %s 的 SHA-256", assetName)
+}
+
+// latestRelease 從 release 列表中取版本號最新的一筆 (略過草稿)
+func latestRelease(releases []GitHubRelease) *GitHubRelease {
+	var latest *GitHubRelease
+	for i := range releases {
+		if releases[i].Draft {
+			continue
+		}
+		if latest == nil || compareVersions(releases[i].TagName, latest.TagName) > 0 {
+			latest = &releases[i]
+		}
+	}
+	return latest
+}
+
 // findAssetURL 根據平台找到下載連結
-func (u *Updater) findAssetURL(assets []GitHubAsset) string {
+// 預發佈版的檔名可能附加版本標籤 (his-parser-web-linux-amd64-v1.2.0-beta.1)，比對前先去除
+func (u *Updater) findAssetURL(release GitHubRelease) string {
 	osName := runtime.GOOS
 	archName := runtime.GOARCH
 
@@ -189,8 +302,18 @@ func (u *Updater) findAssetURL(assets []GitHubAsset) string {
 		)
 	}
 
-	for _, asset := range assets {
+	tag := strings.ToLower(release.TagName)
+	version := strings.ToLower(normalizeVersion(release.TagName))
+
+	for _, asset := range release.Assets {
 		assetLower := strings.ToLower(asset.Name)
+		if release.Prerelease && tag != "" {
+			if stripped := strings.Replace(assetLower, "-"+tag, "", 1); stripped != assetLower {
+				assetLower = stripped
+			} else {
+				assetLower = strings.Replace(assetLower, "-"+version, "", 1)
+			}
+		}
 		for _, expected := range expectedNames {
 			if strings.ToLower(expected) == assetLower {
 				return asset.BrowserDownloadURL
@@ -209,6 +332,10 @@ func (u *Updater) IsUpdateAvailable() bool {
 	if u.latestRelease == nil {
 		return false
 	}
+	// 關閉預發佈選項後，先前查到的預發佈版不再視為可用更新
+	if u.latestRelease.Prerelease && !u.AllowPrerelease {
+		return false
+	}
 
 	latestVersion := normalizeVersion(u.latestRelease.TagName)
 	return compareVersions(latestVersion, u.currentVersion) > 0
@@ -225,11 +352,14 @@ func (u *Updater) GetStatus() UpdateStatus {
 		IsDownloading:    u.isDownloading,
 		DownloadProgress: u.downloadProgress,
 		DownloadReady:    u.downloadedPath != "",
+		Verified:         u.verified,
+		AllowPrerelease:  u.AllowPrerelease,
 	}
 
-	if u.latestRelease != nil {
+	if u.latestRelease != nil && (!u.latestRelease.Prerelease || u.AllowPrerelease) {
 		latestVersion := normalizeVersion(u.latestRelease.TagName)
 		status.LatestVersion = latestVersion
+		status.Prerelease = u.latestRelease.Prerelease
 		status.UpdateAvailable = compareVersions(latestVersion, u.currentVersion) > 0
 		status.ReleaseNotes = u.latestRelease.Body
 		status.ReleaseURL = u.latestRelease.HTMLURL
@@ -256,7 +386,10 @@ func (u *Updater) DownloadUpdate() error {
 	}
 	u.isDownloading = true
 	u.downloadProgress = 0
+	u.verified = false
+	u.downloadedPath = ""
 	downloadURL := u.downloadURL
+	checksumURL := u.checksumURL
 	u.mu.Unlock()
 
 	defer func() {
@@ -291,6 +424,10 @@ func (u *Updater) DownloadUpdate() error {
 	}
 	defer out.Close()
 
+	// 邊下載邊計算雜湊
+	hasher := sha256.New()
+	writer := io.MultiWriter(out, hasher)
+
 	totalSize := resp.ContentLength
 	var downloaded int64
 	buf := make([]byte, 32*1024)
@@ -298,7 +435,7 @@ func (u *Updater) DownloadUpdate() error {
 	for {
 		n, err := resp.Body.Read(buf)
 		if n > 0 {
-			out.Write(buf[:n])
+			writer.Write(buf[:n])
 			downloaded += int64(n)
 			if totalSize > 0 {
 				u.mu.Lock()
@@ -315,6 +452,14 @@ func (u *Updater) DownloadUpdate() error {
 		}
 	}
 
+	// 驗證 SHA-256，不符或無法驗證時刪除下載檔
+	if err := verifyDownload(checksumURL, filename, hex.EncodeToString(hasher.Sum(nil))); err != nil {
+		out.Close()
+		os.Remove(downloadPath)
+		u.setError(err)
+		return err
+	}
+
 	// 設定執行權限（Unix）
 	if runtime.GOOS != "windows" {
 		os.Chmod(downloadPath, 0755)
@@ -323,28 +468,63 @@ func (u *Updater) DownloadUpdate() error {
 	u.mu.Lock()
 	u.downloadedPath = downloadPath
 	u.downloadProgress = 100
+	u.verified = true
 	u.mu.Unlock()
 
 	return nil
 }
 
-// ApplyUpdate 套用更新
+// verifyDownload 比對下載檔雜湊與 release 提供的校驗值
+func verifyDownload(checksumURL, assetName, actual string) error {
+	if checksumURL == "" {
+		return fmt.Errorf("release 未提供校驗檔，無法驗證下載內容")
+	}
+	expected, err := fetchChecksum(checksumURL, assetName)
+	if err != nil {
+		return err
+	}
+	if expected != actual {
+		return fmt.Errorf("SHA-256 校驗不符 (預期 %s，實際 %s)，下載檔可能已損毀", expected, actual)
+	}
+	return nil
+}
+
+// ApplyUpdate 套用更新 (下載檔須已通過 SHA-256 驗證)
 func (u *Updater) ApplyUpdate() error {
 	u.mu.RLock()
 	downloadedPath := u.downloadedPath
+	verified := u.verified
 	u.mu.RUnlock()
 
 	if downloadedPath == "" {
 		return fmt.Errorf("尚未下載更新")
 	}
+	if !verified {
+		return fmt.Errorf("下載檔未通過 SHA-256 驗證，拒絕套用")
+	}
 
 	config, err := GetInstallConfig()
 	if err != nil {
 		return err
 	}
 
-	// 複製新版本到安裝目錄
+	// 先將舊檔改名為備份 (Windows 執行中的 exe 無法覆蓋，但可以改名)
+	backupPath := config.ExePath + ".bak"
+	os.Remove(backupPath)
+	hasBackup := true
+	if err := os.Rename(config.ExePath, backupPath); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("無法備份舊執行檔: %w", err)
+		}
+		hasBackup = false
+	}
+
+	// 複製新版本到安裝目錄，失敗時還原備份
 	if err := copyFile(downloadedPath, config.ExePath); err != nil {
+		if hasBackup {
+			os.Remove(config.ExePath)
+			os.Rename(backupPath, config.ExePath)
+		}
 		return fmt.Errorf("無法替換執行檔: %w", err)
 	}
 
@@ -359,13 +539,42 @@ func (u *Updater) ApplyUpdate() error {
 	return nil
 }
 
+// Rollback 以 ApplyUpdate 留下的備份 (.bak) 還原舊版執行檔
+func (u *Updater) Rollback() error {
+	config, err := GetInstallConfig()
+	if err != nil {
+		return err
+	}
+
+	backupPath := config.ExePath + ".bak"
+	if _, err := os.Stat(backupPath); err != nil {
+		return fmt.Errorf("找不到備份檔，無法回滾")
+	}
+
+	// 目前的執行檔可能正在執行，先改名移開再放回備份
+	failedPath := config.ExePath + ".failed"
+	os.Remove(failedPath)
+	if err := os.Rename(config.ExePath, failedPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("無法移開目前執行檔: %w", err)
+	}
+	if err := os.Rename(backupPath, config.ExePath); err != nil {
+		os.Rename(failedPath, config.ExePath)
+		return fmt.Errorf("無法還原備份: %w", err)
+	}
+
+	// 執行中的檔案在 Windows 無法刪除，留待下次回滾時清除
+	os.Remove(failedPath)
+
+	return nil
+}
+
 func (u *Updater) setError(err error) {
 	u.mu.Lock()
 	u.lastError = err
 	u.mu.Unlock()
 }
 
-// normalizeVersion 正規化版本號
+// normalizeVersion 正規化版本號 (去除 v 前綴，保留 pre-release 標籤)
 func normalizeVersion(v string) string {
 	v = strings.TrimSpace(v)
 	v = strings.TrimPrefix(v, "v")
@@ -373,30 +582,93 @@ func normalizeVersion(v string) string {
 	return v
 }
 
-// compareVersions 比較版本號
+// compareVersions 依語意化版本 (SemVer) 比較版本號
+// 先比較 major.minor.patch (缺少的段視為 0)，同號時正式版大於預發佈版，
+// 預發佈標籤依 . 分段比較：純數字段以數值比較，其餘依字典序；build metadata (+ 之後) 不列入比較
 func compareVersions(a, b string) int {
-	aParts := strings.Split(a, ".")
-	bParts := strings.Split(b, ".")
+	aCore, aPre := splitVersion(a)
+	bCore, bPre := splitVersion(b)
 
-	maxLen := len(aParts)
-	if len(bParts) > maxLen {
-		maxLen = len(bParts)
+	maxLen := len(aCore)
+	if len(bCore) > maxLen {
+		maxLen = len(bCore)
 	}
-
 	for i := 0; i < maxLen; i++ {
 		var aNum, bNum int
-		if i < len(aParts) {
-			fmt.Sscanf(aParts[i], "%d", &aNum)
+		if i < len(aCore) {
+			aNum = aCore[i]
 		}
-		if i < len(bParts) {
-			fmt.Sscanf(bParts[i], "%d", &bNum)
+		if i < len(bCore) {
+			bNum = bCore[i]
 		}
-		if aNum > bNum {
-			return 1
+		if aNum != bNum {
+			return compareInt(aNum, bNum)
 		}
-		if aNum < bNum {
-			return -1
+	}
+
+	switch {
+	case aPre == "" && bPre == "":
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return comparePrerelease(aPre, bPre)
+}
+
+// splitVersion 拆出版本號的數字段與 pre-release 標籤
+func splitVersion(v string) ([]int, string) {
+	v = normalizeVersion(v)
+	if idx := strings.Index(v, "+"); idx >= 0 {
+		v = v[:idx]
+	}
+	core, pre := v, ""
+	if idx := strings.Index(v, "-"); idx >= 0 {
+		core, pre = v[:idx], v[idx+1:]
+	}
+
+	var nums []int
+	for _, part := range strings.Split(core, ".") {
+		n, _ := strconv.Atoi(part)
+		nums = append(nums, n)
+	}
+	return nums, pre
+}
+
+// comparePrerelease 比較 pre-release 標籤 (rc.2 < rc.10，alpha < beta)
+func comparePrerelease(a, b string) int {
+	aIDs := strings.Split(a, ".")
+	bIDs := strings.Split(b, ".")
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		aNum, aErr := strconv.Atoi(aIDs[i])
+		bNum, bErr := strconv.Atoi(bIDs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNum != bNum {
+				return compareInt(aNum, bNum)
+			}
+		case aErr == nil:
+			return -1 // 數字段小於文字段
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(aIDs[i], bIDs[i]); c != 0 {
+				return c
+			}
 		}
 	}
+	// 前段相同時，段數較多者較大 (rc < rc.1)
+	return compareInt(len(aIDs), len(bIDs))
+}
+
+// compareInt 比較兩個整數 (回傳 1 / 0 / -1)
+func compareInt(a, b int) int {
+	switch {
+	case a > b:
+		return 1
+	case a < b:
+		return -1
+	}
 	return 0
 }
@@ -4,6 +4,7 @@ go 1.21
 
 require (
 	fyne.io/fyne/v2 v2.7.1
+	github.com/mattn/go-sqlite3 v1.14.33
 	golang.org/x/text v0.22.0
 )
 
@@ -0,0 +1,150 @@
+// Package parser 壓縮檔匯入
+// 健保署下載的申報檔常為 .gz 或 .zip，解壓後再依原流程解析 (ZIP 內多個檔案會合併結果)
+package parser
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// maxDecompressedSize 解壓後內容大小上限 (防止 zip bomb)
+const maxDecompressedSize = 100 << 20
+
+// isGzipContent 判斷是否為 gzip 格式 (magic bytes 0x1F 0x8B)
+func isGzipContent(content []byte) bool {
+	return len(content) >= 2 && content[0] == 0x1F && content[1] == 0x8B
+}
+
+// isXLSXArchive 判斷 ZIP 是否為 Excel 活頁簿 (含 xl/workbook.xml)
+func isXLSXArchive(content []byte) bool {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return false
+	}
+	for _, f := range zr.File {
+		if f.Name == "xl/workbook.xml" {
+			return true
+		}
+	}
+	return false
+}
+
+// isArchiveContent 判斷是否為需要先解壓的壓縮檔 (gzip 或非 Excel 的 ZIP)
+func isArchiveContent(content []byte) bool {
+	return isGzipContent(content) || (isZipContent(content) && !isXLSXArchive(content))
+}
+
+// parseArchive 解壓後解析；ZIP 內有多個檔案時逐一解析並合併 (見 ParseHISFiles)
+// 壓縮檔內的壓縮檔不再展開，以免多層壓縮繞過大小上限
+func parseArchive(content []byte, filename string, vendor HISVendor, opts ...ParseOption) (*HISImportResult, error) {
+	if isGzipContent(content) {
+		data, name, err := gunzipLimited(content)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			name = trimSuffixFold(filename, ".gz")
+		}
+		if isGzipContent(data) {
+			return nil, fmt.Errorf("不支援多層 gzip 壓縮")
+		}
+		return ParseWithOptions(bytes.NewReader(data), name, vendor, opts...)
+	}
+
+	files, skipped, err := unzipLimited(content)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("壓縮檔內沒有可解析的檔案: %w", ErrNoRecords)
+	}
+
+	var result *HISImportResult
+	if len(files) == 1 {
+		for name, data := range files {
+			result, err = ParseWithOptions(bytes.NewReader(data), name, vendor, opts...)
+		}
+	} else {
+		readers := make(map[string]io.Reader, len(files))
+		for name, data := range files {
+			readers[name] = bytes.NewReader(data)
+		}
+		result, err = ParseHISFiles(readers, vendor, opts...)
+	}
+	if result != nil {
+		for _, name := range skipped {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("略過壓縮檔內的壓縮檔: %s", name))
+		}
+	}
+	return result, err
+}
+
+// gunzipLimited 解壓 gzip 並限制解壓後大小，回傳內容與原始檔名 (若有記錄)
+func gunzipLimited(content []byte) ([]byte, string, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, "", fmt.Errorf("無法開啟 gzip: %w", err)
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("gzip 解壓失敗: %w", err)
+	}
+	if len(data) > maxDecompressedSize {
+		return nil, "", fmt.Errorf("解壓後超過 %d MB 上限", maxDecompressedSize>>20)
+	}
+	return data, zr.Name, nil
+}
+
+// unzipLimited 解壓 ZIP 內所有檔案 (略過目錄與系統檔)，所有檔案合計受大小上限限制
+// 內含的壓縮檔不展開，檔名列於 skipped
+func unzipLimited(content []byte) (files map[string][]byte, skipped []string, err error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("無法開啟 ZIP: %w", err)
+	}
+
+	files = make(map[string][]byte)
+	var total int64
+	for _, f := range zr.File {
+		base := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("無法讀取 %s: %w", f.Name, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, maxDecompressedSize-total+1))
+		rc.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("解壓 %s 失敗: %w", f.Name, err)
+		}
+		total += int64(len(data))
+		if total > maxDecompressedSize {
+			return nil, nil, fmt.Errorf("解壓後超過 %d MB 上限", maxDecompressedSize>>20)
+		}
+
+		if isArchiveContent(data) {
+			skipped = append(skipped, f.Name)
+			continue
+		}
+		files[f.Name] = data
+	}
+	return files, skipped, nil
+}
+
+// trimSuffixFold 不分大小寫去除副檔名
+func trimSuffixFold(s, suffix string) string {
+	if len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix) {
+		return s[:len(s)-len(suffix)]
+	}
+	return s
+}
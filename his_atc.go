@@ -0,0 +1,171 @@
+// Package parser ATC 藥品分類標記
+// 對照表由使用者自行載入 (健保碼 → ATC 碼)，執行檔不內建完整藥品資料
+package parser
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	atcTable   map[string]string
+	atcTableMu sync.RWMutex
+)
+
+// atcMainGroups ATC 第一層 (解剖學主類) 名稱
+var atcMainGroups = map[byte]string{
+	'A': "消化道及代謝",
+	'B': "血液及造血器官",
+	'C': "心血管系統",
+	'D': "皮膚科用藥",
+	'G': "泌尿生殖系統及性荷爾蒙",
+	'H': "全身性荷爾蒙製劑",
+	'J': "全身性抗感染劑",
+	'L': "抗腫瘤及免疫調節劑",
+	'M': "肌肉骨骼系統",
+	'N': "神經系統",
+	'P': "抗寄生蟲藥、殺蟲劑及驅蟲劑",
+	'R': "呼吸系統",
+	'S': "感覺器官",
+	'V': "其他",
+}
+
+// ATCUsage 依 ATC 主類彙總的用藥統計
+type ATCUsage struct {
+	ATCClass      string  `json:"atc_class"` // ATC 第一層代碼 (如 C)
+	ClassName     string  `json:"class_name"`
+	TotalQty      float64 `json:"total_qty"`
+	DispenseCount int     `json:"dispense_count"`
+	DrugCount     int     `json:"drug_count"` // 不同藥品數
+}
+
+// SetATCTable 設定健保碼 → ATC 碼對照表，傳入 nil 可清除
+// 設定後所有解析結果會自動填入 ATCCode 與 ATCClass
+func SetATCTable(table map[string]string) {
+	normalized := make(map[string]string, len(table))
+	for code, atc := range table {
+		code, atc = normalizeATCKey(code), normalizeATCKey(atc)
+		if code != "" && atc != "" {
+			normalized[code] = atc
+		}
+	}
+
+	atcTableMu.Lock()
+	defer atcTableMu.Unlock()
+	if table == nil {
+		atcTable = nil
+		return
+	}
+	atcTable = normalized
+}
+
+// LoadATCTableCSV 從 CSV 載入 ATC 對照表 (欄位: 健保碼,ATC碼)，可含表頭
+func LoadATCTableCSV(r io.Reader) (map[string]string, error) {
+	table := make(map[string]string)
+	scanner := newCSVScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields := parseCSVLine(strings.TrimSpace(scanner.Text()), ',')
+		if len(fields) < 2 {
+			continue
+		}
+		code := normalizeATCKey(fields[0])
+		atc := normalizeATCKey(fields[1])
+		// 略過表頭 (ATC 碼必須以英文字母開頭)
+		if code == "" || atc == "" || atc[0] < 'A' || atc[0] > 'Z' || strings.Contains(atc, "ATC") {
+			continue
+		}
+		table[code] = atc
+	}
+	return table, scanError(scanner.Err(), lineNum)
+}
+
+// normalizeATCKey 正規化健保碼或 ATC 碼 (去除空白與不可見字元並轉大寫)
+func normalizeATCKey(s string) string {
+	return strings.ToUpper(sanitizeField(s))
+}
+
+// GetATCClassName 取得 ATC 第一層分類名稱
+func GetATCClassName(atc string) string {
+	atc = normalizeATCKey(atc)
+	if atc == "" {
+		return ""
+	}
+	return atcMainGroups[atc[0]]
+}
+
+// atcClassOf 藥品的 ATC 第一層代碼，未標記 ATCClass 時取 ATCCode 的首字
+func atcClassOf(item HISPrescriptionItem) string {
+	class := normalizeATCKey(item.ATCClass)
+	if class == "" {
+		class = normalizeATCKey(item.ATCCode)
+	}
+	if len(class) > 1 {
+		class = class[:1]
+	}
+	return class
+}
+
+// tagATC 依對照表填入藥品的 ATC 碼
+func tagATC(result *HISImportResult) {
+	atcTableMu.RLock()
+	defer atcTableMu.RUnlock()
+	if len(atcTable) == 0 {
+		return
+	}
+
+	for i := range result.Prescriptions {
+		items := result.Prescriptions[i].Items
+		for j := range items {
+			atc, ok := atcTable[normalizeATCKey(items[j].DrugCode)]
+			if !ok {
+				continue
+			}
+			items[j].ATCCode = atc
+			items[j].ATCClass = atc[:1]
+		}
+	}
+}
+
+// AggregateDrugUsageByATC 依 ATC 主類彙總用藥量 (需先設定 ATC 對照表)
+// ATC 碼不分大小寫與前後空白；未對應到 ATC 碼的藥品歸入空白分類。依總量由多到少排序，總量相同時依分類代碼
+func AggregateDrugUsageByATC(result *HISImportResult) []ATCUsage {
+	usageMap := make(map[string]*ATCUsage)
+	drugSeen := make(map[string]map[string]bool)
+
+	for _, rx := range result.Prescriptions {
+		for _, item := range rx.Items {
+			if !isDrugItem(item) {
+				continue
+			}
+			class := atcClassOf(item)
+			usage, ok := usageMap[class]
+			if !ok {
+				usage = &ATCUsage{ATCClass: class, ClassName: GetATCClassName(class)}
+				usageMap[class] = usage
+				drugSeen[class] = make(map[string]bool)
+			}
+			usage.TotalQty += item.Quantity
+			usage.DispenseCount++
+			if code := normalizeATCKey(item.DrugCode); !drugSeen[class][code] {
+				drugSeen[class][code] = true
+				usage.DrugCount++
+			}
+		}
+	}
+
+	usages := make([]ATCUsage, 0, len(usageMap))
+	for _, u := range usageMap {
+		usages = append(usages, *u)
+	}
+	sort.SliceStable(usages, func(i, j int) bool {
+		if usages[i].TotalQty != usages[j].TotalQty {
+			return usages[i].TotalQty > usages[j].TotalQty
+		}
+		return usages[i].ATCClass < usages[j].ATCClass
+	})
+	return usages
+}
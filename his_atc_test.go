@@ -0,0 +1,38 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAggregateDrugUsageByATC(t *testing.T) {
+	table, err := LoadATCTableCSV(strings.NewReader("健保碼,ATC碼\n ac12345100 , c08ca01 \nBC23456100,N02BE01\n"))
+	if err != nil {
+		t.Fatalf("LoadATCTableCSV: %v", err)
+	}
+	if want := map[string]string{"AC12345100": "C08CA01", "BC23456100": "N02BE01"}; !reflect.DeepEqual(table, want) {
+		t.Fatalf("table = %v, want %v", table, want)
+	}
+	SetATCTable(table)
+	defer SetATCTable(nil)
+
+	result := &HISImportResult{Prescriptions: []HISPrescription{{
+		Items: []HISPrescriptionItem{
+			{OrderType: OrderTypeDrug, DrugCode: "AC12345100", Quantity: 10},
+			{OrderType: OrderTypeDrug, DrugCode: "BC23456100", Quantity: 10},
+			{OrderType: OrderTypeDrug, DrugCode: "XX00000000", ATCCode: " j01ca04", Quantity: 10},
+			{OrderType: OrderTypeDrug, DrugCode: "YY00000000", ATCClass: "j", Quantity: 5},
+		},
+	}}}
+	tagATC(result)
+
+	var got []string
+	for _, u := range AggregateDrugUsageByATC(result) {
+		got = append(got, u.ATCClass)
+	}
+	// J 合計 15 居首，C 與 N 同為 10 依分類代碼排序
+	if want := []string{"J", "C", "N"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("classes = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,214 @@
+// Package parser 多檔批次解析
+// 一次匯入整個月的日檔時，以 worker pool 並行解析後合併為單一結果
+package parser
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// FileStat 多檔解析中單一檔案的統計
+type FileStat struct {
+	Filename      string `json:"filename"`
+	SourceType    string `json:"source_type,omitempty"`
+	SourceVendor  string `json:"source_vendor,omitempty"`
+	Success       bool   `json:"success"`
+	Total         int    `json:"total"`
+	Imported      int    `json:"imported"`
+	Skipped       int    `json:"skipped"`
+	Failed        int    `json:"failed"`
+	Patients      int    `json:"patients"`
+	Prescriptions int    `json:"prescriptions"`
+	Error         string `json:"error,omitempty"` // 解析失敗原因 (如 ErrEmptyFile)
+}
+
+// ParseHISFiles 並行解析多個檔案並合併結果 (key 為檔名)
+// 同時解析的檔案數可用 WithWorkers 設定，其餘選項套用至每個檔案；
+// 單一檔案失敗時記錄於 Errors 並繼續處理其他檔案，不會中止整批。各檔案的統計依檔名順序記錄於 Files；
+// 不同檔案間重複的處方依 MergeDuplicatePrescriptions 合併，重複筆數由 Imported 移至 Skipped
+func ParseHISFiles(files map[string]io.Reader, vendor HISVendor, opts ...ParseOption) (*HISImportResult, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("未提供檔案: %w", ErrNoRecords)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	o := newParseOptions(opts...)
+	workers := o.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(names) {
+		workers = len(names)
+	}
+
+	type fileResult struct {
+		result *HISImportResult
+		err    error
+	}
+	results := make([]fileResult, len(names))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result, err := ParseWithOptions(files[names[i]], names[i], vendor, opts...)
+				results[i] = fileResult{result, err}
+			}
+		}()
+	}
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	if err := o.err(); err != nil {
+		return nil, err
+	}
+
+	// 依檔名順序合併，確保結果與並行順序無關
+	merged := &HISImportResult{}
+	patientIndex := make(map[string]int)
+	for i, name := range names {
+		result, err := results[i].result, results[i].err
+		stat := FileStat{Filename: name}
+		if err != nil {
+			stat.Error = err.Error()
+		}
+		if result == nil {
+			merged.Errors = append(merged.Errors, fmt.Sprintf("[%s] 解析失敗: %v", name, err))
+			merged.Failed++
+			merged.Files = append(merged.Files, stat)
+			continue
+		}
+		stat.SourceType, stat.SourceVendor = result.SourceType, result.SourceVendor
+		stat.Success = result.Success && err == nil
+		stat.Total, stat.Imported, stat.Skipped, stat.Failed = result.Total, result.Imported, result.Skipped, result.Failed
+		stat.Patients, stat.Prescriptions = len(result.Patients), len(result.Prescriptions)
+		merged.Files = append(merged.Files, stat)
+
+		if err != nil {
+			merged.Errors = append(merged.Errors, fmt.Sprintf("[%s] %v", name, err))
+			if result.Failed == 0 {
+				merged.Failed++
+			}
+		}
+		mergeResultInto(merged, result, patientIndex, "["+name+"] ")
+	}
+
+	mergeDuplicateResults(merged)
+	finishMergedResult(merged)
+	return merged, nil
+}
+
+// MergeResults 合併多次解析的結果 (如每月匯入累積成總結果)，不修改傳入的結果
+// 病患以身分證去重並補齊欄位，處方以身分證與處方序號去重 (同 MergeDuplicatePrescriptions)，
+// 已遮蔽 (MaskAll) 的結果以遮蔽前的身分證比對，並重新產生病患代號；
+// 重複的處方由 Imported 移至 Skipped，其餘筆數統計加總，總點數、自費金額與藥品使用統計依合併後的處方重新計算；
+// 來源格式或廠商不同時標為 "mixed"。nil 結果略過，全部為 nil 時回傳空結果
+func MergeResults(results ...*HISImportResult) *HISImportResult {
+	merged := &HISImportResult{}
+	patientIndex := make(map[string]int)
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		mergeResultInto(merged, result, patientIndex, "")
+		merged.Files = append(merged.Files, result.Files...)
+	}
+	mergeDuplicateResults(merged)
+	rekeyPatients(merged)
+	finishMergedResult(merged)
+	return merged
+}
+
+// mergeDuplicateResults 合併不同檔案或結果間重複的處方 (同 MergeDuplicatePrescriptions)，重複筆數由 Imported 移至 Skipped
+func mergeDuplicateResults(merged *HISImportResult) {
+	count := len(merged.Prescriptions)
+	merged.Prescriptions = MergeDuplicatePrescriptions(merged.Prescriptions)
+	if dup := count - len(merged.Prescriptions); dup > 0 {
+		merged.Imported -= dup
+		merged.Skipped += dup
+		merged.Warnings = append(merged.Warnings, fmt.Sprintf("%d 筆重複的處方已合併", dup))
+	}
+}
+
+// rekeyPatients 合併已遮蔽的結果後重新產生病患代號 (各結果遮蔽時的代號互不相同)
+func rekeyPatients(r *HISImportResult) {
+	key := newPatientKeyer()
+	for i := range r.Patients {
+		if p := &r.Patients[i]; p.Key != "" {
+			p.Key = key(p.identity())
+		}
+	}
+	for i := range r.Prescriptions {
+		if rx := &r.Prescriptions[i]; rx.PatientKey != "" {
+			rx.PatientKey = key(rx.patientIdentity())
+		}
+	}
+}
+
+// mergeResultInto 將 result 的統計、訊息、病患與處方併入 merged (錯誤與警告加上 prefix)
+// 處方僅串接，去重由呼叫端決定
+func mergeResultInto(merged, result *HISImportResult, patientIndex map[string]int, prefix string) {
+	switch {
+	case merged.SourceType == "":
+		merged.SourceType, merged.SourceVendor = result.SourceType, result.SourceVendor
+	case merged.SourceType != result.SourceType:
+		merged.SourceType = "mixed"
+	}
+	if merged.SourceVendor != result.SourceVendor {
+		merged.SourceVendor = "mixed"
+	}
+
+	merged.Total += result.Total
+	merged.Imported += result.Imported
+	merged.Skipped += result.Skipped
+	merged.Failed += result.Failed
+	for _, e := range result.Errors {
+		merged.Errors = append(merged.Errors, prefix+e)
+	}
+	merged.DetailedErrors = append(merged.DetailedErrors, result.DetailedErrors...)
+	for _, w := range result.Warnings {
+		merged.Warnings = append(merged.Warnings, prefix+w)
+	}
+	for _, code := range result.UnknownDrugCodes {
+		if !containsString(merged.UnknownDrugCodes, code) {
+			merged.UnknownDrugCodes = append(merged.UnknownDrugCodes, code)
+		}
+	}
+
+	for i := range result.Patients {
+		p := result.Patients[i]
+		if idx, exists := patientIndex[p.identity()]; exists {
+			mergePatient(&merged.Patients[idx], &p)
+			continue
+		}
+		patientIndex[p.identity()] = len(merged.Patients)
+		merged.Patients = append(merged.Patients, p)
+	}
+	for _, rx := range result.Prescriptions {
+		rx.Items = append([]HISPrescriptionItem(nil), rx.Items...)
+		rx.DiagnosisCodes = append([]string(nil), rx.DiagnosisCodes...)
+		merged.Prescriptions = append(merged.Prescriptions, rx)
+	}
+}
+
+// finishMergedResult 排序並依合併後的處方重新計算金額與使用統計
+func finishMergedResult(merged *HISImportResult) {
+	merged.Sort()
+	merged.SelfPayTotal = calcSelfPayTotal(merged.Prescriptions)
+	fillTotals(merged)
+	merged.DrugUsages, merged.ServiceFees = summarizeUsages(merged.Prescriptions)
+	merged.Success = merged.Failed == 0
+}
@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeResultsSameMonth(t *testing.T) {
+	month := parseTestdata(t, "chronic_nhi.xml", VendorNHI)
+	if month.Imported != len(month.Prescriptions) {
+		t.Fatalf("fixture imported = %d, prescriptions = %d", month.Imported, len(month.Prescriptions))
+	}
+
+	merged := MergeResults(month, month)
+	if len(merged.Prescriptions) != len(month.Prescriptions) {
+		t.Fatalf("prescriptions = %d, want %d", len(merged.Prescriptions), len(month.Prescriptions))
+	}
+	if merged.Imported != len(merged.Prescriptions) {
+		t.Errorf("Imported = %d, want %d", merged.Imported, len(merged.Prescriptions))
+	}
+	if merged.Skipped != month.Skipped*2+len(month.Prescriptions) {
+		t.Errorf("Skipped = %d, want %d", merged.Skipped, month.Skipped*2+len(month.Prescriptions))
+	}
+	if merged.Total != month.Total*2 {
+		t.Errorf("Total = %d, want %d", merged.Total, month.Total*2)
+	}
+	if len(merged.Patients) != len(month.Patients) {
+		t.Errorf("patients = %d, want %d", len(merged.Patients), len(month.Patients))
+	}
+}
+
+func TestMergeResultsMixedVendors(t *testing.T) {
+	nhi := parseTestdata(t, "chronic_nhi.xml", VendorNHI)
+	dm := parseTestdata(t, "chronic_drmaster.xml", VendorDrMaster)
+
+	merged := MergeResults(nhi, nil, dm)
+	if merged.SourceVendor != "mixed" {
+		t.Errorf("SourceVendor = %q, want mixed", merged.SourceVendor)
+	}
+	if want := len(nhi.Prescriptions) + len(dm.Prescriptions); len(merged.Prescriptions) != want || merged.Imported != want {
+		t.Errorf("prescriptions/imported = %d/%d, want %d", len(merged.Prescriptions), merged.Imported, want)
+	}
+	vendors := map[string]int{}
+	for _, rx := range merged.Prescriptions {
+		vendors[rx.SourceVendor]++
+	}
+	if vendors["nhi"] != len(nhi.Prescriptions) || vendors["drmaster"] != len(dm.Prescriptions) {
+		t.Errorf("prescription vendors = %v", vendors)
+	}
+	ids := map[string]bool{}
+	for _, r := range []*HISImportResult{nhi, dm} {
+		for _, p := range r.Patients {
+			ids[p.NationalID] = true
+		}
+	}
+	if len(merged.Patients) != len(ids) {
+		t.Errorf("patients = %d, want %d distinct", len(merged.Patients), len(ids))
+	}
+}
+
+func TestMergeResultsMasked(t *testing.T) {
+	// 兩位病患部分遮蔽後相同，合併時仍須以原始身分證區分
+	month := func(date string) *HISImportResult {
+		r := &HISImportResult{
+			Patients: []HISPatient{{NationalID: "A123456789"}, {NationalID: "A123000789"}},
+			Prescriptions: []HISPrescription{
+				{PatientID: "A123456789", PrescriptionNo: "RX-" + date, DispenseDate: date},
+				{PatientID: "A123000789", PrescriptionNo: "RX-" + date, DispenseDate: date},
+			},
+		}
+		r.Imported = len(r.Prescriptions)
+		r.MaskAll(MaskPartial)
+		return r
+	}
+
+	merged := MergeResults(month("2024-01-05"), month("2024-02-05"))
+	if len(merged.Patients) != 2 || len(merged.Prescriptions) != 4 {
+		t.Fatalf("patients/prescriptions = %d/%d, want 2/4", len(merged.Patients), len(merged.Prescriptions))
+	}
+	for _, p := range merged.Patients {
+		if got := len(merged.PatientTimeline(p.Key)); got != 2 {
+			t.Errorf("timeline for %s = %d entries, want 2", p.Key, got)
+		}
+	}
+}
+
+func TestParseHISFilesMergesDuplicates(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "chronic_nhi.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := parseTestdata(t, "chronic_nhi.xml", VendorNHI)
+
+	merged, err := ParseHISFiles(map[string]io.Reader{
+		"day1.xml": bytes.NewReader(content),
+		"day2.xml": bytes.NewReader(content), // 重複上傳同一份日檔
+	}, VendorNHI)
+	if err != nil {
+		t.Fatalf("ParseHISFiles: %v", err)
+	}
+	if len(merged.Prescriptions) != len(one.Prescriptions) || merged.Imported != len(one.Prescriptions) {
+		t.Errorf("prescriptions/imported = %d/%d, want %d", len(merged.Prescriptions), merged.Imported, len(one.Prescriptions))
+	}
+	if merged.Skipped != one.Skipped*2+len(one.Prescriptions) {
+		t.Errorf("Skipped = %d, want %d", merged.Skipped, one.Skipped*2+len(one.Prescriptions))
+	}
+}
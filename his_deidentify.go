@@ -0,0 +1,163 @@
+// Package parser 去識別化輸出
+// 學術研究用資料集：身分證以一致的代號取代，移除姓名電話，生日降低精度，醫院代碼雜湊化
+package parser
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BirthdayGranularity 去識別化後保留的生日精度
+type BirthdayGranularity int
+
+const (
+	BirthdayYear     BirthdayGranularity = iota // 只保留出生年 (Birthday 為 YYYY)
+	BirthdayAgeGroup                            // 只保留年齡層 (Birthday 清空，年齡層記錄於 AgeBand)
+	BirthdayRemove                              // 完全移除
+)
+
+// DeidentifyOptions 去識別化選項 (零值即為最嚴格的預設)
+type DeidentifyOptions struct {
+	// Salt 代號與雜湊的金鑰；空字串時病患代號依出現順序編號 (P000001...)，醫院代碼以隨機金鑰雜湊，
+	// 僅同一批次內一致。跨批次需要對應同一人時指定相同的 Salt (請妥善保管，取得 Salt 即可比對身分證)
+	Salt         string
+	IDPrefix     string              // 病患代號前綴，預設 "P"
+	Birthday     BirthdayGranularity // 生日精度，預設只保留出生年
+	AgeGroupSize int                 // BirthdayAgeGroup 時的年齡層間距 (如 10 為 60-69)，0 為標準年齡層 (見 AgeGroup 常數)
+	AsOf         time.Time           // 計算年齡層的基準日，零值為目前時間
+	KeepProvider bool                // 保留原處方醫院代碼與名稱 (預設雜湊化並移除名稱)
+}
+
+// Deidentify 產生去識別化的新結果，不修改原物件
+//   - 身分證以代號取代 (同一人在同一批次的病患與處方中對應同一代號)
+//   - 移除姓名、電話、健保卡號、藥師資料、就醫識別碼與申報原始段別
+//   - 生日依 opts.Birthday 只保留出生年、年齡層或完全移除
+//   - 原處方醫院代碼以 HMAC-SHA256 雜湊化，處方序號 (可能含身分證) 一併雜湊
+//
+// 錯誤明細 (含原始行內容) 不輸出；Errors 與 Warnings 保留 (其中的身分證已遮蔽)。
+// 需在 MaskAll 之前呼叫，否則遮蔽後相同的身分證會對應到同一代號
+func (r *HISImportResult) Deidentify(opts DeidentifyOptions) *HISImportResult {
+	if r == nil {
+		return nil
+	}
+
+	d := newDeidentifier(opts)
+	out := *r
+	out.Claim = nil
+	out.DetailedErrors = nil
+	out.Errors = append([]string(nil), r.Errors...)
+	out.Warnings = append([]string(nil), r.Warnings...)
+	out.DrugUsages = append([]HISDrugUsage(nil), r.DrugUsages...)
+	out.ServiceFees = append([]HISServiceFee(nil), r.ServiceFees...)
+	out.UnknownDrugCodes = append([]string(nil), r.UnknownDrugCodes...)
+	out.VendorCandidates = append([]VendorMatch(nil), r.VendorCandidates...)
+	out.Files = append([]FileStat(nil), r.Files...)
+
+	asOf := opts.AsOf
+	if asOf.IsZero() {
+		asOf = time.Now()
+	}
+	out.Patients = make([]HISPatient, len(r.Patients))
+	for i, p := range r.Patients {
+		if p.Gender == "" {
+			p.Gender = GenderFromNationalID(p.NationalID)
+		}
+		p.NationalID = d.pseudoID(p.NationalID)
+		p.Name, p.Phone, p.Mobile, p.CardNumber = "", "", "", ""
+		p.rawNationalID = ""
+		switch opts.Birthday {
+		case BirthdayYear:
+			if len(p.Birthday) >= 4 {
+				p.Birthday = p.Birthday[:4]
+			}
+		case BirthdayAgeGroup:
+			p.AgeBand = ageBand(p.Age(asOf), opts.AgeGroupSize)
+			p.Birthday = ""
+		default:
+			p.Birthday = ""
+		}
+		out.Patients[i] = p
+	}
+
+	out.Prescriptions = make([]HISPrescription, len(r.Prescriptions))
+	for i, rx := range r.Prescriptions {
+		rx.PatientID = d.pseudoID(rx.PatientID)
+		rx.rawPatientID, rx.noSeq = "", ""
+		if rx.PrescriptionNo != "" {
+			rx.PrescriptionNo = "RX" + d.hash(rx.PrescriptionNo)
+		}
+		if !opts.KeepProvider {
+			if rx.ProviderCode != "" {
+				rx.ProviderCode = "H" + d.hash(rx.ProviderCode)
+			}
+			rx.ProviderName = ""
+		}
+		rx.PharmacistID, rx.PharmacistName, rx.VisitID = "", "", ""
+		rx.Items = append([]HISPrescriptionItem(nil), rx.Items...)
+		rx.Procedures = append([]HISProcedureItem(nil), rx.Procedures...)
+		rx.DiagnosisCodes = append([]string(nil), rx.DiagnosisCodes...)
+		out.Prescriptions[i] = rx
+	}
+	return &out
+}
+
+// deidentifier 同一批次的代號對照與雜湊金鑰
+type deidentifier struct {
+	key    []byte
+	salted bool
+	prefix string
+	ids    map[string]string
+}
+
+// newDeidentifier 建立代號產生器，未指定 Salt 時使用隨機金鑰
+func newDeidentifier(opts DeidentifyOptions) *deidentifier {
+	d := &deidentifier{
+		key:    []byte(opts.Salt),
+		salted: opts.Salt != "",
+		prefix: firstNonEmpty(opts.IDPrefix, "P"),
+		ids:    make(map[string]string),
+	}
+	if !d.salted {
+		d.key = make([]byte, 32)
+		rand.Read(d.key)
+	}
+	return d
+}
+
+// pseudoID 身分證對應的代號 (不分大小寫與前後空白)，空字串原樣回傳
+func (d *deidentifier) pseudoID(id string) string {
+	id = strings.ToUpper(strings.TrimSpace(id))
+	if id == "" {
+		return ""
+	}
+	if pseudo, ok := d.ids[id]; ok {
+		return pseudo
+	}
+	pseudo := fmt.Sprintf("%s%06d", d.prefix, len(d.ids)+1)
+	if d.salted {
+		pseudo = d.prefix + d.hash(id)
+	}
+	d.ids[id] = pseudo
+	return pseudo
+}
+
+// hash HMAC-SHA256 前 12 碼 (大寫十六進位)
+func (d *deidentifier) hash(s string) string {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write([]byte(strings.ToUpper(strings.TrimSpace(s))))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil))[:12])
+}
+
+// ageBand 年齡對應的年齡層，size 為 0 時使用標準年齡層
+func ageBand(age, size int) string {
+	if size <= 0 || age < 0 {
+		return ageGroupOf(age)
+	}
+	low := age / size * size
+	return fmt.Sprintf("%d-%d", low, low+size-1)
+}
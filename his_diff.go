@@ -0,0 +1,131 @@
+// Package parser 重複匯入偵測與增量比對
+// 以病患、處方與藥品計算檔案指紋，並比對兩次匯入結果的處方差異
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// ResultDiff 兩次匯入結果的處方差異 (以病患 + 處方序號識別同一張處方)
+type ResultDiff struct {
+	Added     []HISPrescription `json:"added,omitempty"`   // 新結果才有的處方
+	Removed   []HISPrescription `json:"removed,omitempty"` // 舊結果才有的處方
+	Changed   []HISPrescription `json:"changed,omitempty"` // 兩邊都有但醫令不同的處方 (新結果的版本)
+	Unchanged int               `json:"unchanged"`         // 完全相同的處方數
+}
+
+// Empty 兩次結果的處方是否完全相同
+func (d ResultDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Fingerprint 計算解析結果的指紋 (SHA-256 十六進位字串)
+// 由排序後的病患身分證、處方識別與藥品代碼集合計算，與檔案編碼、記錄順序無關 (遮蔽後仍使用原始身分證)；
+// 指紋相同表示兩次匯入的內容相同，可用來提示重複匯入
+func (r *HISImportResult) Fingerprint() string {
+	if r == nil {
+		return ""
+	}
+
+	patients := make(map[string]bool)
+	prescriptions := make(map[string]bool)
+	drugs := make(map[string]bool)
+	for _, p := range r.Patients {
+		patients[p.identity()] = true
+	}
+	for i := range r.Prescriptions {
+		rx := &r.Prescriptions[i]
+		patients[rx.patientIdentity()] = true
+		prescriptions[prescriptionKey(rx)] = true
+		for _, item := range rx.allItems() {
+			drugs[item.DrugCode] = true
+		}
+	}
+
+	h := sha256.New()
+	for _, set := range []map[string]bool{patients, prescriptions, drugs} {
+		for _, key := range sortedKeys(set) {
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{0xFF})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DiffResults 比對兩次匯入結果，列出 b 相對於 a 新增、移除與異動的處方
+// 供增量匯入時只處理有變動的處方；任一方為 nil 時視為空結果
+func DiffResults(a, b *HISImportResult) ResultDiff {
+	var diff ResultDiff
+	old := make(map[string]*HISPrescription)
+	if a != nil {
+		for i := range a.Prescriptions {
+			old[prescriptionKey(&a.Prescriptions[i])] = &a.Prescriptions[i]
+		}
+	}
+
+	seen := make(map[string]bool)
+	if b != nil {
+		for i := range b.Prescriptions {
+			rx := &b.Prescriptions[i]
+			key := prescriptionKey(rx)
+			seen[key] = true
+			prev, ok := old[key]
+			switch {
+			case !ok:
+				diff.Added = append(diff.Added, *rx)
+			case itemSignature(prev) != itemSignature(rx):
+				diff.Changed = append(diff.Changed, *rx)
+			default:
+				diff.Unchanged++
+			}
+		}
+	}
+
+	if a != nil {
+		for i := range a.Prescriptions {
+			if !seen[prescriptionKey(&a.Prescriptions[i])] {
+				diff.Removed = append(diff.Removed, a.Prescriptions[i])
+			}
+		}
+	}
+	return diff
+}
+
+// prescriptionKey 處方識別: 病患 (遮蔽後仍為原始身分證) + 處方序號，無序號時改用調劑日期時間與就醫識別
+func prescriptionKey(rx *HISPrescription) string {
+	return prescriptionKeyFor(rx.patientIdentity(), rx)
+}
+
+// prescriptionKeyFor 以指定的病患識別組成處方識別
+func prescriptionKeyFor(patientID string, rx *HISPrescription) string {
+	if rx.PrescriptionNo != "" {
+		return patientID + "\x00" + rx.PrescriptionNo
+	}
+	return strings.Join([]string{patientID, rx.DispenseDate, rx.DispenseTime, visitKey(rx)}, "\x00")
+}
+
+// itemSignature 處方醫令的比對字串 (藥品代碼、數量、天數，排序後與順序無關)
+func itemSignature(rx *HISPrescription) string {
+	var parts []string
+	for _, item := range rx.allItems() {
+		parts = append(parts, item.DrugCode+"|"+formatFloat(item.Quantity)+"|"+formatInt(item.DaysSupply))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "\x00")
+}
+
+// sortedKeys 取出 map 的 key 並排序 (略過空字串)
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
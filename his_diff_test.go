@@ -0,0 +1,34 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffResultsMasked(t *testing.T) {
+	parse := func(rows string) *HISImportResult {
+		t.Helper()
+		result, err := ParseWithOptions(strings.NewReader("身分證,姓名,藥品代碼,數量,處方號\n"+rows), "data.csv", VendorGeneric)
+		if err != nil {
+			t.Fatalf("ParseWithOptions: %v", err)
+		}
+		result.MaskAll(MaskFull)
+		return result
+	}
+	// 兩位病患使用相同的處方號，遮蔽後身分證相同
+	a := parse("A123456789,王小明,AC12345100,28,RX001\nB223456782,李小華,BC23456100,7,RX001\n")
+	b := parse("A123456789,王小明,AC12345100,28,RX001\nB223456782,李小華,BC23456100,14,RX001\n")
+	c := parse("A123456789,王小明,AC12345100,28,RX001\nC123456781,李小華,BC23456100,7,RX001\n")
+
+	diff := DiffResults(a, b)
+	if len(diff.Added) != 0 || len(diff.Removed) != 0 || len(diff.Changed) != 1 || diff.Unchanged != 1 {
+		t.Errorf("diff = %d added, %d removed, %d changed, %d unchanged, want 0/0/1/1",
+			len(diff.Added), len(diff.Removed), len(diff.Changed), diff.Unchanged)
+	}
+	if a.Fingerprint() == c.Fingerprint() {
+		t.Error("different patients have the same fingerprint after masking")
+	}
+	if a.Fingerprint() != parse("B223456782,李小華,BC23456100,7,RX001\nA123456789,王小明,AC12345100,28,RX001\n").Fingerprint() {
+		t.Error("same content in another order has a different fingerprint")
+	}
+}
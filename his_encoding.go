@@ -0,0 +1,99 @@
+// Package parser GBK / GB18030 編碼偵測
+// 大陸系統匯出的檔案為 GBK，與 Big5 位元組範圍重疊，需比較兩者的常用字比例才能區分
+package parser
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/transform"
+)
+
+// detectGBK 偵測是否為 GBK / GB18030 編碼 (僅掃描前 64KB)
+// 合法 UTF-8 或純 ASCII 一律回傳 false；否則分別統計雙位元組落在
+// Big5 常用字區 (0xA440–0xC67E、標點 0xA140–0xA3BF) 與 GBK 一級漢字區 (0xB0A1–0xD7FE、符號 0xA1A1–0xA3FE)
+// 及 Big5 不使用的擴充區 (首位元組 0x81–0xA0 或次位元組 0x80–0xA0) 的比例，
+// GBK 比例較高且以 GB18030 試解碼後合法中文比例足夠時才判定為 GBK
+func detectGBK(content []byte) bool {
+	if len(content) > encodingSampleSize {
+		content = content[:encodingSampleSize]
+	}
+	if utf8.Valid(content) {
+		return false
+	}
+
+	pairs, big5Common, gbkCommon, bad := 0, 0, 0, 0
+	for i := 0; i < len(content); i++ {
+		b1 := content[i]
+		if b1 < 0x80 {
+			continue
+		}
+		if b1 < 0x81 || b1 > 0xFE || i+1 >= len(content) {
+			bad++
+			continue
+		}
+		b2 := content[i+1]
+
+		// GB18030 四位元組序列 (第二位元組為數字)，Big5 中不會出現
+		if b2 >= 0x30 && b2 <= 0x39 {
+			if i+3 >= len(content) {
+				break
+			}
+			pairs++
+			gbkCommon++
+			i += 3
+			continue
+		}
+		if b2 < 0x40 || b2 == 0x7F || b2 == 0xFF {
+			bad++
+			continue
+		}
+
+		pairs++
+		code := int(b1)<<8 | int(b2)
+		if (code >= 0xA440 && code <= 0xC67E) || (code >= 0xA140 && code <= 0xA3BF) {
+			big5Common++
+		}
+		switch {
+		case b2 >= 0xA1 && ((code >= 0xB0A1 && code <= 0xD7FE) || (code >= 0xA1A1 && code <= 0xA3FE)):
+			gbkCommon++
+		case b1 <= 0xA0 || (b2 >= 0x80 && b2 <= 0xA0):
+			// GBK 擴充區 (繁體字多在此)，Big5 不使用這些位元組組合
+			gbkCommon++
+		}
+		i++
+	}
+
+	if pairs == 0 || bad > pairs/10 || gbkCommon <= big5Common || gbkCommon*10 < pairs*7 {
+		return false
+	}
+	return gb18030ChineseRatio(content) >= 0.9
+}
+
+// gb18030ChineseRatio 以 GB18030 試解碼，回傳非 ASCII 字元中合法中文 (漢字與全形標點) 的比例
+func gb18030ChineseRatio(content []byte) float64 {
+	decoded, _, err := transform.Bytes(simplifiedchinese.GB18030.NewDecoder(), content)
+	if err != nil {
+		return 0
+	}
+
+	total, chinese := 0, 0
+	for _, r := range string(decoded) {
+		if r < utf8.RuneSelf {
+			continue
+		}
+		total++
+		switch {
+		case unicode.Is(unicode.Han, r),
+			r >= 0x3000 && r <= 0x303F, // CJK 標點
+			r >= 0xFF00 && r <= 0xFFEF, // 全形字元
+			r >= 0x2010 && r <= 0x203F: // 引號、破折號等一般標點
+			chinese++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(chinese) / float64(total)
+}
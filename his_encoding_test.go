@@ -0,0 +1,147 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// big5GenericCSV 產生 rows 列的 Big5 通用 CSV
+func big5GenericCSV(tb testing.TB, rows int) []byte {
+	tb.Helper()
+	var sb strings.Builder
+	sb.WriteString("身分證,姓名,處方號,藥品代碼,藥品名稱,數量,天數\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&sb, "A123456789,王小明,RX%06d,AC12345100,脈優錠 5 毫克,28,28\n", i/3)
+	}
+	encoded, err := traditionalchinese.Big5.NewEncoder().String(sb.String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return []byte(encoded)
+}
+
+// BenchmarkDecodeText 比較同一份內容重複解碼：
+// per-call 每次建立新的 ParseOptions (重構前各入口各自偵測與轉換)，cached 共用同一 ParseOptions (重構後)
+func BenchmarkDecodeText(b *testing.B) {
+	content := big5GenericCSV(b, 20000)
+	const lookups = 3 // 自動偵測廠商時最多讀取內容的次數
+
+	b.Run("per-call", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(content)))
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < lookups; j++ {
+				newParseOptions().decodeText(content)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(content)))
+		for i := 0; i < b.N; i++ {
+			o := newParseOptions()
+			for j := 0; j < lookups; j++ {
+				o.decodeText(content)
+			}
+		}
+	})
+}
+
+// BenchmarkDetectEncoding 編碼偵測只取樣前 encodingSampleSize，耗時不隨檔案大小增加
+func BenchmarkDetectEncoding(b *testing.B) {
+	for _, rows := range []int{1000, 100000} {
+		content := big5GenericCSV(b, rows)
+		b.Run(fmt.Sprintf("%dKB", len(content)>>10), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				detectEncoding(content)
+			}
+		})
+	}
+}
+
+// BenchmarkParseWithOptionsBig5 自動偵測廠商並解析 Big5 通用 CSV 的整體耗時
+func BenchmarkParseWithOptionsBig5(b *testing.B) {
+	content := big5GenericCSV(b, 20000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(content)))
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseWithOptions(bytes.NewReader(content), "data.csv", VendorAuto); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDetectBig5Samples(t *testing.T) {
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"yaosheng_big5.csv", true},
+		{"yaosheng_utf8.csv", false},
+		{"ascii_only.csv", false},
+	}
+	for _, tt := range tests {
+		content, err := os.ReadFile(filepath.Join("testdata", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := detectBig5(content); got != tt.want {
+			t.Errorf("detectBig5(%s) = %v, want %v", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestDetectBig5ShortText(t *testing.T) {
+	// 只有少量中文、標點與全形數字的短檔
+	short, err := traditionalchinese.Big5.NewEncoder().String("A123456789,王小明，１２３\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detectBig5([]byte(short)) {
+		t.Error("detectBig5(short Big5) = false, want true")
+	}
+	if detectBig5([]byte("A123456789,王小明，１２３\n")) {
+		t.Error("detectBig5(short UTF-8) = true, want false")
+	}
+}
+
+func TestDecodeYaoshengSamples(t *testing.T) {
+	big5 := parseTestdata(t, "yaosheng_big5.csv", VendorYaosheng)
+	utf := parseTestdata(t, "yaosheng_utf8.csv", VendorYaosheng)
+
+	names := func(r *HISImportResult) []string {
+		var out []string
+		for _, rx := range r.Prescriptions {
+			for _, item := range rx.Items {
+				out = append(out, item.DrugName)
+			}
+		}
+		sort.Strings(out)
+		return out
+	}
+	want := []string{"克補錠，飯後服用", "普拿疼錠 500 毫克", "脈優錠５毫克（降血壓）"}
+	if got := names(big5); !reflect.DeepEqual(got, want) {
+		t.Errorf("Big5 drug names = %q, want %q", got, want)
+	}
+	if got := names(utf); !reflect.DeepEqual(got, want) {
+		t.Errorf("UTF-8 drug names = %q, want %q", got, want)
+	}
+	for _, r := range []*HISImportResult{big5, utf} {
+		found := false
+		for _, p := range r.Patients {
+			found = found || (p.NationalID == "A123456789" && p.Name == "王小明")
+		}
+		if !found {
+			t.Errorf("patients = %+v, want A123456789 王小明", r.Patients)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Package parser 錯誤類型
+// 各解析與匯出入口以 fmt.Errorf("...: %w", ErrXxx) 包裝下列錯誤，呼叫端以 errors.Is 判斷原因，不需比對錯誤訊息
+package parser
+
+import "errors"
+
+var (
+	// ErrEmptyFile 檔案為空或去除空白後沒有內容 (所有解析入口一致回傳)
+	ErrEmptyFile = errors.New("檔案為空或僅含空白")
+
+	// ErrReadFailed 讀取輸入失敗 (底層 I/O 錯誤一併包裝，可用 errors.Unwrap 或 errors.As 取得)
+	ErrReadFailed = errors.New("讀取檔案失敗")
+
+	// ErrUnknownFormat 無法識別的檔案格式 (非 XML、申報 CSV、通用 CSV、Excel 或廠商格式，或檔案結構損壞)
+	ErrUnknownFormat = errors.New("無法識別的檔案格式")
+
+	// ErrEncodingFailed 匯出時文字編碼轉換失敗 (ExportToNHIUploadXML 轉 Big5)；解析時解碼失敗則保留原始內容，不回傳此錯誤
+	ErrEncodingFailed = errors.New("編碼轉換失敗")
+
+	// ErrNoRecords 沒有可處理的資料: ParseHISFiles 未提供檔案、壓縮檔內沒有可解析的檔案，
+	// 或匯出、報表與 FHIR 轉換時未提供結果或處方；檔案內容為空時回傳 ErrEmptyFile，解析不到任何處方則不視為錯誤
+	ErrNoRecords = errors.New("沒有可處理的資料")
+
+	// ErrInvalidColumnMapping 自訂欄位對應含未知欄位或負數索引 (見 ValidateColumnMapping)
+	ErrInvalidColumnMapping = errors.New("欄位對應錯誤")
+
+	// ErrStrict 嚴格模式下解析結果含錯誤 (見 WithStrict)，仍會回傳已解析的結果
+	ErrStrict = errors.New("嚴格模式")
+)
@@ -0,0 +1,350 @@
+// Package parser 解析結果匯出
+// 將巢狀的處方結構轉換為試算表可用的表格格式
+package parser
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/transform"
+)
+
+// FlattenedItemHeaders 明細表 (一列一藥品) 欄位名稱
+var FlattenedItemHeaders = []string{
+	"身分證", "姓名", "生日", "電話",
+	"處方序號", "調劑日期", "調劑時間", "就醫類別", "就醫序號", "慢箋次數",
+	"原處方醫院", "診斷碼",
+	"醫令類別", "藥品代碼", "藥品名稱", "頻率", "途徑", "數量", "天數", "單價", "自費",
+}
+
+// FlattenItems 將處方展開為一列一藥品的明細表 (病患 + 處方 + 藥品欄位)
+// 第一列為表頭；沒有藥品的處方仍輸出一列以保留處方資訊
+func FlattenItems(result *HISImportResult) [][]string {
+	rows := [][]string{FlattenedItemHeaders}
+	if result == nil {
+		return rows
+	}
+
+	patients := make(map[string]*HISPatient, len(result.Patients))
+	for i := range result.Patients {
+		patients[result.Patients[i].NationalID] = &result.Patients[i]
+	}
+
+	for _, rx := range result.Prescriptions {
+		base := []string{rx.PatientID, "", "", ""}
+		if p, ok := patients[rx.PatientID]; ok {
+			base = []string{p.NationalID, p.Name, p.Birthday, firstNonEmpty(p.Phone, p.Mobile)}
+		}
+		base = append(base,
+			rx.PrescriptionNo,
+			rx.DispenseDate,
+			rx.DispenseTime,
+			rx.VisitType,
+			rx.VisitSequence,
+			formatInt(rx.ChronicRefillNo),
+			firstNonEmpty(rx.ProviderName, rx.ProviderCode),
+			rx.DiagnosisCode,
+		)
+
+		items := rx.allItems()
+		if len(items) == 0 {
+			row := append(append([]string{}, base...), make([]string, 9)...)
+			rows = append(rows, row)
+			continue
+		}
+
+		for _, item := range items {
+			selfPay := ""
+			if item.IsSelfPay {
+				selfPay = "Y"
+			}
+			row := append(append([]string{}, base...),
+				item.OrderType,
+				item.DrugCode,
+				item.DrugName,
+				item.Frequency,
+				item.Route,
+				formatFloat(item.Quantity),
+				formatInt(item.DaysSupply),
+				formatFloat(item.UnitPrice),
+				selfPay,
+			)
+			rows = append(rows, row)
+		}
+	}
+
+	return rows
+}
+
+// utf8BOM 讓 Excel 以 UTF-8 開啟 CSV 的位元組順序記號
+const utf8BOM = "\xEF\xBB\xBF"
+
+// ToCSV 將處方明細 (一列一藥品，欄位同 FlattenItems) 輸出為 CSV
+// 開頭含 UTF-8 BOM 讓 Excel 正確顯示中文；可指定遮蔽模式遮蔽身分證與電話，未指定時不遮蔽
+func (r *HISImportResult) ToCSV(w io.Writer, mask ...MaskMode) error {
+	return r.writeDelimited(w, ',', mask)
+}
+
+// ToTSV 同 ToCSV，改以 Tab 分隔
+func (r *HISImportResult) ToTSV(w io.Writer, mask ...MaskMode) error {
+	return r.writeDelimited(w, '\t', mask)
+}
+
+// ToXLSX 將處方明細 (一列一藥品，欄位同 FlattenItems) 輸出為 Excel 活頁簿的「明細」工作表
+// 儲存格一律為文字以保留藥品代碼與身分證的前導零；遮蔽模式同 ToCSV
+func (r *HISImportResult) ToXLSX(w io.Writer, mask ...MaskMode) error {
+	return writeXLSX(w, "明細", r.flattenMasked(mask))
+}
+
+// flattenMasked 產生明細表並依指定的遮蔽模式遮蔽身分證與電話
+func (r *HISImportResult) flattenMasked(mask []MaskMode) [][]string {
+	mode := MaskNone
+	if len(mask) > 0 {
+		mode = mask[0]
+	}
+	rows := FlattenItems(r)
+	if mode != MaskNone {
+		for _, row := range rows[1:] {
+			row[0] = MaskNationalID(row[0], mode)
+			row[3] = MaskPhone(row[3], mode)
+		}
+	}
+	return rows
+}
+
+// writeDelimited 輸出分隔字元格式的明細表
+func (r *HISImportResult) writeDelimited(w io.Writer, comma rune, mask []MaskMode) error {
+	if _, err := io.WriteString(w, utf8BOM); err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	for _, row := range r.flattenMasked(mask) {
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// xlsxPackageFiles 單一工作表活頁簿的固定組件 (工作表內容另行寫入 xl/worksheets/sheet1.xml)
+var xlsxPackageFiles = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// writeXLSX 將 rows 寫成只有一個工作表的 XLSX，儲存格皆為行內字串
+func writeXLSX(w io.Writer, sheetName string, rows [][]string) error {
+	zw := zip.NewWriter(w)
+	for _, f := range xlsxPackageFiles {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, f.body); err != nil {
+			return err
+		}
+	}
+
+	var wb bytes.Buffer
+	wb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="`)
+	xml.EscapeText(&wb, []byte(sheetName))
+	wb.WriteString(`" sheetId="1" r:id="rId1"/></sheets></workbook>`)
+	fw, err := zw.Create("xl/workbook.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(wb.Bytes()); err != nil {
+		return err
+	}
+
+	fw, err = zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	var sb bytes.Buffer
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range rows {
+		fmt.Fprintf(&sb, `<row r="%d">`, i+1)
+		for j, v := range row {
+			if v == "" {
+				continue
+			}
+			fmt.Fprintf(&sb, `<c r="%s%d" t="inlineStr"><is><t xml:space="preserve">`, xlsxColumnName(j), i+1)
+			xml.EscapeText(&sb, []byte(v))
+			sb.WriteString(`</t></is></c>`)
+		}
+		sb.WriteString(`</row>`)
+		// 分段寫出，避免大型明細表整份留在記憶體
+		if sb.Len() >= 64*1024 {
+			if _, err := fw.Write(sb.Bytes()); err != nil {
+				return err
+			}
+			sb.Reset()
+		}
+	}
+	sb.WriteString(`</sheetData></worksheet>`)
+	if _, err := fw.Write(sb.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// xlsxColumnName 欄序 (0 起算) 轉為 Excel 欄名 (A、B ... Z、AA ...)，與 xlsxColumnIndex 相反
+func xlsxColumnName(col int) string {
+	name := ""
+	for col++; col > 0; col = (col - 1) / 26 {
+		name = string(rune('A'+(col-1)%26)) + name
+	}
+	return name
+}
+
+// ExportToNHIUploadXML 將解析結果轉回健保署每日上傳 XML
+// isBig5 為 true 時輸出 Big5 編碼 (無法以 Big5 表示的字元改為 XML 字元參照)，否則輸出 UTF-8
+func ExportToNHIUploadXML(result *HISImportResult, isBig5 bool) ([]byte, error) {
+	if result == nil {
+		return nil, fmt.Errorf("匯出失敗: %w", ErrNoRecords)
+	}
+
+	patients := make(map[string]*HISPatient, len(result.Patients))
+	for i := range result.Patients {
+		patients[result.Patients[i].NationalID] = &result.Patients[i]
+	}
+
+	doc := NHIUploadXML{Records: make([]NHIRecord, 0, len(result.Prescriptions))}
+	for _, rx := range result.Prescriptions {
+		rec := NHIRecord{
+			MB1: NHIMB1{
+				A01: firstNonEmpty(rx.DataFormat, "1"),
+				A12: rx.PatientID,
+				A14: rx.ProviderCode,
+				A17: toROCDateTime(rx.DispenseDate, rx.DispenseTime),
+				A18: rx.VisitSequence,
+				A54: rx.VisitID,
+				A23: rx.VisitType,
+				D10: rx.PaymentCategory,
+				D19: rx.DiagnosisCode,
+				D31: rx.PharmacistID,
+				D32: rx.PharmacistName,
+			},
+		}
+		if p, ok := patients[rx.PatientID]; ok {
+			rec.MB1.A11 = p.CardNumber
+			rec.MB1.A13 = toROCDate(p.Birthday)
+			rec.MB1.D20 = p.Name
+			rec.MB1.D21 = firstNonEmpty(p.Phone, p.Mobile)
+		}
+
+		for _, item := range rx.allItems() {
+			mb2 := NHIMB2{
+				P1:  item.OrderType,
+				P2:  item.DrugCode,
+				P3:  item.DrugName,
+				P5:  item.Frequency,
+				P6:  item.Route,
+				P7:  formatFloat(item.Quantity),
+				P8:  formatFloat(item.UnitPrice),
+				D27: formatInt(item.DaysSupply),
+				D36: formatInt(rx.ChronicRefillNo),
+			}
+			if item.IsSelfPay {
+				mb2.P10 = "Y"
+			}
+			rec.MB2s = append(rec.MB2s, mb2)
+		}
+
+		doc.Records = append(doc.Records, rec)
+	}
+
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("XML 產生失敗: %w", err)
+	}
+
+	if !isBig5 {
+		return append([]byte(`<?xml version="1.0" encoding="UTF-8"?>`+"\n"), body...), nil
+	}
+
+	encoder := encoding.HTMLEscapeUnsupported(traditionalchinese.Big5.NewEncoder())
+	encoded, _, err := transform.Bytes(encoder, body)
+	if err != nil {
+		return nil, fmt.Errorf("Big5 %w: %w", ErrEncodingFailed, err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="Big5"?>` + "\n")
+	buf.Write(encoded)
+	return buf.Bytes(), nil
+}
+
+// toROCDate 西元日期轉民國年 (YYYY-MM-DD -> YYYMMDD)，無法解析時回傳空字串
+func toROCDate(date string) string {
+	t, err := time.Parse("2006-01-02", strings.TrimSpace(date))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%03d%02d%02d", t.Year()-1911, t.Month(), t.Day())
+}
+
+// toROCDateTime 西元日期與時間轉民國年 (YYYY-MM-DD + HH:MM:SS -> YYYMMDDHHMMSS)
+// 缺少時間時補 000000
+func toROCDateTime(date, clock string) string {
+	d := toROCDate(date)
+	if d == "" {
+		return ""
+	}
+	hms := strings.ReplaceAll(strings.TrimSpace(clock), ":", "")
+	if len(hms) != 6 {
+		hms = "000000"
+	}
+	return d + hms
+}
+
+// formatFloat 數值轉字串 (去除多餘小數位)
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// formatInt 整數轉字串，0 輸出空字串
+func formatInt(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// firstNonEmpty 回傳第一個非空字串
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
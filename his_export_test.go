@@ -0,0 +1,43 @@
+package parser
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestToXLSX(t *testing.T) {
+	result := parseTestdata(t, "chronic_nhi.xml", VendorNHI)
+
+	var buf bytes.Buffer
+	if err := result.ToXLSX(&buf, MaskPartial); err != nil {
+		t.Fatalf("ToXLSX: %v", err)
+	}
+	rows, err := readXLSXFirstSheet(buf.Bytes())
+	if err != nil {
+		t.Fatalf("readXLSXFirstSheet: %v", err)
+	}
+
+	want := result.flattenMasked([]MaskMode{MaskPartial})
+	if len(rows) != len(want) {
+		t.Fatalf("rows = %d, want %d", len(rows), len(want))
+	}
+	for i := range want {
+		// 讀回時省略列尾的空白儲存格
+		got := append(rows[i], make([]string, len(want[i])-len(rows[i]))...)
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("row %d = %q, want %q", i, got, want[i])
+		}
+	}
+	if rows[1][0] == result.Prescriptions[0].PatientID {
+		t.Errorf("national ID %q was not masked", rows[1][0])
+	}
+}
+
+func TestXLSXColumnName(t *testing.T) {
+	for _, col := range []int{0, 25, 26, 51, 52, 701, 702} {
+		if got := xlsxColumnIndex(xlsxColumnName(col) + "1"); got != col {
+			t.Errorf("xlsxColumnIndex(xlsxColumnName(%d)) = %d", col, got)
+		}
+	}
+}
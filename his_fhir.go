@@ -0,0 +1,284 @@
+// Package parser FHIR R4 輸出
+// 將處方與病患轉為 FHIR MedicationRequest / Patient 資源，方便對接 FHIR 伺服器
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// FHIR 代碼系統 (健保藥品代碼使用健保署登記的 OID，可依對接的伺服器調整)
+var (
+	FHIRSystemNHIDrug    = "urn:oid:2.16.886.101.20003.20014" // 健保藥品代碼 (電子病歷交換使用的 OID)
+	FHIRSystemNationalID = "http://www.moi.gov.tw"            // 國民身分證統一編號
+)
+
+// fhirSystemGTSAbbreviation HL7 給藥時程縮寫代碼系統
+const fhirSystemGTSAbbreviation = "http://terminology.hl7.org/CodeSystem/v3-GTSAbbreviation"
+
+// fhirGTSCodes 可對應至 GTSAbbreviation 的標準頻率代碼
+var fhirGTSCodes = map[string]string{
+	"QD": "QD", "BID": "BID", "TID": "TID", "QID": "QID",
+	"QAM": "AM", "QPM": "PM", "QOD": "QOD",
+	"Q1H": "Q1H", "Q2H": "Q2H", "Q3H": "Q3H", "Q4H": "Q4H", "Q6H": "Q6H", "Q8H": "Q8H",
+}
+
+type fhirCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+type fhirCodeableConcept struct {
+	Coding []fhirCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+type fhirIdentifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+
+type fhirReference struct {
+	Reference  string          `json:"reference,omitempty"`
+	Identifier *fhirIdentifier `json:"identifier,omitempty"`
+	Display    string          `json:"display,omitempty"`
+}
+
+type fhirQuantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+	System string  `json:"system,omitempty"`
+	Code   string  `json:"code,omitempty"`
+}
+
+type fhirTimingRepeat struct {
+	Frequency  int     `json:"frequency"`
+	Period     float64 `json:"period"`
+	PeriodUnit string  `json:"periodUnit"`
+}
+
+type fhirTiming struct {
+	Repeat *fhirTimingRepeat    `json:"repeat,omitempty"`
+	Code   *fhirCodeableConcept `json:"code,omitempty"`
+}
+
+type fhirDosage struct {
+	Text   string               `json:"text,omitempty"`
+	Timing *fhirTiming          `json:"timing,omitempty"`
+	Route  *fhirCodeableConcept `json:"route,omitempty"`
+}
+
+type fhirDispenseRequest struct {
+	NumberOfRepeatsAllowed int           `json:"numberOfRepeatsAllowed,omitempty"`
+	Quantity               *fhirQuantity `json:"quantity,omitempty"`
+	ExpectedSupplyDuration *fhirQuantity `json:"expectedSupplyDuration,omitempty"`
+}
+
+// fhirMedicationRequest FHIR R4 MedicationRequest (僅含本套件可填入的欄位)
+type fhirMedicationRequest struct {
+	ResourceType              string                `json:"resourceType"`
+	ID                        string                `json:"id,omitempty"`
+	Status                    string                `json:"status"`
+	Intent                    string                `json:"intent"`
+	GroupIdentifier           *fhirIdentifier       `json:"groupIdentifier,omitempty"`
+	MedicationCodeableConcept fhirCodeableConcept   `json:"medicationCodeableConcept"`
+	Subject                   fhirReference         `json:"subject"`
+	AuthoredOn                string                `json:"authoredOn,omitempty"`
+	Requester                 *fhirReference        `json:"requester,omitempty"`
+	ReasonCode                []fhirCodeableConcept `json:"reasonCode,omitempty"`
+	DosageInstruction         []fhirDosage          `json:"dosageInstruction,omitempty"`
+	DispenseRequest           *fhirDispenseRequest  `json:"dispenseRequest,omitempty"`
+}
+
+type fhirBundleEntry struct {
+	Resource interface{} `json:"resource"`
+}
+
+type fhirBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Entry        []fhirBundleEntry `json:"entry"`
+}
+
+type fhirHumanName struct {
+	Text string `json:"text"`
+}
+
+type fhirContactPoint struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+	Use    string `json:"use,omitempty"`
+}
+
+// fhirPatient FHIR R4 Patient
+type fhirPatient struct {
+	ResourceType string             `json:"resourceType"`
+	ID           string             `json:"id"`
+	Identifier   []fhirIdentifier   `json:"identifier,omitempty"`
+	Name         []fhirHumanName    `json:"name,omitempty"`
+	Telecom      []fhirContactPoint `json:"telecom,omitempty"`
+	Gender       string             `json:"gender,omitempty"`
+	BirthDate    string             `json:"birthDate,omitempty"`
+}
+
+// FHIRPatientID 病患的 FHIR 資源 id (身分證號 SHA-256 前 16 碼，避免個資出現在 URL 中)
+func FHIRPatientID(nationalID string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(nationalID))))
+	return "pt-" + hex.EncodeToString(sum[:])[:16]
+}
+
+// ToFHIRPatient 輸出 FHIR R4 Patient 資源 JSON
+// 資源 id 為身分證號雜湊 (見 FHIRPatientID)，身分證號放在 identifier
+func (p *HISPatient) ToFHIRPatient() ([]byte, error) {
+	if p == nil || p.NationalID == "" {
+		return nil, fmt.Errorf("病患缺少身分證號")
+	}
+
+	res := fhirPatient{
+		ResourceType: "Patient",
+		ID:           FHIRPatientID(p.NationalID),
+		Identifier:   []fhirIdentifier{{System: FHIRSystemNationalID, Value: p.NationalID}},
+		BirthDate:    p.Birthday,
+	}
+	if p.Name != "" {
+		res.Name = []fhirHumanName{{Text: p.Name}}
+	}
+	if p.Mobile != "" {
+		res.Telecom = append(res.Telecom, fhirContactPoint{System: "phone", Value: p.Mobile, Use: "mobile"})
+	}
+	if p.Phone != "" {
+		res.Telecom = append(res.Telecom, fhirContactPoint{System: "phone", Value: p.Phone, Use: "home"})
+	}
+	switch p.Gender {
+	case "M":
+		res.Gender = "male"
+	case "F":
+		res.Gender = "female"
+	}
+	return json.Marshal(res)
+}
+
+// ToFHIRMedicationRequest 輸出 FHIR R4 MedicationRequest JSON
+// FHIR 的 MedicationRequest 一筆只描述一個藥品，因此回傳 type 為 collection 的 Bundle，
+// 每個藥品醫令一筆資源並以 groupIdentifier (處方序號) 串連；病患以 reference 指向 Patient/<FHIRPatientID>
+func (rx *HISPrescription) ToFHIRMedicationRequest() ([]byte, error) {
+	if rx == nil {
+		return nil, fmt.Errorf("沒有處方資料: %w", ErrNoRecords)
+	}
+	if rx.PatientID == "" {
+		return nil, fmt.Errorf("處方缺少病患身分證號")
+	}
+
+	bundle := fhirBundle{ResourceType: "Bundle", Type: "collection", Entry: []fhirBundleEntry{}}
+	for i, item := range rx.Items {
+		if !isDrugItem(item) || item.DrugCode == "" {
+			continue
+		}
+		bundle.Entry = append(bundle.Entry, fhirBundleEntry{Resource: rx.fhirMedicationRequest(i, item)})
+	}
+	return json.Marshal(bundle)
+}
+
+// fhirMedicationRequest 將單一藥品醫令轉為 MedicationRequest
+func (rx *HISPrescription) fhirMedicationRequest(index int, item HISPrescriptionItem) fhirMedicationRequest {
+	req := fhirMedicationRequest{
+		ResourceType: "MedicationRequest",
+		Status:       "completed",
+		Intent:       "order",
+		MedicationCodeableConcept: fhirCodeableConcept{
+			Coding: []fhirCoding{{System: FHIRSystemNHIDrug, Code: item.DrugCode, Display: item.DrugName}},
+			Text:   item.DrugName,
+		},
+		Subject: fhirReference{Reference: "Patient/" + FHIRPatientID(rx.PatientID)},
+	}
+	if rx.PrescriptionNo != "" {
+		req.ID = fmt.Sprintf("%s-%d", fhirSafeID(rx.PrescriptionNo), index+1)
+		req.GroupIdentifier = &fhirIdentifier{Value: rx.PrescriptionNo}
+	}
+	if rx.DispenseDate != "" {
+		req.AuthoredOn = rx.DispenseDate
+		if rx.DispenseTime != "" {
+			req.AuthoredOn += "T" + rx.DispenseTime + "+08:00"
+		}
+	}
+	if rx.ProviderCode != "" {
+		req.Requester = &fhirReference{Identifier: &fhirIdentifier{Value: rx.ProviderCode}, Display: rx.ProviderName}
+	}
+	for _, code := range rx.DiagnosisCodes {
+		req.ReasonCode = append(req.ReasonCode, fhirCodeableConcept{
+			Coding: []fhirCoding{{System: "http://hl7.org/fhir/sid/icd-10", Code: code}},
+		})
+	}
+
+	dosage := fhirDosage{Text: item.Frequency, Timing: fhirTimingOf(item.Frequency)}
+	if item.Route != "" {
+		code, name := NormalizeRoute(item.Route)
+		dosage.Route = &fhirCodeableConcept{Coding: []fhirCoding{{Code: code, Display: name}}, Text: firstNonEmpty(name, item.Route)}
+	}
+	if dosage.Text != "" || dosage.Timing != nil || dosage.Route != nil {
+		req.DosageInstruction = []fhirDosage{dosage}
+	}
+
+	dispense := &fhirDispenseRequest{}
+	if item.Quantity > 0 {
+		dispense.Quantity = &fhirQuantity{Value: item.Quantity}
+	}
+	if item.DaysSupply > 0 {
+		dispense.ExpectedSupplyDuration = &fhirQuantity{Value: float64(item.DaysSupply), Unit: "days", System: "http://unitsofmeasure.org", Code: "d"}
+	}
+	// 總次數僅取自來源資料 (未提供時為 0，不推估)
+	if rx.TotalRefills > 1 {
+		dispense.NumberOfRepeatsAllowed = rx.TotalRefills - 1
+	}
+	if dispense.Quantity != nil || dispense.ExpectedSupplyDuration != nil || dispense.NumberOfRepeatsAllowed > 0 {
+		req.DispenseRequest = dispense
+	}
+	return req
+}
+
+// fhirTimingOf 將頻率轉為 FHIR Timing (每日 n 次、每 n 日一次或每週 n 次)，無法辨識時僅保留文字
+func fhirTimingOf(frequency string) *fhirTiming {
+	if strings.TrimSpace(frequency) == "" {
+		return nil
+	}
+	times, code := ParseFrequency(frequency)
+	timing := &fhirTiming{Code: &fhirCodeableConcept{Text: code}}
+	if gts, ok := fhirGTSCodes[code]; ok {
+		timing.Code.Coding = []fhirCoding{{System: fhirSystemGTSAbbreviation, Code: gts}}
+	}
+
+	isWhole := func(f float64) bool { return f > 0 && math.Abs(f-math.Round(f)) < 1e-6 }
+	switch {
+	case times <= 0:
+	case isWhole(times):
+		timing.Repeat = &fhirTimingRepeat{Frequency: int(math.Round(times)), Period: 1, PeriodUnit: "d"}
+	case isWhole(times * 7):
+		timing.Repeat = &fhirTimingRepeat{Frequency: int(math.Round(times * 7)), Period: 1, PeriodUnit: "wk"}
+	case isWhole(1 / times):
+		timing.Repeat = &fhirTimingRepeat{Frequency: 1, Period: math.Round(1 / times), PeriodUnit: "d"}
+	}
+	return timing
+}
+
+// fhirSafeID 將字串轉為 FHIR id 允許的字元 (英數、- 與 .，最長 64 字元)
+func fhirSafeID(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('-')
+		}
+	}
+	id := sb.String()
+	if len(id) > 60 {
+		id = id[:60]
+	}
+	return id
+}
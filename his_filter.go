@@ -0,0 +1,95 @@
+// Package parser 處方過濾
+// 依調劑日期等條件篩選處方，並同步調整病患列表與統計
+package parser
+
+import (
+	"time"
+)
+
+// FilterByDateRange 回傳僅含調劑日期落在 [start, end] (含首尾，以日為單位) 的處方的新結果
+// start 或 end 為零值時表示該端不設限；includeUndated 控制調劑日期為空 (或無法解析) 的處方是否納入
+// 不再被任何處方參照的病患會一併移除，處方數、點數與藥品統計皆依過濾後的處方重新計算；原結果不會被修改
+func (r *HISImportResult) FilterByDateRange(start, end time.Time, includeUndated bool) *HISImportResult {
+	if r == nil {
+		return nil
+	}
+
+	from, to := truncateDay(start), truncateDay(end)
+	filtered := &HISImportResult{
+		Success:      r.Success,
+		SourceType:   r.SourceType,
+		SourceVendor: r.SourceVendor,
+		Failed:       r.Failed,
+		Errors:       append([]string(nil), r.Errors...),
+		Warnings:     append([]string(nil), r.Warnings...),
+		Claim:        r.Claim,
+	}
+	filtered.DetailedErrors = append([]ParseError(nil), r.DetailedErrors...)
+
+	referenced := make(map[string]bool)
+	for _, rx := range r.Prescriptions {
+		day, ok := parseDispenseDay(rx.DispenseDate)
+		switch {
+		case !ok:
+			if !includeUndated {
+				continue
+			}
+		case !from.IsZero() && day.Before(from), !to.IsZero() && day.After(to):
+			continue
+		}
+		filtered.Prescriptions = append(filtered.Prescriptions, rx)
+		referenced[rx.PatientID] = true
+	}
+
+	for _, p := range r.Patients {
+		if referenced[p.NationalID] {
+			filtered.Patients = append(filtered.Patients, p)
+		}
+	}
+
+	usedCodes := make(map[string]bool)
+	for _, rx := range filtered.Prescriptions {
+		for _, item := range rx.Items {
+			usedCodes[item.DrugCode] = true
+		}
+	}
+	for _, code := range r.UnknownDrugCodes {
+		if usedCodes[code] {
+			filtered.UnknownDrugCodes = append(filtered.UnknownDrugCodes, code)
+		}
+	}
+
+	filtered.Total = len(filtered.Prescriptions)
+	filtered.Imported = len(filtered.Prescriptions)
+	filtered.Skipped = len(r.Prescriptions) - len(filtered.Prescriptions)
+	filtered.SelfPayTotal = calcSelfPayTotal(filtered.Prescriptions)
+	fillTotals(filtered)
+	filtered.DrugUsages, filtered.ServiceFees = summarizeUsages(filtered.Prescriptions)
+	return filtered
+}
+
+// parseDispenseDay 解析調劑日期 (YYYY-MM-DD，亦接受 YYYY/MM/DD 與民國年)
+func parseDispenseDay(date string) (time.Time, bool) {
+	if date == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{"2006-01-02", "2006/01/02"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t, true
+		}
+	}
+	if converted := convertROCDate(date); converted != "" {
+		if t, err := time.Parse("2006-01-02", converted); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// truncateDay 取日期部分 (忽略時區與時間)，零值維持零值
+func truncateDay(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
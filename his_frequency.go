@@ -0,0 +1,196 @@
+// Package parser 藥品使用頻率標準化
+// 各廠商頻率寫法不一 (BID、Bid、2#、一日兩次)，統一轉換為標準代碼與每日次數
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// frequencyTable 標準頻率代碼與每日次數
+var frequencyTable = map[string]float64{
+	"QD":      1,
+	"BID":     2,
+	"TID":     3,
+	"QID":     4,
+	"HS":      1,
+	"QN":      1,
+	"QAM":     1,
+	"QPM":     1,
+	"QOD":     0.5,
+	"QW":      1.0 / 7,
+	"BIW":     2.0 / 7,
+	"TIW":     3.0 / 7,
+	"STAT":    1,
+	"ASORDER": 0,
+	"PRN":     0,
+}
+
+// frequencyAliases 常見別名 (含中文寫法) 對應標準代碼
+var frequencyAliases = map[string]string{
+	"QDAY":      "QD",
+	"DAILY":     "QD",
+	"ONCE":      "QD",
+	"1X1":       "QD",
+	"ST":        "STAT",
+	"QHS":       "HS",
+	"BEDTIME":   "HS",
+	"ASNEEDED":  "PRN",
+	"AS":        "ASORDER",
+	"ASORDERED": "ASORDER",
+	"QOW":       "QW",
+	"QWK":       "QW",
+	"WEEKLY":    "QW",
+	"一日一次":      "QD",
+	"每日一次":      "QD",
+	"每天一次":      "QD",
+	"一天一次":      "QD",
+	"一日兩次":      "BID",
+	"一日二次":      "BID",
+	"每日兩次":      "BID",
+	"每日二次":      "BID",
+	"每天兩次":      "BID",
+	"一天兩次":      "BID",
+	"一日三次":      "TID",
+	"每日三次":      "TID",
+	"每天三次":      "TID",
+	"一天三次":      "TID",
+	"一日四次":      "QID",
+	"每日四次":      "QID",
+	"每天四次":      "QID",
+	"一天四次":      "QID",
+	"睡前":        "HS",
+	"睡前一次":      "HS",
+	"早上":        "QAM",
+	"晚上":        "QPM",
+	"隔日":        "QOD",
+	"隔天":        "QOD",
+	"每兩天":       "QOD",
+	"每週一次":      "QW",
+	"每周一次":      "QW",
+	"需要時":       "PRN",
+	"必要時":       "PRN",
+	"需要時使用":     "PRN",
+	"立即":        "STAT",
+	"依指示":       "ASORDER",
+	"遵醫囑":       "ASORDER",
+}
+
+// timesToFrequency 每日次數對應標準代碼
+var timesToFrequency = map[int]string{1: "QD", 2: "BID", 3: "TID", 4: "QID"}
+
+// ParseFrequency 解析藥品使用頻率，回傳每日次數與標準代碼
+// 支援標準代碼 (QD/BID/TID/QID/QnH/HS/PRN...)、飯前飯後後綴 (TIDAC、BID PC)、
+// 加睡前 (TID+HS)、數字寫法 (2#、3X/D、3次/日) 與中文寫法 (一日兩次、睡前、需要時)
+// 無法辨識時 timesPerDay 為 0 並原樣回傳輸入字串；PRN 等不定時頻率 timesPerDay 亦為 0
+func ParseFrequency(raw string) (timesPerDay float64, canonical string) {
+	s := normalizeFrequencyText(raw)
+	if s == "" {
+		return 0, raw
+	}
+
+	if times, code, ok := lookupFrequency(s); ok {
+		return times, code
+	}
+
+	// 加睡前: TID+HS、TIDHS、TID&HS
+	for _, sep := range []string{"+HS", "&HS", "HS"} {
+		if base := strings.TrimSuffix(s, sep); base != s && base != "" {
+			if times, code, ok := lookupFrequency(base); ok && times > 0 {
+				return times + 1, code + "+HS"
+			}
+		}
+	}
+
+	return 0, raw
+}
+
+// lookupFrequency 查詢標準代碼、別名、QnH 與數字寫法 (會去除 AC/PC 飯前飯後後綴)
+func lookupFrequency(s string) (float64, string, bool) {
+	for _, candidate := range []string{s, strings.TrimSuffix(strings.TrimSuffix(s, "AC"), "PC")} {
+		if candidate == "" {
+			continue
+		}
+		if alias, ok := frequencyAliases[candidate]; ok {
+			candidate = alias
+		}
+		if times, ok := frequencyTable[candidate]; ok {
+			return times, candidate, true
+		}
+
+		// 每 n 小時: Q6H、Q8H、每6小時
+		if strings.HasPrefix(candidate, "Q") && strings.HasSuffix(candidate, "H") {
+			if hours, err := strconv.Atoi(candidate[1 : len(candidate)-1]); err == nil && hours > 0 && hours <= 72 {
+				return 24 / float64(hours), fmt.Sprintf("Q%dH", hours), true
+			}
+		}
+		if strings.HasPrefix(candidate, "每") && strings.HasSuffix(candidate, "小時") {
+			if hours, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(candidate, "每"), "小時")); err == nil && hours > 0 && hours <= 72 {
+				return 24 / float64(hours), fmt.Sprintf("Q%dH", hours), true
+			}
+		}
+
+		// 數字寫法: 2#、3X/D、3/D、3次/日、3TIMES/DAY
+		if n, ok := parseTimesPerDayNumber(candidate); ok {
+			if code, ok := timesToFrequency[n]; ok {
+				return float64(n), code, true
+			}
+			return float64(n), fmt.Sprintf("%dX/D", n), true
+		}
+	}
+	return 0, "", false
+}
+
+// parseTimesPerDayNumber 解析數字型頻率寫法
+func parseTimesPerDayNumber(s string) (int, bool) {
+	for _, suffix := range []string{"#", "X/D", "X/DAY", "/D", "/DAY", "次/日", "次/天", "TIMES/DAY", "TIMES/D", "X"} {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err == nil && n > 0 && n <= 24 {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeFrequencyText 全形轉半形、轉大寫並去除空白與標點
+func normalizeFrequencyText(raw string) string {
+	var sb strings.Builder
+	for _, r := range strings.TrimSpace(raw) {
+		if r >= '！' && r <= '～' {
+			r -= 0xFEE0
+		}
+		switch {
+		case r == ' ' || r == '　' || r == '.' || r == '-' || r == '_' || r == '\t':
+			continue
+		case r >= 'a' && r <= 'z':
+			sb.WriteRune(r - 'a' + 'A')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+
+	s := sb.String()
+	// 中文數字轉阿拉伯數字 (每6小時、每八小時)
+	if strings.HasPrefix(s, "每") {
+		s = strings.NewReplacer("一", "1", "二", "2", "兩", "2", "三", "3", "四", "4", "六", "6", "八", "8", "十二", "12").Replace(s)
+		// 已列於別名表的寫法 (每日一次、每兩天) 保留原字串
+		if _, ok := frequencyAliases[sb.String()]; ok {
+			return sb.String()
+		}
+	}
+	return s
+}
+
+// tagTimesPerDay 依頻率填入每日次數
+func tagTimesPerDay(result *HISImportResult) {
+	for i := range result.Prescriptions {
+		items := result.Prescriptions[i].Items
+		for j := range items {
+			items[j].TimesPerDay, _ = ParseFrequency(items[j].Frequency)
+		}
+	}
+}
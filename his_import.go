@@ -4,14 +4,24 @@ package parser
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/transform"
 )
 
@@ -21,52 +31,56 @@ import (
 
 // NHIUploadXML 健保每日上傳 XML 根元素
 type NHIUploadXML struct {
-	XMLName xml.Name     `xml:"RECS"`
-	Records []NHIRecord  `xml:"REC"`
+	XMLName xml.Name    `xml:"RECS"`
+	Records []NHIRecord `xml:"REC"`
 }
 
 // NHIRecord 單筆就醫/調劑紀錄
 type NHIRecord struct {
-	MSH  NHIMSH   `xml:"MSH"`  // 訊息表頭
-	MB1  NHIMB1   `xml:"MB1"`  // 就醫基本資料
-	MB2s []NHIMB2 `xml:"MB2"`  // 醫令明細 (多筆)
+	MSH  NHIMSH   `xml:"MSH"` // 訊息表頭
+	MB1  NHIMB1   `xml:"MB1"` // 就醫基本資料
+	MB2s []NHIMB2 `xml:"MB2"` // 醫令明細 (多筆)
 }
 
 // NHIMSH 訊息表頭區段
 type NHIMSH struct {
-	H1  string `xml:"h1"`  // 醫事機構代號
-	H2  string `xml:"h2"`  // 費用年月 (民國 YYYMM)
-	H3  string `xml:"h3"`  // 申報類別
+	H1 string `xml:"h1"` // 醫事機構代號
+	H2 string `xml:"h2"` // 費用年月 (民國 YYYMM)
+	H3 string `xml:"h3"` // 申報類別
 }
 
 // NHIMB1 就醫基本資料區段
 type NHIMB1 struct {
-	A01 string `xml:"A01"` // 資料格式: 1=正常, 2=異常, 3=補正正常, 4=補正異常
-	A11 string `xml:"A11"` // 卡片號碼
-	A12 string `xml:"A12"` // 身分證號 (病患主鍵)
-	A13 string `xml:"A13"` // 出生日期 (民國 YYYMMDD)
-	A14 string `xml:"A14"` // 原處方醫療機構代碼
-	A17 string `xml:"A17"` // 就診日期時間 (民國 YYYMMDDHHMMSS)
-	A18 string `xml:"A18"` // 就醫序號 (IC02=慢箋第2次, IC03=第3次...)
-	A23 string `xml:"A23"` // 就醫類別 (08=慢箋, AF=釋出處方)
-	D19 string `xml:"d19"` // 主診斷代碼 (ICD-10)
-	D20 string `xml:"d20"` // 病患姓名
-	D21 string `xml:"d21"` // 病患電話
-	D31 string `xml:"d31"` // 調劑藥師身分證
-	D32 string `xml:"d32"` // 藥師姓名
+	A01 string `xml:"A01"`           // 資料格式: 1=正常, 2=異常, 3=補正正常, 4=補正異常
+	A11 string `xml:"A11"`           // 卡片號碼
+	A12 string `xml:"A12"`           // 身分證號 (病患主鍵)
+	A13 string `xml:"A13"`           // 出生日期 (民國 YYYMMDD)
+	A14 string `xml:"A14"`           // 原處方醫療機構代碼
+	A17 string `xml:"A17"`           // 就診日期時間 (民國 YYYMMDDHHMMSS)
+	A18 string `xml:"A18"`           // 就醫序號 (IC02=慢箋第2次, IC03=第3次...)
+	A54 string `xml:"A54,omitempty"` // 就醫識別碼 (新制，逐步取代就醫序號)
+	A23 string `xml:"A23"`           // 就醫類別 (08=慢箋, AF=釋出處方)
+	D10 string `xml:"d10,omitempty"` // 給付類別 (補充欄位，缺欄位時為空)
+	D19 string `xml:"d19"`           // 主診斷代碼 (ICD-10)
+	D20 string `xml:"d20"`           // 病患姓名
+	D21 string `xml:"d21"`           // 病患電話
+	D31 string `xml:"d31"`           // 調劑藥師身分證
+	D32 string `xml:"d32"`           // 藥師姓名
+	D35 string `xml:"d35,omitempty"` // 醫療費用點數 (補充欄位，對應 HISPrescription.TotalPoints)
 }
 
 // NHIMB2 醫令明細區段
 type NHIMB2 struct {
-	P1  string `xml:"p1"`  // 醫令類別: 1=藥品, 2=診療, 9=藥事服務費
-	P2  string `xml:"p2"`  // 醫令代碼 (健保碼)
-	P3  string `xml:"p3"`  // 藥品名稱
-	P5  string `xml:"p5"`  // 使用頻率 (BID, TID, QID...)
-	P6  string `xml:"p6"`  // 給藥途徑 (PO, EXT...)
-	P7  string `xml:"p7"`  // 總量
-	P8  string `xml:"p8"`  // 單價
-	D27 string `xml:"d27"` // 給藥日份
-	D36 string `xml:"d36"` // 連處次數 (慢箋第幾次)
+	P1  string `xml:"p1"`            // 醫令類別: 1=藥品, 2=診療, 9=藥事服務費
+	P2  string `xml:"p2"`            // 醫令代碼 (健保碼)
+	P3  string `xml:"p3"`            // 藥品名稱
+	P5  string `xml:"p5"`            // 使用頻率 (BID, TID, QID...)
+	P6  string `xml:"p6"`            // 給藥途徑 (PO, EXT...)
+	P7  string `xml:"p7"`            // 總量
+	P8  string `xml:"p8"`            // 單價
+	D27 string `xml:"d27"`           // 給藥日份
+	D36 string `xml:"d36"`           // 連處次數 (慢箋第幾次)
+	P10 string `xml:"p10,omitempty"` // 自費註記 (Y=自費不申報, 空白=健保申報)
 }
 
 // ============================================================================
@@ -75,28 +89,35 @@ type NHIMB2 struct {
 
 // NHIClaimCSV 費用申報 CSV 解析結果
 type NHIClaimCSV struct {
-	Header    NHIClaimHeader
-	Claims    []NHIClaimDetail
-	Items     []NHIClaimItem
+	Header      NHIClaimHeader
+	Claims      []NHIClaimDetail
+	Items       []NHIClaimItem
+	Subtotals   []NHIClaimSubtotal
+	Adjustments []NHIClaimAdjustment
 }
 
 // NHIClaimHeader 申報表頭
 type NHIClaimHeader struct {
-	T1  string // 資料格式 (30=藥局)
-	T2  string // 服務機構代號
-	T3  string // 費用年月
-	T4  string // 申報類別
+	T1 string // 資料格式 (30=藥局)
+	T2 string // 服務機構代號
+	T3 string // 費用年月
+	T4 string // 申報類別
 }
 
 // NHIClaimDetail 門診費用明細
 type NHIClaimDetail struct {
-	D1  string  // 案件分類
-	D2  string  // 流水號
-	D3  string  // 就醫日期
-	D4  string  // 病患身分證
-	D5  string  // 病患姓名
-	D39 float64 // 合計點數
-	D40 float64 // 部分負擔
+	D1  string   // 案件分類
+	D2  string   // 流水號
+	D3  string   // 就醫日期
+	D4  string   // 病患身分證
+	D5  string   // 病患姓名
+	D39 float64  // 合計點數
+	D40 float64  // 部分負擔
+	D41 string   // 部分負擔代號 (格式 2.0)
+	D42 float64  // 自費金額 (格式 2.0)
+	D43 []string // 特定治療項目代號 (格式 2.0，最多四組)
+
+	Version string // 申報格式版本 (依欄位數判斷，見 claimDetailLayoutFor)
 }
 
 // NHIClaimItem 醫令項目
@@ -108,141 +129,400 @@ type NHIClaimItem struct {
 	P8 float64 // 單價
 }
 
+// NHIClaimSubtotal 申報小計 (S 段)
+type NHIClaimSubtotal struct {
+	S1 string  // 案件分類 (空白為全部案件)
+	S2 int     // 申報件數
+	S3 float64 // 申報點數
+}
+
+// NHIClaimAdjustment 退補記錄 (R 段)
+type NHIClaimAdjustment struct {
+	R1 string  // 案件分類
+	R2 string  // 原流水號
+	R3 float64 // 退補點數 (負值為退)
+}
+
 // ============================================================================
 // 轉換後的標準化資料結構
 // ============================================================================
 
 // HISImportResult HIS 匯入結果
 type HISImportResult struct {
-	Success       bool                `json:"success"`
-	SourceType    string              `json:"source_type"`    // xml, csv
-	SourceVendor  string              `json:"source_vendor"`  // nhi, yaosheng, vision, jubo
-	Total         int                 `json:"total"`
-	Imported      int                 `json:"imported"`
-	Skipped       int                 `json:"skipped"`
-	Failed        int                 `json:"failed"`
-	Errors        []string            `json:"errors,omitempty"`
-	Patients      []HISPatient        `json:"patients,omitempty"`
-	Prescriptions []HISPrescription   `json:"prescriptions,omitempty"`
-	DrugUsages    []HISDrugUsage      `json:"drug_usages,omitempty"`
+	Success          bool              `json:"success"`
+	SourceType       string            `json:"source_type"`                 // xml, csv
+	SourceVendor     string            `json:"source_vendor"`               // nhi, yaosheng, vision, jubo
+	VendorCandidates []VendorMatch     `json:"vendor_candidates,omitempty"` // 自動偵測時的候選廠商 (依信心排序)
+	Total            int               `json:"total"`
+	Imported         int               `json:"imported"`
+	Skipped          int               `json:"skipped"`
+	Failed           int               `json:"failed"`
+	Errors           []string          `json:"errors,omitempty"`
+	DetailedErrors   []ParseError      `json:"detailed_errors,omitempty"` // 逐行錯誤明細 (Errors 為對應的可讀摘要)
+	Warnings         []string          `json:"warnings,omitempty"`        // 不影響匯入的資料品質提示
+	SelfPayTotal     float64           `json:"self_pay_total,omitempty"`  // 自費項目總金額
+	GrandTotal       float64           `json:"grand_total,omitempty"`     // 所有處方總點數合計
+	Patients         []HISPatient      `json:"patients,omitempty"`
+	Prescriptions    []HISPrescription `json:"prescriptions,omitempty"`
+	DrugUsages       []HISDrugUsage    `json:"drug_usages,omitempty"`
+	UnknownDrugCodes []string          `json:"unknown_drug_codes,omitempty"` // 藥品主檔找不到的代碼 (見 EnrichWithDrugMaster)
+	ServiceFees      []HISServiceFee   `json:"service_fees,omitempty"`       // 藥事服務費統計 (與藥費分開)
+	Claim            *NHIClaimCSV      `json:"claim,omitempty"`              // 費用申報原始段別 (僅申報 CSV)
+	Files            []FileStat        `json:"files,omitempty"`              // 多檔合併時各檔案的統計 (見 ParseHISFiles)
+}
+
+// ParseError 單行解析錯誤明細 (含原始內容與推測的問題欄位，方便除錯)
+type ParseError struct {
+	LineNum int    `json:"line_num"`
+	RawLine string `json:"raw_line"`
+	Field   string `json:"field,omitempty"` // 推測的問題欄位
+	Reason  string `json:"reason"`
+}
+
+// Error 實作 error 介面
+func (e ParseError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("第 %d 行 %s: %s", e.LineNum, e.Field, e.Reason)
+	}
+	return fmt.Sprintf("第 %d 行: %s", e.LineNum, e.Reason)
+}
+
+// maxRawLineLen 錯誤明細保留的原始行長度上限 (位元組)
+const maxRawLineLen = 512
+
+// addLineError 記錄單行錯誤: summary 加入 Errors，明細加入 DetailedErrors
+func (r *HISImportResult) addLineError(summary string, lineNum int, raw, field, reason string) {
+	if len(raw) > maxRawLineLen {
+		cut := maxRawLineLen
+		for cut > 0 && !utf8.RuneStart(raw[cut]) {
+			cut--
+		}
+		raw = raw[:cut] + "..."
+	}
+	r.Errors = append(r.Errors, summary)
+	r.DetailedErrors = append(r.DetailedErrors, ParseError{
+		LineNum: lineNum,
+		RawLine: raw,
+		Field:   field,
+		Reason:  reason,
+	})
+}
+
+// missingFieldName 欄位不足時推測缺少的第一個欄位名稱 (未列出名稱時以欄序表示)
+func missingFieldName(names []string, count int) string {
+	if count >= 0 && count < len(names) && names[count] != "" {
+		return names[count]
+	}
+	return fmt.Sprintf("第 %d 欄", count+1)
 }
 
 // HISPatient 標準化病患資料
 type HISPatient struct {
-	NationalID   string  `json:"national_id"`
-	Name         string  `json:"name"`
-	Birthday     string  `json:"birthday,omitempty"`     // YYYY-MM-DD 格式
-	Phone        string  `json:"phone,omitempty"`
-	CardNumber   string  `json:"card_number,omitempty"`  // 健保卡號
+	NationalID     string `json:"national_id"`
+	Name           string `json:"name"`
+	Birthday       string `json:"birthday,omitempty"` // YYYY-MM-DD 格式
+	Phone          string `json:"phone,omitempty"`
+	Mobile         string `json:"mobile,omitempty"`           // 手機 (僅部分廠商分欄提供，見 NormalizePhone)
+	CardNumber     string `json:"card_number,omitempty"`      // 健保卡號
+	IDValid        bool   `json:"id_valid"`                   // 身分證檢核碼是否正確
+	Gender         string `json:"gender,omitempty"`           // M=男, F=女 (由身分證推導)
+	CardVisitCount int    `json:"card_visit_count,omitempty"` // IC 卡上傳檔中的就醫次數
+	AgeBand        string `json:"age_band,omitempty"`         // 去識別化後的年齡層 (見 Deidentify)
+	Key            string `json:"key,omitempty"`              // 遮蔽後查詢用的病患代號 (見 MaskAll、PatientTimeline)
+
+	rawNationalID string // 遮蔽前的身分證 (MaskAll 時保留，不輸出)
 }
 
 // HISPrescription 標準化處方資料
 type HISPrescription struct {
-	PatientID        string           `json:"patient_id"`         // 身分證
-	PrescriptionNo   string           `json:"prescription_no"`    // 處方序號
-	DispenseDate     string           `json:"dispense_date"`      // 調劑日期 YYYY-MM-DD
-	DispenseTime     string           `json:"dispense_time"`      // 調劑時間 HH:MM:SS
-	VisitType        string           `json:"visit_type"`         // 就醫類別
-	VisitSequence    string           `json:"visit_sequence"`     // 就醫序號 (IC01, IC02...)
-	ChronicRefillNo  int              `json:"chronic_refill_no"`  // 慢箋第幾次
-	ProviderCode     string           `json:"provider_code"`      // 原處方醫院代碼
-	ProviderName     string           `json:"provider_name,omitempty"`
-	DiagnosisCode    string           `json:"diagnosis_code,omitempty"` // ICD-10
-	PharmacistID     string           `json:"pharmacist_id,omitempty"`
-	PharmacistName   string           `json:"pharmacist_name,omitempty"`
-	TotalPoints      float64          `json:"total_points,omitempty"`   // 總點數
-	Copay            float64          `json:"copay,omitempty"`          // 部分負擔
-	DataFormat       string           `json:"data_format"`              // 1=正常, 3=補正
-	Items            []HISPrescriptionItem `json:"items"`
+	PatientID       string                `json:"patient_id"`                // 身分證
+	PrescriptionNo  string                `json:"prescription_no"`           // 處方序號
+	DispenseDate    string                `json:"dispense_date"`             // 調劑日期 YYYY-MM-DD
+	DispenseTime    string                `json:"dispense_time"`             // 調劑時間 HH:MM:SS
+	VisitType       string                `json:"visit_type"`                // 就醫類別
+	VisitTypeName   string                `json:"visit_type_name,omitempty"` // 就醫類別名稱 (見 GetVisitTypeName)
+	VisitSequence   string                `json:"visit_sequence"`            // 就醫序號 (IC01, IC02...)
+	VisitID         string                `json:"visit_id,omitempty"`        // 就醫識別碼 (新制)
+	ChronicRefillNo int                   `json:"chronic_refill_no"`         // 慢箋第幾次
+	TotalRefills    int                   `json:"total_refills,omitempty"`   // 慢箋可調劑總次數 (0 為資料未提供)
+	ProviderCode    string                `json:"provider_code"`             // 原處方醫院代碼
+	ProviderName    string                `json:"provider_name,omitempty"`
+	DiagnosisCode   string                `json:"diagnosis_code,omitempty"`  // ICD-10 (主診斷，即 DiagnosisCodes 第一碼)
+	DiagnosisCodes  []string              `json:"diagnosis_codes,omitempty"` // 正規化後的所有診斷碼
+	PharmacistID    string                `json:"pharmacist_id,omitempty"`
+	PharmacistName  string                `json:"pharmacist_name,omitempty"`
+	TotalPoints     float64               `json:"total_points,omitempty"`     // 總點數
+	Copay           float64               `json:"copay,omitempty"`            // 部分負擔
+	CopayCategory   string                `json:"copay_category,omitempty"`   // 部分負擔代號 (申報格式 2.0)
+	PaymentCategory string                `json:"payment_category,omitempty"` // 給付類別 (每日上傳 MB1 d10)
+	SelfPayAmount   float64               `json:"self_pay_amount,omitempty"`  // 自費金額 (申報格式 2.0)
+	DataFormat      string                `json:"data_format"`                // 1=正常, 3=補正
+	Items           []HISPrescriptionItem `json:"items"`
+	Procedures      []HISProcedureItem    `json:"procedures,omitempty"`    // 診療醫令 (醫令類別 2，不計入藥品)
+	SourceIndex     int                   `json:"source_index,omitempty"`  // 原始檔中的位置 (XML 為第幾個 REC，文字檔為行號，DBF 為第幾筆記錄)
+	SourceVendor    string                `json:"source_vendor,omitempty"` // 來源廠商 (同 HISImportResult.SourceVendor，合併多檔時用於區分)
+	PatientKey      string                `json:"patient_key,omitempty"`   // 遮蔽後查詢用的病患代號 (同 HISPatient.Key)
+
+	generatedNo  bool   // 處方序號由解析器組成 (來源檔無處方號)，可由 PrescriptionNoFormatter 重新格式化
+	noSeq        string // 組成處方序號使用的序號
+	rawPatientID string // 遮蔽前的身分證 (MaskAll 時保留，不輸出)
 }
 
 // HISPrescriptionItem 處方藥品項目
 type HISPrescriptionItem struct {
-	OrderType    string  `json:"order_type"`     // 1=藥品, 9=藥事服務費
-	DrugCode     string  `json:"drug_code"`      // 健保碼
+	OrderType    string  `json:"order_type"` // 1=藥品, 9=藥事服務費
+	DrugCode     string  `json:"drug_code"`  // 健保碼
 	DrugName     string  `json:"drug_name"`
-	Frequency    string  `json:"frequency"`      // BID, TID...
-	Route        string  `json:"route"`          // PO, EXT...
-	Quantity     float64 `json:"quantity"`       // 總量
-	DaysSupply   int     `json:"days_supply"`    // 天數
-	UnitPrice    float64 `json:"unit_price"`     // 單價
+	Frequency    string  `json:"frequency"`               // BID, TID...
+	TimesPerDay  float64 `json:"times_per_day,omitempty"` // 每日次數 (由頻率換算，無法辨識為 0)
+	Route        string  `json:"route"`                   // PO, EXT... (已標準化，無法辨識時保留原值)
+	RouteName    string  `json:"route_name,omitempty"`    // 給藥途徑中文名稱 (口服、外用...)
+	Quantity     float64 `json:"quantity"`                // 總量
+	DaysSupply   int     `json:"days_supply"`             // 天數
+	DosePerTime  float64 `json:"dose_per_time,omitempty"` // 單次劑量 (展望、看診大師 D28)
+	Unit         string  `json:"unit,omitempty"`          // 劑量單位 (看診大師 D29)
+	UnitPrice    float64 `json:"unit_price"`              // 單價
+	IsSelfPay    bool    `json:"is_self_pay,omitempty"`   // 自費 (不向健保申報)
+	ATCCode      string  `json:"atc_code,omitempty"`      // ATC 碼 (需設定對照表)
+	ATCClass     string  `json:"atc_class,omitempty"`     // ATC 第一層分類
+	CodeCategory string  `json:"code_category,omitempty"` // 代碼類別 (見 ValidateNHIDrugCode)
+}
+
+// HISProcedureItem 診療醫令 (醫令類別 2)，與藥品分開保存供稽核
+type HISProcedureItem struct {
+	Code     string  `json:"code"` // 診療項目代碼
+	Name     string  `json:"name"`
+	Quantity float64 `json:"quantity"` // 數量
+	Points   float64 `json:"points"`   // 點數 (數量 × 單價)
+}
+
+// asItem 轉回醫令項目 (匯出時與藥品醫令一併輸出)
+func (p HISProcedureItem) asItem() HISPrescriptionItem {
+	item := HISPrescriptionItem{
+		OrderType: OrderTypeTreatment,
+		DrugCode:  p.Code,
+		DrugName:  p.Name,
+		Quantity:  p.Quantity,
+		UnitPrice: p.Points,
+	}
+	if p.Quantity != 0 {
+		item.UnitPrice = p.Points / p.Quantity
+	}
+	return item
+}
+
+// allItems 回傳藥品醫令與診療醫令 (匯出用)
+func (rx *HISPrescription) allItems() []HISPrescriptionItem {
+	if len(rx.Procedures) == 0 {
+		return rx.Items
+	}
+	items := append([]HISPrescriptionItem(nil), rx.Items...)
+	for _, p := range rx.Procedures {
+		items = append(items, p.asItem())
+	}
+	return items
+}
+
+// splitProcedures 將醫令類別 2 (診療) 自 Items 移至 Procedures
+func splitProcedures(result *HISImportResult) {
+	for i := range result.Prescriptions {
+		rx := &result.Prescriptions[i]
+		items := rx.Items[:0]
+		for _, item := range rx.Items {
+			if item.OrderType != OrderTypeTreatment {
+				items = append(items, item)
+				continue
+			}
+			rx.Procedures = append(rx.Procedures, HISProcedureItem{
+				Code:     item.DrugCode,
+				Name:     item.DrugName,
+				Quantity: item.Quantity,
+				Points:   item.Quantity * item.UnitPrice,
+			})
+		}
+		rx.Items = items
+	}
 }
 
 // HISDrugUsage 藥品使用統計 (用於庫存分析)
 type HISDrugUsage struct {
-	DrugCode     string  `json:"drug_code"`
-	DrugName     string  `json:"drug_name"`
-	TotalQty     float64 `json:"total_qty"`
-	DispenseCount int    `json:"dispense_count"`
+	DrugCode      string  `json:"drug_code"`
+	DrugName      string  `json:"drug_name"`
+	TotalQty      float64 `json:"total_qty"`
+	DispenseCount int     `json:"dispense_count"`
 	AvgMonthlyQty float64 `json:"avg_monthly_qty"` // 月均消耗量
 }
 
+// HISServiceFee 藥事服務費統計 (醫令類別 9，稽核時需與藥費分開計算)
+type HISServiceFee struct {
+	Code        string  `json:"code"` // 服務費代碼 (如 05206B)
+	Name        string  `json:"name"`
+	Count       int     `json:"count"`        // 申報次數
+	TotalPoints float64 `json:"total_points"` // 總點數
+}
+
+// 醫令類別 (MB2 p1)
+const (
+	OrderTypeDrug       = "1" // 藥品
+	OrderTypeTreatment  = "2" // 診療
+	OrderTypeMaterial   = "3" // 特材
+	OrderTypeServiceFee = "9" // 藥事服務費
+)
+
+// isDrugItem 是否為藥品醫令 (未提供醫令類別的廠商格式視為藥品)
+func isDrugItem(item HISPrescriptionItem) bool {
+	return item.OrderType == OrderTypeDrug || item.OrderType == ""
+}
+
+// summarizeUsages 由處方彙總藥品使用量與藥事服務費 (依首次出現順序)
+// 僅藥品醫令計入 DrugUsages；診療、特材等其他類別兩者皆不計入
+func summarizeUsages(rxs []HISPrescription) ([]HISDrugUsage, []HISServiceFee) {
+	feeMap := make(map[string]int)
+	var fees []HISServiceFee
+
+	for _, rx := range rxs {
+		for _, item := range rx.Items {
+			if item.OrderType != OrderTypeServiceFee {
+				continue
+			}
+			idx, ok := feeMap[item.DrugCode]
+			if !ok {
+				idx = len(fees)
+				feeMap[item.DrugCode] = idx
+				fees = append(fees, HISServiceFee{Code: item.DrugCode, Name: item.DrugName})
+			}
+			fees[idx].Count++
+			fees[idx].TotalPoints += item.Quantity * item.UnitPrice
+		}
+	}
+	return ComputeDrugUsageStats(rxs), fees
+}
+
+// ComputeDrugUsageStats 計算各藥品的總量、調劑次數與月均消耗量 (依首次出現順序)
+// 月份數為所有處方調劑日期涵蓋的月份 (最早至最晚，含首尾)，資料不足一個月或無日期時以 1 個月計
+func ComputeDrugUsageStats(rxs []HISPrescription) []HISDrugUsage {
+	usageMap := make(map[string]int)
+	var usages []HISDrugUsage
+
+	for _, rx := range rxs {
+		for _, item := range rx.Items {
+			if !isDrugItem(item) || item.DrugCode == "" {
+				continue
+			}
+			idx, ok := usageMap[item.DrugCode]
+			if !ok {
+				idx = len(usages)
+				usageMap[item.DrugCode] = idx
+				usages = append(usages, HISDrugUsage{DrugCode: item.DrugCode, DrugName: item.DrugName})
+			}
+			usages[idx].TotalQty += item.Quantity
+			usages[idx].DispenseCount++
+		}
+	}
+
+	months := float64(coveredMonths(rxs))
+	for i := range usages {
+		usages[i].AvgMonthlyQty = usages[i].TotalQty / months
+	}
+	return usages
+}
+
+// coveredMonths 處方調劑日期涵蓋的月份數 (最早月至最晚月，含首尾)，至少為 1
+func coveredMonths(rxs []HISPrescription) int {
+	var first, last time.Time
+	for _, rx := range rxs {
+		day, ok := parseDispenseDay(rx.DispenseDate)
+		if !ok {
+			continue
+		}
+		if first.IsZero() || day.Before(first) {
+			first = day
+		}
+		if day.After(last) {
+			last = day
+		}
+	}
+	if first.IsZero() {
+		return 1
+	}
+	months := (last.Year()-first.Year())*12 + int(last.Month()-first.Month()) + 1
+	if months < 1 {
+		months = 1
+	}
+	return months
+}
+
 // ============================================================================
 // XML 解析函數
 // ============================================================================
 
 // ParseNHIUploadXML 解析健保每日上傳 XML (Big5 編碼)
 func ParseNHIUploadXML(r io.Reader, isBig5 bool) (*HISImportResult, error) {
+	return parseNHIUploadXML(context.Background(), r, isBig5, nil)
+}
+
+// parseNHIUploadXML 解析健保每日上傳 XML，每筆 REC 前檢查 ctx 是否已取消
+func parseNHIUploadXML(ctx context.Context, r io.Reader, isBig5 bool, progress *progressReporter) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "xml",
 		SourceVendor: "nhi",
 	}
 
 	// Big5 轉 UTF-8
-	var reader io.Reader = r
+	blank := &blankReader{r: r}
+	var reader io.Reader = blank
 	if isBig5 {
-		reader = transform.NewReader(r, traditionalchinese.Big5.NewDecoder())
+		reader = transform.NewReader(blank, traditionalchinese.Big5.NewDecoder())
 	}
 
-	// 解析 XML
-	var xmlData NHIUploadXML
-	decoder := xml.NewDecoder(reader)
-	if err := decoder.Decode(&xmlData); err != nil {
-		result.Errors = append(result.Errors, "XML 解析失敗: "+err.Error())
-		return result, err
-	}
-
-	result.Total = len(xmlData.Records)
 	patientMap := make(map[string]*HISPatient)
-	drugUsageMap := make(map[string]*HISDrugUsage)
 
-	for i, rec := range xmlData.Records {
+	// 逐筆串流解析 REC (SOAP/CDATA/HTML 跳脫包裝的內容遞迴解析)，單筆損壞時略過並繼續
+	err := streamXMLRecords(reader, true, func(i int, chunk xmlRecordChunk, recErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.report(result.Total, 0)
+		result.Total++
+		var rec NHIRecord
+		if recErr == nil {
+			recErr = decodeXMLRecord(chunk, &rec)
+		}
+		if recErr != nil {
+			addXMLRecordError(result, i, chunk, recErr)
+			return nil
+		}
+		addXMLRecordWarning(result, i, chunk)
+		checkMSHProviderCode(result, i, rec.MSH.H1)
+
 		// 解析病患
 		if rec.MB1.A12 != "" {
 			patient := extractPatientFromMB1(&rec.MB1)
-			if _, exists := patientMap[patient.NationalID]; !exists {
-				patientMap[patient.NationalID] = patient
-			}
+			upsertPatient(patientMap, patient)
 		}
 
 		// 解析處方
 		prescription, err := extractPrescriptionFromRecord(&rec)
 		if err != nil {
-			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 筆處方解析失敗: %s", i+1, err.Error()))
+			result.addLineError(fmt.Sprintf("第 %d 筆處方解析失敗: %s", i, err.Error()), i, chunk.Data, "", err.Error())
 			result.Failed++
-			continue
-		}
-
-		// 統計藥品使用量
-		for _, item := range prescription.Items {
-			if item.OrderType == "1" { // 僅統計藥品
-				key := item.DrugCode
-				if usage, exists := drugUsageMap[key]; exists {
-					usage.TotalQty += item.Quantity
-					usage.DispenseCount++
-				} else {
-					drugUsageMap[key] = &HISDrugUsage{
-						DrugCode:      item.DrugCode,
-						DrugName:      item.DrugName,
-						TotalQty:      item.Quantity,
-						DispenseCount: 1,
-					}
-				}
-			}
+			return nil
 		}
 
+		prescription.SourceIndex = i
 		result.Prescriptions = append(result.Prescriptions, *prescription)
 		result.Imported++
+		return nil
+	})
+	if result.Total == 0 && !blank.seen && err == nil {
+		return emptyFileResult(result)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		result.Errors = append(result.Errors, err.Error())
+		return result, err
 	}
 
 	// 輸出病患列表
@@ -250,28 +530,365 @@ func ParseNHIUploadXML(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 		result.Patients = append(result.Patients, *p)
 	}
 
-	// 輸出藥品使用統計
-	for _, u := range drugUsageMap {
-		result.DrugUsages = append(result.DrugUsages, *u)
-	}
+	// 同一處方被拆成多筆 REC 時合併
+	mergeSplitPrescriptions(result)
 
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
 
+// ParseNHIUploadXMLStream 串流解析健保每日上傳 XML
+// 每讀完一筆 <REC> 即轉換為處方交給 fn，不會一次載入整份檔案；fn 回傳錯誤時停止解析
+// 串流無法跳過損壞的單筆，XML 語法錯誤時即停止 (需容錯時改用 ParseNHIUploadXML)
+func ParseNHIUploadXMLStream(r io.Reader, isBig5 bool, fn func(*HISPrescription) error) error {
+	return ParseNHIUploadXMLStreamContext(context.Background(), r, isBig5, fn)
+}
+
+// ParseNHIUploadXMLStreamContext 同 ParseNHIUploadXMLStream，ctx 取消或逾時時停止讀取並回傳 ctx.Err()
+// 已交給 fn 的處方不會收回，呼叫端應依回傳的錯誤決定是否捨棄
+func ParseNHIUploadXMLStreamContext(ctx context.Context, r io.Reader, isBig5 bool, fn func(*HISPrescription) error) error {
+	blank := &blankReader{r: r}
+	var reader io.Reader = blank
+	if isBig5 {
+		reader = transform.NewReader(blank, traditionalchinese.Big5.NewDecoder())
+	}
+
+	recNo := 0
+	err := streamXMLRecords(reader, isBig5, func(i int, chunk xmlRecordChunk, recErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		recNo = i
+		var rec NHIRecord
+		if recErr == nil {
+			recErr = decodeXMLRecord(chunk, &rec)
+		}
+		if recErr != nil {
+			return fmt.Errorf("第 %d 筆 REC XML 解析失敗: %w", i, recErr)
+		}
+		rx, err := extractPrescriptionFromRecord(&rec)
+		if err != nil {
+			return fmt.Errorf("第 %d 筆處方解析失敗: %w", i, err)
+		}
+		rx.SourceIndex = i
+		rx.SourceVendor = "nhi"
+		return fn(rx)
+	})
+	if recNo == 0 && !blank.seen && err == nil {
+		return ErrEmptyFile
+	}
+	return err
+}
+
+// blankReader 記錄讀取的內容是否含空白 (ASCII 空白與 UTF-8 BOM) 以外的位元組，供串流解析判斷空檔
+type blankReader struct {
+	r    io.Reader
+	seen bool
+}
+
+func (b *blankReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	for _, c := range p[:n] {
+		if b.seen {
+			break
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n', 0xEF, 0xBB, 0xBF:
+		default:
+			b.seen = true
+		}
+	}
+	return n, err
+}
+
+// maxXMLUnwrapDepth SOAP/CDATA/HTML 跳脫包裝最多解開的層數
+const maxXMLUnwrapDepth = 3
+
+// streamXMLRecords 以 RawToken 逐筆讀取 <REC> 元素，重組為單筆區段後交給 fn (recNo 從 1 起算)
+// 每次只保留目前這一筆，不會一次載入整份檔案；decoded 為 true 表示內容已轉為 UTF-8，忽略 XML 宣告的編碼
+// 缺少 </REC> 時以下一個 <REC> 或 </RECS> 為界並標記 Repaired；
+// REC 內的 XML 語法錯誤以 err 交給 fn (chunk 為損壞前已讀取的內容)，並略過至下一個 <REC> 繼續讀取；
+// 找不到任何 <REC> 且 XML 損壞時回傳 ErrUnknownFormat
+func streamXMLRecords(r io.Reader, decoded bool, fn func(recNo int, chunk xmlRecordChunk, err error) error) error {
+	br := bufio.NewReader(r)
+	if !decoded && isBig5Label(xmlDeclaredEncoding(br)) {
+		br = bufio.NewReader(transform.NewReader(br, traditionalchinese.Big5.NewDecoder()))
+	}
+	recNo := 0
+	return readXMLRecords(&recordByteReader{Reader: br}, 0, &recNo, fn)
+}
+
+// readXMLRecords streamXMLRecords 的遞迴實作，depth 為已解開的包裝層數
+func readXMLRecords(br *recordByteReader, depth int, recNo *int, fn func(int, xmlRecordChunk, error) error) error {
+	var buf bytes.Buffer
+	inRec := false
+	found := *recNo > 0
+
+	// finish 結束目前這一筆 (recErr 不為 nil 表示已損壞)
+	finish := func(repaired bool, recErr error) error {
+		inRec = false
+		*recNo++
+		if recErr != nil {
+			return fn(*recNo, xmlRecordChunk{Data: buf.String()}, recErr)
+		}
+		if repaired {
+			buf.WriteString("</REC>")
+		}
+		return fn(*recNo, xmlRecordChunk{Data: buf.String(), Repaired: repaired}, nil)
+	}
+
+	decoder := newRecordDecoder(br)
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			if inRec {
+				return finish(true, nil)
+			}
+			return nil
+		}
+		var syntaxErr *xml.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			if inRec {
+				if err := finish(false, err); err != nil {
+					return err
+				}
+			}
+			// 略過損壞的內容，從下一個 <REC> 以新的 decoder 繼續 (decoder 的錯誤不會重設)
+			if !skipToXMLRec(br) {
+				if !found {
+					return fmt.Errorf("%w: XML 解析失敗: %w", ErrUnknownFormat, err)
+				}
+				return nil
+			}
+			decoder = newRecordDecoder(br)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrReadFailed, err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "REC" {
+				if inRec {
+					if err := finish(true, nil); err != nil {
+						return err
+					}
+				}
+				inRec, found = true, true
+				buf.Reset()
+			}
+		case xml.EndElement:
+			if inRec && t.Name.Local == "RECS" {
+				if err := finish(true, nil); err != nil {
+					return err
+				}
+				continue
+			}
+		case xml.CharData:
+			// 包在 CDATA 或 HTML 跳脫文字中的 RECS 遞迴解析
+			if !inRec && depth < maxXMLUnwrapDepth &&
+				(bytes.Contains(t, []byte("<REC")) || bytes.Contains(t, []byte("&lt;REC"))) {
+				inner := &recordByteReader{Reader: bufio.NewReader(bytes.NewReader(t.Copy()))}
+				if err := readXMLRecords(inner, depth+1, recNo, fn); err != nil {
+					return err
+				}
+				found = found || *recNo > 0
+				continue
+			}
+		}
+		if !inRec {
+			continue
+		}
+		writeXMLToken(&buf, tok)
+		if end, ok := tok.(xml.EndElement); ok && end.Name.Local == "REC" {
+			if err := finish(false, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// recordByteReader 供 decoder 逐位元組讀取的 reader，記錄最後讀取的位元組
+// decoder 直接由此讀取 (實作 io.ByteReader)，發生錯誤時讀取位置即為錯誤發生處
+type recordByteReader struct {
+	*bufio.Reader
+	last    byte
+	pending bool // 重新同步時補回已被讀取的 '<'
+}
+
+func (r *recordByteReader) ReadByte() (byte, error) {
+	if r.pending {
+		r.pending = false
+		r.last = '<'
+		return '<', nil
+	}
+	c, err := r.Reader.ReadByte()
+	if err == nil {
+		r.last = c
+	}
+	return c, err
+}
+
+// newRecordDecoder 建立逐筆讀取 REC 的 decoder
+func newRecordDecoder(br *recordByteReader) *xml.Decoder {
+	decoder := xml.NewDecoder(br)
+	decoder.Strict = false // 未跳脫的 & 視為文字
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil // 編碼已於 streamXMLRecords 處理
+	}
+	return decoder
+}
+
+// skipToXMLRec 略過 br 中下一個 <REC> 開始標籤 (排除 <RECS>) 之前的內容，找不到時回傳 false
+// 截斷的標籤後緊接 <REC> 時，decoder 可能已讀走其 '<'，此時補回後再交給新的 decoder
+func skipToXMLRec(br *recordByteReader) bool {
+	if br.last == '<' {
+		if p, _ := br.Peek(len("REC>")); len(p) == len("REC>") && indexXMLRecStart("<"+string(p)) == 0 {
+			br.pending = true
+			return true
+		}
+	}
+	br.last = 0
+	for {
+		p, _ := br.Peek(len("<REC>"))
+		if len(p) < len("<REC>") {
+			return false
+		}
+		if string(p[:4]) == "<REC" && indexXMLRecStart(string(p)) == 0 {
+			return true
+		}
+		if _, err := br.Discard(1); err != nil {
+			return false
+		}
+	}
+}
+
+// writeXMLToken 將 REC 內的 token 寫回 XML (去除命名空間前綴，略過註解與處理指令)
+func writeXMLToken(buf *bytes.Buffer, tok xml.Token) {
+	switch t := tok.(type) {
+	case xml.StartElement:
+		buf.WriteByte('<')
+		buf.WriteString(t.Name.Local)
+		for _, attr := range t.Attr {
+			if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+				continue
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(attr.Name.Local)
+			buf.WriteString(`="`)
+			xml.EscapeText(buf, []byte(attr.Value))
+			buf.WriteByte('"')
+		}
+		buf.WriteByte('>')
+	case xml.EndElement:
+		buf.WriteString("</")
+		buf.WriteString(t.Name.Local)
+		buf.WriteByte('>')
+	case xml.CharData:
+		xml.EscapeText(buf, t)
+	}
+}
+
+// xmlDeclaredEncoding 讀取 XML 宣告中的 encoding (不消耗 br 的內容)，未宣告時回傳空字串
+func xmlDeclaredEncoding(br *bufio.Reader) string {
+	head, _ := br.Peek(256)
+	head = bytes.TrimPrefix(head, utf8BOMBytes)
+	if !bytes.HasPrefix(bytes.TrimSpace(head), []byte("<?xml")) {
+		return ""
+	}
+	if end := bytes.Index(head, []byte("?>")); end >= 0 {
+		head = head[:end]
+	}
+	i := bytes.Index(head, []byte("encoding"))
+	if i < 0 {
+		return ""
+	}
+	rest := bytes.TrimLeft(head[i+len("encoding"):], " =")
+	if len(rest) == 0 || (rest[0] != '"' && rest[0] != '\'') {
+		return ""
+	}
+	quote := rest[0]
+	rest = rest[1:]
+	if end := bytes.IndexByte(rest, quote); end >= 0 {
+		return string(rest[:end])
+	}
+	return ""
+}
+
+// isBig5Label 判斷編碼名稱是否為 Big5
+func isBig5Label(label string) bool {
+	switch strings.ToLower(label) {
+	case "big5", "big-5", "cp950":
+		return true
+	}
+	return false
+}
+
+// xmlRecordChunk streamXMLRecords 重組出的單筆 <REC> 區段
+type xmlRecordChunk struct {
+	Data     string
+	Repaired bool // 原始資料缺少 </REC>，已自動補上
+}
+
+// indexXMLRecStart 尋找 <REC> 開始標籤 (排除 <RECS>)
+func indexXMLRecStart(s string) int {
+	offset := 0
+	for {
+		i := strings.Index(s[offset:], "<REC")
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		if next := i + len("<REC"); next < len(s) && (s[next] == '>' || s[next] == ' ' || s[next] == '\t' || s[next] == '\r' || s[next] == '\n') {
+			return i
+		}
+		offset = i + len("<REC")
+	}
+}
+
+// decodeXMLRecord 解碼單筆 <REC> 區段
+// 使用非嚴格模式：未跳脫的 & 視為文字，內層缺少結束標籤時自動補齊
+func decodeXMLRecord(chunk xmlRecordChunk, v interface{}) error {
+	decoder := xml.NewDecoder(strings.NewReader(chunk.Data))
+	decoder.Strict = false
+	return decoder.Decode(v)
+}
+
+// addXMLRecordError 記錄單筆 REC 的 XML 損壞錯誤
+func addXMLRecordError(result *HISImportResult, recNo int, chunk xmlRecordChunk, err error) {
+	result.addLineError(fmt.Sprintf("第 %d 筆 REC XML 損壞，已略過: %s", recNo, err.Error()), recNo, chunk.Data, "", "XML 損壞")
+	result.Failed++
+}
+
+// addXMLRecordWarning 記錄自動補上 </REC> 的提示
+func addXMLRecordWarning(result *HISImportResult, recNo int, chunk xmlRecordChunk) {
+	if chunk.Repaired {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("第 %d 筆 REC 缺少結束標籤，已自動補齊", recNo))
+	}
+}
+
+// isNHIXMLContent 判斷內容是否為 (可能被包裝的) 健保 XML
+func isNHIXMLContent(content string) bool {
+	return strings.Contains(content, "<?xml") ||
+		strings.Contains(content, "<RECS>") ||
+		strings.Contains(content, "<REC>") ||
+		strings.Contains(content, "&lt;RECS&gt;")
+}
+
 // extractPatientFromMB1 從 MB1 區段提取病患資料
 func extractPatientFromMB1(mb1 *NHIMB1) *HISPatient {
 	patient := &HISPatient{
-		NationalID: strings.TrimSpace(mb1.A12),
-		Name:       strings.TrimSpace(mb1.D20),
-		CardNumber: strings.TrimSpace(mb1.A11),
-		Phone:      strings.TrimSpace(mb1.D21),
+		NationalID: sanitizeField(mb1.A12),
+		Name:       sanitizeField(mb1.D20),
+		CardNumber: sanitizeField(mb1.A11),
+		Phone:      sanitizeField(mb1.D21),
 	}
 
 	// 民國年轉西元年 (YYYMMDD -> YYYY-MM-DD)
-	if mb1.A13 != "" && len(mb1.A13) == 7 {
-		patient.Birthday = convertROCDate(mb1.A13)
-	}
+	patient.Birthday = ParseFlexibleDate(mb1.A13)
 
 	return patient
 }
@@ -279,26 +896,28 @@ func extractPatientFromMB1(mb1 *NHIMB1) *HISPatient {
 // extractPrescriptionFromRecord 從 REC 提取處方資料
 func extractPrescriptionFromRecord(rec *NHIRecord) (*HISPrescription, error) {
 	rx := &HISPrescription{
-		PatientID:      strings.TrimSpace(rec.MB1.A12),
-		ProviderCode:   strings.TrimSpace(rec.MB1.A14),
-		VisitType:      strings.TrimSpace(rec.MB1.A23),
-		VisitSequence:  strings.TrimSpace(rec.MB1.A18),
-		DiagnosisCode:  strings.TrimSpace(rec.MB1.D19),
-		PharmacistID:   strings.TrimSpace(rec.MB1.D31),
-		PharmacistName: strings.TrimSpace(rec.MB1.D32),
-		DataFormat:     strings.TrimSpace(rec.MB1.A01),
+		PatientID:       sanitizeField(rec.MB1.A12),
+		ProviderCode:    sanitizeField(rec.MB1.A14),
+		VisitType:       sanitizeField(rec.MB1.A23),
+		VisitSequence:   sanitizeField(rec.MB1.A18),
+		VisitID:         sanitizeField(rec.MB1.A54),
+		DiagnosisCode:   sanitizeField(rec.MB1.D19),
+		PharmacistID:    sanitizeField(rec.MB1.D31),
+		PharmacistName:  sanitizeField(rec.MB1.D32),
+		DataFormat:      sanitizeField(rec.MB1.A01),
+		PaymentCategory: sanitizeField(rec.MB1.D10),
 	}
 
 	// 解析就診日期時間 (民國 YYYMMDDHHMMSS)
-	if rec.MB1.A17 != "" && len(rec.MB1.A17) >= 7 {
-		rx.DispenseDate = convertROCDate(rec.MB1.A17[:7])
-		if len(rec.MB1.A17) >= 13 {
-			rx.DispenseTime = rec.MB1.A17[7:9] + ":" + rec.MB1.A17[9:11] + ":" + rec.MB1.A17[11:13]
-		}
+	rx.DispenseDate, rx.DispenseTime = splitROCDateTime(rec.MB1.A17)
+
+	// 醫療費用點數 (d35)，缺欄位或無法解析時由醫令計算 (見 fillTotals)
+	if points, err := strconv.ParseFloat(sanitizeField(rec.MB1.D35), 64); err == nil {
+		rx.TotalPoints = points
 	}
 
 	// 生成處方序號
-	rx.PrescriptionNo = fmt.Sprintf("%s-%s-%s", rx.ProviderCode, rx.DispenseDate, rx.VisitSequence)
+	setGeneratedPrescriptionNo(rx, fmt.Sprintf("%s-%s-%s", rx.ProviderCode, rx.DispenseDate, visitKey(rx)), visitKey(rx))
 
 	// 解析慢箋次數 (IC02 -> 2, IC03 -> 3)
 	if strings.HasPrefix(rx.VisitSequence, "IC") && len(rx.VisitSequence) >= 4 {
@@ -307,25 +926,31 @@ func extractPrescriptionFromRecord(rec *NHIRecord) (*HISPrescription, error) {
 		}
 	}
 
+	// 新制就醫識別碼取代就醫序號時 A18 可能為空，改由醫令的連處次數 (d36) 判斷
+	if rx.ChronicRefillNo == 0 && len(rec.MB2s) > 0 {
+		rx.ChronicRefillNo, _ = strconv.Atoi(sanitizeField(rec.MB2s[0].D36))
+	}
+
 	// 解析醫令明細
 	for _, mb2 := range rec.MB2s {
 		item := HISPrescriptionItem{
-			OrderType: strings.TrimSpace(mb2.P1),
-			DrugCode:  strings.TrimSpace(mb2.P2),
-			DrugName:  strings.TrimSpace(mb2.P3),
-			Frequency: strings.TrimSpace(mb2.P5),
-			Route:     strings.TrimSpace(mb2.P6),
+			OrderType: sanitizeField(mb2.P1),
+			DrugCode:  sanitizeField(mb2.P2),
+			DrugName:  sanitizeField(mb2.P3),
+			Frequency: sanitizeField(mb2.P5),
+			Route:     sanitizeField(mb2.P6),
+			IsSelfPay: parseSelfPayFlag(mb2.P10),
 		}
 
 		// 解析數值
 		if mb2.P7 != "" {
-			item.Quantity, _ = strconv.ParseFloat(strings.TrimSpace(mb2.P7), 64)
+			item.Quantity, _ = strconv.ParseFloat(sanitizeField(mb2.P7), 64)
 		}
 		if mb2.P8 != "" {
-			item.UnitPrice, _ = strconv.ParseFloat(strings.TrimSpace(mb2.P8), 64)
+			item.UnitPrice, _ = strconv.ParseFloat(sanitizeField(mb2.P8), 64)
 		}
 		if mb2.D27 != "" {
-			item.DaysSupply, _ = strconv.Atoi(strings.TrimSpace(mb2.D27))
+			item.DaysSupply, _ = strconv.Atoi(sanitizeField(mb2.D27))
 		}
 
 		rx.Items = append(rx.Items, item)
@@ -339,11 +964,20 @@ func extractPrescriptionFromRecord(rec *NHIRecord) (*HISPrescription, error) {
 // ============================================================================
 
 // ParseNHIClaimCSV 解析健保費用申報 CSV (Big5 編碼)
+// 支援 H/t 表頭、d 費用明細、p 醫令、S 小計與 R 退補段別；
+// 原始段別資料填入 result.Claim，明細點數加總與小計不符時記錄於 Errors；
+// 有小計 (表尾) 時另以 VerifyTotals 比對解析結果，差異記錄於 Warnings
 func ParseNHIClaimCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
+	return parseNHIClaimCSV(context.Background(), r, isBig5)
+}
+
+// parseNHIClaimCSV 解析健保費用申報 CSV，每行前檢查 ctx 是否已取消
+func parseNHIClaimCSV(ctx context.Context, r io.Reader, isBig5 bool) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "csv",
 		SourceVendor: "nhi",
 	}
+	claim := &NHIClaimCSV{}
 
 	// Big5 轉 UTF-8
 	var reader io.Reader = r
@@ -351,17 +985,22 @@ func ParseNHIClaimCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 		reader = transform.NewReader(r, traditionalchinese.Big5.NewDecoder())
 	}
 
-	scanner := bufio.NewScanner(reader)
+	scanner := newLineScanner(reader)
 	lineNum := 0
 	currentPatientID := ""
 	var currentRx *HISPrescription
+	hasContent := false
 
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+		line := sanitizeField(scanner.Text())
 		if line == "" {
 			continue
 		}
+		hasContent = true
 
 		fields := strings.Split(line, ",")
 		if len(fields) < 2 {
@@ -369,12 +1008,45 @@ func ParseNHIClaimCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 		}
 
 		// 判斷記錄類型
-		recordType := strings.TrimSpace(fields[0])
+		recordType := sanitizeField(fields[0])
 
 		switch {
-		case recordType == "t" || recordType == "T":
-			// 表頭記錄 - 跳過
-			continue
+		case recordType == "t" || recordType == "T" || recordType == "h" || recordType == "H":
+			// 表頭記錄
+			claim.Header = NHIClaimHeader{
+				T1: sanitizeField(getField(fields, 1)),
+				T2: sanitizeField(getField(fields, 2)),
+				T3: sanitizeField(getField(fields, 3)),
+				T4: sanitizeField(getField(fields, 4)),
+			}
+
+		case recordType == "s" || recordType == "S":
+			// 小計 (對帳用)
+			subtotal := NHIClaimSubtotal{S1: sanitizeField(getField(fields, 1))}
+			subtotal.S2, _ = strconv.Atoi(sanitizeField(getField(fields, 2)))
+			points, err := strconv.ParseFloat(sanitizeField(getField(fields, 3)), 64)
+			if err != nil {
+				result.addLineError(fmt.Sprintf("第 %d 行小計點數無法解析", lineNum),
+					lineNum, line, "申報點數", "點數格式錯誤")
+				continue
+			}
+			subtotal.S3 = points
+			claim.Subtotals = append(claim.Subtotals, subtotal)
+
+		case recordType == "r" || recordType == "R":
+			// 退補 (對帳時併入明細點數)
+			adj := NHIClaimAdjustment{
+				R1: sanitizeField(getField(fields, 1)),
+				R2: sanitizeField(getField(fields, 2)),
+			}
+			points, err := strconv.ParseFloat(sanitizeField(getField(fields, 3)), 64)
+			if err != nil {
+				result.addLineError(fmt.Sprintf("第 %d 行退補點數無法解析", lineNum),
+					lineNum, line, "退補點數", "點數格式錯誤")
+				continue
+			}
+			adj.R3 = points
+			claim.Adjustments = append(claim.Adjustments, adj)
 
 		case recordType == "d" || recordType == "D":
 			// 門診費用明細
@@ -382,17 +1054,20 @@ func ParseNHIClaimCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 				result.Prescriptions = append(result.Prescriptions, *currentRx)
 			}
 
-			rx, err := parseClaimDetailLine(fields)
+			rx, detail, err := parseClaimDetailLine(fields)
 			if err != nil {
-				result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行解析失敗: %s", lineNum, err.Error()))
+				result.addLineError(fmt.Sprintf("第 %d 行解析失敗: %s", lineNum, err.Error()),
+					lineNum, line, missingFieldName(claimDetailFields, len(fields)), err.Error())
 				result.Failed++
 				currentRx = nil
 				continue
 			}
 
+			rx.SourceIndex = lineNum
 			currentRx = rx
 			currentPatientID = rx.PatientID
 			result.Total++
+			claim.Claims = append(claim.Claims, *detail)
 
 		case recordType == "p" || recordType == "P":
 			// 醫令明細
@@ -402,11 +1077,19 @@ func ParseNHIClaimCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 
 			item, err := parseClaimItemLine(fields)
 			if err != nil {
-				result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行醫令解析失敗: %s", lineNum, err.Error()))
+				result.addLineError(fmt.Sprintf("第 %d 行醫令解析失敗: %s", lineNum, err.Error()),
+					lineNum, line, missingFieldName(claimItemFields, len(fields)), err.Error())
 				continue
 			}
 
 			currentRx.Items = append(currentRx.Items, *item)
+			claim.Items = append(claim.Items, NHIClaimItem{
+				P1: item.OrderType,
+				P2: item.DrugCode,
+				P3: item.DrugName,
+				P7: item.Quantity,
+				P8: item.UnitPrice,
+			})
 
 			// 提取病患資訊
 			if currentPatientID != "" {
@@ -415,47 +1098,187 @@ func ParseNHIClaimCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 		}
 	}
 
+	result.addScanError(scanner.Err(), lineNum)
+	if !hasContent && scanner.Err() == nil {
+		return emptyFileResult(result)
+	}
+
 	// 加入最後一筆
 	if currentRx != nil {
 		result.Prescriptions = append(result.Prescriptions, *currentRx)
 	}
 
+	result.Errors = append(result.Errors, reconcileClaimTotals(claim)...)
+	result.Claim = claim
+
 	result.Imported = len(result.Prescriptions)
+	finalizeResult(result)
+	if count, points, ok := claimTrailerTotals(claim); ok {
+		result.Warnings = append(result.Warnings, result.VerifyTotals(count, points)...)
+	}
 	result.Success = result.Failed == 0
 	return result, nil
 }
 
-// parseClaimDetailLine 解析費用明細行
-func parseClaimDetailLine(fields []string) (*HISPrescription, error) {
+// claimTrailerTotals 取得表尾的總件數與總點數 (扣除退補)，供 VerifyTotals 比對
+// 有案件分類空白的小計時以其為全檔合計，否則加總各分類小計；無小計時回傳 false
+func claimTrailerTotals(claim *NHIClaimCSV) (int, float64, bool) {
+	if len(claim.Subtotals) == 0 {
+		return 0, 0, false
+	}
+
+	count, points := 0, 0.0
+	found := false
+	for _, subtotal := range claim.Subtotals {
+		if subtotal.S1 == "" {
+			count, points = subtotal.S2, subtotal.S3
+			found = true
+		}
+	}
+	if !found {
+		for _, subtotal := range claim.Subtotals {
+			count += subtotal.S2
+			points += subtotal.S3
+		}
+	}
+	for _, adj := range claim.Adjustments {
+		points -= adj.R3
+	}
+	// 小計未填件數時不比對筆數
+	if count == 0 {
+		count = -1
+	}
+	return count, points, true
+}
+
+// reconcileClaimTotals 以 S 段小計核對明細點數 (d 段合計點數加上 R 段退補)
+// 小計案件分類空白時核對全部案件；回傳不符的說明
+func reconcileClaimTotals(claim *NHIClaimCSV) []string {
+	var errs []string
+	for _, subtotal := range claim.Subtotals {
+		count := 0
+		points := 0.0
+		for _, d := range claim.Claims {
+			if subtotal.S1 == "" || d.D1 == subtotal.S1 {
+				count++
+				points += d.D39
+			}
+		}
+		for _, adj := range claim.Adjustments {
+			if subtotal.S1 == "" || adj.R1 == subtotal.S1 {
+				points += adj.R3
+			}
+		}
+
+		scope := "全部案件"
+		if subtotal.S1 != "" {
+			scope = "案件分類 " + subtotal.S1
+		}
+		if math.Abs(points-subtotal.S3) > 0.005 {
+			errs = append(errs, fmt.Sprintf("小計核對不符 (%s): 申報 %s 點，明細加總 %s 點",
+				scope, formatFloat(subtotal.S3), formatFloat(points)))
+		}
+		if subtotal.S2 > 0 && count != subtotal.S2 {
+			errs = append(errs, fmt.Sprintf("小計件數不符 (%s): 申報 %d 件，明細 %d 件", scope, subtotal.S2, count))
+		}
+	}
+	return errs
+}
+
+// claimDetailFields 申報 d 行欄位名稱 (僅列出解析使用的前段欄位)
+var claimDetailFields = []string{"記錄類型", "案件分類", "流水號", "就醫日期", "身分證"}
+
+// claimItemFields 申報 p 行欄位名稱
+var claimItemFields = []string{"記錄類型", "醫令類別", "藥品代碼", "藥品名稱", "", "", "", "總量", "單價"}
+
+// claimDetailLayout 申報 d 行欄位索引 (各版本欄位數不同，-1 表示該版本無此欄位)
+type claimDetailLayout struct {
+	Version          string
+	TotalPoints      int // 合計點數
+	Copay            int // 部分負擔
+	CopayCategory    int // 部分負擔代號
+	SelfPayAmount    int // 自費金額
+	SpecialTreatment int // 特定治療項目代號 (一) 起始索引，連續四欄
+}
+
+// claimDetailLayouts 已知的申報格式版本 (依最少欄位數由多到少排列)
+var claimDetailLayouts = []struct {
+	minFields int
+	layout    claimDetailLayout
+}{
+	{47, claimDetailLayout{Version: "2.0", TotalPoints: 39, Copay: 40, CopayCategory: 41, SelfPayAmount: 42, SpecialTreatment: 43}},
+	{0, claimDetailLayout{Version: "1.0", TotalPoints: 39, Copay: 40, CopayCategory: -1, SelfPayAmount: -1, SpecialTreatment: -1}},
+}
+
+// claimDetailLayoutFor 依 d 行欄位總數判斷申報格式版本
+// 2.0 格式於合計點數、部分負擔之後新增部分負擔代號、自費金額與特定治療項目代號，舊格式欄位位置不變
+func claimDetailLayoutFor(fieldCount int) claimDetailLayout {
+	for _, l := range claimDetailLayouts {
+		if fieldCount >= l.minFields {
+			return l.layout
+		}
+	}
+	return claimDetailLayouts[len(claimDetailLayouts)-1].layout
+}
+
+// parseClaimDetailLine 解析費用明細行，回傳處方與原始段別資料
+func parseClaimDetailLine(fields []string) (*HISPrescription, *NHIClaimDetail, error) {
 	if len(fields) < 10 {
-		return nil, fmt.Errorf("欄位不足")
+		return nil, nil, fmt.Errorf("欄位不足")
+	}
+	layout := claimDetailLayoutFor(len(fields))
+	field := func(idx int) string {
+		return sanitizeField(getField(fields, idx))
+	}
+	number := func(idx int) float64 {
+		f, _ := strconv.ParseFloat(field(idx), 64)
+		return f
 	}
 
 	rx := &HISPrescription{
-		PatientID: strings.TrimSpace(getField(fields, 4)),
+		PatientID: field(4),
 	}
 
 	// 案件分類
-	rx.VisitType = strings.TrimSpace(getField(fields, 1))
+	rx.VisitType = field(1)
 
 	// 就醫日期 (民國)
-	dateStr := strings.TrimSpace(getField(fields, 3))
+	dateStr := normalizeROCDateTime(getField(fields, 3))
 	if len(dateStr) >= 7 {
 		rx.DispenseDate = convertROCDate(dateStr)
 	}
 
 	// 流水號作為處方序號
-	rx.PrescriptionNo = strings.TrimSpace(getField(fields, 2))
+	rx.PrescriptionNo = field(2)
 
 	// 合計點數與部分負擔
-	if len(fields) > 39 {
-		rx.TotalPoints, _ = strconv.ParseFloat(strings.TrimSpace(fields[39]), 64)
-	}
-	if len(fields) > 40 {
-		rx.Copay, _ = strconv.ParseFloat(strings.TrimSpace(fields[40]), 64)
+	rx.TotalPoints = number(layout.TotalPoints)
+	rx.Copay = number(layout.Copay)
+
+	// 格式 2.0 新增欄位
+	rx.CopayCategory = field(layout.CopayCategory)
+	rx.SelfPayAmount = number(layout.SelfPayAmount)
+
+	detail := &NHIClaimDetail{
+		D1:      rx.VisitType,
+		D2:      rx.PrescriptionNo,
+		D3:      field(3),
+		D4:      rx.PatientID,
+		D5:      field(5),
+		D39:     rx.TotalPoints,
+		D40:     rx.Copay,
+		D41:     rx.CopayCategory,
+		D42:     rx.SelfPayAmount,
+		Version: layout.Version,
+	}
+	if layout.SpecialTreatment >= 0 {
+		for i := 0; i < 4; i++ {
+			if code := field(layout.SpecialTreatment + i); code != "" {
+				detail.D43 = append(detail.D43, code)
+			}
+		}
 	}
-
-	return rx, nil
+	return rx, detail, nil
 }
 
 // parseClaimItemLine 解析醫令明細行
@@ -465,19 +1288,19 @@ func parseClaimItemLine(fields []string) (*HISPrescriptionItem, error) {
 	}
 
 	item := &HISPrescriptionItem{
-		OrderType: strings.TrimSpace(getField(fields, 1)),
-		DrugCode:  strings.TrimSpace(getField(fields, 2)),
-		DrugName:  strings.TrimSpace(getField(fields, 3)),
+		OrderType: sanitizeField(getField(fields, 1)),
+		DrugCode:  sanitizeField(getField(fields, 2)),
+		DrugName:  sanitizeField(getField(fields, 3)),
 	}
 
 	// 總量
 	if qtyStr := getField(fields, 7); qtyStr != "" {
-		item.Quantity, _ = strconv.ParseFloat(strings.TrimSpace(qtyStr), 64)
+		item.Quantity, _ = strconv.ParseFloat(sanitizeField(qtyStr), 64)
 	}
 
 	// 單價
 	if priceStr := getField(fields, 8); priceStr != "" {
-		item.UnitPrice, _ = strconv.ParseFloat(strings.TrimSpace(priceStr), 64)
+		item.UnitPrice, _ = strconv.ParseFloat(sanitizeField(priceStr), 64)
 	}
 
 	return item, nil
@@ -492,51 +1315,77 @@ func ParseHISFile(r io.Reader, filename string) (*HISImportResult, error) {
 	// 讀取完整內容 (需要多次解析嘗試)
 	content, err := io.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("讀取檔案失敗: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
 	}
 
-	// 判斷是否為 Big5 編碼
-	isBig5 := detectBig5(content)
+	// 壓縮檔 (.gz / .zip) 先解壓，內含檔案依健保署標準格式解析
+	if isArchiveContent(content) {
+		return parseArchive(content, filename, VendorNHI)
+	}
+	o := newParseOptions()
+	if isBlankContent(content, o) {
+		return emptyFileResult(nil)
+	}
+	return parseHISContent(content, o)
+}
 
-	// 如果是 Big5，先轉換整份內容為 UTF-8
-	var contentBytes []byte
-	if isBig5 {
-		decoded, _, err := transform.Bytes(traditionalchinese.Big5.NewDecoder(), content)
-		if err != nil {
-			// 轉換失敗，嘗試當作 UTF-8
-			contentBytes = content
-		} else {
-			contentBytes = decoded
-		}
-	} else {
-		contentBytes = content
+// ParseHISFileContext 同 ParseHISFile，ctx 取消或逾時時提前結束並回傳 ctx.Err()
+// 取消時不回傳解析到一半的結果；其他選項 (如 WithStrict) 可一併傳入
+func ParseHISFileContext(ctx context.Context, r io.Reader, filename string, opts ...ParseOption) (*HISImportResult, error) {
+	return ParseWithOptions(r, filename, VendorNHI, append(opts, WithContext(ctx))...)
+}
+
+// parseHISContent 依解析選項解碼並解析健保署標準格式內容
+func parseHISContent(content []byte, o *ParseOptions) (*HISImportResult, error) {
+	// Excel 檔案 (ZIP 容器)
+	if isZipContent(content) {
+		return parseGenericXLSX(o.context(), content, o.ColumnMapping, o.progress)
 	}
 
-	contentStr := string(contentBytes)
+	// 依選項決定編碼 (預設自動偵測 Big5)，統一轉換為 UTF-8
+	contentStr := o.decodeText(content)
 
 	// XML 檔案
-	if strings.Contains(contentStr, "<?xml") || strings.Contains(contentStr, "<RECS>") || strings.Contains(contentStr, "<REC>") {
+	if isNHIXMLContent(contentStr) {
 		// XML 解析時需要原始 bytes (若為 Big5) 或已轉換的 UTF-8
-		return ParseNHIUploadXML(strings.NewReader(contentStr), false)
+		return parseNHIUploadXML(o.context(), strings.NewReader(contentStr), false, o.progress)
 	}
 
-	// CSV 檔案 (健保申報格式)
-	if strings.HasPrefix(strings.TrimSpace(contentStr), "t,") ||
-		strings.HasPrefix(strings.TrimSpace(contentStr), "T,") ||
-		strings.HasPrefix(strings.TrimSpace(contentStr), "30,") {
-		return ParseNHIClaimCSV(strings.NewReader(contentStr), false)
+	// CSV 檔案 (健保申報格式)，僅去除開頭的 BOM 與空白後比對前綴
+	head := trimLeadingBlank(contentStr)
+	if strings.HasPrefix(head, "t,") ||
+		strings.HasPrefix(head, "T,") ||
+		strings.HasPrefix(head, "H,") ||
+		strings.HasPrefix(head, "30,") {
+		return parseNHIClaimCSV(o.context(), strings.NewReader(contentStr), false)
 	}
 
-	// 通用 CSV (以逗號或 Tab 分隔)
-	if strings.Contains(contentStr, ",") || strings.Contains(contentStr, "\t") {
-		return parseGenericCSV(strings.NewReader(contentStr), false)
+	// 通用 CSV (以逗號、Tab 或分號分隔，依標題行判斷)
+	if strings.ContainsAny(contentStr, ",\t;") {
+		return parseGenericCSVWithMapping(o.context(), strings.NewReader(contentStr), false, 0, o.ColumnMapping, o.progress)
 	}
 
-	return nil, fmt.Errorf("無法識別的檔案格式")
+	return nil, ErrUnknownFormat
+}
+
+// parseGenericCSV 解析通用 CSV 格式 (嘗試智慧欄位對應)，delim 為 0 時依標題行自動偵測分隔符
+func parseGenericCSV(r io.Reader, isBig5 bool, delim rune) (*HISImportResult, error) {
+	return parseGenericCSVWithMapping(context.Background(), r, isBig5, delim, nil, nil)
 }
 
-// parseGenericCSV 解析通用 CSV 格式 (嘗試智慧欄位對應)
-func parseGenericCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
+// ParseGenericCSVWithMapping 以指定的欄位對應解析通用 CSV (第一列為標題，分隔符自動偵測)
+// colMap 為欄位 key → 欄位索引 (0 起算)，可用 key 見 DetectColumns；nil 時自動偵測。
+// 對應含未知 key 或負數索引時回傳 ErrInvalidColumnMapping
+func ParseGenericCSVWithMapping(r io.Reader, isBig5 bool, colMap map[string]int) (*HISImportResult, error) {
+	if err := ValidateColumnMapping(colMap); err != nil {
+		return nil, err
+	}
+	return parseGenericCSVWithMapping(context.Background(), r, isBig5, 0, colMap, nil)
+}
+
+// parseGenericCSVWithMapping 解析通用 CSV，讀取與逐列解析時檢查 ctx 是否已取消
+// delim 為 0 時以第一個非空白行 (標題行) 偵測分隔符
+func parseGenericCSVWithMapping(ctx context.Context, r io.Reader, isBig5 bool, delim rune, colMap map[string]int, progress *progressReporter) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "csv",
 		SourceVendor: "generic",
@@ -547,40 +1396,119 @@ func parseGenericCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 		reader = transform.NewReader(r, traditionalchinese.Big5.NewDecoder())
 	}
 
-	scanner := bufio.NewScanner(reader)
+	scanner := newCSVScanner(reader)
+
+	var rows [][]string
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		line := scanner.Text()
+		if sanitizeField(line) == "" {
+			// 保留空白列以維持行號
+			rows = append(rows, nil)
+			continue
+		}
+		if delim == 0 {
+			delim = detectDelimiter(line)
+		}
+		rows = append(rows, parseCSVLine(line, delim))
+		// 引號內含換行的記錄佔多行，補上空白列以維持後續行號
+		for n := strings.Count(line, "\n"); n > 0; n-- {
+			rows = append(rows, nil)
+		}
+	}
+
+	result.addScanError(scanner.Err(), len(rows))
 
+	return parseGenericRows(ctx, result, rows, colMap, progress)
+}
+
+// DetectColumns 讀取通用 CSV / XLSX 的標題列並回傳自動偵測的欄位對應
+// 供前端讓使用者確認或調整後，再以 ParseGenericCSVWithMapping 或 WithColumnMapping 解析
+func DetectColumns(r io.Reader) (headers []string, colMap map[string]int, err error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
+	}
+
+	if isZipContent(content) {
+		rows, err := readXLSXFirstSheet(content)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rows) > 0 {
+			headers = rows[0]
+		}
+	} else {
+		scanner := newCSVScanner(bytes.NewReader(decodeContent(content, detectEncoding(content))))
+		for scanner.Scan() {
+			if line := sanitizeField(scanner.Text()); line != "" {
+				headers = parseCSVLine(line, detectDelimiter(line))
+				break
+			}
+		}
+		if err := scanError(scanner.Err(), 1); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(headers) == 0 {
+		return nil, nil, ErrEmptyFile
+	}
+	colMap, _ = buildColumnMapping(headers)
+	return headers, colMap, nil
+}
+
+// parseGenericRows 解析已切分欄位的表格資料 (第一列為標題，CSV 與 XLSX 共用)
+// colMap 為 nil 時依標題自動對應欄位
+func parseGenericRows(ctx context.Context, result *HISImportResult, rows [][]string, colMap map[string]int, progress *progressReporter) (*HISImportResult, error) {
 	// 讀取標題行
-	if !scanner.Scan() {
-		return result, fmt.Errorf("檔案為空")
+	blank := true
+	for _, row := range rows {
+		if !isBlankRow(row) {
+			blank = false
+			break
+		}
 	}
-	headerLine := scanner.Text()
-	headers := parseCSVLine(headerLine)
+	if blank {
+		return emptyFileResult(result)
+	}
+	headers := rows[0]
 
-	// 建立欄位索引對應
-	colMap := buildColumnMapping(headers)
+	// 建立欄位索引對應 (低信心的對應記錄為警告)
+	if colMap == nil {
+		var confidence map[string]float64
+		colMap, confidence = buildColumnMapping(headers)
+		result.Warnings = append(result.Warnings, lowConfidenceWarnings(headers, colMap, confidence)...)
+	}
 
 	// 用於去重的 map
 	patientMap := make(map[string]*HISPatient)
 	rxMap := make(map[string]*HISPrescription)
 
-	lineNum := 1
-	for scanner.Scan() {
-		lineNum++
-		line := scanner.Text()
-		if strings.TrimSpace(line) == "" {
+	for n, fields := range rows[1:] {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress.report(n, len(rows)-1)
+		if isBlankRow(fields) {
 			continue
 		}
-
-		fields := parseCSVLine(line)
 		result.Total++
+		lineNum := n + 2 // 第 1 行為標題
+
+		if _, ok := colMap["national_id"]; ok && getFieldByKey(fields, colMap, "national_id") == "" {
+			result.addLineError(fmt.Sprintf("第 %d 行缺少身分證，已略過", lineNum), lineNum, strings.Join(fields, ","), "身分證", "缺少必要欄位")
+			result.Failed++
+			continue
+		}
 
 		// 嘗試提取病患
 		patient := extractPatientFromCSV(fields, colMap)
 		if patient != nil && patient.NationalID != "" {
-			// 去重: 同一身分證只保留一筆
-			if _, exists := patientMap[patient.NationalID]; !exists {
-				patientMap[patient.NationalID] = patient
-			}
+			// 去重: 同一身分證只保留一筆，後續資料補齊缺漏欄位
+			upsertPatient(patientMap, patient)
 		}
 
 		// 嘗試提取處方箋
@@ -589,6 +1517,7 @@ func parseGenericCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 			// 用處方序號去重
 			key := rx.PatientID + "-" + rx.PrescriptionNo
 			if _, exists := rxMap[key]; !exists {
+				rx.SourceIndex = lineNum
 				rxMap[key] = rx
 			} else {
 				// 已存在，則合併藥品項目
@@ -608,6 +1537,7 @@ func parseGenericCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 	}
 
 	result.Imported = len(result.Patients) + len(result.Prescriptions)
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
@@ -617,25 +1547,191 @@ func parseGenericCSV(r io.Reader, isBig5 bool) (*HISImportResult, error) {
 // ============================================================================
 
 // convertROCDate 民國年轉西元年 (YYYMMDD -> YYYY-MM-DD)
+// 依長度判斷格式:
+//   - 6 碼: 民國 YYMMDD
+//   - 7 碼: 民國 YYYMMDD
+//   - 8 碼: 首位為 0 (或 1 但非 19 開頭) 視為民國 0YYYMMDD，否則視為西元 YYYYMMDD
+//   - 9 碼以上: 視為 YYYMMDDHHMMSS，取前 7 碼
+//
+// 月或日為 00、或日期不存在 (如 2023-02-29) 時回傳空字串
 func convertROCDate(rocDate string) string {
-	if len(rocDate) < 7 {
+	rocDate = sanitizeField(rocDate)
+
+	var yearStr, monthStr, dayStr string
+	isROC := true
+	switch n := len(rocDate); {
+	case n == 6:
+		yearStr, monthStr, dayStr = rocDate[:2], rocDate[2:4], rocDate[4:6]
+	case n == 7, n > 8:
+		yearStr, monthStr, dayStr = rocDate[:3], rocDate[3:5], rocDate[5:7]
+	case n == 8:
+		yearStr, monthStr, dayStr = rocDate[:4], rocDate[4:6], rocDate[6:8]
+		isROC = rocDate[0] == '0' || (rocDate[0] == '1' && rocDate[1] != '9')
+	default:
 		return ""
 	}
 
-	// 提取年月日
-	yearStr := rocDate[:3]
-	monthStr := rocDate[3:5]
-	dayStr := rocDate[5:7]
-
-	year, err := strconv.Atoi(yearStr)
-	if err != nil {
+	year, errY := strconv.Atoi(yearStr)
+	month, errM := strconv.Atoi(monthStr)
+	day, errD := strconv.Atoi(dayStr)
+	if errY != nil || errM != nil || errD != nil {
 		return ""
 	}
 
 	// 民國年 + 1911 = 西元年
-	adYear := year + 1911
+	if isROC {
+		year += 1911
+	}
+
+	// 檢查日期是否真實存在 (含閏年)
+	if month < 1 || month > 12 || day < 1 {
+		return ""
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if t.Month() != time.Month(month) || t.Day() != day {
+		return ""
+	}
+
+	return t.Format("2006-01-02")
+}
+
+// excelDateEpoch Excel 日期序號的起算日 (序號 1 為 1900-01-01，已計入 Excel 的 1900 閏年錯誤)
+var excelDateEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// Excel 日期序號的合理範圍 (1927-05-18 ~ 2099-12-31)，超出時不視為日期
+const (
+	minExcelDateSerial = 10000
+	maxExcelDateSerial = 73050
+)
+
+// excelSerialDate 將 Excel 日期序號 (5 位數字，可含小數的時間部分，如 31048 或 31048.5) 轉為 YYYY-MM-DD
+// 僅用於已知為日期的 Excel 儲存格；不是序號或超出合理範圍時回傳空字串
+func excelSerialDate(raw string) string {
+	serial, frac, hasFrac := strings.Cut(sanitizeField(raw), ".")
+	if len(serial) != 5 || !isDigits(serial) || (hasFrac && !isDigits(frac)) {
+		return ""
+	}
+	days, _ := strconv.Atoi(serial)
+	if days < minExcelDateSerial || days > maxExcelDateSerial {
+		return ""
+	}
+	return excelDateEpoch.AddDate(0, 0, days).Format("2006-01-02")
+}
+
+// ParseFlexibleDate 將各種日期寫法統一為 YYYY-MM-DD，無法判斷時回傳空字串
+//   - 民國 6/7 碼 (YYMMDD、YYYMMDD)，可附帶時間 (YYYMMDDHHMMSS)
+//   - 西元 8 碼 (YYYYMMDD)，可附帶時間 (YYYYMMDDHHMMSS)
+//   - 含 / - . 分隔且依年月日順序 (1985/1/1、74-01-01、112.01.01)，年份大於 1911 視為西元；
+//     年份在最後的寫法 (01/02/1985) 無法區分月日順序，回傳空字串
+//
+// Excel 日期序號只在已知為日期的儲存格轉換 (見 excelSerialDate)，此處不處理
+func ParseFlexibleDate(raw string) string {
+	s := sanitizeField(raw)
+	if s == "" {
+		return ""
+	}
+
+	if strings.ContainsAny(s, "/-.: ") {
+		datePart := s
+		if idx := strings.IndexAny(s, " T"); idx >= 0 {
+			datePart = s[:idx]
+		}
+		parts := strings.FieldsFunc(datePart, func(r rune) bool {
+			return r == '/' || r == '-' || r == '.'
+		})
+		if len(parts) != 3 || len(parts[1]) > 2 || len(parts[2]) > 2 {
+			return ""
+		}
+		s = normalizeROCDateTime(s)
+		if !isDigits(s) || len(s) < 7 {
+			return ""
+		}
+		return convertROCDate(s[:7])
+	}
+	if !isDigits(s) {
+		return ""
+	}
+	// 西元日期時間 (YYYYMMDDHHMMSS)
+	if len(s) == 14 && (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) {
+		return convertROCDate(s[:8])
+	}
+	return convertROCDate(s)
+}
+
+// isDigits 字串是否非空且全為半形數字
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeROCDateTime 去除民國日期時間的分隔符 (112/01/01 08:30:00 -> 1120101083000)
+// 不含分隔符的輸入原樣回傳；年份大於 1911 時視為西元年並換算為民國年
+func normalizeROCDateTime(raw string) string {
+	raw = sanitizeField(raw)
+	if !strings.ContainsAny(raw, "/-.: ") {
+		return raw
+	}
+
+	datePart, timePart := raw, ""
+	if idx := strings.IndexAny(raw, " T"); idx >= 0 {
+		datePart, timePart = raw[:idx], sanitizeField(raw[idx+1:])
+	}
+
+	parts := strings.FieldsFunc(datePart, func(r rune) bool {
+		return r == '/' || r == '-' || r == '.'
+	})
+	if len(parts) != 3 {
+		return raw
+	}
+	year, errY := strconv.Atoi(parts[0])
+	month, errM := strconv.Atoi(parts[1])
+	day, errD := strconv.Atoi(parts[2])
+	if errY != nil || errM != nil || errD != nil {
+		return raw
+	}
+	if year > 1911 {
+		year -= 1911
+	}
+	normalized := fmt.Sprintf("%03d%02d%02d", year, month, day)
+
+	// 時間部分 (HH:MM[:SS])
+	if timePart != "" {
+		var clock []int
+		for _, f := range strings.Split(timePart, ":") {
+			n, err := strconv.Atoi(sanitizeField(f))
+			if err != nil {
+				return normalized
+			}
+			clock = append(clock, n)
+		}
+		for len(clock) < 3 {
+			clock = append(clock, 0)
+		}
+		normalized += fmt.Sprintf("%02d%02d%02d", clock[0], clock[1], clock[2])
+	}
 
-	return fmt.Sprintf("%04d-%s-%s", adYear, monthStr, dayStr)
+	return normalized
+}
+
+// splitROCDateTime 解析民國日期時間 (YYYMMDDHHMMSS，允許分隔符)
+// 回傳 YYYY-MM-DD 與 HH:MM:SS，無法解析時回傳空字串
+func splitROCDateTime(raw string) (date, clock string) {
+	s := normalizeROCDateTime(raw)
+	if len(s) < 7 {
+		return "", ""
+	}
+	date = convertROCDate(s[:7])
+	if len(s) >= 13 {
+		clock = s[7:9] + ":" + s[9:11] + ":" + s[11:13]
+	}
+	return date, clock
 }
 
 // convertROCDateTime 民國年日期時間轉西元 (YYYMMDDHHMMSS -> time.Time)
@@ -654,125 +1750,348 @@ func convertROCDateTime(rocDateTime string) time.Time {
 	return t
 }
 
-// detectBig5 偵測是否為 Big5 編碼
+// detectEncoding 偵測內容編碼，回傳 utf8 / big5 / gbk / utf16le / utf16be
+// 優先依 BOM 判斷，其次辨識無 BOM 的 UTF-16，最後以 detectGBK、detectBig5 區分 GBK、Big5 與 UTF-8
+func detectEncoding(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, utf8BOMBytes):
+		// 部分系統會在 Big5 內容前誤加 UTF-8 BOM，BOM 之後的內容仍需確認編碼
+		return detectDoubleByteEncoding(content[len(utf8BOMBytes):])
+	case bytes.HasPrefix(content, []byte{0xFF, 0xFE}):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(content, []byte{0xFE, 0xFF}):
+		return EncodingUTF16BE
+	}
+
+	// 無 BOM 的 UTF-16: ASCII 字元的高位元組為 0x00，會集中出現在奇數或偶數位置
+	sample := content
+	if len(sample) > 1024 {
+		sample = sample[:1024]
+	}
+	evenZero, oddZero := 0, 0
+	for i, b := range sample {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZero++
+		} else {
+			oddZero++
+		}
+	}
+	half := len(sample) / 2
+	if half >= 4 {
+		if oddZero > half*2/5 && evenZero < half/10 {
+			return EncodingUTF16LE
+		}
+		if evenZero > half*2/5 && oddZero < half/10 {
+			return EncodingUTF16BE
+		}
+	}
+
+	return detectDoubleByteEncoding(content)
+}
+
+// detectDoubleByteEncoding 區分 GBK、Big5 與 UTF-8 (GBK 判斷需比較兩者比例，須先於 Big5)
+func detectDoubleByteEncoding(content []byte) string {
+	if detectGBK(content) {
+		return EncodingGBK
+	}
+	if detectBig5(content) {
+		return EncodingBig5
+	}
+	return EncodingUTF8
+}
+
+// decodeContent 依編碼將內容轉換為 UTF-8 並去除 BOM，轉換失敗時原樣回傳
+func decodeContent(content []byte, enc string) []byte {
+	// 先移除開頭的 UTF-8 BOM (含誤加在 Big5 內容前者)，避免 BOM 位元組被當成 Big5 解碼
+	content = bytes.TrimPrefix(content, utf8BOMBytes)
+
+	if decoder := encodingDecoder(enc); decoder != nil {
+		if decoded, _, err := transform.Bytes(decoder, content); err == nil {
+			content = decoded
+		}
+	}
+	return bytes.TrimPrefix(content, utf8BOMBytes)
+}
+
+// encodingDecoder 編碼對應的解碼器，UTF-8 (不需轉換) 時回傳 nil
+func encodingDecoder(enc string) *encoding.Decoder {
+	switch enc {
+	case EncodingBig5:
+		return traditionalchinese.Big5.NewDecoder()
+	case EncodingGBK:
+		return simplifiedchinese.GB18030.NewDecoder()
+	case EncodingUTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder()
+	case EncodingUTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewDecoder()
+	}
+	return nil
+}
+
+// utf8BOMBytes UTF-8 位元組順序記號
+var utf8BOMBytes = []byte{0xEF, 0xBB, 0xBF}
+
+// sanitizeField 清除欄位的前後空白與看不見的字元
+// 除 TrimSpace 外，另移除殘留的 BOM (U+FEFF)、零寬字元 (U+200B–U+200D、U+2060)、
+// \r 及其他控制字元 (保留 Tab 與換行，整行使用時不影響分隔)；純可見 ASCII 時直接 TrimSpace
+func sanitizeField(s string) string {
+	clean := true
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x7F {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return strings.TrimSpace(s)
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case r == '\t' || r == '\n':
+			sb.WriteRune(r)
+		case isInvisibleRune(r):
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// isInvisibleRune 是否為 sanitizeField 清除的字元 (控制字元、BOM 與零寬字元)
+func isInvisibleRune(r rune) bool {
+	switch {
+	case r < 0x20 || r == 0x7F, r >= 0x80 && r < 0xA0:
+		return true
+	case r == '\uFEFF', r == '\u200B', r == '\u200C', r == '\u200D', r == '\u2060':
+		return true
+	}
+	return false
+}
+
+// trimLeadingBlank 去除開頭的空白、BOM 與零寬字元 (回傳原字串的子字串，不複製內容)
+func trimLeadingBlank(s string) string {
+	return strings.TrimLeftFunc(s, isBlankRune)
+}
+
+// isBlankRune 是否為空白 (含全形空白) 或 sanitizeField 清除的字元
+func isBlankRune(r rune) bool {
+	return r == ' ' || r == '\u00A0' || r == '\u3000' || isInvisibleRune(r)
+}
+
+// encodingSampleSize 編碼偵測的取樣上限，大檔只需掃描開頭即可判斷
+const encodingSampleSize = 64 << 10
+
+// detectBig5 偵測是否為 Big5 編碼 (僅掃描前 64KB)
+// 先完整驗證 UTF-8 多位元組序列 (含 4 位元組)，合法 UTF-8 或純 ASCII 一律回傳 false；
+// 否則統計 Big5 雙位元組落在常用字區 (0xA440–0xC67E) 與標點、全形數字區 (0xA140–0xA3BF) 的比例
 func detectBig5(content []byte) bool {
-	// 優先驗證 UTF-8：如果內容是合法 UTF-8，就不是 Big5
-	// UTF-8 中文字是 3 字節序列 (0xE0-0xEF 開頭)
-	utf8ValidCount := 0
-	utf8InvalidCount := 0
+	if len(content) > encodingSampleSize {
+		content = content[:encodingSampleSize]
+	}
 
+	// UTF-8 驗證: 取樣截斷處可能切在字元中間，不完整的結尾不算錯誤
+	utf8Valid, utf8Invalid := 0, 0
 	for i := 0; i < len(content); {
-		b := content[i]
-
-		// ASCII 範圍
-		if b < 0x80 {
+		if content[i] < utf8.RuneSelf {
 			i++
 			continue
 		}
-
-		// UTF-8 3 字節序列 (中文字)
-		if b >= 0xE0 && b <= 0xEF && i+2 < len(content) {
-			b2, b3 := content[i+1], content[i+2]
-			// 驗證後續字節是 10xxxxxx 格式
-			if (b2&0xC0) == 0x80 && (b3&0xC0) == 0x80 {
-				utf8ValidCount++
-				i += 3
-				continue
-			}
+		if !utf8.FullRune(content[i:]) {
+			break
 		}
+		r, size := utf8.DecodeRune(content[i:])
+		if r == utf8.RuneError && size == 1 {
+			utf8Invalid++
+		} else {
+			utf8Valid++
+		}
+		i += size
+	}
+	if utf8Valid == 0 && utf8Invalid == 0 {
+		return false // 純 ASCII
+	}
+	if utf8Invalid == 0 || (utf8Valid > 5 && utf8Invalid < utf8Valid/20) {
+		return false // UTF-8 (容許極少數損毀字元)
+	}
 
-		// UTF-8 2 字節序列
-		if b >= 0xC0 && b <= 0xDF && i+1 < len(content) {
-			b2 := content[i+1]
-			if (b2 & 0xC0) == 0x80 {
-				utf8ValidCount++
-				i += 2
-				continue
-			}
+	// Big5 雙位元組統計
+	pairs, common, bad := 0, 0, 0
+	for i := 0; i < len(content); i++ {
+		b1 := content[i]
+		if b1 < 0x80 {
+			continue
+		}
+		if b1 < 0x81 || b1 > 0xFE || i+1 >= len(content) {
+			bad++
+			continue
+		}
+		b2 := content[i+1]
+		if (b2 < 0x40 || b2 > 0x7E) && (b2 < 0xA1 || b2 > 0xFE) {
+			bad++
+			continue
 		}
 
-		// 不是合法 UTF-8 序列
-		utf8InvalidCount++
+		pairs++
+		code := int(b1)<<8 | int(b2)
+		if (code >= 0xA440 && code <= 0xC67E) || (code >= 0xA140 && code <= 0xA3BF) {
+			common++
+		}
 		i++
 	}
 
-	// 如果有大量合法 UTF-8 序列且幾乎沒有非法序列，則為 UTF-8
-	if utf8ValidCount > 5 && utf8InvalidCount < utf8ValidCount/10 {
-		return false // 是 UTF-8，不是 Big5
+	if pairs == 0 || bad > pairs/10 {
+		return false
 	}
+	// 常用字與標點佔多數才判定為 Big5 (罕用字區多為其他編碼的誤判)
+	return common*10 >= pairs*7
+}
 
-	// 否則嘗試檢測 Big5
-	big5Count := 0
-	for i := 0; i < len(content)-1; i++ {
-		b1, b2 := content[i], content[i+1]
-		// Big5 雙字節範圍
-		if b1 >= 0x81 && b1 <= 0xFE {
-			if (b2 >= 0x40 && b2 <= 0x7E) || (b2 >= 0xA1 && b2 <= 0xFE) {
-				big5Count++
-				i++
-			}
+// 欄位對應信心分數
+const (
+	confidenceExact     = 1.0 // 標題與關鍵字完全相同
+	confidenceContains  = 0.6 // 標題包含關鍵字
+	confidenceAmbiguous = 0.3 // 標題同時符合多個欄位的關鍵字
+)
+
+// columnPatterns 通用格式各欄位 key 的常見標題名稱 (欄位對應可用的 key 即為此表的 key)
+var columnPatterns = map[string][]string{
+	"national_id":     {"身分證", "身份證", "ID", "national_id", "pid", "病患ID", "idno", "身份证", "身分证"},
+	"name":            {"姓名", "name", "patient_name", "病患姓名"},
+	"birthday":        {"生日", "出生日期", "birthday", "dob", "birth"},
+	"phone":           {"電話", "phone", "tel", "手機", "mobile", "电话", "手机"},
+	"drug_code":       {"藥品代碼", "藥品代號", "健保碼", "drug_code", "code", "nhi_code", "药品代码", "药品编码"},
+	"drug_name":       {"藥品名稱", "英文名稱", "中文名稱", "drug_name", "藥名", "药品名称", "药名"},
+	"quantity":        {"數量", "總量", "quantity", "qty", "数量"},
+	"days":            {"天數", "日份", "給藥天數", "給藥日數", "days", "day", "天数"},
+	"prescription_no": {"處方箋號", "處方號", "處方箋", "prescription_no", "rx_no", "rxno", "处方号", "处方笺号"},
+	"visit_date":      {"就診日", "就診日期", "調劑日期", "visit_date", "dispense_date", "date", "就诊日期", "调剂日期"},
+	"visit_type":      {"就醫類別", "visit_type", "type"},
+	"hospital":        {"醫院", "hospital", "provider", "來源醫院"},
+	"address":         {"地址", "住址", "address", "addr"},
+	"notes":           {"備註", "notes", "memo", "remark"},
+	"current_stock":   {"現有庫存", "目前庫存", "庫存量", "current_stock", "stock_qty"},
+	"min_stock":       {"安全庫存", "最低庫存", "安全存量", "min_stock"},
+	"supplier":        {"供應商", "廠商", "藥商", "製造廠", "supplier"},
+	"unit_price":      {"單價", "參考價", "健保價", "支付價", "unit_price", "price"},
+	"dosage_form":     {"劑型", "dosage_form"},
+	"unit":            {"規格單位", "包裝單位", "單位", "package_unit", "dosage_unit"},
+	"atc_code":        {"ATC", "atc_code", "atc code", "ATC碼"},
+	"effective_from":  {"有效起日", "生效日", "起日", "effective_from", "start_date"},
+	"effective_to":    {"有效迄日", "失效日", "迄日", "effective_to", "end_date"},
+}
+
+// ValidateColumnMapping 檢查自訂欄位對應：key 需為 DetectColumns 可回傳的欄位，索引不可為負數
+// 索引超過資料列欄位數時該欄視為空白，不視為錯誤
+func ValidateColumnMapping(colMap map[string]int) error {
+	keys := make([]string, 0, len(colMap))
+	for key := range colMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := columnPatterns[key]; !ok {
+			return fmt.Errorf("%w: 未知的欄位 %q", ErrInvalidColumnMapping, key)
+		}
+		if colMap[key] < 0 {
+			return fmt.Errorf("%w: 欄位 %q 的索引 %d 不可為負數", ErrInvalidColumnMapping, key, colMap[key])
 		}
 	}
-
-	return big5Count > 5
+	return nil
 }
 
-// buildColumnMapping 建立欄位名稱對應索引
-func buildColumnMapping(headers []string) map[string]int {
+// buildColumnMapping 建立欄位名稱對應索引，並回傳各欄位的對應信心分數
+// 完全相同為 1.0、包含為 0.6，標題同時符合多個欄位時降為 0.3
+func buildColumnMapping(headers []string) (map[string]int, map[string]float64) {
 	colMap := make(map[string]int)
+	confidence := make(map[string]float64)
 
-	// 常見欄位名稱對應
-	patterns := map[string][]string{
-		"national_id":     {"身分證", "身份證", "ID", "national_id", "pid", "病患ID", "idno"},
-		"name":            {"姓名", "name", "patient_name", "病患姓名"},
-		"birthday":        {"生日", "出生日期", "birthday", "dob", "birth"},
-		"phone":           {"電話", "phone", "tel", "手機", "mobile"},
-		"drug_code":       {"藥品代碼", "健保碼", "drug_code", "code", "nhi_code"},
-		"drug_name":       {"藥品名稱", "drug_name", "藥名"},
-		"quantity":        {"數量", "總量", "quantity", "qty"},
-		"days":            {"天數", "日份", "給藥天數", "給藥日數", "days", "day"},
-		"prescription_no": {"處方箋號", "處方號", "處方箋", "prescription_no", "rx_no", "rxno"},
-		"visit_date":      {"就診日", "就診日期", "調劑日期", "visit_date", "dispense_date", "date"},
-		"visit_type":      {"就醫類別", "visit_type", "type"},
-		"hospital":        {"醫院", "hospital", "provider", "來源醫院"},
-	}
-
+	// 各欄位取最長的符合字串；不同欄位的符合字串互相包含時只保留較長者 (如 "ATC CODE" 對應 atc_code 而非 drug_code)，
+	// 互不相干的符合字串則各自對應
 	for i, h := range headers {
-		h = strings.ToLower(strings.TrimSpace(h))
-		for key, variants := range patterns {
+		h = strings.ToLower(sanitizeField(h))
+		matches := make(map[string]string)
+		for key, variants := range columnPatterns {
 			for _, v := range variants {
-				if strings.Contains(h, strings.ToLower(v)) {
-					colMap[key] = i
-					break
+				v = strings.ToLower(v)
+				if strings.Contains(h, v) && len(v) > len(matches[key]) {
+					matches[key] = v
 				}
 			}
 		}
+
+		for key, alias := range matches {
+			if shadowedAlias(key, alias, matches) {
+				continue
+			}
+			score := confidenceContains
+			switch {
+			case alias == h:
+				score = confidenceExact
+			case len(matches) > 1:
+				score = confidenceAmbiguous
+			}
+			// 多個標題對應同一欄位時保留信心較高者 (相同時以後出現者為準)
+			if prev, ok := confidence[key]; ok && prev > score {
+				continue
+			}
+			colMap[key] = i
+			confidence[key] = score
+		}
+	}
+
+	return colMap, confidence
+}
+
+// shadowedAlias 判斷 key 的符合字串是否被其他欄位更長的符合字串包含 (相同時保留代碼較小的欄位)
+func shadowedAlias(key, alias string, matches map[string]string) bool {
+	for other, v := range matches {
+		if other != key && strings.Contains(v, alias) && (len(v) > len(alias) || other < key) {
+			return true
+		}
 	}
+	return false
+}
+
+// lowConfidenceWarnings 列出信心分數未達完全相符的欄位對應，提醒使用者確認是否需手動指定欄位
+func lowConfidenceWarnings(headers []string, colMap map[string]int, confidence map[string]float64) []string {
+	keys := make([]string, 0, len(colMap))
+	for key := range colMap {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool { return colMap[keys[a]] < colMap[keys[b]] })
 
-	return colMap
+	var warnings []string
+	for _, key := range keys {
+		if score := confidence[key]; score < confidenceExact {
+			warnings = append(warnings, fmt.Sprintf("欄位對應信心偏低: 「%s」→ %s (%.1f)，如有錯誤請手動指定欄位",
+				sanitizeField(headers[colMap[key]]), key, score))
+		}
+	}
+	return warnings
 }
 
 // extractPatientFromCSV 從 CSV 行提取病患資料
 func extractPatientFromCSV(fields []string, colMap map[string]int) *HISPatient {
 	patient := &HISPatient{}
 
-	if idx, ok := colMap["national_id"]; ok && idx < len(fields) {
-		patient.NationalID = strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["national_id"]; ok && idx >= 0 && idx < len(fields) {
+		patient.NationalID = sanitizeField(fields[idx])
 	}
-	if idx, ok := colMap["name"]; ok && idx < len(fields) {
-		patient.Name = strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["name"]; ok && idx >= 0 && idx < len(fields) {
+		patient.Name = sanitizeField(fields[idx])
 	}
-	if idx, ok := colMap["birthday"]; ok && idx < len(fields) {
-		birthday := strings.TrimSpace(fields[idx])
-		// 嘗試轉換民國年
-		if len(birthday) == 7 && birthday[0] >= '0' && birthday[0] <= '1' {
-			patient.Birthday = convertROCDate(birthday)
-		} else {
-			patient.Birthday = birthday
-		}
+	if idx, ok := colMap["birthday"]; ok && idx >= 0 && idx < len(fields) {
+		// 民國、西元與 Excel 序號混用
+		patient.Birthday = ParseFlexibleDate(fields[idx])
 	}
-	if idx, ok := colMap["phone"]; ok && idx < len(fields) {
-		patient.Phone = strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["phone"]; ok && idx >= 0 && idx < len(fields) {
+		patient.Phone = sanitizeField(fields[idx])
 	}
 
 	return patient
@@ -783,18 +2102,18 @@ func extractPrescriptionFromCSV(fields []string, colMap map[string]int) *HISPres
 	rx := &HISPrescription{}
 
 	// 病患身分證
-	if idx, ok := colMap["national_id"]; ok && idx < len(fields) {
-		rx.PatientID = strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["national_id"]; ok && idx >= 0 && idx < len(fields) {
+		rx.PatientID = sanitizeField(fields[idx])
 	}
 
 	// 處方箋號
-	if idx, ok := colMap["prescription_no"]; ok && idx < len(fields) {
-		rx.PrescriptionNo = strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["prescription_no"]; ok && idx >= 0 && idx < len(fields) {
+		rx.PrescriptionNo = sanitizeField(fields[idx])
 	}
 
 	// 就診日期
-	if idx, ok := colMap["visit_date"]; ok && idx < len(fields) {
-		dateStr := strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["visit_date"]; ok && idx >= 0 && idx < len(fields) {
+		dateStr := sanitizeField(fields[idx])
 		// 嘗試轉換民國年
 		if len(dateStr) == 7 && dateStr[0] >= '0' && dateStr[0] <= '1' {
 			rx.DispenseDate = convertROCDate(dateStr)
@@ -804,28 +2123,28 @@ func extractPrescriptionFromCSV(fields []string, colMap map[string]int) *HISPres
 	}
 
 	// 就醫類別
-	if idx, ok := colMap["visit_type"]; ok && idx < len(fields) {
-		rx.VisitType = strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["visit_type"]; ok && idx >= 0 && idx < len(fields) {
+		rx.VisitType = sanitizeField(fields[idx])
 	}
 
 	// 醫院
-	if idx, ok := colMap["hospital"]; ok && idx < len(fields) {
-		rx.ProviderName = strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["hospital"]; ok && idx >= 0 && idx < len(fields) {
+		rx.ProviderName = sanitizeField(fields[idx])
 	}
 
 	// 藥品項目
 	item := HISPrescriptionItem{}
-	if idx, ok := colMap["drug_code"]; ok && idx < len(fields) {
-		item.DrugCode = strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["drug_code"]; ok && idx >= 0 && idx < len(fields) {
+		item.DrugCode = sanitizeField(fields[idx])
 	}
-	if idx, ok := colMap["drug_name"]; ok && idx < len(fields) {
-		item.DrugName = strings.TrimSpace(fields[idx])
+	if idx, ok := colMap["drug_name"]; ok && idx >= 0 && idx < len(fields) {
+		item.DrugName = sanitizeField(fields[idx])
 	}
-	if idx, ok := colMap["quantity"]; ok && idx < len(fields) {
-		item.Quantity, _ = strconv.ParseFloat(strings.TrimSpace(fields[idx]), 64)
+	if idx, ok := colMap["quantity"]; ok && idx >= 0 && idx < len(fields) {
+		item.Quantity, _ = strconv.ParseFloat(sanitizeField(fields[idx]), 64)
 	}
-	if idx, ok := colMap["days"]; ok && idx < len(fields) {
-		item.DaysSupply, _ = strconv.Atoi(strings.TrimSpace(fields[idx]))
+	if idx, ok := colMap["days"]; ok && idx >= 0 && idx < len(fields) {
+		item.DaysSupply, _ = strconv.Atoi(sanitizeField(fields[idx]))
 	}
 
 	if item.DrugCode != "" {
@@ -840,28 +2159,560 @@ func extractPrescriptionFromCSV(fields []string, colMap map[string]int) *HISPres
 	return rx
 }
 
-// parseCSVLine 解析 CSV 行 (處理引號)
-func parseCSVLine(line string) []string {
+// csvDelimiters 可自動偵測的欄位分隔符 (同次數時依此順序優先)
+var csvDelimiters = []rune{',', '\t', ';'}
+
+// detectDelimiter 統計標題行中各候選分隔符 (逗號、Tab、分號) 在引號外的出現次數，取最多者
+// 皆未出現時回傳逗號
+func detectDelimiter(headerLine string) rune {
+	counts := make(map[rune]int, len(csvDelimiters))
+	inQuotes := false
+	for _, r := range headerLine {
+		if r == '"' {
+			inQuotes = !inQuotes
+			continue
+		}
+		if !inQuotes {
+			counts[r]++
+		}
+	}
+
+	best := ','
+	for _, d := range csvDelimiters {
+		if counts[d] > counts[best] {
+			best = d
+		}
+	}
+	return best
+}
+
+// parseCSVLine 解析以 delim 分隔的 CSV 記錄 (處理引號)
+// 以引號包住的欄位可含分隔符與換行，欄位內的 "" 視為一個引號；未包引號的欄位中的引號保留原字元
+func parseCSVLine(line string, delim rune) []string {
+	line = strings.TrimRight(line, "\r\n")
 	var fields []string
 	var field strings.Builder
 	inQuotes := false
+	fieldStart := true
 
-	for _, r := range line {
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
 		switch {
-		case r == '"':
-			inQuotes = !inQuotes
-		case r == ',' && !inQuotes:
+		case inQuotes && r == '"':
+			if i+1 < len(runes) && runes[i+1] == '"' {
+				field.WriteRune('"')
+				i++
+			} else {
+				inQuotes = false
+			}
+		case inQuotes:
+			field.WriteRune(r)
+		case r == '"' && fieldStart:
+			inQuotes = true
+		case r == delim:
 			fields = append(fields, field.String())
 			field.Reset()
+			fieldStart = true
+			continue
+		case fieldStart && (r == ' ' || r == '\t'):
+			// 引號前的空白不影響欄位是否以引號包住
+			field.WriteRune(r)
+			continue
 		default:
 			field.WriteRune(r)
 		}
+		fieldStart = false
 	}
 	fields = append(fields, field.String())
 
 	return fields
 }
 
+// newCSVScanner 建立逐筆讀取 CSV 記錄的 Scanner，引號內的換行不視為記錄結束
+func newCSVScanner(r io.Reader) *bufio.Scanner {
+	scanner := newLineScanner(r)
+	scanner.Split(scanCSVRecords)
+	return scanner
+}
+
+// scanCSVRecords bufio.SplitFunc: 以引號外的換行切分記錄 (去除行尾 \r，引號內的 \r\n 轉為 \n)
+// 僅欄位開頭 (行首或逗號、Tab、分號之後) 的引號視為包住欄位，避免 5" 之類的單一引號吃掉後續資料
+func scanCSVRecords(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	inQuotes := false
+	multiline := false
+	fieldStart := true
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if inQuotes {
+			switch {
+			case b == '"' && i+1 >= len(data) && !atEOF:
+				// 無法判斷是否為 "" 轉義，等待更多資料
+				return 0, nil, nil
+			case b == '"' && i+1 < len(data) && data[i+1] == '"':
+				i++
+			case b == '"':
+				inQuotes = false
+			case b == '\n':
+				multiline = true
+			}
+			continue
+		}
+
+		switch b {
+		case '\n':
+			return i + 1, csvRecordToken(data[:i], multiline), nil
+		case '"':
+			inQuotes = fieldStart
+			fieldStart = false
+		case ',', '\t', ';':
+			fieldStart = true
+		case ' ':
+		default:
+			fieldStart = false
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), csvRecordToken(data, multiline), nil
+	}
+	return 0, nil, nil
+}
+
+// csvRecordToken 去除記錄行尾的 \r，跨行記錄的 \r\n 統一為 \n
+func csvRecordToken(record []byte, multiline bool) []byte {
+	record = bytes.TrimSuffix(record, []byte("\r"))
+	if multiline {
+		record = bytes.ReplaceAll(record, []byte("\r\n"), []byte("\n"))
+	}
+	return record
+}
+
+// Sort 將病患依身分證號、處方依 (身分證號, 調劑日期, 處方序號) 排序，藥品項目維持原始順序
+// 解析器多以 map 彙整資料，排序後每次輸出順序一致；所有解析器輸出前皆會呼叫
+func (r *HISImportResult) Sort() {
+	if r == nil {
+		return
+	}
+	sort.SliceStable(r.Patients, func(i, j int) bool {
+		return r.Patients[i].NationalID < r.Patients[j].NationalID
+	})
+	sort.SliceStable(r.Prescriptions, func(i, j int) bool {
+		a, b := &r.Prescriptions[i], &r.Prescriptions[j]
+		if a.PatientID != b.PatientID {
+			return a.PatientID < b.PatientID
+		}
+		if a.DispenseDate != b.DispenseDate {
+			return a.DispenseDate < b.DispenseDate
+		}
+		return a.PrescriptionNo < b.PrescriptionNo
+	})
+}
+
+// finalizeResult 解析完成後的共同後處理 (所有解析器回傳前呼叫)
+func finalizeResult(result *HISImportResult) {
+	tagSourceVendor(result)
+	result.Sort()
+	splitProcedures(result)
+	validateDrugCodes(result)
+	validatePatientIDs(result)
+	validateProviderCodes(result)
+	normalizeDiagnosisCodes(result)
+	tagTimesPerDay(result)
+	tagRoutes(result)
+	tagVisitTypeNames(result)
+	markChronicPrescriptions(result)
+	tagATC(result)
+	result.SelfPayTotal = calcSelfPayTotal(result.Prescriptions)
+	fillTotals(result)
+	result.DrugUsages, result.ServiceFees = summarizeUsages(result.Prescriptions)
+	warnUndatedUsage(result)
+}
+
+// tagSourceVendor 以結果的來源廠商填入尚未標記的處方
+func tagSourceVendor(result *HISImportResult) {
+	for i := range result.Prescriptions {
+		if result.Prescriptions[i].SourceVendor == "" {
+			result.Prescriptions[i].SourceVendor = result.SourceVendor
+		}
+	}
+}
+
+// FindBySourceIndex 依原始檔中的位置 (見 HISPrescription.SourceIndex) 找出處方
+// 合併多個檔案的結果可能有多筆相同位置，可再以 SourceVendor 區分；找不到時回傳 nil
+func (r *HISImportResult) FindBySourceIndex(idx int) []*HISPrescription {
+	var found []*HISPrescription
+	for i := range r.Prescriptions {
+		if r.Prescriptions[i].SourceIndex == idx {
+			found = append(found, &r.Prescriptions[i])
+		}
+	}
+	return found
+}
+
+// DetectChronicPrescription 綜合判斷是否為慢性病連續處方箋，回傳目前第幾次與可調劑總次數
+// 判斷依據 (任一成立即為慢箋):
+//   - 就醫類別 08 (慢箋)
+//   - 就醫序號 IC02 以後 (慢箋續領)；IC01 為首次領藥，需搭配其他依據
+//   - 連處總次數 (看診大師 d37) 大於 1
+//   - 任一藥品給藥天數 >= 28
+//   - 非 IC 就醫序號時，已由連處次數 (d36) 或 CSV 欄位標記慢箋次數
+//
+// 就醫類別 AF (醫院釋出處方) 本身不代表慢箋，依上述條件判斷。
+// 總次數只取自資料 (不少於目前次數)，未提供時回傳 0，呼叫端應視為未知而非推估
+func DetectChronicPrescription(rx *HISPrescription) (isChronic bool, refillNo int, totalRefills int) {
+	if rx == nil {
+		return false, 0, 0
+	}
+
+	seqNo := 0
+	isICSeq := strings.HasPrefix(rx.VisitSequence, "IC") && len(rx.VisitSequence) >= 4
+	if isICSeq {
+		seqNo, _ = strconv.Atoi(rx.VisitSequence[2:4])
+	}
+
+	maxDays := 0
+	for _, item := range rx.Items {
+		if item.DaysSupply > maxDays {
+			maxDays = item.DaysSupply
+		}
+	}
+
+	switch {
+	case rx.VisitType == "08":
+		isChronic = true
+	case seqNo >= 2:
+		isChronic = true
+	case rx.TotalRefills > 1:
+		isChronic = true
+	case maxDays >= 28:
+		isChronic = true
+	case !isICSeq && rx.ChronicRefillNo > 0:
+		isChronic = true
+	}
+	if !isChronic {
+		return false, 0, 0
+	}
+
+	refillNo = seqNo
+	if refillNo == 0 {
+		refillNo = rx.ChronicRefillNo
+	}
+	if refillNo == 0 {
+		refillNo = 1
+	}
+
+	totalRefills = rx.TotalRefills
+	if totalRefills > 0 && totalRefills < refillNo {
+		totalRefills = refillNo
+	}
+	return true, refillNo, totalRefills
+}
+
+// markChronicPrescriptions 依 DetectChronicPrescription 更新慢箋次數與總次數
+func markChronicPrescriptions(result *HISImportResult) {
+	for i := range result.Prescriptions {
+		rx := &result.Prescriptions[i]
+		_, rx.ChronicRefillNo, rx.TotalRefills = DetectChronicPrescription(rx)
+	}
+}
+
+// MergeDuplicatePrescriptions 合併同一病患、同一處方序號的處方 (保留首次出現的順序)
+// 後出現的處方補上前者缺漏的欄位 (就醫、醫院、診斷、藥師等)，診斷碼取聯集；
+// 藥品項目僅加入尚未出現的項目 (同藥品代碼且同數量視為重複)；帶有新藥品項目的分段記錄金額加總，重複記錄金額取較大值
+func MergeDuplicatePrescriptions(rxs []HISPrescription) []HISPrescription {
+	merged := make([]HISPrescription, 0, len(rxs))
+	index := make(map[string]int, len(rxs))
+
+	for _, rx := range rxs {
+		if rx.PrescriptionNo == "" {
+			merged = append(merged, rx)
+			continue
+		}
+		key := rx.patientIdentity() + "\x00" + rx.PrescriptionNo
+		idx, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			merged = append(merged, rx)
+			continue
+		}
+		mergePrescription(&merged[idx], &rx)
+	}
+	return merged
+}
+
+// mergeSplitPrescriptions 合併同一處方被拆成的多筆記錄，合併掉的筆數自 Total 與 Imported 扣除
+func mergeSplitPrescriptions(result *HISImportResult) {
+	count := len(result.Prescriptions)
+	result.Prescriptions = MergeDuplicatePrescriptions(result.Prescriptions)
+	if merged := count - len(result.Prescriptions); merged > 0 {
+		result.Total -= merged
+		result.Imported -= merged
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%d 筆同一處方序號的記錄已合併", merged))
+	}
+}
+
+// mergePrescription 將 src 合併至 dst
+// src 帶有新的藥品項目時視為同一處方的分段記錄，總點數、部分負擔與自費金額加總；
+// 否則視為重複記錄，金額取較大值
+func mergePrescription(dst, src *HISPrescription) {
+	fill := func(d *string, s string) {
+		if *d == "" {
+			*d = s
+		}
+	}
+	fill(&dst.DispenseDate, src.DispenseDate)
+	fill(&dst.DispenseTime, src.DispenseTime)
+	fill(&dst.VisitType, src.VisitType)
+	fill(&dst.VisitSequence, src.VisitSequence)
+	fill(&dst.VisitID, src.VisitID)
+	fill(&dst.ProviderCode, src.ProviderCode)
+	fill(&dst.ProviderName, src.ProviderName)
+	fill(&dst.PharmacistID, src.PharmacistID)
+	fill(&dst.PharmacistName, src.PharmacistName)
+	fill(&dst.DataFormat, src.DataFormat)
+	fill(&dst.CopayCategory, src.CopayCategory)
+	fill(&dst.PaymentCategory, src.PaymentCategory)
+	fill(&dst.SourceVendor, src.SourceVendor)
+	if dst.SourceIndex == 0 {
+		dst.SourceIndex = src.SourceIndex
+	}
+
+	if src.ChronicRefillNo > dst.ChronicRefillNo {
+		dst.ChronicRefillNo = src.ChronicRefillNo
+	}
+	if src.TotalRefills > dst.TotalRefills {
+		dst.TotalRefills = src.TotalRefills
+	}
+
+	// 診斷碼取聯集: 尚未正規化時串接原始字串 (由 normalizeDiagnosisCodes 拆分去重)
+	switch {
+	case dst.DiagnosisCode == "":
+		dst.DiagnosisCode = src.DiagnosisCode
+	case src.DiagnosisCode != "" && src.DiagnosisCode != dst.DiagnosisCode && len(dst.DiagnosisCodes) == 0:
+		dst.DiagnosisCode += ";" + src.DiagnosisCode
+	}
+	for _, code := range src.DiagnosisCodes {
+		if !containsString(dst.DiagnosisCodes, code) {
+			dst.DiagnosisCodes = append(dst.DiagnosisCodes, code)
+		}
+	}
+
+	seen := make(map[itemKey]bool, len(dst.Items))
+	for _, item := range dst.Items {
+		seen[makeItemKey(item, keyQuantity)] = true
+	}
+	split := false
+	for _, item := range src.Items {
+		k := makeItemKey(item, keyQuantity)
+		if !seen[k] {
+			seen[k] = true
+			dst.Items = append(dst.Items, item)
+			split = true
+		}
+	}
+
+	if split {
+		dst.TotalPoints += src.TotalPoints
+		dst.Copay += src.Copay
+		dst.SelfPayAmount += src.SelfPayAmount
+		return
+	}
+	if src.TotalPoints > dst.TotalPoints {
+		dst.TotalPoints = src.TotalPoints
+	}
+	if src.Copay > dst.Copay {
+		dst.Copay = src.Copay
+	}
+	if src.SelfPayAmount > dst.SelfPayAmount {
+		dst.SelfPayAmount = src.SelfPayAmount
+	}
+}
+
+// containsString 判斷字串切片是否包含指定值
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// identity 病患的去重依據 (遮蔽後仍為原始身分證)
+func (p *HISPatient) identity() string {
+	return firstNonEmpty(p.rawNationalID, p.NationalID)
+}
+
+// patientIdentity 處方所屬病患的去重依據 (遮蔽後仍為原始身分證)
+func (rx *HISPrescription) patientIdentity() string {
+	return firstNonEmpty(rx.rawPatientID, rx.PatientID)
+}
+
+// visitKey 處方鍵值使用的就醫識別: 優先使用新制就醫識別碼，未提供時退回就醫序號 (A18)
+func visitKey(rx *HISPrescription) string {
+	return firstNonEmpty(rx.VisitID, rx.VisitSequence)
+}
+
+// isBlankContent 內容是否只有空白、BOM 與零寬字元 (Excel 檔不視為空檔)
+// 依偵測的編碼逐字元解碼，遇到第一個可見字元即停止，不轉換整份內容
+func isBlankContent(content []byte, o *ParseOptions) bool {
+	if isZipContent(content) {
+		return false
+	}
+	var r io.Reader = bytes.NewReader(bytes.TrimPrefix(content, utf8BOMBytes))
+	if decoder := encodingDecoder(o.encodingOf(content)); decoder != nil {
+		r = transform.NewReader(r, decoder)
+	}
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			return true
+		}
+		if !isBlankRune(c) {
+			return false
+		}
+	}
+}
+
+// emptyFileResult 將結果標記為空檔 (Success 為 false，Errors 含 ErrEmptyFile 說明) 並回傳 ErrEmptyFile
+func emptyFileResult(result *HISImportResult) (*HISImportResult, error) {
+	if result == nil {
+		result = &HISImportResult{}
+	}
+	result.Success = false
+	result.Errors = append(result.Errors, ErrEmptyFile.Error())
+	return result, ErrEmptyFile
+}
+
+// setGeneratedPrescriptionNo 設定解析器組成的預設處方序號，並記錄序號供 PrescriptionNoFormatter 使用
+func setGeneratedPrescriptionNo(rx *HISPrescription, no, seq string) {
+	rx.PrescriptionNo = no
+	rx.generatedNo = true
+	rx.noSeq = seq
+}
+
+// parseSelfPayFlag 解析自費註記，欄位缺漏時視為健保申報
+func parseSelfPayFlag(flag string) bool {
+	switch strings.ToUpper(sanitizeField(flag)) {
+	case "Y", "1", "自費", "自付":
+		return true
+	}
+	return false
+}
+
+// calcSelfPayTotal 計算自費項目總金額 (總量 × 單價)
+func calcSelfPayTotal(rxs []HISPrescription) float64 {
+	total := 0.0
+	for _, rx := range rxs {
+		for _, item := range rx.Items {
+			if item.IsSelfPay {
+				total += item.Quantity * item.UnitPrice
+			}
+		}
+	}
+	return total
+}
+
+// CalculateTotal 計算處方總金額 (各項目總量 × 單價加總，含藥事服務費)
+func (rx *HISPrescription) CalculateTotal() float64 {
+	return rx.calculateTotal(true)
+}
+
+// CalculateDrugTotal 計算處方總金額，不含藥事服務費 (醫令類別 9)
+func (rx *HISPrescription) CalculateDrugTotal() float64 {
+	return rx.calculateTotal(false)
+}
+
+func (rx *HISPrescription) calculateTotal(includeServiceFee bool) float64 {
+	total := 0.0
+	for _, item := range rx.Items {
+		if !includeServiceFee && item.OrderType == OrderTypeServiceFee {
+			continue
+		}
+		total += item.Quantity * item.UnitPrice
+	}
+	for _, p := range rx.Procedures {
+		total += p.Points
+	}
+	return total
+}
+
+// fillTotals 未提供總點數的處方 (如 XML) 以項目金額補上，並計算 GrandTotal
+func fillTotals(result *HISImportResult) {
+	result.GrandTotal = 0
+	for i := range result.Prescriptions {
+		rx := &result.Prescriptions[i]
+		if rx.TotalPoints == 0 {
+			rx.TotalPoints = rx.CalculateTotal()
+		}
+		result.GrandTotal += rx.TotalPoints
+	}
+}
+
+// DefaultMaxLineSize 文字檔單行長度上限預設值 (bytes)
+const DefaultMaxLineSize = 10 * 1024 * 1024
+
+// maxLineSize 目前的單行長度上限，0 表示使用預設值
+var maxLineSize atomic.Int64
+
+// SetMaxLineSize 設定文字檔 (CSV/TXT/DAT) 單行長度上限，n <= 0 時恢復預設值
+// 超過上限的行會中止解析並記錄錯誤，而不是靜默截斷
+func SetMaxLineSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	maxLineSize.Store(int64(n))
+}
+
+// getMaxLineSize 取得目前的單行長度上限
+func getMaxLineSize() int {
+	if n := maxLineSize.Load(); n > 0 {
+		return int(n)
+	}
+	return DefaultMaxLineSize
+}
+
+// initialLineBuffer Scanner 初始緩衝區大小 (同 bufio 預設)，遇到長行時自動擴充至單行長度上限
+const initialLineBuffer = 4 * 1024
+
+// newLineScanner 建立套用單行長度上限的逐行 Scanner (預設 bufio 上限僅 64KB)
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	max := getMaxLineSize()
+	initial := initialLineBuffer
+	if max < initial {
+		initial = max
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, initial), max)
+	return scanner
+}
+
+// scanError 將 Scanner 錯誤轉為說明訊息 (lineNum 為最後成功讀取的行號)
+func scanError(err error, lineNum int) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("第 %d 行超過單行長度上限 (%d bytes)，該行之後的資料未匯入", lineNum+1, getMaxLineSize())
+	}
+	return fmt.Errorf("讀取第 %d 行失敗: %w", lineNum+1, err)
+}
+
+// addScanError 逐行讀取中斷時記錄錯誤 (含行號與原因)
+func (r *HISImportResult) addScanError(err error, lineNum int) {
+	summary := scanError(err, lineNum)
+	if summary == nil {
+		return
+	}
+	reason := "讀取失敗"
+	if errors.Is(err, bufio.ErrTooLong) {
+		reason = "超過單行長度上限"
+	}
+	r.addLineError(summary.Error(), lineNum+1, "", "", reason)
+	r.Failed++
+}
+
 // getField 安全取得欄位值
 func getField(fields []string, index int) string {
 	if index >= 0 && index < len(fields) {
@@ -912,9 +2763,15 @@ type InventoryImport struct {
 
 // NHIDrugImport 健保藥品匯入資料
 type NHIDrugImport struct {
-	DrugCode string
-	DrugName string
-	Supplier string
+	DrugCode      string
+	DrugName      string
+	Supplier      string
+	DosageForm    string // 劑型 (錠劑、膠囊劑...)
+	Unit          string // 包裝/規格單位
+	ATCCode       string
+	UnitPrice     float64 // 健保參考價
+	EffectiveFrom string  // 有效起日 YYYY-MM-DD
+	EffectiveTo   string  // 有效迄日 YYYY-MM-DD
 }
 
 // ParsePatientCSV 解析病患 CSV 檔案
@@ -923,21 +2780,16 @@ func ParsePatientCSV(r io.Reader) (*ImportResult, []PatientImport) {
 	result := &ImportResult{Errors: []string{}}
 	var patients []PatientImport
 
-	// 嘗試偵測編碼
+	// 偵測編碼並轉換為 UTF-8
 	content, _ := io.ReadAll(r)
-	var reader io.Reader
-	if detectBig5(content) {
-		reader = transform.NewReader(strings.NewReader(string(content)), traditionalchinese.Big5.NewDecoder())
-	} else {
-		reader = strings.NewReader(string(content))
-	}
+	reader := bytes.NewReader(decodeContent(content, detectEncoding(content)))
 
-	scanner := bufio.NewScanner(reader)
+	scanner := newCSVScanner(reader)
 	lineNo := 0
 
 	for scanner.Scan() {
 		lineNo++
-		line := strings.TrimSpace(scanner.Text())
+		line := sanitizeField(scanner.Text())
 		if line == "" {
 			continue
 		}
@@ -950,19 +2802,19 @@ func ParsePatientCSV(r io.Reader) (*ImportResult, []PatientImport) {
 			continue
 		}
 
-		fields := parseCSVLine(line)
+		fields := parseCSVLine(line, ',')
 		if len(fields) < 2 {
 			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行格式錯誤", lineNo))
 			continue
 		}
 
 		patient := PatientImport{
-			NationalID: strings.TrimSpace(getField(fields, 0)),
-			Name:       strings.TrimSpace(getField(fields, 1)),
-			Birthday:   strings.TrimSpace(getField(fields, 2)),
-			Phone:      strings.TrimSpace(getField(fields, 3)),
-			Address:    strings.TrimSpace(getField(fields, 4)),
-			Notes:      strings.TrimSpace(getField(fields, 5)),
+			NationalID: sanitizeField(getField(fields, 0)),
+			Name:       sanitizeField(getField(fields, 1)),
+			Birthday:   ParseFlexibleDate(getField(fields, 2)),
+			Phone:      sanitizeField(getField(fields, 3)),
+			Address:    sanitizeField(getField(fields, 4)),
+			Notes:      sanitizeField(getField(fields, 5)),
 		}
 
 		if patient.NationalID == "" || patient.Name == "" {
@@ -974,6 +2826,10 @@ func ParsePatientCSV(r io.Reader) (*ImportResult, []PatientImport) {
 		result.Success++
 	}
 
+	if err := scanError(scanner.Err(), lineNo); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
 	return result, patients
 }
 
@@ -983,21 +2839,16 @@ func ParseInventoryCSV(r io.Reader) (*ImportResult, []InventoryImport) {
 	result := &ImportResult{Errors: []string{}}
 	var items []InventoryImport
 
-	// 嘗試偵測編碼
+	// 偵測編碼並轉換為 UTF-8
 	content, _ := io.ReadAll(r)
-	var reader io.Reader
-	if detectBig5(content) {
-		reader = transform.NewReader(strings.NewReader(string(content)), traditionalchinese.Big5.NewDecoder())
-	} else {
-		reader = strings.NewReader(string(content))
-	}
+	reader := bytes.NewReader(decodeContent(content, detectEncoding(content)))
 
-	scanner := bufio.NewScanner(reader)
+	scanner := newCSVScanner(reader)
 	lineNo := 0
 
 	for scanner.Scan() {
 		lineNo++
-		line := strings.TrimSpace(scanner.Text())
+		line := sanitizeField(scanner.Text())
 		if line == "" {
 			continue
 		}
@@ -1010,15 +2861,15 @@ func ParseInventoryCSV(r io.Reader) (*ImportResult, []InventoryImport) {
 			continue
 		}
 
-		fields := parseCSVLine(line)
+		fields := parseCSVLine(line, ',')
 		if len(fields) < 2 {
 			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行格式錯誤", lineNo))
 			continue
 		}
 
 		item := InventoryImport{
-			DrugCode: strings.TrimSpace(getField(fields, 0)),
-			DrugName: strings.TrimSpace(getField(fields, 1)),
+			DrugCode: sanitizeField(getField(fields, 0)),
+			DrugName: sanitizeField(getField(fields, 1)),
 		}
 
 		// 解析數值欄位
@@ -1028,11 +2879,11 @@ func ParseInventoryCSV(r io.Reader) (*ImportResult, []InventoryImport) {
 		if safety := getField(fields, 3); safety != "" {
 			item.MinStock, _ = strconv.ParseFloat(safety, 64)
 		}
-		item.Supplier = strings.TrimSpace(getField(fields, 4))
+		item.Supplier = sanitizeField(getField(fields, 4))
 		if price := getField(fields, 5); price != "" {
 			item.UnitPrice, _ = strconv.ParseFloat(price, 64)
 		}
-		item.Notes = strings.TrimSpace(getField(fields, 6))
+		item.Notes = sanitizeField(getField(fields, 6))
 
 		if item.DrugCode == "" || item.DrugName == "" {
 			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行缺少必要欄位", lineNo))
@@ -1043,52 +2894,66 @@ func ParseInventoryCSV(r io.Reader) (*ImportResult, []InventoryImport) {
 		result.Success++
 	}
 
+	if err := scanError(scanner.Err(), lineNo); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
 	return result, items
 }
 
 // ParseNHIDrugFile 解析健保藥品主檔
-// CSV 欄位順序: 健保碼,藥品名稱,廠商...
+// 有表頭時依欄位名稱對應 (健保碼/藥品名稱/劑型/單位/ATC/參考價/有效起迄日...)，
+// 無表頭時依預設順序: 健保碼,藥品名稱,廠商
 func ParseNHIDrugFile(r io.Reader) (*ImportResult, []NHIDrugImport) {
 	result := &ImportResult{Errors: []string{}}
 	var items []NHIDrugImport
 
-	// 嘗試偵測編碼
 	content, _ := io.ReadAll(r)
-	var reader io.Reader
-	if detectBig5(content) {
-		reader = transform.NewReader(strings.NewReader(string(content)), traditionalchinese.Big5.NewDecoder())
-	} else {
-		reader = strings.NewReader(string(content))
-	}
+	reader := bytes.NewReader(decodeContent(content, detectEncoding(content)))
 
-	scanner := bufio.NewScanner(reader)
+	scanner := newCSVScanner(reader)
 	lineNo := 0
+	var colMap map[string]int
 
 	for scanner.Scan() {
 		lineNo++
-		line := strings.TrimSpace(scanner.Text())
+		line := sanitizeField(scanner.Text())
 		if line == "" {
 			continue
 		}
 
-		result.Total++
+		fields := parseCSVLine(line, ',')
 
-		// 跳過表頭
-		if lineNo == 1 && (strings.Contains(line, "健保碼") || strings.Contains(line, "藥品代碼") || strings.Contains(line, "代碼")) {
-			result.Total--
-			continue
+		// 第一個非空白行決定欄位對應 (表頭需含代碼與名稱欄)
+		if colMap == nil {
+			colMap, _ = buildColumnMapping(fields)
+			_, hasCode := colMap["drug_code"]
+			_, hasName := colMap["drug_name"]
+			if hasCode && hasName {
+				continue
+			}
+			colMap = map[string]int{"drug_code": 0, "drug_name": 1, "supplier": 2}
 		}
 
-		fields := parseCSVLine(line)
+		result.Total++
+
 		if len(fields) < 2 {
 			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行格式錯誤", lineNo))
 			continue
 		}
 
 		item := NHIDrugImport{
-			DrugCode: strings.TrimSpace(getField(fields, 0)),
-			DrugName: strings.TrimSpace(getField(fields, 1)),
-			Supplier: strings.TrimSpace(getField(fields, 2)),
+			DrugCode:      getFieldByKey(fields, colMap, "drug_code"),
+			DrugName:      getFieldByKey(fields, colMap, "drug_name"),
+			Supplier:      getFieldByKey(fields, colMap, "supplier"),
+			DosageForm:    getFieldByKey(fields, colMap, "dosage_form"),
+			Unit:          getFieldByKey(fields, colMap, "unit"),
+			ATCCode:       strings.ToUpper(getFieldByKey(fields, colMap, "atc_code")),
+			EffectiveFrom: convertROCDate(normalizeROCDateTime(getFieldByKey(fields, colMap, "effective_from"))),
+			EffectiveTo:   convertROCDate(normalizeROCDateTime(getFieldByKey(fields, colMap, "effective_to"))),
+		}
+		if price := strings.ReplaceAll(getFieldByKey(fields, colMap, "unit_price"), ",", ""); price != "" {
+			item.UnitPrice, _ = strconv.ParseFloat(price, 64)
 		}
 
 		if item.DrugCode == "" || item.DrugName == "" {
@@ -1100,5 +2965,74 @@ func ParseNHIDrugFile(r io.Reader) (*ImportResult, []NHIDrugImport) {
 		result.Success++
 	}
 
+	if err := scanError(scanner.Err(), lineNo); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
 	return result, items
 }
+
+// BuildDrugLookup 建立健保碼 → 藥品主檔對照 (代碼不分大小寫)
+// 同一藥品有多筆價格期間時，保留有效起日最新的一筆
+func BuildDrugLookup(drugs []NHIDrugImport) map[string]NHIDrugImport {
+	lookup := make(map[string]NHIDrugImport, len(drugs))
+	for _, d := range drugs {
+		code := strings.ToUpper(sanitizeField(d.DrugCode))
+		if code == "" {
+			continue
+		}
+		if existing, ok := lookup[code]; ok && existing.EffectiveFrom > d.EffectiveFrom {
+			continue
+		}
+		lookup[code] = d
+	}
+	return lookup
+}
+
+// EnrichWithDrugMaster 以藥品主檔補齊缺漏的藥名與單價 (健保參考價)，兩者各自判斷是否缺漏
+// 代碼比對忽略前後空白與大小寫；主檔找不到的藥品代碼收集於 UnknownDrugCodes
+func (r *HISImportResult) EnrichWithDrugMaster(lookup map[string]NHIDrugImport) {
+	if r == nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range r.UnknownDrugCodes {
+		seen[code] = true
+	}
+
+	for i := range r.Prescriptions {
+		items := r.Prescriptions[i].Items
+		for j := range items {
+			item := &items[j]
+			if !isDrugItem(*item) || sanitizeField(item.DrugCode) == "" {
+				continue
+			}
+
+			code := strings.ToUpper(sanitizeField(item.DrugCode))
+			drug, ok := lookup[item.DrugCode]
+			if !ok {
+				drug, ok = lookup[code]
+			}
+			if !ok {
+				if !seen[code] {
+					seen[code] = true
+					r.UnknownDrugCodes = append(r.UnknownDrugCodes, code)
+				}
+				continue
+			}
+
+			if item.DrugName == "" {
+				item.DrugName = drug.DrugName
+			}
+			if item.UnitPrice == 0 {
+				item.UnitPrice = drug.UnitPrice
+			}
+		}
+	}
+
+	// 補上單價後重新計算金額與用量統計
+	r.SelfPayTotal = calcSelfPayTotal(r.Prescriptions)
+	fillTotals(r)
+	r.DrugUsages, r.ServiceFees = summarizeUsages(r.Prescriptions)
+}
@@ -0,0 +1,687 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+const genericMappingCSV = "身分證,姓名,藥品代碼,數量,處方號\nA123456789,王小明,AC12345100,28,RX001\n"
+
+func TestParseGenericCSVWithMappingRejectsInvalidMapping(t *testing.T) {
+	tests := []struct {
+		name   string
+		colMap map[string]int
+	}{
+		{"negative index", map[string]int{"national_id": -1}},
+		{"unknown key", map[string]int{"national_id": 0, "nickname": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseGenericCSVWithMapping(strings.NewReader(genericMappingCSV), false, tt.colMap)
+			if !errors.Is(err, ErrInvalidColumnMapping) {
+				t.Fatalf("ParseGenericCSVWithMapping error = %v, want ErrInvalidColumnMapping", err)
+			}
+			_, err = ParseWithOptions(strings.NewReader(genericMappingCSV), "data.csv", VendorGeneric, WithColumnMapping(tt.colMap))
+			if !errors.Is(err, ErrInvalidColumnMapping) {
+				t.Fatalf("ParseWithOptions error = %v, want ErrInvalidColumnMapping", err)
+			}
+		})
+	}
+}
+
+func TestParseGenericCSVWithMappingOutOfRangeIndex(t *testing.T) {
+	colMap := map[string]int{"national_id": 0, "drug_code": 2, "quantity": 3, "prescription_no": 4, "name": 99}
+	result, err := ParseGenericCSVWithMapping(strings.NewReader(genericMappingCSV), false, colMap)
+	if err != nil {
+		t.Fatalf("ParseGenericCSVWithMapping: %v", err)
+	}
+	if len(result.Patients) != 1 || result.Patients[0].Name != "" {
+		t.Fatalf("patients = %+v, want one patient with empty name", result.Patients)
+	}
+	if len(result.Prescriptions) != 1 || result.Prescriptions[0].Items[0].Quantity != 28 {
+		t.Fatalf("prescriptions = %+v, want one prescription with quantity 28", result.Prescriptions)
+	}
+}
+
+func TestGetFieldByKeyNegativeIndex(t *testing.T) {
+	if got := getFieldByKey([]string{"a", "b"}, map[string]int{"x": -1}, "x"); got != "" {
+		t.Fatalf("getFieldByKey = %q, want empty", got)
+	}
+}
+
+func TestParseFlexibleDate(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"0740101", "1985-01-01"},
+		{"740101", "1985-01-01"},
+		{"19850101", "1985-01-01"},
+		{"1130105103000", "2024-01-05"},
+		{"20240105103000", "2024-01-05"},
+		{"1985/1/1", "1985-01-01"},
+		{"74-01-01", "1985-01-01"},
+		{"112.01.01", "2023-01-01"},
+		{"2024-01-05 10:30", "2024-01-05"},
+		{"01/02/1985", ""},
+		{"12345", ""},
+		{"99999", ""},
+		{"31048", ""},
+		{"1130230", ""},
+		{"abc", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ParseFlexibleDate(tt.in); got != tt.want {
+			t.Errorf("ParseFlexibleDate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExcelSerialDate(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"31048", "1985-01-01"},
+		{"31048.5", "1985-01-01"},
+		{"45296", "2024-01-05"},
+		{"99999", ""},
+		{"09999", ""},
+		{"1985-01-01", ""},
+		{"3104", ""},
+	}
+	for _, tt := range tests {
+		if got := excelSerialDate(tt.in); got != tt.want {
+			t.Errorf("excelSerialDate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestConvertROCDate(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1130229", "2024-02-29"}, // 民國 113 年為閏年
+		{"1120229", ""},           // 民國 112 年非閏年
+		{"0991231", "2010-12-31"},
+		{"1000101", "2011-01-01"},
+		{"991231", "2010-12-31"},
+		{"00991231", "2010-12-31"},
+		{"01000101", "2011-01-01"},
+		{"20240229", "2024-02-29"},
+		{"20230229", ""},
+		{"1130001", ""},
+		{"1130100", ""},
+	}
+	for _, tt := range tests {
+		if got := convertROCDate(tt.in); got != tt.want {
+			t.Errorf("convertROCDate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDetectChronicPrescription(t *testing.T) {
+	tests := []struct {
+		name        string
+		rx          HISPrescription
+		wantChronic bool
+		wantNo      int
+		wantTotal   int
+	}{
+		{"IC02 without total", HISPrescription{VisitSequence: "IC02"}, true, 2, 0},
+		{"IC03 with d37 total", HISPrescription{VisitSequence: "IC03", TotalRefills: 3}, true, 3, 3},
+		{"total below current refill", HISPrescription{VisitSequence: "IC03", TotalRefills: 2}, true, 3, 3},
+		{"d37 total only", HISPrescription{VisitSequence: "0007", TotalRefills: 2}, true, 1, 2},
+		{"AF short course", HISPrescription{VisitType: "AF", Items: []HISPrescriptionItem{{DaysSupply: 7}}}, false, 0, 0},
+		{"AF 28 days", HISPrescription{VisitType: "AF", Items: []HISPrescriptionItem{{DaysSupply: 28}}}, true, 1, 0},
+		{"IC01 alone", HISPrescription{VisitSequence: "IC01"}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chronic, no, total := DetectChronicPrescription(&tt.rx)
+			if chronic != tt.wantChronic || no != tt.wantNo || total != tt.wantTotal {
+				t.Fatalf("DetectChronicPrescription = (%v, %d, %d), want (%v, %d, %d)",
+					chronic, no, total, tt.wantChronic, tt.wantNo, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestChronicPrescriptionFixtures(t *testing.T) {
+	type want struct {
+		refillNo, total int
+	}
+	tests := []struct {
+		file   string
+		vendor HISVendor
+		want   map[string]want // key: 身分證 + 就醫序號
+	}{
+		{"chronic_nhi.xml", VendorNHI, map[string]want{
+			"A123456789 IC02": {2, 0},
+			"A123456789 IC03": {3, 0},
+			"B223456782 0005": {0, 0}, // AF 短天數不是慢箋
+			"C123456781 IC01": {1, 0}, // AF 28 天
+		}},
+		{"chronic_drmaster.xml", VendorDrMaster, map[string]want{
+			"A123456789 IC02": {2, 3},
+			"B223456782 0007": {1, 2}, // 僅 d37 連處總次數
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			result := parseTestdata(t, tt.file, tt.vendor)
+			if len(result.Prescriptions) != len(tt.want) {
+				t.Fatalf("got %d prescriptions, want %d", len(result.Prescriptions), len(tt.want))
+			}
+			for _, rx := range result.Prescriptions {
+				key := rx.PatientID + " " + rx.VisitSequence
+				w, ok := tt.want[key]
+				if !ok {
+					t.Fatalf("unexpected prescription %s", key)
+				}
+				if rx.ChronicRefillNo != w.refillNo || rx.TotalRefills != w.total {
+					t.Errorf("%s: refill %d/%d, want %d/%d", key, rx.ChronicRefillNo, rx.TotalRefills, w.refillNo, w.total)
+				}
+			}
+		})
+	}
+}
+
+func TestSelfPayItemsFixture(t *testing.T) {
+	result := parseTestdata(t, "selfpay_nhi.xml", VendorNHI)
+	if len(result.Prescriptions) != 1 {
+		t.Fatalf("got %d prescriptions, want 1 (errors %q)", len(result.Prescriptions), result.Errors)
+	}
+	want := map[string]bool{"AC12345100": false, "SP0001": true, "BC23456100": false, "SP0002": true}
+	items := result.Prescriptions[0].Items
+	if len(items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(items), len(want))
+	}
+	for _, item := range items {
+		if item.IsSelfPay != want[item.DrugCode] {
+			t.Errorf("%s: IsSelfPay = %v, want %v", item.DrugCode, item.IsSelfPay, want[item.DrugCode])
+		}
+	}
+	if result.SelfPayTotal != 350 { // 2 × 150 + 1 × 50
+		t.Errorf("SelfPayTotal = %v, want 350", result.SelfPayTotal)
+	}
+}
+
+func TestVisitIDFixture(t *testing.T) {
+	result := parseTestdata(t, "visitid_nhi.xml", VendorNHI)
+	want := map[string]struct {
+		no       string
+		refillNo int
+	}{
+		"A123456789": {"1101010010-2024-01-05-V1130105000123", 0}, // A54 優先於 A18
+		"B223456782": {"1101010010-2024-01-05-0002", 0},           // A54 空白時退回 A18
+		"C123456781": {"1101010010-2024-02-03-V1130203000456", 2}, // 僅 A54，慢箋次數取 d36
+	}
+	if len(result.Prescriptions) != len(want) {
+		t.Fatalf("got %d prescriptions, want %d (errors %q)", len(result.Prescriptions), len(want), result.Errors)
+	}
+	for _, rx := range result.Prescriptions {
+		w := want[rx.PatientID]
+		if rx.PrescriptionNo != w.no || rx.ChronicRefillNo != w.refillNo {
+			t.Errorf("%s: no %q refill %d, want %q refill %d", rx.PatientID, rx.PrescriptionNo, rx.ChronicRefillNo, w.no, w.refillNo)
+		}
+	}
+}
+
+func TestYaoshengSlashDateFixture(t *testing.T) {
+	result := parseTestdata(t, "yaosheng_slash.xml", VendorYaosheng)
+	if len(result.Prescriptions) != 1 || len(result.Patients) != 1 {
+		t.Fatalf("prescriptions/patients = %d/%d, want 1/1 (errors %q)", len(result.Prescriptions), len(result.Patients), result.Errors)
+	}
+	rx := result.Prescriptions[0]
+	if rx.DispenseDate != "2024-01-05" || rx.DispenseTime != "08:30:00" {
+		t.Errorf("dispense = %q %q, want 2024-01-05 08:30:00", rx.DispenseDate, rx.DispenseTime)
+	}
+	if got := result.Patients[0].Birthday; got != "1985-01-01" {
+		t.Errorf("birthday = %q, want 1985-01-01", got)
+	}
+}
+
+func TestParseWithMaxRecords(t *testing.T) {
+	selfPay := strings.Replace(strings.Replace(nhiXMLRec, "<A18>0001</A18>", "<A18>0002</A18>", 1),
+		"<d27>7</d27>", "<p8>10</p8><p10>Y</p10><d27>7</d27>", 1)
+	content := "<RECS>" + nhiXMLRec + selfPay + "</RECS>"
+
+	full, err := ParseWithOptions(strings.NewReader(content), "upload.xml", VendorNHI)
+	if err != nil {
+		t.Fatalf("ParseWithOptions: %v", err)
+	}
+	if full.SelfPayTotal != 210 {
+		t.Fatalf("SelfPayTotal = %v, want 210 without a limit", full.SelfPayTotal)
+	}
+
+	result, err := ParseWithOptions(strings.NewReader(content), "upload.xml", VendorNHI, WithMaxRecords(1))
+	if err != nil {
+		t.Fatalf("ParseWithOptions: %v", err)
+	}
+	if len(result.Prescriptions) != 1 || result.Skipped != 1 {
+		t.Fatalf("prescriptions/skipped = %d/%d, want 1/1", len(result.Prescriptions), result.Skipped)
+	}
+	if result.SelfPayTotal != 0 {
+		t.Errorf("SelfPayTotal = %v, want 0 after dropping the self-pay prescription", result.SelfPayTotal)
+	}
+	if len(result.DrugUsages) != 2 || result.DrugUsages[1].DispenseCount != 1 {
+		t.Errorf("DrugUsages = %+v, want the kept prescription only", result.DrugUsages)
+	}
+}
+
+// parseTestdata 以 ParseWithOptions 解析 testdata 下的檔案
+func parseTestdata(t *testing.T, name string, vendor HISVendor, opts ...ParseOption) *HISImportResult {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	result, err := ParseWithOptions(f, name, vendor, opts...)
+	if err != nil {
+		t.Fatalf("ParseWithOptions(%s): %v", name, err)
+	}
+	return result
+}
+
+// nhiXMLRec 健保上傳 XML 的單筆 REC (約 400 bytes)
+const nhiXMLRec = `<REC>
+<MSH><h1>5912345678</h1></MSH>
+<MB1><A12>A123456789</A12><A14>1101010010</A14><A17>1130105103000</A17><A18>0001</A18><A23>01</A23></MB1>
+<MB2><p1>1</p1><p2>AC12345100</p2><p3>Amlodipine 5mg</p3><p5>QD</p5><p7>28</p7><d27>28</d27></MB2>
+<MB2><p1>1</p1><p2>BC23456100</p2><p3>Acetaminophen 500mg</p3><p5>TID</p5><p7>21</p7><d27>7</d27></MB2>
+</REC>
+`
+
+// nhiXMLReader 依序輸出 XML 宣告、n 筆 REC 與 </RECS>，模擬大型上傳檔而不預先配置整份內容
+type nhiXMLReader struct {
+	n    int
+	cur  string
+	done bool
+}
+
+func newNHIXMLReader(size int) *nhiXMLReader {
+	return &nhiXMLReader{n: size / len(nhiXMLRec), cur: "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<RECS>\n"}
+}
+
+func (r *nhiXMLReader) Read(p []byte) (int, error) {
+	for r.cur == "" {
+		switch {
+		case r.n > 0:
+			r.cur = nhiXMLRec
+			r.n--
+		case !r.done:
+			r.cur, r.done = "</RECS>\n", true
+		default:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// BenchmarkParseNHIUploadXMLLarge 解析約 100MB 的上傳 XML，逐筆串流讀取 REC，配置量不含整份檔案的複本
+func BenchmarkParseNHIUploadXMLLarge(b *testing.B) {
+	const size = 100 << 20
+	b.ReportAllocs()
+	b.SetBytes(size)
+	for i := 0; i < b.N; i++ {
+		result, err := ParseNHIUploadXML(newNHIXMLReader(size), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if result.Imported == 0 {
+			b.Fatal("no prescriptions imported")
+		}
+	}
+}
+
+func TestParseTruncatedREC(t *testing.T) {
+	// 各筆使用不同的就醫序號，避免被視為同一處方合併
+	rec := func(seq string) string { return strings.Replace(nhiXMLRec, "<A18>0001</A18>", "<A18>"+seq+"</A18>", 1) }
+	r1, r2, r3 := rec("0001"), rec("0002"), rec("0003")
+	tests := []struct {
+		name         string
+		content      string
+		wantTotal    int
+		wantImported int
+		wantFailed   int
+		wantWarnings int
+	}{
+		{"cut inside tag", "<RECS>" + r1 + r2[:45] + r3 + "</RECS>", 3, 2, 1, 0},
+		{"cut inside end tag", "<RECS>" + r1 + r2[:60] + r3 + "</RECS>", 3, 2, 1, 0},
+		{"missing </REC>", "<RECS>" + r1 + strings.TrimSuffix(r2, "</REC>\n") + r3 + "</RECS>", 3, 3, 0, 1},
+		{"missing </REC> before </RECS>", "<RECS>" + r1 + strings.TrimSuffix(r2, "</REC>\n") + "</RECS>", 2, 2, 0, 1},
+		{"cut at end of file", "<RECS>" + r1 + r2 + r3[:45], 3, 2, 1, 0},
+	}
+	for _, vendor := range []HISVendor{VendorNHI, VendorDrMaster, VendorVision} {
+		for _, tt := range tests {
+			t.Run(string(vendor)+"/"+tt.name, func(t *testing.T) {
+				result, err := ParseWithOptions(strings.NewReader(tt.content), "upload.xml", vendor)
+				if err != nil {
+					t.Fatalf("ParseWithOptions: %v", err)
+				}
+				if result.Total != tt.wantTotal || result.Imported != tt.wantImported || result.Failed != tt.wantFailed {
+					t.Errorf("total/imported/failed = %d/%d/%d, want %d/%d/%d (errors %q)",
+						result.Total, result.Imported, result.Failed, tt.wantTotal, tt.wantImported, tt.wantFailed, result.Errors)
+				}
+				if len(result.Warnings) != tt.wantWarnings {
+					t.Errorf("warnings = %q, want %d", result.Warnings, tt.wantWarnings)
+				}
+			})
+		}
+	}
+}
+
+func TestParseNHIUploadXMLWrapped(t *testing.T) {
+	recs := "<RECS>" + nhiXMLRec + strings.Replace(nhiXMLRec, "<A18>0001</A18>", "<A18>0002</A18>", 1) + "</RECS>"
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"cdata", `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><Upload><![CDATA[` + recs + `]]></Upload></soap:Body></soap:Envelope>`},
+		{"html escaped", `<Upload>` + html.EscapeString(recs) + `</Upload>`},
+		{"escaped twice", `<Upload>` + html.EscapeString(html.EscapeString(recs)) + `</Upload>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseNHIUploadXML(strings.NewReader(tt.content), false)
+			if err != nil {
+				t.Fatalf("ParseNHIUploadXML: %v", err)
+			}
+			if result.Total != 2 || result.Imported != 2 {
+				t.Errorf("total/imported = %d/%d, want 2/2 (errors %q)", result.Total, result.Imported, result.Errors)
+			}
+		})
+	}
+}
+
+func TestParseHISFileBig5ClaimWithBOM(t *testing.T) {
+	claim := "T,1101010010,11301,1\r\n" +
+		"D,01,0001,1130105,A123456789,王小明,,,,,\r\n" +
+		"P,1,AC12345100,脈優錠,,,,28,2.5\r\n"
+	encoded, err := traditionalchinese.Big5.NewEncoder().String(claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := append([]byte("\xEF\xBB\xBF \r\n"), encoded...)
+
+	result, err := ParseHISFile(bytes.NewReader(content), "claim.csv")
+	if err != nil {
+		t.Fatalf("ParseHISFile: %v", err)
+	}
+	if result.SourceType != "csv" || result.SourceVendor != "nhi" {
+		t.Fatalf("source = %s/%s, want csv/nhi (claim CSV)", result.SourceType, result.SourceVendor)
+	}
+	if len(result.Prescriptions) != 1 {
+		t.Fatalf("got %d prescriptions, want 1 (errors %q)", len(result.Prescriptions), result.Errors)
+	}
+	rx := result.Prescriptions[0]
+	if rx.PatientID != "A123456789" || len(rx.Items) != 1 || rx.Items[0].DrugName != "脈優錠" {
+		t.Errorf("prescription = %+v, want A123456789 with 脈優錠", rx)
+	}
+}
+
+func TestIsBlankContent(t *testing.T) {
+	big5, err := traditionalchinese.Big5.NewEncoder().String("  王小明")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"empty", "", true},
+		{"whitespace", " \t\r\n", true},
+		{"bom and zero width", "\xEF\xBB\xBF\u200B\u3000\r\n", true},
+		{"utf-16le blank", "\xFF\xFE \x00\r\x00\n\x00", true},
+		{"utf-16le text", "\xFF\xFE \x00A\x00", false},
+		{"big5 text", big5, false},
+		{"text after blanks", "\xEF\xBB\xBF \n x", false},
+	}
+	for _, tt := range tests {
+		if got := isBlankContent([]byte(tt.content), newParseOptions()); got != tt.want {
+			t.Errorf("isBlankContent(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := ParseWithOptions(strings.NewReader("\xEF\xBB\xBF\u200B \r\n"), "data.csv", VendorAuto); !errors.Is(err, ErrEmptyFile) {
+		t.Errorf("ParseWithOptions(blank) error = %v, want ErrEmptyFile", err)
+	}
+}
+
+func TestParseNHIClaimCSVLongLine(t *testing.T) {
+	long := strings.Repeat("備註", 40*1024) // 單行超過 bufio 預設的 64KB
+	claim := "T,1101010010,11301,1\n" +
+		"D,01,0001,1130105,A123456789," + long + ",,,,,\n" +
+		"P,1,AC12345100,脈優錠,,,,28,2.5\n"
+
+	result, err := ParseNHIClaimCSV(strings.NewReader(claim), false)
+	if err != nil {
+		t.Fatalf("ParseNHIClaimCSV: %v", err)
+	}
+	if len(result.Prescriptions) != 1 || len(result.Prescriptions[0].Items) != 1 {
+		t.Fatalf("prescriptions = %d, want 1 with its item (errors %q)", len(result.Prescriptions), result.Errors)
+	}
+	if result.Claim == nil || len(result.Claim.Claims) != 1 || result.Claim.Claims[0].D5 != long {
+		t.Error("long field was truncated")
+	}
+}
+
+func TestParseDetailedErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		filename string
+		vendor   HISVendor
+		want     ParseError
+	}{
+		{
+			name:     "generic row missing id",
+			content:  genericMappingCSV + ",李小華,BC23456100,7,RX002\n",
+			filename: "data.csv",
+			vendor:   VendorGeneric,
+			want:     ParseError{LineNum: 3, RawLine: ",李小華,BC23456100,7,RX002", Field: "身分證", Reason: "缺少必要欄位"},
+		},
+		{
+			name:     "damaged REC",
+			content:  "<RECS>" + nhiXMLRec + nhiXMLRec[:45] + nhiXMLRec + "</RECS>",
+			filename: "upload.xml",
+			vendor:   VendorNHI,
+			want:     ParseError{LineNum: 2, Reason: "XML 損壞"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseWithOptions(strings.NewReader(tt.content), tt.filename, tt.vendor)
+			if err != nil {
+				t.Fatalf("ParseWithOptions: %v", err)
+			}
+			if result.Failed != 1 || len(result.DetailedErrors) != 1 || len(result.Errors) != 1 {
+				t.Fatalf("failed = %d, detailed errors = %+v, want one (errors %q)", result.Failed, result.DetailedErrors, result.Errors)
+			}
+			got := result.DetailedErrors[0]
+			if tt.want.RawLine == "" && got.RawLine != "" {
+				got.RawLine = "" // 損壞 REC 的原始內容僅確認有記錄
+			} else if tt.want.RawLine == "" {
+				t.Error("RawLine is empty, want the damaged REC")
+			}
+			if got != tt.want {
+				t.Errorf("DetailedErrors[0] = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNHIUploadXMLSplitRecords(t *testing.T) {
+	rec := func(points, code string) string {
+		return `<REC><MB1><A12>A123456789</A12><A14>1101010010</A14><A17>1130105103000</A17><A18>0001</A18><A23>01</A23><d35>` + points +
+			`</d35></MB1><MB2><p1>1</p1><p2>` + code + `</p2><p7>28</p7><d27>28</d27></MB2></REC>`
+	}
+	tests := []struct {
+		name       string
+		content    string
+		wantPoints float64
+		wantItems  int
+	}{
+		{"split", "<RECS>" + rec("100", "AC12345100") + rec("50", "BC23456100") + "</RECS>", 150, 2},
+		{"duplicate", "<RECS>" + rec("100", "AC12345100") + rec("100", "AC12345100") + "</RECS>", 100, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseNHIUploadXML(strings.NewReader(tt.content), false)
+			if err != nil {
+				t.Fatalf("ParseNHIUploadXML: %v", err)
+			}
+			if len(result.Prescriptions) != 1 || result.Total != 1 || result.Imported != 1 {
+				t.Fatalf("prescriptions/total/imported = %d/%d/%d, want 1/1/1", len(result.Prescriptions), result.Total, result.Imported)
+			}
+			rx := result.Prescriptions[0]
+			if rx.TotalPoints != tt.wantPoints || len(rx.Items) != tt.wantItems {
+				t.Errorf("TotalPoints/items = %v/%d, want %v/%d", rx.TotalPoints, len(rx.Items), tt.wantPoints, tt.wantItems)
+			}
+		})
+	}
+}
+
+func TestParseWithProgress(t *testing.T) {
+	var calls [][2]int
+	progress := WithProgress(1, func(done, total int) { calls = append(calls, [2]int{done, total}) })
+	result, err := ParseWithOptions(strings.NewReader(genericMappingCSV), "data.csv", VendorGeneric, progress)
+	if err != nil {
+		t.Fatalf("ParseWithOptions: %v", err)
+	}
+	if len(calls) == 0 || calls[len(calls)-1] != [2]int{result.Total, result.Total} {
+		t.Errorf("progress calls = %v, want last %d/%d", calls, result.Total, result.Total)
+	}
+}
+
+func TestParseWithMergeItemsResummarizes(t *testing.T) {
+	mb2 := `<MB2><p1>1</p1><p2>AC12345100</p2><p7>14</p7><d27>14</d27></MB2>`
+	content := `<RECS><REC><MB1><A12>A123456789</A12><A14>1101010010</A14><A17>1130105103000</A17><A18>IC02</A18><A23>08</A23></MB1>` +
+		mb2 + mb2 + `</REC></RECS>`
+
+	result, err := ParseWithOptions(strings.NewReader(content), "upload.xml", VendorNHI, WithMergeItems(true))
+	if err != nil {
+		t.Fatalf("ParseWithOptions: %v", err)
+	}
+	if len(result.Prescriptions) != 1 || len(result.Prescriptions[0].Items) != 1 {
+		t.Fatalf("prescriptions = %+v, want one with a merged item", result.Prescriptions)
+	}
+	if len(result.DrugUsages) != 1 || result.DrugUsages[0].DispenseCount != 1 || result.DrugUsages[0].TotalQty != 28 {
+		t.Errorf("DrugUsages = %+v, want AC12345100 dispensed once with 28", result.DrugUsages)
+	}
+}
+
+func TestBuildColumnMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    map[string]int
+	}{
+		{"longer alias wins", []string{"ATC CODE", "藥品代碼"}, map[string]int{"atc_code": 0, "drug_code": 1}},
+		{"birthday is not days", []string{"birthday", "days"}, map[string]int{"birthday": 0, "days": 1}},
+		{"start date is not visit date", []string{"start_date", "end_date"}, map[string]int{"effective_from": 0, "effective_to": 1}},
+		{"unrelated aliases both map", []string{"姓名電話"}, map[string]int{"name": 0, "phone": 0}},
+		{"exact header beats ambiguous", []string{"姓名電話", "電話"}, map[string]int{"name": 0, "phone": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := buildColumnMapping(tt.headers)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildColumnMapping(%q) = %v, want %v", tt.headers, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnrichWithDrugMaster(t *testing.T) {
+	result := &HISImportResult{Prescriptions: []HISPrescription{{
+		PatientID: "A123456789",
+		Items: []HISPrescriptionItem{
+			{OrderType: OrderTypeDrug, DrugCode: "ac12345100 ", Quantity: 28},
+			{OrderType: OrderTypeDrug, DrugCode: "BC23456100", DrugName: "普拿疼", Quantity: 10},
+			{OrderType: OrderTypeDrug, DrugCode: "XX00000000", Quantity: 1},
+		},
+	}}}
+	result.EnrichWithDrugMaster(BuildDrugLookup([]NHIDrugImport{
+		{DrugCode: "AC12345100", DrugName: "脈優錠", UnitPrice: 2.5},
+		{DrugCode: "BC23456100", DrugName: "Acetaminophen", UnitPrice: 1.5},
+	}))
+
+	items := result.Prescriptions[0].Items
+	if items[0].DrugName != "脈優錠" || items[0].UnitPrice != 2.5 {
+		t.Errorf("item 0 = %q %v, want name and price from master", items[0].DrugName, items[0].UnitPrice)
+	}
+	if items[1].DrugName != "普拿疼" || items[1].UnitPrice != 1.5 {
+		t.Errorf("item 1 = %q %v, want original name with price from master", items[1].DrugName, items[1].UnitPrice)
+	}
+	if !reflect.DeepEqual(result.UnknownDrugCodes, []string{"XX00000000"}) {
+		t.Errorf("UnknownDrugCodes = %q, want [XX00000000]", result.UnknownDrugCodes)
+	}
+}
+
+func TestNonNHIDrugCodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      string
+		wantError bool
+	}{
+		{"in-house code is a warning", "ABC001", false},
+		{"chinese is an error", "院內001", true},
+		{"full-width digit is an error", "AC12345１00", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "身分證,姓名,藥品代碼,數量,處方號\nA123456789,王小明," + tt.code + ",28,RX001\n"
+			result, err := ParseWithOptions(strings.NewReader(content), "data.csv", VendorGeneric)
+			if err != nil {
+				t.Fatalf("ParseWithOptions: %v", err)
+			}
+			reported := result.Warnings
+			if tt.wantError {
+				reported = result.Errors
+			} else if len(result.Errors) != 0 {
+				t.Errorf("errors = %q, want none", result.Errors)
+			}
+			found := false
+			for _, msg := range reported {
+				found = found || strings.Contains(msg, tt.code)
+			}
+			if !found {
+				t.Errorf("errors = %q, warnings = %q, want %s reported", result.Errors, result.Warnings, tt.code)
+			}
+		})
+	}
+}
+
+func TestConsolidateItems(t *testing.T) {
+	rx := HISPrescription{Items: []HISPrescriptionItem{
+		{OrderType: OrderTypeDrug, DrugCode: "AC12345100", Frequency: "QD", Quantity: 14, DaysSupply: 14},
+		{OrderType: OrderTypeDrug, DrugCode: "BC23456100", Frequency: "TID", Quantity: 21, DaysSupply: 7},
+		{OrderType: OrderTypeDrug, DrugCode: "ac12345100", Frequency: "qd", Quantity: 14, DaysSupply: 28, UnitPrice: 2.5},
+		{OrderType: OrderTypeDrug, DrugCode: "AC12345100", Frequency: "BID", Quantity: 28, DaysSupply: 14},
+	}}
+	rx.ConsolidateItems()
+
+	if len(rx.Items) != 3 {
+		t.Fatalf("items = %+v, want 3", rx.Items)
+	}
+	first := rx.Items[0]
+	if first.Quantity != 28 || first.DaysSupply != 28 || first.UnitPrice != 2.5 {
+		t.Errorf("consolidated item = %+v, want quantity 28, days 28, price 2.5", first)
+	}
+	if rx.Items[1].DrugCode != "BC23456100" || rx.Items[2].Frequency != "BID" {
+		t.Errorf("items = %+v, want first-seen order with BID kept separate", rx.Items)
+	}
+}
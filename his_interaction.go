@@ -0,0 +1,129 @@
+// Package parser 藥品交互作用標記
+// 只定義查詢介面，交互作用資料由使用者自備 (CSV 或自行實作 InteractionChecker)
+package parser
+
+import (
+	"io"
+	"strings"
+)
+
+// 交互作用嚴重度 (自備清單可使用其他文字)
+const (
+	InteractionMajor    = "major"    // 嚴重，應避免併用
+	InteractionModerate = "moderate" // 中度，需監測
+	InteractionMinor    = "minor"    // 輕微
+)
+
+// Interaction 兩個藥品間的交互作用
+type Interaction struct {
+	DrugCodeA   string `json:"drug_code_a"`
+	DrugNameA   string `json:"drug_name_a,omitempty"`
+	DrugCodeB   string `json:"drug_code_b"`
+	DrugNameB   string `json:"drug_name_b,omitempty"`
+	Severity    string `json:"severity"`    // 嚴重度 (見 Interaction 常數)
+	Description string `json:"description"` // 說明
+}
+
+// InteractionChecker 藥品交互作用查詢介面
+// Check 以兩個健保藥品代碼查詢，順序不影響結果；無交互作用時回傳 false
+type InteractionChecker interface {
+	Check(codeA, codeB string) (Interaction, bool)
+}
+
+// MapInteractionChecker 以記憶體對照表實作的交互作用查詢
+type MapInteractionChecker struct {
+	pairs map[[2]string]Interaction
+}
+
+// NewMapInteractionChecker 建立空的交互作用對照表
+func NewMapInteractionChecker() *MapInteractionChecker {
+	return &MapInteractionChecker{pairs: make(map[[2]string]Interaction)}
+}
+
+// interactionKey 正規化藥品代碼並排序，使 A-B 與 B-A 對應同一筆
+func interactionKey(codeA, codeB string) [2]string {
+	a := strings.ToUpper(sanitizeField(codeA))
+	b := strings.ToUpper(sanitizeField(codeB))
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// Add 新增一筆交互作用，重複的藥品組合以後者為準
+func (m *MapInteractionChecker) Add(codeA, codeB, severity, description string) {
+	key := interactionKey(codeA, codeB)
+	if key[0] == "" || key[1] == "" || key[0] == key[1] {
+		return
+	}
+	m.pairs[key] = Interaction{
+		DrugCodeA:   key[0],
+		DrugCodeB:   key[1],
+		Severity:    strings.ToLower(sanitizeField(severity)),
+		Description: sanitizeField(description),
+	}
+}
+
+// Len 對照表筆數
+func (m *MapInteractionChecker) Len() int {
+	return len(m.pairs)
+}
+
+// Check 實作 InteractionChecker
+func (m *MapInteractionChecker) Check(codeA, codeB string) (Interaction, bool) {
+	interaction, ok := m.pairs[interactionKey(codeA, codeB)]
+	return interaction, ok
+}
+
+// LoadInteractionsCSV 從 CSV 載入交互作用清單 (欄位: 藥品代碼A,藥品代碼B,嚴重度,說明)，可含表頭
+func LoadInteractionsCSV(r io.Reader) (*MapInteractionChecker, error) {
+	checker := NewMapInteractionChecker()
+	scanner := newCSVScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields := parseCSVLine(sanitizeField(scanner.Text()), ',')
+		if len(fields) < 2 {
+			continue
+		}
+		// 略過表頭
+		if lineNum == 1 && (strings.Contains(fields[0], "藥品") || strings.Contains(strings.ToLower(fields[0]), "code")) {
+			continue
+		}
+		checker.Add(fields[0], fields[1], getField(fields, 2), getField(fields, 3))
+	}
+	return checker, scanError(scanner.Err(), lineNum)
+}
+
+// CheckInteractions 以藥品代碼兩兩查詢同一處方內的交互作用 (僅藥品醫令)
+// 回傳順序依藥品在處方中出現的順序
+func (rx *HISPrescription) CheckInteractions(checker InteractionChecker) []Interaction {
+	if checker == nil {
+		return nil
+	}
+
+	var drugs []HISPrescriptionItem
+	seen := make(map[string]bool)
+	for _, item := range rx.Items {
+		code := strings.ToUpper(item.DrugCode)
+		if !isDrugItem(item) || code == "" || seen[code] {
+			continue
+		}
+		seen[code] = true
+		drugs = append(drugs, item)
+	}
+
+	var interactions []Interaction
+	for i := 0; i < len(drugs); i++ {
+		for j := i + 1; j < len(drugs); j++ {
+			interaction, ok := checker.Check(drugs[i].DrugCode, drugs[j].DrugCode)
+			if !ok {
+				continue
+			}
+			interaction.DrugCodeA, interaction.DrugNameA = drugs[i].DrugCode, drugs[i].DrugName
+			interaction.DrugCodeB, interaction.DrugNameB = drugs[j].DrugCode, drugs[j].DrugName
+			interactions = append(interactions, interaction)
+		}
+	}
+	return interactions
+}
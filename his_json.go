@@ -0,0 +1,185 @@
+// Package parser JSON 輸出
+// 依輸出選項挑選區段、遮蔽個資並省略空欄位，供 BI 等外部系統只取需要的資料
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// JSON 輸出區段 (基本統計欄位如 success、total 一律輸出)
+const (
+	SectionPatients      = "patients"      // 病患列表
+	SectionPrescriptions = "prescriptions" // 處方明細
+	SectionUsage         = "usage"         // 藥品使用統計、藥事服務費與未知藥品代碼
+	SectionErrors        = "errors"        // 錯誤與警告
+	SectionClaim         = "claim"         // 費用申報原始段別
+	SectionSummary       = "summary"       // 統計摘要 (見 Summary)
+)
+
+// OutputOptions JSON 輸出選項 (零值輸出所有區段且不遮蔽)
+type OutputOptions struct {
+	Sections     []string // 要輸出的區段 (見 Section 常數)，空為全部
+	OmitPatients bool     // 不輸出病患列表 (優先於 Sections)
+	Mask         MaskMode // 身分證號與電話的遮蔽模式
+	OmitEmpty    bool     // 省略空字串、零值、false 與空陣列欄位
+	Page         int      // 處方分頁頁碼 (1 起算)，0 為不分頁
+	PageSize     int      // 每頁處方筆數，Page > 0 時必須大於 0
+}
+
+// PageInfo 處方分頁資訊
+type PageInfo struct {
+	Page       int `json:"page"`        // 目前頁碼 (1 起算)
+	PageSize   int `json:"size"`        // 每頁筆數
+	TotalItems int `json:"total"`       // 處方總筆數
+	TotalPages int `json:"total_pages"` // 總頁數
+}
+
+// NewPageInfo 計算分頁資訊；超出範圍的頁碼保留原值 (該頁為空)
+func NewPageInfo(totalItems, page, pageSize int) PageInfo {
+	info := PageInfo{Page: page, PageSize: pageSize, TotalItems: totalItems}
+	if pageSize > 0 {
+		info.TotalPages = (totalItems + pageSize - 1) / pageSize
+	}
+	return info
+}
+
+// bounds 回傳該頁在處方列表中的起訖索引
+func (p PageInfo) bounds() (start, end int) {
+	start = (p.Page - 1) * p.PageSize
+	if start > p.TotalItems {
+		start = p.TotalItems
+	}
+	end = start + p.PageSize
+	if end > p.TotalItems {
+		end = p.TotalItems
+	}
+	return start, end
+}
+
+// ParseSections 解析以逗號分隔的區段名稱 (如 "usage,prescriptions")，未知名稱回傳錯誤
+func ParseSections(s string) ([]string, error) {
+	var sections []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		switch name {
+		case SectionPatients, SectionPrescriptions, SectionUsage, SectionErrors, SectionClaim, SectionSummary:
+			sections = append(sections, name)
+		default:
+			return nil, fmt.Errorf("未知的輸出區段: %s", name)
+		}
+	}
+	return sections, nil
+}
+
+// MarshalJSONWithOptions 依輸出選項將解析結果轉為 JSON (不修改原結果)
+// 統計摘要依完整結果計算，即使省略病患或處方區段，摘要中的筆數仍正確
+func (r *HISImportResult) MarshalJSONWithOptions(opts OutputOptions) ([]byte, error) {
+	if r == nil {
+		return []byte("null"), nil
+	}
+	if _, err := ParseSections(strings.Join(opts.Sections, ",")); err != nil {
+		return nil, err
+	}
+	if opts.Page < 0 || (opts.Page > 0 && opts.PageSize <= 0) {
+		return nil, fmt.Errorf("分頁參數錯誤: page=%d size=%d", opts.Page, opts.PageSize)
+	}
+
+	include := func(section string) bool {
+		if len(opts.Sections) == 0 {
+			return true
+		}
+		for _, s := range opts.Sections {
+			if strings.EqualFold(s, section) {
+				return true
+			}
+		}
+		return false
+	}
+
+	view := *r
+	if !include(SectionPatients) || opts.OmitPatients {
+		view.Patients = nil
+	}
+	if !include(SectionPrescriptions) {
+		view.Prescriptions = nil
+	} else if opts.Page > 0 {
+		start, end := NewPageInfo(len(r.Prescriptions), opts.Page, opts.PageSize).bounds()
+		view.Prescriptions = r.Prescriptions[start:end]
+	}
+	if !include(SectionUsage) {
+		view.DrugUsages, view.ServiceFees, view.UnknownDrugCodes = nil, nil, nil
+	}
+	if !include(SectionErrors) {
+		view.Errors, view.DetailedErrors, view.Warnings = nil, nil, nil
+	}
+	if !include(SectionClaim) {
+		view.Claim = nil
+	}
+
+	// 複製一份再遮蔽，以免修改呼叫端資料
+	if opts.Mask != MaskNone {
+		view.Patients = append([]HISPatient(nil), view.Patients...)
+		view.Prescriptions = append([]HISPrescription(nil), view.Prescriptions...)
+		view.MaskAll(opts.Mask)
+	}
+
+	out := struct {
+		*HISImportResult
+		Summary *ImportSummary `json:"summary,omitempty"`
+	}{HISImportResult: &view}
+	if include(SectionSummary) {
+		summary := r.Summary()
+		out.Summary = &summary
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil || !opts.OmitEmpty {
+		return data, err
+	}
+
+	var tree interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+	tree, _ = pruneEmptyJSON(tree)
+	return json.Marshal(tree)
+}
+
+// pruneEmptyJSON 遞迴移除空值欄位，回傳處理後的值與是否為空
+func pruneEmptyJSON(v interface{}) (interface{}, bool) {
+	switch t := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return t, t == ""
+	case bool:
+		return t, !t
+	case json.Number:
+		f, err := t.Float64()
+		return t, err == nil && f == 0
+	case []interface{}:
+		for i := range t {
+			t[i], _ = pruneEmptyJSON(t[i])
+		}
+		return t, len(t) == 0
+	case map[string]interface{}:
+		for k, child := range t {
+			pruned, empty := pruneEmptyJSON(child)
+			if empty {
+				delete(t, k)
+				continue
+			}
+			t[k] = pruned
+		}
+		return t, len(t) == 0
+	}
+	return v, false
+}
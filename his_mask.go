@@ -0,0 +1,107 @@
+// Package parser 個資遮蔽
+// 身分證號與電話的遮蔽策略，供 Web 介面、報表與其他套件使用者共用
+package parser
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// MaskMode 遮蔽模式
+type MaskMode int
+
+const (
+	MaskNone    MaskMode = iota // 不遮蔽
+	MaskPartial                 // 保留頭尾 (A12****789)
+	MaskFull                    // 全部以 * 取代
+	MaskHash                    // SHA-256 前八碼 (同一人遮蔽後仍可比對)
+)
+
+// MaskNationalID 依模式遮蔽身分證號 (空字串原樣回傳)
+func MaskNationalID(id string, mode MaskMode) string {
+	return maskKeepEnds(id, mode, 3, 3)
+}
+
+// MaskPhone 依模式遮蔽電話 (部分遮蔽保留前 4 碼與後 3 碼，如 0912***678)
+func MaskPhone(phone string, mode MaskMode) string {
+	return maskKeepEnds(phone, mode, 4, 3)
+}
+
+// maskKeepEnds 遮蔽字串，部分遮蔽時保留頭 head 碼與尾 tail 碼
+// 長度不足時僅保留前兩碼，少於 4 碼則全部遮蔽
+func maskKeepEnds(s string, mode MaskMode, head, tail int) string {
+	if s == "" {
+		return s
+	}
+
+	runes := []rune(s)
+	switch mode {
+	case MaskNone:
+		return s
+	case MaskFull:
+		return strings.Repeat("*", len(runes))
+	case MaskHash:
+		sum := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(s))))
+		return hex.EncodeToString(sum[:])[:8]
+	}
+
+	switch {
+	case len(runes) < 4:
+		return strings.Repeat("*", len(runes))
+	case len(runes) > head+tail:
+		return string(runes[:head]) + strings.Repeat("*", len(runes)-head-tail) + string(runes[len(runes)-tail:])
+	default:
+		return string(runes[:2]) + strings.Repeat("*", len(runes)-2)
+	}
+}
+
+// MaskAll 一次遮蔽所有病患與處方的身分證號及電話
+// 遮蔽前為每位病患產生查詢代號 (HISPatient.Key 與 HISPrescription.PatientKey)，
+// 遮蔽後的結果只能以代號查詢病患 (部分遮蔽的值可能對應多位病患，原始身分證也不再可用)
+func (r *HISImportResult) MaskAll(mode MaskMode) {
+	if r == nil || mode == MaskNone {
+		return
+	}
+	key := newPatientKeyer()
+	for i := range r.Patients {
+		p := &r.Patients[i]
+		if p.rawNationalID == "" {
+			p.rawNationalID = p.NationalID
+		}
+		if p.Key == "" {
+			p.Key = key(p.rawNationalID)
+		}
+		p.NationalID = MaskNationalID(p.NationalID, mode)
+		p.Phone = MaskPhone(p.Phone, mode)
+		p.Mobile = MaskPhone(p.Mobile, mode)
+	}
+	for i := range r.Prescriptions {
+		rx := &r.Prescriptions[i]
+		if rx.rawPatientID == "" {
+			rx.rawPatientID = rx.PatientID
+		}
+		if rx.PatientKey == "" {
+			rx.PatientKey = key(rx.rawPatientID)
+		}
+		rx.PatientID = MaskNationalID(rx.PatientID, mode)
+	}
+}
+
+// newPatientKeyer 回傳產生病患代號的函數：以隨機 salt 雜湊身分證，
+// 同一次遮蔽中同一人的代號相同，但無法由身分證推算或比對代號
+func newPatientKeyer() func(id string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return func(id string) string {
+		id = strings.ToUpper(strings.TrimSpace(id))
+		if id == "" {
+			return ""
+		}
+		h := sha256.New()
+		h.Write(salt)
+		h.Write([]byte(id))
+		return hex.EncodeToString(h.Sum(nil))[:16]
+	}
+}
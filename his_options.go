@@ -0,0 +1,433 @@
+// Package parser 解析選項
+// 以 functional options 統一傳遞所有解析入口的設定，零值即為預設行為
+package parser
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// 支援的編碼 (與 detectEncoding 回傳值相同)
+const (
+	EncodingAuto    = ""        // 自動偵測 (預設)
+	EncodingBig5    = "big5"    // Big5
+	EncodingGBK     = "gbk"     // GBK / GB18030 (大陸系統)
+	EncodingUTF8    = "utf8"    // UTF-8
+	EncodingUTF16LE = "utf16le" // UTF-16 Little Endian
+	EncodingUTF16BE = "utf16be" // UTF-16 Big Endian
+)
+
+// ParseOptions 解析選項 (零值即為預設行為)
+type ParseOptions struct {
+	Encoding      string         // 檔案編碼，空字串為自動偵測
+	Strict        bool           // 嚴格模式: 有任何錯誤即視為失敗並回傳 error
+	MaxRecords    int            // 最多保留的處方筆數，0 為不限制
+	MaxErrors     int            // 最多保留的錯誤訊息數，0 為不限制
+	MergeItems    bool           // 合併處方內重複的藥品項目 (目前僅限慢箋，見 CoalesceChronicItems)
+	Workers       int            // ParseHISFiles 同時解析的檔案數，0 為 CPU 核心數
+	DATLayout     *DATLayout     // 耀聖 DAT 欄位位置，nil 為依記錄長度自動判斷
+	ColumnMapping map[string]int // 通用格式的欄位對應 (key → 欄位索引)，nil 為自動偵測
+	CheckQuantity bool           // 檢查藥品數量與天數一致性，可疑項目記錄於 Errors (見 ValidateQuantity)
+	Consolidate   bool           // 合計處方內同藥品、同頻率與途徑的醫令 (見 HISPrescription.ConsolidateItems)
+
+	PrescriptionNoFormatter PrescriptionNoFormatter // 自訂處方序號格式，nil 為各廠商預設 (如 DM-醫院代碼-日期-就醫序號)
+	Progress                ProgressFunc            // 解析進度回呼，nil 為不回報
+	ProgressEvery           int                     // 每處理幾筆記錄回報一次，0 為預設 (defaultProgressEvery)
+
+	ctx      context.Context   // 取消與逾時控制，nil 視為 context.Background()
+	decoded  *decodedText      // 已偵測編碼的內容快取 (判斷廠商與解析共用，避免重複偵測與轉換)
+	progress *progressReporter // 依 Progress 與 ProgressEvery 建立的進度回報器，未設定 Progress 時為 nil
+}
+
+// decodedText 已偵測編碼的內容與轉換後的 UTF-8 字串
+type decodedText struct {
+	src     []byte
+	enc     string
+	text    string
+	hasText bool
+}
+
+// ParseOption 解析選項設定函數
+type ParseOption func(*ParseOptions)
+
+// WithEncoding 指定檔案編碼 (big5 / gbk / utf-8 / utf-16le / utf-16be)，略過自動偵測
+func WithEncoding(encoding string) ParseOption {
+	return func(o *ParseOptions) {
+		switch strings.ToLower(strings.TrimSpace(encoding)) {
+		case "big5", "big-5", "cp950":
+			o.Encoding = EncodingBig5
+		case "gbk", "gb2312", "gb18030", "cp936":
+			o.Encoding = EncodingGBK
+		case "utf-8", "utf8":
+			o.Encoding = EncodingUTF8
+		case "utf-16le", "utf16le", "utf-16", "utf16", "unicode":
+			o.Encoding = EncodingUTF16LE
+		case "utf-16be", "utf16be":
+			o.Encoding = EncodingUTF16BE
+		default:
+			o.Encoding = EncodingAuto
+		}
+	}
+}
+
+// WithStrict 啟用嚴格模式
+func WithStrict(strict bool) ParseOption {
+	return func(o *ParseOptions) {
+		o.Strict = strict
+	}
+}
+
+// WithMaxRecords 限制保留的處方筆數
+func WithMaxRecords(n int) ParseOption {
+	return func(o *ParseOptions) {
+		o.MaxRecords = n
+	}
+}
+
+// WithMaxErrors 限制保留的錯誤訊息數 (其餘以摘要一行表示)
+func WithMaxErrors(n int) ParseOption {
+	return func(o *ParseOptions) {
+		o.MaxErrors = n
+	}
+}
+
+// WithMergeItems 合併處方內重複的藥品項目
+func WithMergeItems(merge bool) ParseOption {
+	return func(o *ParseOptions) {
+		o.MergeItems = merge
+	}
+}
+
+// WithConsolidateItems 解析後自動合計處方內分列的相同藥品
+func WithConsolidateItems(consolidate bool) ParseOption {
+	return func(o *ParseOptions) {
+		o.Consolidate = consolidate
+	}
+}
+
+// WithWorkers 設定 ParseHISFiles 同時解析的檔案數
+func WithWorkers(n int) ParseOption {
+	return func(o *ParseOptions) {
+		o.Workers = n
+	}
+}
+
+// WithDATLayout 指定耀聖 DAT 欄位位置 (新版格式可自訂，不必修改原始碼)
+func WithDATLayout(layout *DATLayout) ParseOption {
+	return func(o *ParseOptions) {
+		o.DATLayout = layout
+	}
+}
+
+// WithColumnMapping 指定通用格式的欄位對應，覆蓋自動偵測 (見 DetectColumns)
+// 對應含未知欄位或負數索引時 ParseWithOptions 回傳 ErrInvalidColumnMapping
+func WithColumnMapping(colMap map[string]int) ParseOption {
+	return func(o *ParseOptions) {
+		o.ColumnMapping = colMap
+	}
+}
+
+// WithQuantityCheck 啟用數量與天數一致性檢查
+func WithQuantityCheck(check bool) ParseOption {
+	return func(o *ParseOptions) {
+		o.CheckQuantity = check
+	}
+}
+
+// PrescriptionNoFormatter 處方序號格式器，來源檔無處方號而由解析器組成時呼叫
+// 傳入病患身分證、原處方醫院代碼、調劑日期 (YYYY-MM-DD) 與序號 (就醫序號或來源檔的流水號，可能為空)
+type PrescriptionNoFormatter func(patientID, providerCode, date, seq string) string
+
+// WithPrescriptionNoFormatter 以自訂格式產生處方序號，對接既有的編號規則
+// 來源檔本身提供的處方號 (如通用格式的處方號欄、HL7 ORC-2) 不受影響
+func WithPrescriptionNoFormatter(f PrescriptionNoFormatter) ParseOption {
+	return func(o *ParseOptions) {
+		o.PrescriptionNoFormatter = f
+	}
+}
+
+// defaultProgressEvery 未指定時每處理幾筆記錄回報一次進度
+const defaultProgressEvery = 100
+
+// ProgressFunc 解析進度回呼，done 為已處理的記錄數，total 為總記錄數 (無法預先得知時為 0)
+// 目前 XML (逐筆 REC) 與通用 CSV / Excel 會在解析過程中回報，其他格式僅於完成時回報一次 (done == total)
+type ProgressFunc func(done, total int)
+
+// WithProgress 每處理 every 筆記錄呼叫一次 fn 回報進度 (開始與完成時必定呼叫)
+// fn 在解析的 goroutine 中同步執行，耗時的處理會拖慢解析
+func WithProgress(every int, fn ProgressFunc) ParseOption {
+	return func(o *ParseOptions) {
+		o.ProgressEvery = every
+		o.Progress = fn
+	}
+}
+
+// progressReporter 依間隔節流的進度回報器
+type progressReporter struct {
+	every int
+	fn    ProgressFunc
+	last  int // 上次回報的 done，-1 表示尚未回報
+}
+
+// newProgressReporter 建立進度回報器，fn 為 nil 時回傳 nil (不回報)
+func newProgressReporter(every int, fn ProgressFunc) *progressReporter {
+	if fn == nil {
+		return nil
+	}
+	if every <= 0 {
+		every = defaultProgressEvery
+	}
+	return &progressReporter{every: every, fn: fn, last: -1}
+}
+
+// report 回報解析進度，done 為 every 的倍數或已完成時才呼叫回呼；p 為 nil (未設定 WithProgress) 時不做任何事
+func (p *progressReporter) report(done, total int) {
+	if p == nil || done == p.last {
+		return
+	}
+	if done%p.every == 0 || done == total {
+		p.last = done
+		p.fn(done, total)
+	}
+}
+
+// WithContext 指定 context，取消或逾時時解析會提前結束並回傳 ctx.Err() (不回傳部分結果)
+func WithContext(ctx context.Context) ParseOption {
+	return func(o *ParseOptions) {
+		o.ctx = ctx
+	}
+}
+
+// newParseOptions 套用選項並回傳設定
+func newParseOptions(opts ...ParseOption) *ParseOptions {
+	o := &ParseOptions{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+	o.progress = newProgressReporter(o.ProgressEvery, o.Progress)
+	return o
+}
+
+// decode 取得內容的解碼快取，同一份內容 (相同底層陣列) 只偵測一次編碼
+func (o *ParseOptions) decode(content []byte) *decodedText {
+	if c := o.decoded; c != nil && len(c.src) == len(content) &&
+		(len(content) == 0 || &c.src[0] == &content[0]) {
+		return c
+	}
+
+	enc := o.Encoding
+	if enc == EncodingAuto {
+		enc = detectEncoding(content)
+	}
+	o.decoded = &decodedText{src: content, enc: enc}
+	return o.decoded
+}
+
+// context 取得解析用的 context，未指定時為 context.Background()
+func (o *ParseOptions) context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+// err 回傳 context 的取消或逾時錯誤，未取消時為 nil
+func (o *ParseOptions) err() error {
+	return o.context().Err()
+}
+
+// encodingOf 依選項決定內容編碼，未指定時自動偵測
+func (o *ParseOptions) encodingOf(content []byte) string {
+	return o.decode(content).enc
+}
+
+// decodeText 依選項將內容轉換為 UTF-8 字串 (已去除 BOM)，轉換結果會快取
+func (o *ParseOptions) decodeText(content []byte) string {
+	c := o.decode(content)
+	if !c.hasText {
+		c.text = string(decodeContent(content, c.enc))
+		c.hasText = true
+	}
+	return c.text
+}
+
+// apply 解析完成後套用筆數限制與嚴格模式
+func (o *ParseOptions) apply(result *HISImportResult) error {
+	if result == nil {
+		return nil
+	}
+
+	if o.PrescriptionNoFormatter != nil {
+		formatPrescriptionNos(result, o.PrescriptionNoFormatter)
+	}
+
+	// 合併醫令會改變品項數與調劑次數，需重新彙總藥品使用統計
+	if o.MergeItems {
+		for i := range result.Prescriptions {
+			CoalesceChronicItems(&result.Prescriptions[i])
+		}
+		result.DrugUsages, result.ServiceFees = summarizeUsages(result.Prescriptions)
+	}
+	if o.Consolidate {
+		result.ConsolidateItems()
+	}
+
+	if o.MaxRecords > 0 && len(result.Prescriptions) > o.MaxRecords {
+		result.Skipped += len(result.Prescriptions) - o.MaxRecords
+		result.Prescriptions = result.Prescriptions[:o.MaxRecords]
+		fillTotals(result)
+		result.DrugUsages, result.ServiceFees = summarizeUsages(result.Prescriptions)
+		result.SelfPayTotal = calcSelfPayTotal(result.Prescriptions)
+	}
+
+	if o.CheckQuantity {
+		validateQuantities(result)
+	}
+
+	if o.MaxErrors > 0 && len(result.Errors) > o.MaxErrors {
+		omitted := len(result.Errors) - o.MaxErrors
+		result.Errors = append(result.Errors[:o.MaxErrors], fmt.Sprintf("另有 %d 筆錯誤未列出", omitted))
+	}
+	if o.MaxErrors > 0 && len(result.DetailedErrors) > o.MaxErrors {
+		result.DetailedErrors = result.DetailedErrors[:o.MaxErrors]
+	}
+
+	if o.Strict && len(result.Errors) > 0 {
+		result.Success = false
+		return fmt.Errorf("%w: 共 %d 筆錯誤", ErrStrict, len(result.Errors))
+	}
+	return nil
+}
+
+// formatPrescriptionNos 以格式器重新產生解析器組成的處方序號，並依新序號重新排序
+func formatPrescriptionNos(result *HISImportResult, format PrescriptionNoFormatter) {
+	for i := range result.Prescriptions {
+		rx := &result.Prescriptions[i]
+		if !rx.generatedNo {
+			continue
+		}
+		seq := firstNonEmpty(rx.noSeq, visitKey(rx))
+		if no := format(rx.PatientID, rx.ProviderCode, rx.DispenseDate, seq); no != "" {
+			rx.PrescriptionNo = no
+		}
+	}
+	result.Sort()
+}
+
+// CoalesceChronicItems 合併慢箋處方中連續且相同藥品的醫令 (加總數量與天數)
+// 部分廠商會將長天數慢箋的單一藥品拆成每日一筆 MB2，逐筆計算會高估品項數並低估單品用量；
+// 僅處理慢箋 (就醫類別 08 或慢箋次數 > 0)，且醫令類別、自費註記與單價皆相同才合併
+func CoalesceChronicItems(rx *HISPrescription) {
+	if rx == nil || len(rx.Items) < 2 || (rx.VisitType != "08" && rx.ChronicRefillNo == 0) {
+		return
+	}
+
+	rx.Items = mergeItems(rx.Items, keyOrderType|keySelfPay|keyUnitPrice, true, func(last *HISPrescriptionItem, item HISPrescriptionItem) {
+		last.Quantity += item.Quantity
+		last.DaysSupply += item.DaysSupply
+	})
+}
+
+// ConsolidateItems 合計處方內相同藥品的醫令 (數量相加、天數取最大、單價取第一個非零值)
+// 同一藥品因分次給藥被拆成多列時使用；藥品代碼 (不分大小寫)、醫令類別、頻率、途徑與自費註記皆相同才合計，
+// 不同頻率或途徑的同藥品視為不同醫令保留分列。合計後依首次出現的順序排列
+func (rx *HISPrescription) ConsolidateItems() {
+	if rx == nil || len(rx.Items) < 2 {
+		return
+	}
+
+	rx.Items = mergeItems(rx.Items, keyOrderType|keyFrequency|keyRoute|keySelfPay, false, func(first *HISPrescriptionItem, item HISPrescriptionItem) {
+		first.Quantity += item.Quantity
+		if item.DaysSupply > first.DaysSupply {
+			first.DaysSupply = item.DaysSupply
+		}
+		if first.UnitPrice == 0 {
+			first.UnitPrice = item.UnitPrice
+		}
+	})
+}
+
+// itemKeyField 比對醫令是否相同時納入的欄位 (藥品代碼一律納入)
+type itemKeyField uint8
+
+const (
+	keyOrderType itemKeyField = 1 << iota
+	keyFrequency
+	keyRoute
+	keySelfPay
+	keyUnitPrice
+	keyQuantity
+)
+
+// itemKey 醫令比對鍵: 藥品代碼、頻率與途徑不分大小寫，未納入的欄位保持零值
+type itemKey struct {
+	code, orderType, frequency, route string
+	selfPay                           bool
+	unitPrice, quantity               float64
+}
+
+// makeItemKey 依 fields 建立醫令比對鍵
+func makeItemKey(item HISPrescriptionItem, fields itemKeyField) itemKey {
+	key := itemKey{code: strings.ToUpper(item.DrugCode)}
+	if fields&keyOrderType != 0 {
+		key.orderType = item.OrderType
+	}
+	if fields&keyFrequency != 0 {
+		key.frequency = strings.ToUpper(item.Frequency)
+	}
+	if fields&keyRoute != 0 {
+		key.route = strings.ToUpper(item.Route)
+	}
+	if fields&keySelfPay != 0 {
+		key.selfPay = item.IsSelfPay
+	}
+	if fields&keyUnitPrice != 0 {
+		key.unitPrice = item.UnitPrice
+	}
+	if fields&keyQuantity != 0 {
+		key.quantity = item.Quantity
+	}
+	return key
+}
+
+// mergeItems 以 combine 將比對鍵相同的醫令併入首次出現者，consecutive 為 true 時只合併相鄰的醫令
+// 無藥品代碼的醫令不合併；結果依首次出現的順序排列，並沿用 items 的底層陣列
+func mergeItems(items []HISPrescriptionItem, fields itemKeyField, consecutive bool, combine func(first *HISPrescriptionItem, item HISPrescriptionItem)) []HISPrescriptionItem {
+	index := make(map[itemKey]int)
+	merged := items[:0]
+	for _, item := range items {
+		if item.DrugCode == "" {
+			merged = append(merged, item)
+			continue
+		}
+		key := makeItemKey(item, fields)
+		if consecutive {
+			if n := len(merged); n > 0 && merged[n-1].DrugCode != "" && makeItemKey(merged[n-1], fields) == key {
+				combine(&merged[n-1], item)
+				continue
+			}
+		} else if idx, ok := index[key]; ok {
+			combine(&merged[idx], item)
+			continue
+		}
+		if !consecutive {
+			index[key] = len(merged)
+		}
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+// ConsolidateItems 合計所有處方的相同藥品醫令 (見 HISPrescription.ConsolidateItems)，並重新統計藥品使用量
+func (r *HISImportResult) ConsolidateItems() {
+	if r == nil {
+		return
+	}
+	for i := range r.Prescriptions {
+		r.Prescriptions[i].ConsolidateItems()
+	}
+	r.DrugUsages, r.ServiceFees = summarizeUsages(r.Prescriptions)
+}
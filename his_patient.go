@@ -0,0 +1,198 @@
+// Package parser 病患資料分析
+// 由生日計算年齡與年齡層，供用藥分析分組統計
+package parser
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 年齡層
+const (
+	AgeGroupInfant  = "0-6 嬰幼兒"
+	AgeGroupMinor   = "7-17 兒童青少年"
+	AgeGroupAdult   = "18-64 成人"
+	AgeGroupElderly = "65+ 長者"
+	AgeGroupUnknown = "未知"
+)
+
+// Age 計算病患於 asOf 當日的足歲年齡
+// 生日為空、格式錯誤或晚於 asOf 時回傳 -1
+func (p *HISPatient) Age(asOf time.Time) int {
+	if p == nil || p.Birthday == "" {
+		return -1
+	}
+	birth, err := time.Parse("2006-01-02", p.Birthday)
+	if err != nil {
+		return -1
+	}
+
+	y, m, d := asOf.Date()
+	by, bm, bd := birth.Date()
+	if y < by || (y == by && (m < bm || (m == bm && d < bd))) {
+		return -1
+	}
+
+	age := y - by
+	if m < bm || (m == bm && d < bd) {
+		age--
+	}
+	return age
+}
+
+// AgeGroup 依目前年齡回傳年齡層，無法計算年齡時為 AgeGroupUnknown
+func (p *HISPatient) AgeGroup() string {
+	return ageGroupOf(p.Age(time.Now()))
+}
+
+// ageGroupOf 年齡對應年齡層
+func ageGroupOf(age int) string {
+	switch {
+	case age < 0:
+		return AgeGroupUnknown
+	case age <= 6:
+		return AgeGroupInfant
+	case age <= 17:
+		return AgeGroupMinor
+	case age <= 64:
+		return AgeGroupAdult
+	default:
+		return AgeGroupElderly
+	}
+}
+
+// GenderFromNationalID 由身分證或居留證號推導性別 (M/F)，無法判斷時回傳空字串
+// 身分證第二碼 1=男 2=女；新式居留證第二碼 8=男 9=女；舊式居留證第二碼 A/C=男 B/D=女
+func GenderFromNationalID(id string) string {
+	id = strings.ToUpper(strings.TrimSpace(id))
+	if len(id) != 10 || id[0] < 'A' || id[0] > 'Z' {
+		return ""
+	}
+	switch id[1] {
+	case '1', '8', 'A', 'C':
+		return "M"
+	case '2', '9', 'B', 'D':
+		return "F"
+	}
+	return ""
+}
+
+// AgeDistribution 統計各年齡層病患數
+func (r *HISImportResult) AgeDistribution() map[string]int {
+	dist := make(map[string]int)
+	if r == nil {
+		return dist
+	}
+	now := time.Now()
+	for i := range r.Patients {
+		dist[ageGroupOf(r.Patients[i].Age(now))]++
+	}
+	return dist
+}
+
+// mergePatient 以新資料補齊已存在病患的缺漏欄位
+// 同一身分證先出現的記錄可能缺電話或生日，後續記錄的非空欄位會補上；
+// 姓名取較長者 (避免「王小」之類的截斷)，已有值不會被空字串覆蓋
+func mergePatient(existing, patient *HISPatient) {
+	if existing == nil || patient == nil {
+		return
+	}
+	if utf8.RuneCountInString(patient.Name) > utf8.RuneCountInString(existing.Name) {
+		existing.Name = patient.Name
+	}
+	if existing.Birthday == "" {
+		existing.Birthday = patient.Birthday
+	}
+	if existing.Phone == "" {
+		existing.Phone = patient.Phone
+	}
+	if existing.Mobile == "" {
+		existing.Mobile = patient.Mobile
+	}
+	if existing.CardNumber == "" {
+		existing.CardNumber = patient.CardNumber
+	}
+	if existing.Gender == "" {
+		existing.Gender = patient.Gender
+	}
+}
+
+// upsertPatient 將病患寫入 patientMap，已存在時以 mergePatient 合併
+// 回傳是否為新加入的病患 (供需要維持出現順序的解析器使用)
+func upsertPatient(patientMap map[string]*HISPatient, patient *HISPatient) bool {
+	if existing, exists := patientMap[patient.NationalID]; exists {
+		mergePatient(existing, patient)
+		return false
+	}
+	patientMap[patient.NationalID] = patient
+	return true
+}
+
+// TimelineEntry 病患用藥時間軸的一次調劑
+type TimelineEntry struct {
+	Date            string                `json:"date"` // 調劑日期 YYYY-MM-DD
+	Time            string                `json:"time,omitempty"`
+	PrescriptionNo  string                `json:"prescription_no"`
+	ProviderCode    string                `json:"provider_code"`
+	ProviderName    string                `json:"provider_name,omitempty"`
+	VisitType       string                `json:"visit_type"`
+	VisitTypeName   string                `json:"visit_type_name,omitempty"`
+	ChronicRefillNo int                   `json:"chronic_refill_no,omitempty"`
+	DiagnosisCodes  []string              `json:"diagnosis_codes,omitempty"`
+	Drugs           []HISPrescriptionItem `json:"drugs"` // 僅藥品醫令 (不含藥事服務費與診療)
+}
+
+// PatientTimeline 回傳指定病患依調劑日期排序的歷次處方與藥品
+// 未遮蔽的結果以身分證查詢；已遮蔽 (MaskAll) 的結果只接受病患代號 (HISPatient.Key)，
+// 不比對遮蔽後的值 (可能對應多位病患) 或原始身分證 (避免遮蔽後的結果被用來確認某人是否在檔案中)
+func (r *HISImportResult) PatientTimeline(id string) []TimelineEntry {
+	id = sanitizeField(id)
+	if r == nil || id == "" {
+		return nil
+	}
+	nationalID := strings.ToUpper(id)
+
+	var entries []TimelineEntry
+	for i := range r.Prescriptions {
+		rx := &r.Prescriptions[i]
+		if rx.PatientKey != "" {
+			if rx.PatientKey != id {
+				continue
+			}
+		} else if rx.PatientID != nationalID {
+			continue
+		}
+
+		entry := TimelineEntry{
+			Date:            rx.DispenseDate,
+			Time:            rx.DispenseTime,
+			PrescriptionNo:  rx.PrescriptionNo,
+			ProviderCode:    rx.ProviderCode,
+			ProviderName:    rx.ProviderName,
+			VisitType:       rx.VisitType,
+			VisitTypeName:   rx.VisitTypeName,
+			ChronicRefillNo: rx.ChronicRefillNo,
+			DiagnosisCodes:  rx.DiagnosisCodes,
+			Drugs:           []HISPrescriptionItem{},
+		}
+		if len(entry.DiagnosisCodes) == 0 && rx.DiagnosisCode != "" {
+			entry.DiagnosisCodes = []string{rx.DiagnosisCode}
+		}
+		for _, item := range rx.Items {
+			if isDrugItem(item) {
+				entry.Drugs = append(entry.Drugs, item)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Date != entries[j].Date {
+			return entries[i].Date < entries[j].Date
+		}
+		return entries[i].Time < entries[j].Time
+	})
+	return entries
+}
@@ -0,0 +1,34 @@
+package parser
+
+import "testing"
+
+func TestPatientTimelineMasked(t *testing.T) {
+	// 兩位病患部分遮蔽後皆為 A12****789
+	result := &HISImportResult{
+		Patients: []HISPatient{{NationalID: "A123456789"}, {NationalID: "A123000789"}},
+		Prescriptions: []HISPrescription{
+			{PatientID: "A123456789", PrescriptionNo: "RX1", DispenseDate: "2024-02-01"},
+			{PatientID: "A123000789", PrescriptionNo: "RX2", DispenseDate: "2024-01-15"},
+			{PatientID: "A123456789", PrescriptionNo: "RX3", DispenseDate: "2024-01-01"},
+		},
+	}
+	if got := len(result.PatientTimeline("a123456789")); got != 2 {
+		t.Fatalf("unmasked timeline = %d entries, want 2", got)
+	}
+
+	result.MaskAll(MaskPartial)
+	for _, id := range []string{"A12****789", "A123456789"} {
+		if got := result.PatientTimeline(id); got != nil {
+			t.Errorf("PatientTimeline(%q) after MaskAll = %d entries, want none", id, len(got))
+		}
+	}
+
+	key := result.Patients[0].Key
+	if key == "" || key == result.Patients[1].Key {
+		t.Fatalf("patient keys = %q, %q, want distinct non-empty keys", key, result.Patients[1].Key)
+	}
+	timeline := result.PatientTimeline(key)
+	if len(timeline) != 2 || timeline[0].PrescriptionNo != "RX3" || timeline[1].PrescriptionNo != "RX1" {
+		t.Errorf("PatientTimeline(key) = %+v, want RX3, RX1", timeline)
+	}
+}
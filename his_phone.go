@@ -0,0 +1,84 @@
+// Package parser 電話號碼正規化
+// 各廠商電話寫法不一 (含括號區碼、分機、+886 國碼)，統一為手機與市話的標準格式
+package parser
+
+import (
+	"strings"
+)
+
+// phoneAreaCodes 台灣市話區碼 (長者優先比對，如 0836 先於 08)
+var phoneAreaCodes = []string{"0836", "0826", "037", "049", "082", "089", "02", "03", "04", "05", "06", "07", "08"}
+
+// phoneExtMarkers 分機標記 (其後的數字視為分機)
+var phoneExtMarkers = []string{"#", "EXT", "分機", "轉", "X"}
+
+// NormalizePhone 正規化電話號碼，回傳標準格式與是否為手機
+// 手機 (09 開頭 10 碼) 格式為 0912-345-678；市話格式為 區碼-號碼 (如 02-2345-6789、049-234-5678)，
+// 分機以 #123 附加；+886 / 886 國碼會轉為 0。無法辨識時回傳僅含數字的字串
+func NormalizePhone(raw string) (normalized string, isMobile bool) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	if s == "" {
+		return "", false
+	}
+
+	ext := ""
+	for _, marker := range phoneExtMarkers {
+		if idx := strings.Index(s, marker); idx > 0 {
+			ext = digitsOnly(s[idx+len(marker):])
+			s = s[:idx]
+			break
+		}
+	}
+
+	digits := digitsOnly(s)
+	if strings.HasPrefix(digits, "886") && len(digits) >= 11 {
+		digits = "0" + strings.TrimPrefix(digits[3:], "0")
+	}
+	if digits == "" {
+		return "", false
+	}
+
+	if len(digits) == 10 && strings.HasPrefix(digits, "09") {
+		return digits[:4] + "-" + digits[4:7] + "-" + digits[7:], true
+	}
+
+	normalized = digits
+	for _, area := range phoneAreaCodes {
+		local := strings.TrimPrefix(digits, area)
+		if local == digits || len(local) < 5 || len(local) > 8 {
+			continue
+		}
+		normalized = area + "-" + splitLocalNumber(local)
+		break
+	}
+	if ext != "" {
+		normalized += "#" + ext
+	}
+	return normalized, false
+}
+
+// splitLocalNumber 市話號碼分段 (8 碼 4-4、7 碼 3-4，其餘不分段)
+func splitLocalNumber(local string) string {
+	switch len(local) {
+	case 8:
+		return local[:4] + "-" + local[4:]
+	case 7:
+		return local[:3] + "-" + local[3:]
+	default:
+		return local
+	}
+}
+
+// digitsOnly 僅保留數字 (含全形數字)
+func digitsOnly(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if r >= '０' && r <= '９' {
+			r -= 0xFEE0
+		}
+		if r >= '0' && r <= '9' {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,158 @@
+// Package parser 慢箋領藥對帳
+// 將同一張慢性病連續處方箋的多次調劑 (IC01/IC02/IC03) 串成一條記錄，追蹤跳號與未回來領藥的病患
+package parser
+
+import (
+	"sort"
+	"strings"
+)
+
+// RefillDispense 慢箋的單次調劑
+type RefillDispense struct {
+	RefillNo       int    `json:"refill_no"` // 第幾次調劑
+	PrescriptionNo string `json:"prescription_no"`
+	DispenseDate   string `json:"dispense_date"`
+	VisitSequence  string `json:"visit_sequence,omitempty"`
+	DaysSupply     int    `json:"days_supply"` // 最長給藥天數
+}
+
+// RefillChain 同一病患同一原處方的多次領藥
+type RefillChain struct {
+	PatientID      string           `json:"patient_id"`
+	ProviderCode   string           `json:"provider_code"` // 原處方醫院代碼
+	ProviderName   string           `json:"provider_name,omitempty"`
+	VisitType      string           `json:"visit_type"` // 首次調劑的就醫類別 (AF 為醫院釋出)
+	DiagnosisCode  string           `json:"diagnosis_code,omitempty"`
+	DrugCodes      []string         `json:"drug_codes"`
+	TotalRefills   int              `json:"total_refills,omitempty"`   // 可調劑總次數 (資料未提供時為 0，不推估下一次領藥)
+	Dispenses      []RefillDispense `json:"dispenses"`                 // 依調劑次數排序
+	MissingRefills []int            `json:"missing_refills,omitempty"` // 已領次數之間缺少的次數 (跳號)
+	HasGap         bool             `json:"has_gap"`
+	NextRefillNo   int              `json:"next_refill_no,omitempty"` // 下一次應領的次數，已領完或總次數未知為 0
+	NextDueDate    string           `json:"next_due_date,omitempty"`  // 下一次預計領藥日 (最後調劑日 + 給藥天數)
+}
+
+// MatchRefills 將慢箋處方依病患、原處方醫院與藥品組合串成領藥記錄
+// 僅納入 DetectChronicPrescription 判定為慢箋者；同一組合的調劑次數重新從較小次數開始時視為新開立的處方。
+// 首次出現的次數之前的調劑 (如第 1 次在醫院領藥) 不視為跳號
+func MatchRefills(rxs []HISPrescription) []RefillChain {
+	type candidate struct {
+		rx       *HISPrescription
+		refillNo int
+		total    int
+		day      string
+	}
+
+	groups := make(map[string][]candidate)
+	var keys []string
+	for i := range rxs {
+		rx := &rxs[i]
+		isChronic, refillNo, total := DetectChronicPrescription(rx)
+		if !isChronic || rx.PatientID == "" {
+			continue
+		}
+		key := strings.Join([]string{rx.PatientID, rx.ProviderCode, strings.Join(refillDrugCodes(rx), ",")}, "\x00")
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], candidate{rx: rx, refillNo: refillNo, total: total, day: rx.DispenseDate})
+	}
+
+	var chains []RefillChain
+	for _, key := range keys {
+		group := groups[key]
+		sort.SliceStable(group, func(i, j int) bool {
+			if group[i].day != group[j].day {
+				return group[i].day < group[j].day
+			}
+			return group[i].refillNo < group[j].refillNo
+		})
+
+		var chain *RefillChain
+		lastNo := 0
+		for _, c := range group {
+			if chain == nil || c.refillNo <= lastNo {
+				if chain != nil {
+					chains = append(chains, finishRefillChain(*chain))
+				}
+				chain = &RefillChain{
+					PatientID:     c.rx.PatientID,
+					ProviderCode:  c.rx.ProviderCode,
+					ProviderName:  c.rx.ProviderName,
+					VisitType:     c.rx.VisitType,
+					DiagnosisCode: c.rx.DiagnosisCode,
+					DrugCodes:     refillDrugCodes(c.rx),
+				}
+			}
+			if c.total > chain.TotalRefills {
+				chain.TotalRefills = c.total
+			}
+			chain.Dispenses = append(chain.Dispenses, RefillDispense{
+				RefillNo:       c.refillNo,
+				PrescriptionNo: c.rx.PrescriptionNo,
+				DispenseDate:   c.rx.DispenseDate,
+				VisitSequence:  c.rx.VisitSequence,
+				DaysSupply:     maxDaysSupply(c.rx),
+			})
+			lastNo = c.refillNo
+		}
+		if chain != nil {
+			chains = append(chains, finishRefillChain(*chain))
+		}
+	}
+
+	sort.SliceStable(chains, func(i, j int) bool {
+		if chains[i].PatientID != chains[j].PatientID {
+			return chains[i].PatientID < chains[j].PatientID
+		}
+		return chains[i].Dispenses[0].DispenseDate < chains[j].Dispenses[0].DispenseDate
+	})
+	return chains
+}
+
+// finishRefillChain 計算跳號、下一次應領次數與預計領藥日 (總次數未知時不預測下一次)
+func finishRefillChain(chain RefillChain) RefillChain {
+	first := chain.Dispenses[0]
+	last := chain.Dispenses[len(chain.Dispenses)-1]
+
+	seen := make(map[int]bool, len(chain.Dispenses))
+	for _, d := range chain.Dispenses {
+		seen[d.RefillNo] = true
+	}
+	for n := first.RefillNo + 1; n < last.RefillNo; n++ {
+		if !seen[n] {
+			chain.MissingRefills = append(chain.MissingRefills, n)
+		}
+	}
+	chain.HasGap = len(chain.MissingRefills) > 0
+
+	if chain.TotalRefills > 0 && last.RefillNo < chain.TotalRefills {
+		chain.NextRefillNo = last.RefillNo + 1
+		if day, ok := parseDispenseDay(last.DispenseDate); ok && last.DaysSupply > 0 {
+			chain.NextDueDate = day.AddDate(0, 0, last.DaysSupply).Format("2006-01-02")
+		}
+	}
+	return chain
+}
+
+// refillDrugCodes 處方中藥品醫令的代碼 (排序、去重)，作為辨識同一慢箋的依據
+func refillDrugCodes(rx *HISPrescription) []string {
+	set := make(map[string]bool)
+	for _, item := range rx.Items {
+		if isDrugItem(item) {
+			set[strings.ToUpper(item.DrugCode)] = true
+		}
+	}
+	return sortedKeys(set)
+}
+
+// maxDaysSupply 處方中最長的給藥天數
+func maxDaysSupply(rx *HISPrescription) int {
+	days := 0
+	for _, item := range rx.Items {
+		if item.DaysSupply > days {
+			days = item.DaysSupply
+		}
+	}
+	return days
+}
@@ -0,0 +1,79 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+// refillRx 建立慢箋測試處方 (total 為 0 表示資料未提供總次數)
+func refillRx(seq, date string, total int) HISPrescription {
+	return HISPrescription{
+		PatientID:     "A123456789",
+		ProviderCode:  "1101010010",
+		VisitType:     "08",
+		VisitSequence: seq,
+		DispenseDate:  date,
+		TotalRefills:  total,
+		Items:         []HISPrescriptionItem{{OrderType: OrderTypeDrug, DrugCode: "AC12345100", Quantity: 28, DaysSupply: 28}},
+	}
+}
+
+func TestMatchRefills(t *testing.T) {
+	tests := []struct {
+		name        string
+		rxs         []HISPrescription
+		wantTotal   int
+		wantMissing []int
+		wantNextNo  int
+		wantNextDue string
+	}{
+		{
+			name: "complete",
+			rxs: []HISPrescription{
+				refillRx("IC01", "2024-01-05", 3),
+				refillRx("IC02", "2024-02-02", 3),
+				refillRx("IC03", "2024-03-01", 3),
+			},
+			wantTotal: 3,
+		},
+		{
+			name: "partial with gap",
+			rxs: []HISPrescription{
+				refillRx("IC01", "2024-01-05", 4),
+				refillRx("IC03", "2024-03-01", 4),
+			},
+			wantTotal:   4,
+			wantMissing: []int{2},
+			wantNextNo:  4,
+			wantNextDue: "2024-03-29",
+		},
+		{
+			name: "unknown total",
+			rxs: []HISPrescription{
+				refillRx("IC02", "2024-02-02", 0),
+				refillRx("IC03", "2024-03-01", 0),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chains := MatchRefills(tt.rxs)
+			if len(chains) != 1 {
+				t.Fatalf("got %d chains, want 1", len(chains))
+			}
+			c := chains[0]
+			if len(c.Dispenses) != len(tt.rxs) {
+				t.Errorf("dispenses = %d, want %d", len(c.Dispenses), len(tt.rxs))
+			}
+			if c.TotalRefills != tt.wantTotal {
+				t.Errorf("TotalRefills = %d, want %d", c.TotalRefills, tt.wantTotal)
+			}
+			if !reflect.DeepEqual(c.MissingRefills, tt.wantMissing) || c.HasGap != (len(tt.wantMissing) > 0) {
+				t.Errorf("MissingRefills = %v (HasGap %v), want %v", c.MissingRefills, c.HasGap, tt.wantMissing)
+			}
+			if c.NextRefillNo != tt.wantNextNo || c.NextDueDate != tt.wantNextDue {
+				t.Errorf("next = %d %q, want %d %q", c.NextRefillNo, c.NextDueDate, tt.wantNextNo, tt.wantNextDue)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Package parser 列印用 HTML 報表
+// 產生可直接列印或另存 PDF 的摘要報表 (病患列表、藥品統計、處方明細)
+package parser
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed his_report.html
+var reportFS embed.FS
+
+var reportTemplate = template.Must(template.New("his_report.html").Funcs(template.FuncMap{
+	"num":   formatFloat,
+	"money": formatMoney,
+}).ParseFS(reportFS, "his_report.html"))
+
+// ReportOptions 報表選項
+type ReportOptions struct {
+	Title       string    // 報表標題，預設「HIS 匯入摘要報表」
+	ClinicName  string    // 機構名稱
+	ShowFullID  bool      // 顯示完整身分證號與電話 (預設遮蔽)
+	GeneratedAt time.Time // 產生時間，零值為目前時間
+}
+
+// reportData 報表樣板資料
+type reportData struct {
+	*HISImportResult
+	Title       string
+	ClinicName  string
+	ShowFullID  bool
+	GeneratedAt string
+	DateFrom    string
+	DateTo      string
+	ItemCount   int
+}
+
+// RenderReportHTML 產生列印用 HTML 報表
+// 處方依調劑日期排序，藥品統計依總量由多到少排序；身分證號與電話預設遮蔽
+func RenderReportHTML(result *HISImportResult, opts ReportOptions) ([]byte, error) {
+	if result == nil {
+		return nil, fmt.Errorf("報表產生失敗: %w", ErrNoRecords)
+	}
+
+	// 複製一份以免修改呼叫端資料
+	view := *result
+	view.Prescriptions = append([]HISPrescription(nil), result.Prescriptions...)
+	sort.SliceStable(view.Prescriptions, func(i, j int) bool {
+		a, b := view.Prescriptions[i], view.Prescriptions[j]
+		if a.DispenseDate != b.DispenseDate {
+			return a.DispenseDate < b.DispenseDate
+		}
+		return a.DispenseTime < b.DispenseTime
+	})
+	view.DrugUsages, view.ServiceFees = summarizeUsages(view.Prescriptions)
+	sort.SliceStable(view.DrugUsages, func(i, j int) bool {
+		return view.DrugUsages[i].TotalQty > view.DrugUsages[j].TotalQty
+	})
+
+	if !opts.ShowFullID {
+		view.Patients = append([]HISPatient(nil), result.Patients...)
+		view.MaskAll(MaskPartial)
+	}
+
+	data := reportData{
+		HISImportResult: &view,
+		Title:           firstNonEmpty(opts.Title, "HIS 匯入摘要報表"),
+		ClinicName:      opts.ClinicName,
+		ShowFullID:      opts.ShowFullID,
+	}
+
+	generatedAt := opts.GeneratedAt
+	if generatedAt.IsZero() {
+		generatedAt = time.Now()
+	}
+	data.GeneratedAt = generatedAt.Format("2006-01-02 15:04")
+
+	summary := view.Summary()
+	data.DateFrom, data.DateTo = summary.DateFrom, summary.DateTo
+	data.ItemCount = summary.OrderLines
+
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("報表產生失敗: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// formatMoney 金額加上千分位 (1234567.5 -> 1,234,567.5)
+func formatMoney(f float64) string {
+	s := formatFloat(f)
+	intPart, frac := s, ""
+	if idx := strings.Index(s, "."); idx >= 0 {
+		intPart, frac = s[:idx], s[idx:]
+	}
+	sign := ""
+	if strings.HasPrefix(intPart, "-") {
+		sign, intPart = "-", intPart[1:]
+	}
+
+	var sb strings.Builder
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteRune(c)
+	}
+	return sign + sb.String() + frac
+}
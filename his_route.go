@@ -0,0 +1,76 @@
+// Package parser 給藥途徑標準化
+// 各廠商途徑寫法不一 (PO、p.o.、口服)，統一轉換為標準代碼與中文名稱
+package parser
+
+// routeNames 標準給藥途徑代碼與中文名稱
+var routeNames = map[string]string{
+	"PO":  "口服",
+	"EXT": "外用",
+	"IV":  "靜脈",
+	"IM":  "肌肉",
+	"SC":  "皮下",
+	"SL":  "舌下",
+	"INH": "吸入",
+}
+
+// routeAliases 常見別名 (含中文寫法) 對應標準代碼
+var routeAliases = map[string]string{
+	"ORAL":          "PO",
+	"口服":            "PO",
+	"內服":            "PO",
+	"TOPICAL":       "EXT",
+	"TOP":           "EXT",
+	"EXTERNAL":      "EXT",
+	"外用":            "EXT",
+	"局部":            "EXT",
+	"IVD":           "IV",
+	"IVP":           "IV",
+	"IVF":           "IV",
+	"INTRAVENOUS":   "IV",
+	"靜脈":            "IV",
+	"靜脈注射":          "IV",
+	"靜注":            "IV",
+	"INTRAMUSCULAR": "IM",
+	"肌肉":            "IM",
+	"肌肉注射":          "IM",
+	"肌注":            "IM",
+	"SQ":            "SC",
+	"SUBQ":          "SC",
+	"SUBCUT":        "SC",
+	"SUBCUTANEOUS":  "SC",
+	"皮下":            "SC",
+	"皮下注射":          "SC",
+	"SUBLINGUAL":    "SL",
+	"舌下":            "SL",
+	"舌下含服":          "SL",
+	"INHL":          "INH",
+	"INHALATION":    "INH",
+	"吸入":            "INH",
+}
+
+// NormalizeRoute 解析給藥途徑，回傳標準代碼與中文名稱
+// 支援標準代碼 (PO/EXT/IV/IM/SC/SL/INH)、英文別名 (p.o.、ORAL、SQ) 與中文寫法 (口服、外用)
+// 無法辨識時原樣回傳輸入字串，name 為空字串
+func NormalizeRoute(raw string) (code string, name string) {
+	s := normalizeFrequencyText(raw)
+	if s == "" {
+		return raw, ""
+	}
+	if alias, ok := routeAliases[s]; ok {
+		s = alias
+	}
+	if name, ok := routeNames[s]; ok {
+		return s, name
+	}
+	return raw, ""
+}
+
+// tagRoutes 將給藥途徑轉為標準代碼並填入中文名稱
+func tagRoutes(result *HISImportResult) {
+	for i := range result.Prescriptions {
+		items := result.Prescriptions[i].Items
+		for j := range items {
+			items[j].Route, items[j].RouteName = NormalizeRoute(items[j].Route)
+		}
+	}
+}
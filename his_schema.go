@@ -0,0 +1,109 @@
+// Package parser 解析結果 JSON Schema
+// 由 HISImportResult 的結構與 json tag 產生 Draft-07 schema，供前端驗證與產生型別
+package parser
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const jsonSchemaDraft07 = "http://json-schema.org/draft-07/schema#"
+
+var (
+	resultSchemaOnce sync.Once
+	resultSchema     []byte
+)
+
+// GetResultJSONSchema 回傳 HISImportResult 的 JSON Schema (Draft-07)
+// 巢狀結構 (HISPatient、HISPrescription、HISPrescriptionItem、HISDrugUsage...) 置於 definitions；
+// 未標 omitempty 的欄位列為 required
+func GetResultJSONSchema() []byte {
+	resultSchemaOnce.Do(func() {
+		gen := &schemaGenerator{definitions: make(map[string]interface{})}
+		root := gen.structSchema(reflect.TypeOf(HISImportResult{}))
+		root["$schema"] = jsonSchemaDraft07
+		root["title"] = "HISImportResult"
+		root["definitions"] = gen.definitions
+		resultSchema, _ = json.MarshalIndent(root, "", "  ")
+	})
+	return resultSchema
+}
+
+// schemaGenerator 以 reflect 逐層產生 schema，結構型別只定義一次
+type schemaGenerator struct {
+	definitions map[string]interface{}
+}
+
+// typeSchema 產生單一型別的 schema
+func (g *schemaGenerator) typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.typeSchema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := g.definitions[name]; !ok {
+			g.definitions[name] = true // 佔位，避免遞迴型別無限展開
+			g.definitions[name] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema 依 json tag 產生結構的 object schema
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // 未匯出
+		}
+
+		name, opts := field.Name, ""
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ = strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+		}
+
+		prop := g.typeSchema(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+			// 未標 omitempty 的 nil slice / map 會輸出 null
+			if k := field.Type.Kind(); k == reflect.Slice || k == reflect.Map {
+				prop["type"] = []string{prop["type"].(string), "null"}
+			}
+		}
+		properties[name] = prop
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
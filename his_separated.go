@@ -0,0 +1,180 @@
+// Package parser 就醫資料檔與醫令資料檔分離格式
+// 部分醫院將就醫基本資料 (MB1) 與醫令明細 (MB2) 匯出成兩個檔案，以醫院代碼、就醫序號與病患關聯後組回完整處方
+package parser
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// separatedKey 就醫資料與醫令資料的關聯鍵 (醫院代碼、就醫序號或就醫識別碼、身分證)
+type separatedKey struct {
+	provider string
+	visit    string
+	patient  string
+}
+
+// separatedKeyOf 由 MB1 取出關聯鍵，醫院代碼缺漏時以 MSH 醫事機構代號代替
+func separatedKeyOf(rec *NHIRecord) separatedKey {
+	return separatedKey{
+		provider: strings.ToUpper(firstNonEmpty(sanitizeField(rec.MB1.A14), sanitizeField(rec.MSH.H1))),
+		visit:    strings.ToUpper(firstNonEmpty(sanitizeField(rec.MB1.A54), sanitizeField(rec.MB1.A18))),
+		patient:  strings.ToUpper(sanitizeField(rec.MB1.A12)),
+	}
+}
+
+// String 警告訊息使用的關聯鍵描述 (身分證已遮蔽)
+func (k separatedKey) String() string {
+	return fmt.Sprintf("醫院 %s、就醫序號 %s、病患 %s", k.provider, k.visit, MaskNationalID(k.patient, MaskPartial))
+}
+
+// separatedOrders 同一關聯鍵的醫令 (依醫令資料檔出現順序)
+type separatedOrders struct {
+	recNo  int // 第一筆出現的 REC 序號
+	mb2s   []NHIMB2
+	usedBy int // 併入的就醫資料 REC 序號，0 表示尚未使用
+}
+
+// ParseSeparatedFiles 解析分離的就醫資料檔與醫令資料檔 (健保上傳 XML 格式，自動偵測 Big5)
+// 就醫資料檔每筆 REC 含 MB1；醫令資料檔每筆 REC 含關聯用的 MB1 欄位 (A12 身分證、A14 醫院代碼、A18 就醫序號或 A54 就醫識別碼)
+// 與該次就醫的 MB2 醫令，同一次就醫可分成多筆 REC。
+// 有就醫資料但無醫令者仍匯入 (處方無藥品)，有醫令但無就醫資料者無法組成處方而略過 (Skipped)，
+// 多筆就醫資料對應同一組醫令時僅併入第一筆，以上皆記錄於 Warnings。
+// Total 為就醫資料檔的 REC 數 (含損壞)，加上無法組成處方的醫令 (損壞的 REC 與無對應就醫資料的每組醫令)；
+// 同一處方的多筆就醫資料合併後只計一筆
+func ParseSeparatedFiles(visitFile, orderFile io.Reader) (*HISImportResult, error) {
+	result := &HISImportResult{
+		SourceType:   "xml",
+		SourceVendor: "nhi",
+	}
+
+	visits, err := readSeparatedRecords(result, visitFile, "就醫資料檔")
+	if err != nil {
+		return result, err
+	}
+	result.Total = len(visits) + result.Failed // 損壞的 REC 已計入 Failed
+	damagedVisits := result.Failed
+	orders, err := readSeparatedRecords(result, orderFile, "醫令資料檔")
+	if err != nil {
+		return result, err
+	}
+	result.Total += result.Failed - damagedVisits
+	if len(visits) == 0 && len(orders) == 0 {
+		return emptyFileResult(result)
+	}
+
+	// 醫令依關聯鍵分組
+	orderMap := make(map[separatedKey]*separatedOrders)
+	var orderKeys []separatedKey
+	for _, order := range orders {
+		key := separatedKeyOf(order.rec)
+		group, ok := orderMap[key]
+		if !ok {
+			group = &separatedOrders{recNo: order.recNo}
+			orderMap[key] = group
+			orderKeys = append(orderKeys, key)
+		}
+		group.mb2s = append(group.mb2s, order.rec.MB2s...)
+	}
+
+	patientMap := make(map[string]*HISPatient)
+	for _, visit := range visits {
+		rec := visit.rec
+		key := separatedKeyOf(rec)
+		group, ok := orderMap[key]
+		switch {
+		case ok && group.usedBy == 0:
+			group.usedBy = visit.recNo
+			rec.MB2s = append(rec.MB2s, group.mb2s...)
+		case ok:
+			result.Warnings = append(result.Warnings, fmt.Sprintf("就醫資料檔第 %d 筆與第 %d 筆對應同一組醫令，醫令僅併入第 %d 筆 (%s)",
+				visit.recNo, group.usedBy, group.usedBy, key))
+		case len(rec.MB2s) == 0:
+			result.Warnings = append(result.Warnings, fmt.Sprintf("就醫資料檔第 %d 筆無對應醫令 (%s)", visit.recNo, key))
+		}
+
+		if rec.MB1.A12 != "" {
+			upsertPatient(patientMap, extractPatientFromMB1(&rec.MB1))
+		}
+		prescription, err := extractPrescriptionFromRecord(rec)
+		if err != nil {
+			result.addLineError(fmt.Sprintf("第 %d 筆處方解析失敗: %s", visit.recNo, err.Error()), visit.recNo, "", "", err.Error())
+			result.Failed++
+			continue
+		}
+		prescription.SourceIndex = visit.recNo
+		result.Prescriptions = append(result.Prescriptions, *prescription)
+		result.Imported++
+	}
+
+	// 沒有就醫資料的醫令
+	for _, key := range orderKeys {
+		group := orderMap[key]
+		if group.usedBy != 0 {
+			continue
+		}
+		result.Warnings = append(result.Warnings, fmt.Sprintf("醫令資料檔第 %d 筆起共 %d 筆醫令無對應就醫資料，已略過 (%s)",
+			group.recNo, len(group.mb2s), key))
+		result.Total++
+		result.Skipped++
+	}
+
+	for _, p := range patientMap {
+		result.Patients = append(result.Patients, *p)
+	}
+	mergeSplitPrescriptions(result)
+
+	finalizeResult(result)
+	result.Success = result.Failed == 0
+	return result, nil
+}
+
+// separatedRecord 分離格式檔案中的一筆 REC
+type separatedRecord struct {
+	recNo int
+	rec   *NHIRecord
+}
+
+// readSeparatedRecords 讀取並逐筆解碼分離格式檔案的 REC，單筆損壞時記錄錯誤並略過
+func readSeparatedRecords(result *HISImportResult, r io.Reader, label string) ([]separatedRecord, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		err = fmt.Errorf("%w: %s: %w", ErrReadFailed, label, err)
+		result.Errors = append(result.Errors, err.Error())
+		return nil, err
+	}
+	text := newParseOptions().decodeText(content)
+	if sanitizeField(text) == "" {
+		return nil, nil
+	}
+	if !isNHIXMLContent(text) {
+		err := fmt.Errorf("%w: %s 不是健保上傳 XML", ErrUnknownFormat, label)
+		result.Errors = append(result.Errors, err.Error())
+		return nil, err
+	}
+
+	var records []separatedRecord
+	err = streamXMLRecords(strings.NewReader(text), true, func(i int, chunk xmlRecordChunk, recErr error) error {
+		rec := &NHIRecord{}
+		if recErr == nil {
+			recErr = decodeXMLRecord(chunk, rec)
+		}
+		if recErr != nil {
+			result.addLineError(fmt.Sprintf("%s第 %d 筆 REC XML 損壞，已略過: %s", label, i, recErr.Error()), i, chunk.Data, "", "XML 損壞")
+			result.Failed++
+			return nil
+		}
+		if chunk.Repaired {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s第 %d 筆 REC 缺少結束標籤，已自動補齊", label, i))
+		}
+		records = append(records, separatedRecord{recNo: i, rec: rec})
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("%s: %w", label, err)
+		result.Errors = append(result.Errors, err.Error())
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+// separatedVisit 就醫資料檔的一筆 REC
+func separatedVisit(id, seq, date string) string {
+	return "<REC><MSH><h1>5912345678</h1></MSH><MB1><A12>" + id + "</A12><A14>1101010010</A14><A17>" + date +
+		"103000</A17><A18>" + seq + "</A18><A23>01</A23></MB1></REC>\n"
+}
+
+// separatedOrder 醫令資料檔的一筆 REC (只含關聯欄位與一筆醫令)
+func separatedOrder(id, seq, drug string) string {
+	return "<REC><MB1><A12>" + id + "</A12><A14>1101010010</A14><A18>" + seq + "</A18></MB1>" +
+		"<MB2><p1>1</p1><p2>" + drug + "</p2><p7>28</p7><d27>28</d27></MB2></REC>\n"
+}
+
+func TestParseSeparatedFiles(t *testing.T) {
+	visits := "<RECS>\n" +
+		separatedVisit("A123456789", "0001", "1130105") + // 兩筆醫令
+		separatedVisit("B223456782", "0002", "1130105") + // 無醫令
+		separatedVisit("A123456789", "0001", "1130105") + // 與第 1 筆同一關聯鍵
+		"<REC><MB1><A12 A123</A12></MB1></REC>\n" + // 損壞
+		"</RECS>"
+	orders := "<RECS>\n" +
+		separatedOrder("A123456789", "0001", "AC12345100") +
+		separatedOrder("C123456781", "0009", "BC23456100") + // 無對應就醫資料
+		separatedOrder("A123456789", "0001", "BC23456100") +
+		"</RECS>"
+
+	result, err := ParseSeparatedFiles(strings.NewReader(visits), strings.NewReader(orders))
+	if err != nil {
+		t.Fatalf("ParseSeparatedFiles: %v", err)
+	}
+
+	var joined *HISPrescription
+	for i := range result.Prescriptions {
+		if rx := &result.Prescriptions[i]; rx.PatientID == "A123456789" {
+			joined = rx
+		}
+	}
+	if joined == nil || len(joined.Items) != 2 {
+		t.Fatalf("joined prescription = %+v, want A123456789 with 2 items", joined)
+	}
+
+	// 第 3 筆與第 1 筆為同一處方，合併後不重複計入
+	if result.Total != 4 || result.Imported != 2 || result.Skipped != 1 || result.Failed != 1 {
+		t.Errorf("total/imported/skipped/failed = %d/%d/%d/%d, want 4/2/1/1",
+			result.Total, result.Imported, result.Skipped, result.Failed)
+	}
+	if result.Imported+result.Skipped+result.Failed > result.Total {
+		t.Errorf("imported+skipped+failed exceeds total %d", result.Total)
+	}
+
+	want := []string{"就醫資料檔第 2 筆無對應醫令", "就醫資料檔第 3 筆與第 1 筆對應同一組醫令", "醫令資料檔第 2 筆起共 1 筆醫令無對應就醫資料"}
+	for _, w := range want {
+		found := false
+		for _, got := range result.Warnings {
+			found = found || strings.HasPrefix(got, w)
+		}
+		if !found {
+			t.Errorf("warnings = %q, want one starting with %q", result.Warnings, w)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Package parser SQLite 匯出
+// 將多次匯入的結果累積到本機資料庫；本套件不內建驅動程式，由呼叫端 import 後以 database/sql 寫入
+// (cmd/web 以 cgo 編譯時內建 github.com/mattn/go-sqlite3)
+package parser
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SQLiteDriverName database/sql 的 SQLite 驅動程式名稱
+// modernc.org/sqlite 為 "sqlite"，github.com/mattn/go-sqlite3 為 "sqlite3"
+var SQLiteDriverName = "sqlite"
+
+// ErrNoSQLiteDriver 尚未註冊 SQLite 驅動程式
+var ErrNoSQLiteDriver = errors.New("未註冊 SQLite 驅動程式，請 import modernc.org/sqlite 或設定 SQLiteDriverName")
+
+// sqliteSchema 資料表與索引 (可重複執行)
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS patients (
+		national_id TEXT PRIMARY KEY,
+		name        TEXT NOT NULL DEFAULT '',
+		birthday    TEXT NOT NULL DEFAULT '',
+		gender      TEXT NOT NULL DEFAULT '',
+		phone       TEXT NOT NULL DEFAULT '',
+		mobile      TEXT NOT NULL DEFAULT '',
+		card_number TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS prescriptions (
+		rx_key            TEXT PRIMARY KEY,
+		patient_id        TEXT NOT NULL,
+		prescription_no   TEXT NOT NULL DEFAULT '',
+		dispense_date     TEXT NOT NULL DEFAULT '',
+		dispense_time     TEXT NOT NULL DEFAULT '',
+		visit_type        TEXT NOT NULL DEFAULT '',
+		visit_sequence    TEXT NOT NULL DEFAULT '',
+		chronic_refill_no INTEGER NOT NULL DEFAULT 0,
+		provider_code     TEXT NOT NULL DEFAULT '',
+		diagnosis_code    TEXT NOT NULL DEFAULT '',
+		total_points      REAL NOT NULL DEFAULT 0,
+		copay             REAL NOT NULL DEFAULT 0,
+		source_vendor     TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS prescription_items (
+		rx_key      TEXT NOT NULL REFERENCES prescriptions(rx_key) ON DELETE CASCADE,
+		seq         INTEGER NOT NULL,
+		order_type  TEXT NOT NULL DEFAULT '',
+		drug_code   TEXT NOT NULL DEFAULT '',
+		drug_name   TEXT NOT NULL DEFAULT '',
+		frequency   TEXT NOT NULL DEFAULT '',
+		route       TEXT NOT NULL DEFAULT '',
+		quantity    REAL NOT NULL DEFAULT 0,
+		days_supply INTEGER NOT NULL DEFAULT 0,
+		unit_price  REAL NOT NULL DEFAULT 0,
+		is_self_pay INTEGER NOT NULL DEFAULT 0,
+		atc_code    TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (rx_key, seq)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_prescriptions_patient_id ON prescriptions (patient_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_prescription_items_drug_code ON prescription_items (drug_code)`,
+}
+
+// 病患以身分證為鍵，重複匯入時只以非空值覆蓋既有資料
+const sqliteUpsertPatient = `INSERT INTO patients (national_id, name, birthday, gender, phone, mobile, card_number)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (national_id) DO UPDATE SET
+		name        = COALESCE(NULLIF(excluded.name, ''), patients.name),
+		birthday    = COALESCE(NULLIF(excluded.birthday, ''), patients.birthday),
+		gender      = COALESCE(NULLIF(excluded.gender, ''), patients.gender),
+		phone       = COALESCE(NULLIF(excluded.phone, ''), patients.phone),
+		mobile      = COALESCE(NULLIF(excluded.mobile, ''), patients.mobile),
+		card_number = COALESCE(NULLIF(excluded.card_number, ''), patients.card_number)`
+
+// 處方以 rx_key (身分證 + 處方序號，無序號時加上日期與就醫序號) 為鍵，重複匯入時以新資料取代
+const sqliteUpsertPrescription = `INSERT INTO prescriptions (rx_key, patient_id, prescription_no, dispense_date, dispense_time,
+		visit_type, visit_sequence, chronic_refill_no, provider_code, diagnosis_code, total_points, copay, source_vendor)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (rx_key) DO UPDATE SET
+		patient_id        = excluded.patient_id,
+		prescription_no   = excluded.prescription_no,
+		dispense_date     = excluded.dispense_date,
+		dispense_time     = excluded.dispense_time,
+		visit_type        = excluded.visit_type,
+		visit_sequence    = excluded.visit_sequence,
+		chronic_refill_no = excluded.chronic_refill_no,
+		provider_code     = excluded.provider_code,
+		diagnosis_code    = excluded.diagnosis_code,
+		total_points      = excluded.total_points,
+		copay             = excluded.copay,
+		source_vendor     = excluded.source_vendor`
+
+const sqliteInsertItem = `INSERT INTO prescription_items (rx_key, seq, order_type, drug_code, drug_name, frequency, route,
+		quantity, days_supply, unit_price, is_self_pay, atc_code)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// ExportSQLite 將解析結果寫入 SQLite 檔 (不存在時建立)，重複匯入同一處方不會產生重複資料
+// 需先 import 已註冊為 SQLiteDriverName 的驅動程式，否則回傳 ErrNoSQLiteDriver
+func (r *HISImportResult) ExportSQLite(path string) error {
+	registered := false
+	for _, name := range sql.Drivers() {
+		if name == SQLiteDriverName {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return ErrNoSQLiteDriver
+	}
+
+	db, err := sql.Open(SQLiteDriverName, path)
+	if err != nil {
+		return fmt.Errorf("開啟 SQLite 檔失敗: %w", err)
+	}
+	defer db.Close()
+
+	return r.ExportSQLiteDB(db)
+}
+
+// ExportSQLiteDB 將解析結果寫入已開啟的 SQLite 資料庫 (單一 transaction 批次寫入)
+func (r *HISImportResult) ExportSQLiteDB(db *sql.DB) error {
+	if r == nil {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("開始 transaction 失敗: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range sqliteSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("建立資料表失敗: %w", err)
+		}
+	}
+
+	patientStmt, err := tx.Prepare(sqliteUpsertPatient)
+	if err != nil {
+		return fmt.Errorf("準備病患寫入失敗: %w", err)
+	}
+	defer patientStmt.Close()
+	for _, p := range r.Patients {
+		if p.NationalID == "" {
+			continue
+		}
+		if _, err := patientStmt.Exec(p.NationalID, p.Name, p.Birthday, p.Gender, p.Phone, p.Mobile, p.CardNumber); err != nil {
+			return fmt.Errorf("寫入病患 %s 失敗: %w", MaskNationalID(p.NationalID, MaskPartial), err)
+		}
+	}
+
+	rxStmt, err := tx.Prepare(sqliteUpsertPrescription)
+	if err != nil {
+		return fmt.Errorf("準備處方寫入失敗: %w", err)
+	}
+	defer rxStmt.Close()
+	deleteItems, err := tx.Prepare(`DELETE FROM prescription_items WHERE rx_key = ?`)
+	if err != nil {
+		return fmt.Errorf("準備醫令寫入失敗: %w", err)
+	}
+	defer deleteItems.Close()
+	itemStmt, err := tx.Prepare(sqliteInsertItem)
+	if err != nil {
+		return fmt.Errorf("準備醫令寫入失敗: %w", err)
+	}
+	defer itemStmt.Close()
+
+	for i := range r.Prescriptions {
+		rx := &r.Prescriptions[i]
+		// 以輸出的身分證組成鍵值，遮蔽後不會把原始身分證寫入檔案
+		key := strings.ReplaceAll(prescriptionKeyFor(rx.PatientID, rx), "\x00", "|")
+		if _, err := rxStmt.Exec(key, rx.PatientID, rx.PrescriptionNo, rx.DispenseDate, rx.DispenseTime,
+			rx.VisitType, rx.VisitSequence, rx.ChronicRefillNo, rx.ProviderCode, rx.DiagnosisCode,
+			rx.TotalPoints, rx.Copay, r.SourceVendor); err != nil {
+			return fmt.Errorf("寫入處方 %s 失敗: %w", rx.PrescriptionNo, err)
+		}
+
+		// 醫令以本次匯入為準，先清除舊資料避免重複
+		if _, err := deleteItems.Exec(key); err != nil {
+			return fmt.Errorf("清除處方 %s 醫令失敗: %w", rx.PrescriptionNo, err)
+		}
+		for seq, item := range rx.allItems() {
+			selfPay := 0
+			if item.IsSelfPay {
+				selfPay = 1
+			}
+			if _, err := itemStmt.Exec(key, seq+1, item.OrderType, item.DrugCode, item.DrugName, item.Frequency,
+				item.Route, item.Quantity, item.DaysSupply, item.UnitPrice, selfPay, item.ATCCode); err != nil {
+				return fmt.Errorf("寫入處方 %s 醫令失敗: %w", rx.PrescriptionNo, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("寫入 SQLite 失敗: %w", err)
+	}
+	return nil
+}
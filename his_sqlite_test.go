@@ -0,0 +1,69 @@
+//go:build cgo
+
+package parser
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestExportSQLiteRoundTrip(t *testing.T) {
+	defer func(name string) { SQLiteDriverName = name }(SQLiteDriverName)
+	SQLiteDriverName = "sqlite3"
+
+	result, err := ParseWithOptions(strings.NewReader(genericMappingCSV), "data.csv", VendorGeneric)
+	if err != nil {
+		t.Fatalf("ParseWithOptions: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "his.db")
+	// 重複匯出同一結果不應產生重複資料
+	for i := 0; i < 2; i++ {
+		if err := result.ExportSQLite(path); err != nil {
+			t.Fatalf("ExportSQLite #%d: %v", i+1, err)
+		}
+	}
+
+	db, err := sql.Open(SQLiteDriverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var patients, prescriptions, items int
+	for table, n := range map[string]*int{"patients": &patients, "prescriptions": &prescriptions, "prescription_items": &items} {
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+	}
+	if patients != 1 || prescriptions != 1 || items != 1 {
+		t.Fatalf("patients/prescriptions/items = %d/%d/%d, want 1/1/1", patients, prescriptions, items)
+	}
+
+	var name, code string
+	var qty float64
+	err = db.QueryRow(`SELECT p.name, i.drug_code, i.quantity FROM prescription_items i
+		JOIN prescriptions r ON r.rx_key = i.rx_key
+		JOIN patients p ON p.national_id = r.patient_id
+		WHERE p.national_id = ?`, "A123456789").Scan(&name, &code, &qty)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if name != "王小明" || code != "AC12345100" || qty != 28 {
+		t.Errorf("row = %s %s %v, want 王小明 AC12345100 28", name, code, qty)
+	}
+}
+
+func TestExportSQLiteNoDriver(t *testing.T) {
+	defer func(name string) { SQLiteDriverName = name }(SQLiteDriverName)
+	SQLiteDriverName = "no-such-driver"
+
+	err := (&HISImportResult{}).ExportSQLite(filepath.Join(t.TempDir(), "his.db"))
+	if !errors.Is(err, ErrNoSQLiteDriver) {
+		t.Errorf("ExportSQLite error = %v, want ErrNoSQLiteDriver", err)
+	}
+}
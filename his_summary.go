@@ -0,0 +1,77 @@
+// Package parser 匯入統計摘要
+// 彙整病患、處方、品項、日期範圍與慢箋比例，讓使用者一眼看懂匯入概況
+package parser
+
+// ImportSummary 匯入統計摘要
+type ImportSummary struct {
+	SourceType         string  `json:"source_type"`
+	SourceVendor       string  `json:"source_vendor"`
+	Patients           int     `json:"patients"`             // 病患數
+	Prescriptions      int     `json:"prescriptions"`        // 處方數
+	DrugItems          int     `json:"drug_items"`           // 藥品品項數 (不重複藥品代碼)
+	OrderLines         int     `json:"order_lines"`          // 醫令筆數
+	RecordsBeforeDedup int     `json:"records_before_dedup"` // 去重前的原始記錄數
+	RecordsAfterDedup  int     `json:"records_after_dedup"`  // 去重合併後的處方數
+	Failed             int     `json:"failed"`
+	DateFrom           string  `json:"date_from,omitempty"` // 最早調劑日 YYYY-MM-DD
+	DateTo             string  `json:"date_to,omitempty"`   // 最晚調劑日 YYYY-MM-DD
+	Providers          int     `json:"providers"`           // 原處方醫院數
+	ChronicCount       int     `json:"chronic_count"`       // 慢箋處方數
+	ChronicRatio       float64 `json:"chronic_ratio"`       // 慢箋比例 (0~1)
+	GrandTotal         float64 `json:"grand_total"`
+	SelfPayTotal       float64 `json:"self_pay_total"`
+	Errors             int     `json:"errors"`
+	Warnings           int     `json:"warnings"`
+}
+
+// Summary 彙整匯入統計摘要
+func (r *HISImportResult) Summary() ImportSummary {
+	s := ImportSummary{
+		SourceType:         r.SourceType,
+		SourceVendor:       r.SourceVendor,
+		Patients:           len(r.Patients),
+		Prescriptions:      len(r.Prescriptions),
+		RecordsBeforeDedup: r.Total,
+		RecordsAfterDedup:  len(r.Prescriptions),
+		Failed:             r.Failed,
+		GrandTotal:         r.GrandTotal,
+		SelfPayTotal:       r.SelfPayTotal,
+		Errors:             len(r.Errors),
+		Warnings:           len(r.Warnings),
+	}
+
+	drugs := make(map[string]bool)
+	providers := make(map[string]bool)
+	for i := range r.Prescriptions {
+		rx := &r.Prescriptions[i]
+		s.OrderLines += len(rx.Items) + len(rx.Procedures)
+		for _, item := range rx.Items {
+			if isDrugItem(item) && item.DrugCode != "" {
+				drugs[item.DrugCode] = true
+			}
+		}
+		if rx.ProviderCode != "" {
+			providers[rx.ProviderCode] = true
+		}
+		if isChronic, _, _ := DetectChronicPrescription(rx); isChronic {
+			s.ChronicCount++
+		}
+
+		if rx.DispenseDate == "" {
+			continue
+		}
+		if s.DateFrom == "" || rx.DispenseDate < s.DateFrom {
+			s.DateFrom = rx.DispenseDate
+		}
+		if rx.DispenseDate > s.DateTo {
+			s.DateTo = rx.DispenseDate
+		}
+	}
+
+	s.DrugItems = len(drugs)
+	s.Providers = len(providers)
+	if s.Prescriptions > 0 {
+		s.ChronicRatio = float64(s.ChronicCount) / float64(s.Prescriptions)
+	}
+	return s
+}
@@ -0,0 +1,203 @@
+// Package parser 純文字報表
+// 給不熟 JSON/CSV 的使用者直接列印：匯入統計、各病患處方與藥品、藥品使用量排行，欄位依中文全形寬度對齊
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/text/width"
+)
+
+// textReportTopDrugs 藥品使用量排行列出的品項數
+const textReportTopDrugs = 20
+
+// 處方明細欄寬 (顯示寬度，全形字元算 2)
+const (
+	textColCode = 12
+	textColName = 32
+	textColFreq = 8
+	textColDays = 6
+	textColQty  = 8
+)
+
+// ToTextReport 輸出中文排版的純文字報表 (UTF-8)
+// 病患依 Patients 順序、處方依調劑日期排序；身分證與電話依結果現況輸出，需遮蔽時請先呼叫 MaskAll
+func (r *HISImportResult) ToTextReport(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	summary := r.Summary()
+
+	fmt.Fprintln(bw, "HIS 匯入報表")
+	fmt.Fprintln(bw, strings.Repeat("=", 60))
+	fmt.Fprintf(bw, "產生時間：%s\n", time.Now().Format("2006-01-02 15:04"))
+	fmt.Fprintf(bw, "資料來源：%s (%s)\n", GetVendorName(HISVendor(r.SourceVendor)), r.SourceType)
+	if summary.DateFrom != "" {
+		fmt.Fprintf(bw, "調劑期間：%s ~ %s\n", summary.DateFrom, summary.DateTo)
+	}
+	fmt.Fprintln(bw)
+
+	fmt.Fprintln(bw, "【匯入統計】")
+	fmt.Fprintf(bw, "  病患 %d 位、處方 %d 筆、醫令 %d 筆、藥品 %d 項\n",
+		summary.Patients, summary.Prescriptions, summary.OrderLines, summary.DrugItems)
+	fmt.Fprintf(bw, "  原始記錄 %d 筆、匯入 %d 筆、略過 %d 筆、失敗 %d 筆\n", r.Total, r.Imported, r.Skipped, r.Failed)
+	fmt.Fprintf(bw, "  慢箋 %d 筆 (%.1f%%)、總點數 %s、自費 %s\n",
+		summary.ChronicCount, summary.ChronicRatio*100, formatMoney(r.GrandTotal), formatMoney(r.SelfPayTotal))
+	if len(r.Errors) > 0 || len(r.Warnings) > 0 {
+		fmt.Fprintf(bw, "  錯誤 %d 筆、警告 %d 筆\n", len(r.Errors), len(r.Warnings))
+	}
+	fmt.Fprintln(bw)
+
+	fmt.Fprintln(bw, "【病患處方】")
+	for _, group := range textReportPatients(r) {
+		p := group.patient
+		header := "  " + firstNonEmpty(p.Name, "(未具名)") + "  " + p.NationalID
+		if p.Birthday != "" {
+			header += "  生日 " + p.Birthday
+		}
+		if phone := firstNonEmpty(p.Mobile, p.Phone); phone != "" {
+			header += "  電話 " + phone
+		}
+		fmt.Fprintln(bw, header)
+
+		for _, rx := range group.prescriptions {
+			line := "    " + strings.TrimSpace(rx.DispenseDate+" "+rx.DispenseTime)
+			if rx.PrescriptionNo != "" {
+				line += "  處方 " + rx.PrescriptionNo
+			}
+			if provider := firstNonEmpty(rx.ProviderName, rx.ProviderCode); provider != "" {
+				line += "  " + provider
+			}
+			if isChronic, refillNo, total := DetectChronicPrescription(rx); isChronic && total > 0 {
+				line += fmt.Sprintf("  慢箋 %d/%d", refillNo, total)
+			} else if isChronic {
+				line += fmt.Sprintf("  慢箋第 %d 次", refillNo)
+			}
+			fmt.Fprintln(bw, line)
+
+			if len(rx.Items) == 0 {
+				fmt.Fprintln(bw, "      (無藥品)")
+				continue
+			}
+			fmt.Fprintln(bw, "      "+padWidth("代碼", textColCode)+padWidth("藥品名稱", textColName)+
+				padWidth("頻率", textColFreq)+padWidthLeft("天數", textColDays)+padWidthLeft("數量", textColQty))
+			for _, item := range rx.Items {
+				name := item.DrugName
+				if item.IsSelfPay {
+					name = "(自費) " + name
+				}
+				fmt.Fprintln(bw, "      "+padWidth(item.DrugCode, textColCode)+padWidth(name, textColName)+
+					padWidth(item.Frequency, textColFreq)+padWidthLeft(fmt.Sprint(item.DaysSupply), textColDays)+
+					padWidthLeft(formatFloat(item.Quantity), textColQty))
+			}
+		}
+		fmt.Fprintln(bw)
+	}
+
+	fmt.Fprintln(bw, "【藥品使用量排行】")
+	usages := r.TopDrugs(0)
+	if len(usages) == 0 {
+		fmt.Fprintln(bw, "  (無藥品資料)")
+	} else {
+		fmt.Fprintln(bw, "  "+padWidthLeft("排名", 5)+"  "+padWidth("代碼", textColCode)+padWidth("藥品名稱", textColName)+
+			padWidthLeft("總量", 10)+padWidthLeft("次數", textColDays))
+	}
+	for i, u := range usages {
+		if i == textReportTopDrugs {
+			fmt.Fprintf(bw, "  其餘 %d 項未列出\n", len(usages)-textReportTopDrugs)
+			break
+		}
+		fmt.Fprintln(bw, "  "+padWidthLeft(fmt.Sprint(i+1), 5)+"  "+padWidth(u.DrugCode, textColCode)+padWidth(u.DrugName, textColName)+
+			padWidthLeft(formatFloat(u.TotalQty), 10)+padWidthLeft(fmt.Sprint(u.DispenseCount), textColDays))
+	}
+
+	return bw.Flush()
+}
+
+// textPatientGroup 報表中一位病患與其處方
+type textPatientGroup struct {
+	patient       HISPatient
+	prescriptions []*HISPrescription
+}
+
+// textReportPatients 依病患分組處方 (處方依調劑日期與時間排序)，Patients 中沒有的病患依處方出現順序附在最後
+func textReportPatients(r *HISImportResult) []textPatientGroup {
+	var groups []textPatientGroup
+	index := make(map[string]int)
+	for _, p := range r.Patients {
+		if _, ok := index[p.NationalID]; ok {
+			continue
+		}
+		index[p.NationalID] = len(groups)
+		groups = append(groups, textPatientGroup{patient: p})
+	}
+	for i := range r.Prescriptions {
+		rx := &r.Prescriptions[i]
+		idx, ok := index[rx.PatientID]
+		if !ok {
+			idx = len(groups)
+			index[rx.PatientID] = idx
+			groups = append(groups, textPatientGroup{patient: HISPatient{NationalID: rx.PatientID}})
+		}
+		groups[idx].prescriptions = append(groups[idx].prescriptions, rx)
+	}
+
+	for _, g := range groups {
+		rxs := g.prescriptions
+		sort.SliceStable(rxs, func(i, j int) bool {
+			if rxs[i].DispenseDate != rxs[j].DispenseDate {
+				return rxs[i].DispenseDate < rxs[j].DispenseDate
+			}
+			return rxs[i].DispenseTime < rxs[j].DispenseTime
+		})
+	}
+	return groups
+}
+
+// displayWidth 字串在等寬字型中的顯示寬度 (中文等全形字元算 2)
+func displayWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		n += runeWidth(r)
+	}
+	return n
+}
+
+// runeWidth 單一字元的顯示寬度
+func runeWidth(r rune) int {
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// truncateWidth 截斷超過顯示寬度的字串 (保留一格放省略號)
+func truncateWidth(s string, w int) string {
+	if displayWidth(s) <= w {
+		return s
+	}
+	n := 0
+	for i, r := range s {
+		if n+runeWidth(r) > w-1 {
+			return s[:i] + "…"
+		}
+		n += runeWidth(r)
+	}
+	return s
+}
+
+// padWidth 靠左對齊並補空白至指定寬度，過長時截斷 (欄與欄之間保留一格空白)
+func padWidth(s string, w int) string {
+	s = truncateWidth(s, w-1)
+	return s + strings.Repeat(" ", w-displayWidth(s))
+}
+
+// padWidthLeft 靠右對齊 (數字欄)
+func padWidthLeft(s string, w int) string {
+	s = truncateWidth(s, w-1)
+	return strings.Repeat(" ", w-displayWidth(s)) + s
+}
@@ -0,0 +1,66 @@
+// Package parser 藥品使用量趨勢
+// 依調劑年月彙總各藥品消耗量，供庫存管理預測叫貨
+package parser
+
+import (
+	"fmt"
+	"sort"
+)
+
+// UnknownMonth 調劑日期為空或無法解析時歸入的年月
+const UnknownMonth = "unknown"
+
+// MonthlyDrugUsage 各藥品每月的消耗量 (藥品代碼 → 年月 YYYY-MM → 數量)，僅計入藥品醫令
+// 調劑日期為空或無法解析的處方歸入 UnknownMonth (解析時已於 Warnings 記錄筆數)
+func MonthlyDrugUsage(rxs []HISPrescription) map[string]map[string]float64 {
+	usage := make(map[string]map[string]float64)
+	for _, rx := range rxs {
+		month := UnknownMonth
+		if day, ok := parseDispenseDay(rx.DispenseDate); ok {
+			month = day.Format("2006-01")
+		}
+		for _, item := range rx.Items {
+			if !isDrugItem(item) || item.DrugCode == "" {
+				continue
+			}
+			months, ok := usage[item.DrugCode]
+			if !ok {
+				months = make(map[string]float64)
+				usage[item.DrugCode] = months
+			}
+			months[month] += item.Quantity
+		}
+	}
+	return usage
+}
+
+// warnUndatedUsage 有藥品醫令的處方缺少調劑日期時，於 Warnings 記錄將歸入 UnknownMonth 的筆數
+func warnUndatedUsage(result *HISImportResult) {
+	unknown := 0
+	for _, rx := range result.Prescriptions {
+		if _, ok := parseDispenseDay(rx.DispenseDate); ok {
+			continue
+		}
+		for _, item := range rx.Items {
+			if isDrugItem(item) && item.DrugCode != "" {
+				unknown++
+				break
+			}
+		}
+	}
+	if unknown > 0 {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%d 筆處方無調劑日期，藥品使用量歸入 %s", unknown, UnknownMonth))
+	}
+}
+
+// TopDrugs 消耗量 (總量) 前 n 名的藥品，總量相同時依首次出現順序；n 小於等於 0 時回傳全部
+func (r *HISImportResult) TopDrugs(n int) []HISDrugUsage {
+	usages := append([]HISDrugUsage(nil), r.DrugUsages...)
+	sort.SliceStable(usages, func(i, j int) bool {
+		return usages[i].TotalQty > usages[j].TotalQty
+	})
+	if n > 0 && n < len(usages) {
+		usages = usages[:n]
+	}
+	return usages
+}
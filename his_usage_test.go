@@ -0,0 +1,35 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMonthlyDrugUsageUndated(t *testing.T) {
+	result := &HISImportResult{Prescriptions: []HISPrescription{
+		{PatientID: "A123456789", DispenseDate: "2024-01-05", Items: []HISPrescriptionItem{{OrderType: OrderTypeDrug, DrugCode: "AC12345100", Quantity: 28}}},
+		{PatientID: "A123456789", Items: []HISPrescriptionItem{{OrderType: OrderTypeDrug, DrugCode: "AC12345100", Quantity: 14}}},
+	}}
+	finalizeResult(result)
+
+	warnings := 0
+	for _, w := range result.Warnings {
+		if strings.Contains(w, UnknownMonth) {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Fatalf("warnings = %q, want one undated warning", result.Warnings)
+	}
+
+	before := append([]string(nil), result.Warnings...)
+	usage := MonthlyDrugUsage(result.Prescriptions)
+	want := map[string]float64{"2024-01": 28, UnknownMonth: 14}
+	if !reflect.DeepEqual(usage["AC12345100"], want) {
+		t.Errorf("usage = %v, want %v", usage["AC12345100"], want)
+	}
+	if !reflect.DeepEqual(result.Warnings, before) {
+		t.Errorf("MonthlyDrugUsage changed warnings to %q", result.Warnings)
+	}
+}
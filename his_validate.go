@@ -0,0 +1,402 @@
+// Package parser 資料驗證函數
+// 身分證、居留證等欄位格式與檢核碼驗證
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// idLetterCodes 身分證首字母對應數值
+var idLetterCodes = map[byte]int{
+	'A': 10, 'B': 11, 'C': 12, 'D': 13, 'E': 14, 'F': 15, 'G': 16, 'H': 17,
+	'I': 34, 'J': 18, 'K': 19, 'L': 20, 'M': 21, 'N': 22, 'O': 35, 'P': 23,
+	'Q': 24, 'R': 25, 'S': 26, 'T': 27, 'U': 28, 'V': 29, 'W': 32, 'X': 30,
+	'Y': 31, 'Z': 33,
+}
+
+// ValidateNationalID 驗證台灣身分證或居留證號檢核碼
+// 支援: 身分證 (A123456789)、新式居留證 (A800000014)、舊式居留證 (AB12345678)
+func ValidateNationalID(id string) bool {
+	id = strings.ToUpper(strings.TrimSpace(id))
+	if len(id) != 10 {
+		return false
+	}
+
+	letterCode, ok := idLetterCodes[id[0]]
+	if !ok {
+		return false
+	}
+
+	// 第二碼: 數字 (身分證 1/2、新式居留證 8/9) 或字母 (舊式居留證)
+	var second int
+	switch c := id[1]; {
+	case c == '1' || c == '2' || c == '8' || c == '9':
+		second = int(c - '0')
+	case c >= 'A' && c <= 'D':
+		// 舊式居留證第二碼字母取對應數值的個位數
+		second = idLetterCodes[c] % 10
+	default:
+		return false
+	}
+
+	for i := 2; i < 10; i++ {
+		if id[i] < '0' || id[i] > '9' {
+			return false
+		}
+	}
+
+	// 首字母拆為十位與個位，依序乘上權重 1,9,8,7,6,5,4,3,2,1,1
+	sum := letterCode/10 + (letterCode%10)*9 + second*8
+	weights := []int{7, 6, 5, 4, 3, 2, 1, 1}
+	for i, w := range weights {
+		sum += int(id[i+2]-'0') * w
+	}
+
+	return sum%10 == 0
+}
+
+// validatePatientIDs 驗證所有病患身分證並將檢核失敗者記錄到 Errors
+func validatePatientIDs(result *HISImportResult) {
+	for i := range result.Patients {
+		p := &result.Patients[i]
+		p.IDValid = ValidateNationalID(p.NationalID)
+		if p.Gender == "" {
+			p.Gender = GenderFromNationalID(p.NationalID)
+		}
+		if !p.IDValid {
+			result.Errors = append(result.Errors, fmt.Sprintf("身分證檢核失敗: %s", MaskNationalID(p.NationalID, MaskPartial)))
+		}
+	}
+}
+
+// NormalizeProviderCode 正規化醫事機構代號 (去除空白、連字號，全形數字轉半形)
+func NormalizeProviderCode(code string) string {
+	var sb strings.Builder
+	for _, r := range strings.TrimSpace(code) {
+		switch {
+		case r >= '０' && r <= '９':
+			sb.WriteRune(r - '０' + '0')
+		case r == ' ' || r == '-' || r == '　':
+			continue
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// ValidateProviderCode 驗證醫事機構代號格式 (10 碼數字)
+// 欄位錯位時常見日期、姓名等內容落入此欄，可藉此及早發現
+func ValidateProviderCode(code string) bool {
+	if len(code) != 10 {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < '0' || code[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMSHProviderCode 檢查 MSH 表頭醫事機構代號 (h1)，格式錯誤時加入警告
+func checkMSHProviderCode(result *HISImportResult, recNo int, code string) {
+	code = NormalizeProviderCode(code)
+	if code != "" && !ValidateProviderCode(code) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("第 %d 筆 MSH 醫事機構代號格式錯誤: %q", recNo, code))
+	}
+}
+
+// validateProviderCodes 正規化處方的原處方醫院代碼，格式錯誤者彙總為警告
+func validateProviderCodes(result *HISImportResult) {
+	invalid := make(map[string]int)
+	var order []string
+	for i := range result.Prescriptions {
+		rx := &result.Prescriptions[i]
+		rx.ProviderCode = NormalizeProviderCode(rx.ProviderCode)
+		if rx.ProviderCode == "" || ValidateProviderCode(rx.ProviderCode) {
+			continue
+		}
+		if invalid[rx.ProviderCode] == 0 {
+			order = append(order, rx.ProviderCode)
+		}
+		invalid[rx.ProviderCode]++
+	}
+
+	for _, code := range order {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("醫事機構代號格式錯誤: %q (%d 筆處方)，請確認欄位是否錯位", code, invalid[code]))
+	}
+}
+
+// 健保代碼類別 (ValidateNHIDrugCode 回傳值)
+const (
+	CodeCategoryDrug      = "drug"      // 藥品: 10 碼，首碼為英文字母 (A 國產、B 輸入、N 中藥等)
+	CodeCategoryMaterial  = "material"  // 特材: 12 碼，首碼為英文字母
+	CodeCategoryTreatment = "treatment" // 診療 (含藥事服務費): 5 碼或 6 碼，如 05206B、P1401C
+)
+
+// ValidateNHIDrugCode 依碼長與字元判斷健保代碼類別並驗證格式
+// 僅接受半形英數字 (不分大小寫)；碼長或首碼不符任一類別時回傳 false 與空類別
+func ValidateNHIDrugCode(code string) (valid bool, category string) {
+	if isMalformedCode(code) {
+		return false, ""
+	}
+	code = strings.ToUpper(strings.TrimSpace(code))
+
+	switch len(code) {
+	case 10:
+		if code[0] >= 'A' && code[0] <= 'Z' && isDigits(code[2:]) {
+			return true, CodeCategoryDrug
+		}
+	case 12:
+		if code[0] >= 'A' && code[0] <= 'Z' {
+			return true, CodeCategoryMaterial
+		}
+	case 5, 6:
+		// 診療代碼中段為數字 (首碼與末碼可為字母)
+		if isDigits(code[1:5]) {
+			return true, CodeCategoryTreatment
+		}
+	}
+	return false, ""
+}
+
+// validateDrugCodes 填入醫令的代碼類別並彙總不符健保格式的代碼：
+// 含中文、全形或符號等明顯錯誤的代碼記錄到 Errors；僅碼長或字首不符者多為院所自訂碼，記錄到 Warnings 並正常匯入
+// 自費項目為院所自訂代碼，空白代碼由其他檢查處理，兩者皆不檢查
+func validateDrugCodes(result *HISImportResult) {
+	invalid := make(map[string]int)
+	var order []string
+	for i := range result.Prescriptions {
+		rx := &result.Prescriptions[i]
+		for j := range rx.Items {
+			item := &rx.Items[j]
+			if item.IsSelfPay || item.DrugCode == "" {
+				continue
+			}
+			valid, category := ValidateNHIDrugCode(item.DrugCode)
+			item.CodeCategory = category
+			if valid {
+				continue
+			}
+			if invalid[item.DrugCode] == 0 {
+				order = append(order, item.DrugCode)
+			}
+			invalid[item.DrugCode]++
+		}
+	}
+
+	for _, code := range order {
+		if isMalformedCode(code) {
+			result.Errors = append(result.Errors, fmt.Sprintf("藥品代碼格式錯誤 (含中文、全形或符號): %q (%d 筆醫令)", code, invalid[code]))
+		} else {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("非健保代碼格式: %q (%d 筆醫令)", code, invalid[code]))
+		}
+	}
+}
+
+// isMalformedCode 代碼是否含英數字以外的字元 (中文、全形、符號)，健保碼與院所自訂碼皆不應出現
+func isMalformedCode(code string) bool {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for i := 0; i < len(code); i++ {
+		if !isUpperAlnum(code[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeICD10 正規化 ICD-10 診斷碼欄位並拆分為多個代碼
+// 全形轉半形、轉大寫、去除非法字元，以空白、分號、逗號或頓號拆分；
+// 僅保留符合 ICD-10-CM 樣式 (字母 + 數字 + 英數字，可選小數點與 1~4 碼延伸) 的代碼，重複者只留一筆
+func NormalizeICD10(raw string) []string {
+	var normalized strings.Builder
+	for _, r := range raw {
+		// 全形英數與符號轉半形
+		if r >= '！' && r <= '～' {
+			r -= 0xFEE0
+		}
+		switch {
+		case r >= 'a' && r <= 'z':
+			normalized.WriteRune(r - 'a' + 'A')
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.':
+			normalized.WriteRune(r)
+		case r == ' ' || r == '　' || r == ';' || r == ',' || r == '、' || r == '/' || r == '|' || r == '\t':
+			normalized.WriteRune(' ')
+		}
+	}
+
+	var codes []string
+	seen := make(map[string]bool)
+	for _, code := range strings.Fields(normalized.String()) {
+		if !isICD10Code(code) || seen[code] {
+			continue
+		}
+		seen[code] = true
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// isICD10Code 檢查是否符合 ICD-10-CM 樣式 (如 I10、E11.9、E119、S72.001A)
+func isICD10Code(code string) bool {
+	if len(code) < 3 || len(code) > 8 {
+		return false
+	}
+	if code[0] < 'A' || code[0] > 'Z' || code[1] < '0' || code[1] > '9' || !isUpperAlnum(code[2]) {
+		return false
+	}
+
+	rest := code[3:]
+	if strings.HasPrefix(rest, ".") {
+		rest = rest[1:]
+		if rest == "" {
+			return false
+		}
+	}
+	if len(rest) > 4 {
+		return false
+	}
+	for i := 0; i < len(rest); i++ {
+		if !isUpperAlnum(rest[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isUpperAlnum 是否為大寫英文字母或數字
+func isUpperAlnum(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// normalizeDiagnosisCodes 將處方診斷碼拆分為 DiagnosisCodes，並以第一碼作為 DiagnosisCode
+func normalizeDiagnosisCodes(result *HISImportResult) {
+	for i := range result.Prescriptions {
+		rx := &result.Prescriptions[i]
+		rx.DiagnosisCodes = NormalizeICD10(rx.DiagnosisCode)
+		if len(rx.DiagnosisCodes) > 0 {
+			rx.DiagnosisCode = rx.DiagnosisCodes[0]
+		}
+	}
+}
+
+// 每日劑量合理範圍 (數量 ÷ 天數)，超出視為可疑
+const (
+	maxDailyQuantity = 20
+	minDailyQuantity = 0.1
+)
+
+// doseTolerance 單次劑量 × 頻率 × 天數 與總量的容許誤差比例
+const doseTolerance = 0.2
+
+// ValidateQuantity 檢查各藥品的數量與天數是否一致，回傳可疑項目說明
+//   - 每日劑量 (數量 ÷ 天數) 大於 20 或小於 0.1
+//   - 慢箋 (天數 >= 28) 數量不足依頻率推算療程所需的一半
+//   - 有單次劑量時，單次劑量 × 每日次數 × 天數 與總量相差超過 20% (總量可進位至整數)
+//
+// 天數或數量為 0 的項目無法判斷，略過不檢查
+func (rx *HISPrescription) ValidateQuantity() []string {
+	var warnings []string
+	for _, item := range rx.Items {
+		if !isDrugItem(item) || item.DaysSupply <= 0 || item.Quantity <= 0 {
+			continue
+		}
+
+		daily := item.Quantity / float64(item.DaysSupply)
+		switch {
+		case daily > maxDailyQuantity:
+			warnings = append(warnings, fmt.Sprintf("藥品 %s 每日 %s 單位 (%s ÷ %d 天)，劑量偏高",
+				item.DrugCode, formatFloat(math.Round(daily*100)/100), formatFloat(item.Quantity), item.DaysSupply))
+		case daily < minDailyQuantity:
+			warnings = append(warnings, fmt.Sprintf("藥品 %s 每日 %s 單位 (%s ÷ %d 天)，劑量偏低",
+				item.DrugCode, formatFloat(math.Round(daily*100)/100), formatFloat(item.Quantity), item.DaysSupply))
+		}
+
+		if item.DaysSupply >= 28 && item.TimesPerDay > 0 {
+			needed := item.TimesPerDay * float64(item.DaysSupply)
+			if item.Quantity < needed/2 {
+				warnings = append(warnings, fmt.Sprintf("藥品 %s 慢箋 %d 天 (%s) 療程需 %s 單位，僅開立 %s",
+					item.DrugCode, item.DaysSupply, item.Frequency, formatFloat(needed), formatFloat(item.Quantity)))
+			}
+		}
+
+		if item.DosePerTime > 0 && item.TimesPerDay > 0 {
+			expected := item.DosePerTime * item.TimesPerDay * float64(item.DaysSupply)
+			if item.Quantity < expected*(1-doseTolerance) || item.Quantity > math.Ceil(expected)*(1+doseTolerance) {
+				warnings = append(warnings, fmt.Sprintf("藥品 %s 單次 %s%s × %s (每日 %s 次) × %d 天 = %s，與總量 %s 不符",
+					item.DrugCode, formatFloat(item.DosePerTime), item.Unit, item.Frequency, formatFloat(item.TimesPerDay),
+					item.DaysSupply, formatFloat(math.Round(expected*100)/100), formatFloat(item.Quantity)))
+			}
+		}
+	}
+	return warnings
+}
+
+// parseDosePerTime 解析單次劑量，接受小數、分數 (1/2) 與帶單位的寫法 (0.5錠)，回傳數值與單位
+func parseDosePerTime(raw string) (float64, string) {
+	s := sanitizeField(raw)
+	end := 0
+	for end < len(s) && (s[end] >= '0' && s[end] <= '9' || s[end] == '.' || s[end] == '/') {
+		end++
+	}
+	num, unit := s[:end], sanitizeField(s[end:])
+	if num == "" {
+		return 0, ""
+	}
+	if slash := strings.Index(num, "/"); slash >= 0 {
+		n, err1 := strconv.ParseFloat(num[:slash], 64)
+		d, err2 := strconv.ParseFloat(num[slash+1:], 64)
+		if err1 != nil || err2 != nil || d == 0 {
+			return 0, ""
+		}
+		return n / d, unit
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, ""
+	}
+	return v, unit
+}
+
+// validateQuantities 對所有處方執行 ValidateQuantity 並將結果記錄到 Errors
+func validateQuantities(result *HISImportResult) {
+	for i := range result.Prescriptions {
+		rx := &result.Prescriptions[i]
+		for _, w := range rx.ValidateQuantity() {
+			result.Errors = append(result.Errors, fmt.Sprintf("處方 %s (%s %s): %s",
+				rx.PrescriptionNo, MaskNationalID(rx.PatientID, MaskPartial), rx.DispenseDate, w))
+		}
+	}
+}
+
+// totalsPointsTolerance 總點數比對的容許誤差 (各筆四捨五入累積的差異)
+const totalsPointsTolerance = 0.5
+
+// VerifyTotals 比對解析到的處方筆數與點數加總是否與申報檔表尾 (總筆數、總點數) 相符，回傳差異說明
+// expectedCount 或 expectedPoints 為負數時略過該項比對
+func (r *HISImportResult) VerifyTotals(expectedCount int, expectedPoints float64) []string {
+	if r == nil {
+		return nil
+	}
+
+	var warnings []string
+	if expectedCount >= 0 && len(r.Prescriptions) != expectedCount {
+		warnings = append(warnings, fmt.Sprintf("處方筆數不符: 表尾 %d 筆，解析 %d 筆 (相差 %d 筆)",
+			expectedCount, len(r.Prescriptions), expectedCount-len(r.Prescriptions)))
+	}
+	if expectedPoints >= 0 {
+		points := 0.0
+		for _, rx := range r.Prescriptions {
+			points += rx.TotalPoints
+		}
+		if math.Abs(points-expectedPoints) > totalsPointsTolerance {
+			warnings = append(warnings, fmt.Sprintf("總點數不符: 表尾 %s 點，解析加總 %s 點",
+				formatFloat(expectedPoints), formatFloat(math.Round(points*100)/100)))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,78 @@
+// Package parser 病患通訊錄匯出
+// 將病患資料輸出為 vCard 3.0，可匯入手機或電腦通訊錄
+package parser
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// vCardLineLimit vCard 單行長度上限 (位元組，不含 CRLF)，超過時折行
+const vCardLineLimit = 75
+
+// ToVCard 輸出單一病患的 vCard 3.0 (UTF-8，CRLF 換行)
+// 包含姓名 (FN/N)、電話 (TEL)、生日 (BDAY)，身分證號以部分遮蔽後放在 NOTE
+func (p *HISPatient) ToVCard() string {
+	if p == nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	writeVCardLine(&sb, "BEGIN:VCARD")
+	writeVCardLine(&sb, "VERSION:3.0")
+	name := firstNonEmpty(p.Name, MaskNationalID(p.NationalID, MaskPartial))
+	writeVCardLine(&sb, "FN;CHARSET=UTF-8:"+escapeVCard(name))
+	writeVCardLine(&sb, "N;CHARSET=UTF-8:"+escapeVCard(name)+";;;;")
+	if p.Mobile != "" {
+		writeVCardLine(&sb, "TEL;TYPE=CELL:"+escapeVCard(p.Mobile))
+	}
+	if p.Phone != "" {
+		writeVCardLine(&sb, "TEL;TYPE=HOME,VOICE:"+escapeVCard(p.Phone))
+	}
+	if p.Birthday != "" {
+		writeVCardLine(&sb, "BDAY:"+escapeVCard(p.Birthday))
+	}
+	if p.NationalID != "" {
+		writeVCardLine(&sb, "NOTE;CHARSET=UTF-8:"+escapeVCard("身分證 "+MaskNationalID(p.NationalID, MaskPartial)))
+	}
+	writeVCardLine(&sb, "END:VCARD")
+	return sb.String()
+}
+
+// ExportPatientsVCard 將所有病患輸出為單一 .vcf 內容
+func ExportPatientsVCard(patients []HISPatient) string {
+	var sb strings.Builder
+	for i := range patients {
+		sb.WriteString(patients[i].ToVCard())
+	}
+	return sb.String()
+}
+
+// escapeVCard 跳脫 vCard 特殊字元 (反斜線、逗號、分號與換行)
+func escapeVCard(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		",", `\,`,
+		";", `\;`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(s)
+}
+
+// writeVCardLine 寫入一行並依 RFC 2425 折行 (續行以空白開頭，不切斷 UTF-8 多位元組字元)
+func writeVCardLine(sb *strings.Builder, line string) {
+	limit := vCardLineLimit
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		sb.WriteString(line[:cut])
+		sb.WriteString("\r\n ")
+		line = line[cut:]
+		limit = vCardLineLimit - 1
+	}
+	sb.WriteString(line)
+	sb.WriteString("\r\n")
+}
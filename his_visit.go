@@ -0,0 +1,50 @@
+// Package parser 就醫類別對照
+// MB1 A23 就醫類別代碼轉換為可讀名稱 (供前端顯示)
+package parser
+
+import "strings"
+
+// visitTypeNames 健保就醫類別代碼對照表
+var visitTypeNames = map[string]string{
+	"01": "西醫門診",
+	"02": "牙醫門診",
+	"03": "中醫門診",
+	"04": "急診",
+	"05": "住院",
+	"06": "門診轉診就醫",
+	"07": "門診手術後之回診",
+	"08": "慢性病連續處方箋",
+	"AA": "同一療程",
+	"AB": "同一療程之慢性病",
+	"AC": "預防保健",
+	"AD": "職業傷害或職業病門診",
+	"AE": "慢性病連續處方箋領藥",
+	"AF": "釋出處方",
+	"AG": "排程檢查",
+	"AH": "居家照護",
+	"BA": "門(急)診當次轉住院",
+	"BB": "出院",
+	"CA": "其他規定不須累計就醫序號",
+}
+
+// GetVisitTypeName 取得就醫類別名稱，未知代碼回傳空字串
+func GetVisitTypeName(code string) string {
+	return visitTypeNames[strings.ToUpper(strings.TrimSpace(code))]
+}
+
+// GetVisitTypes 取得就醫類別對照表 (複本，可直接序列化給前端)
+func GetVisitTypes() map[string]string {
+	types := make(map[string]string, len(visitTypeNames))
+	for code, name := range visitTypeNames {
+		types[code] = name
+	}
+	return types
+}
+
+// tagVisitTypeNames 依就醫類別填入名稱
+func tagVisitTypeNames(result *HISImportResult) {
+	for i := range result.Prescriptions {
+		rx := &result.Prescriptions[i]
+		rx.VisitTypeName = GetVisitTypeName(rx.VisitType)
+	}
+}
@@ -0,0 +1,367 @@
+// Package parser Excel (.xlsx) 匯入
+// 以標準函式庫讀取 OOXML 工作表，所有儲存格一律視為字串以保留前導零
+package parser
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// xlsxSharedStrings xl/sharedStrings.xml
+type xlsxSharedStrings struct {
+	Items []xlsxRichText `xml:"si"`
+}
+
+// xlsxRichText 共用字串或行內字串 (可能分段為多個 run)
+type xlsxRichText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxRichText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var sb strings.Builder
+	sb.WriteString(t.T)
+	for _, r := range t.Runs {
+		sb.WriteString(r.T)
+	}
+	return sb.String()
+}
+
+// xlsxWorkbook xl/workbook.xml
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+// xlsxRelationships xl/_rels/workbook.xml.rels
+type xlsxRelationships struct {
+	Items []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxWorksheet xl/worksheets/sheetN.xml
+type xlsxWorksheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			Ref    string       `xml:"r,attr"`
+			Type   string       `xml:"t,attr"`
+			Value  string       `xml:"v"`
+			Inline xlsxRichText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// isZipContent 判斷是否為 ZIP 格式 (XLSX 亦為 ZIP 容器)
+func isZipContent(content []byte) bool {
+	return len(content) >= 4 && content[0] == 'P' && content[1] == 'K' && content[2] == 0x03 && content[3] == 0x04
+}
+
+// readXLSXFirstSheet 讀取 XLSX 第一個工作表的所有列 (儲存格皆為字串)
+func readXLSXFirstSheet(content []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: 無法開啟 XLSX: %w", ErrUnknownFormat, err)
+	}
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	// 共用字串表 (可能不存在)
+	var sst xlsxSharedStrings
+	if f, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := decodeZipXML(f, &sst); err != nil {
+			return nil, fmt.Errorf("共用字串表解析失敗: %w", err)
+		}
+	}
+
+	sheetFile, ok := files[findFirstSheetPath(files)]
+	if !ok {
+		return nil, fmt.Errorf("找不到工作表: %w", ErrUnknownFormat)
+	}
+
+	var sheet xlsxWorksheet
+	if err := decodeZipXML(sheetFile, &sheet); err != nil {
+		return nil, fmt.Errorf("工作表解析失敗: %w", err)
+	}
+
+	var rows [][]string
+	for _, row := range sheet.Rows {
+		// 補齊被省略的空白列
+		for row.R > 0 && len(rows) < row.R-1 {
+			rows = append(rows, nil)
+		}
+
+		var values []string
+		for i, c := range row.Cells {
+			col := i
+			if c.Ref != "" {
+				col = xlsxColumnIndex(c.Ref)
+			}
+			for len(values) < col {
+				values = append(values, "")
+			}
+
+			var v string
+			switch c.Type {
+			case "s":
+				if idx, err := strconv.Atoi(c.Value); err == nil && idx >= 0 && idx < len(sst.Items) {
+					v = sst.Items[idx].String()
+				}
+			case "inlineStr":
+				v = c.Inline.String()
+			case "", "n":
+				v = xlsxNumberString(c.Value)
+			default:
+				v = c.Value
+			}
+			values = append(values, v)
+		}
+		rows = append(rows, values)
+	}
+
+	return rows, nil
+}
+
+// findFirstSheetPath 依 workbook 關聯找出第一個工作表路徑
+func findFirstSheetPath(files map[string]*zip.File) string {
+	const fallback = "xl/worksheets/sheet1.xml"
+
+	var wb xlsxWorkbook
+	var rels xlsxRelationships
+	wbFile, ok1 := files["xl/workbook.xml"]
+	relFile, ok2 := files["xl/_rels/workbook.xml.rels"]
+	if !ok1 || !ok2 || decodeZipXML(wbFile, &wb) != nil || decodeZipXML(relFile, &rels) != nil || len(wb.Sheets) == 0 {
+		return fallback
+	}
+
+	for _, rel := range rels.Items {
+		if rel.ID != wb.Sheets[0].RID {
+			continue
+		}
+		if strings.HasPrefix(rel.Target, "/") {
+			return strings.TrimPrefix(rel.Target, "/")
+		}
+		return path.Join("xl", rel.Target)
+	}
+	return fallback
+}
+
+// decodeZipXML 解析 ZIP 內的 XML 檔案
+func decodeZipXML(f *zip.File, v interface{}) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// xlsxColumnIndex 儲存格參照轉欄位索引 (A1 -> 0, AB3 -> 27)
+func xlsxColumnIndex(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+	}
+	return col - 1
+}
+
+// xlsxNumberString 數值儲存格轉字串，避免科學記號 (1.23456789E+9 -> 1234567890)
+func xlsxNumberString(v string) string {
+	if !strings.ContainsAny(v, "eE") {
+		return v
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return v
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseGenericXLSX 以通用欄位對應解析 XLSX 處方資料 (colMap 為 nil 時自動對應)
+func parseGenericXLSX(ctx context.Context, content []byte, colMap map[string]int, progress *progressReporter) (*HISImportResult, error) {
+	result := &HISImportResult{
+		SourceType:   "xlsx",
+		SourceVendor: "generic",
+	}
+
+	rows, err := readXLSXFirstSheet(content)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, err
+	}
+	convertXLSXDateCells(rows, colMap, "birthday", "visit_date")
+	return parseGenericRows(ctx, result, rows, colMap, progress)
+}
+
+// convertXLSXDateCells 將日期欄位中的 Excel 日期序號轉為 YYYY-MM-DD (colMap 為 nil 時依標題對應)
+// 儲存格一律以字串讀取，日期格式的儲存格會是序號，只有已知為日期的欄位才轉換
+func convertXLSXDateCells(rows [][]string, colMap map[string]int, keys ...string) {
+	if len(rows) == 0 {
+		return
+	}
+	if colMap == nil {
+		colMap, _ = buildColumnMapping(rows[0])
+	}
+	for _, key := range keys {
+		idx, ok := colMap[key]
+		if !ok || idx < 0 {
+			continue
+		}
+		for _, row := range rows[1:] {
+			if idx < len(row) {
+				if date := excelSerialDate(row[idx]); date != "" {
+					row[idx] = date
+				}
+			}
+		}
+	}
+}
+
+// ParsePatientXLSX 解析病患 Excel 檔案 (第一個工作表)
+// 以表頭關鍵字對應欄位；無法辨識表頭時沿用 CSV 欄位順序: 身分證號,姓名,生日,電話,地址,備註
+func ParsePatientXLSX(r io.Reader) (*ImportResult, []PatientImport) {
+	result := &ImportResult{Errors: []string{}}
+	var patients []PatientImport
+
+	rows, err := readXLSXReader(r)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, patients
+	}
+
+	colMap, startRow := xlsxColumnMap(rows, []string{"national_id", "name"}, map[string]int{
+		"national_id": 0, "name": 1, "birthday": 2, "phone": 3, "address": 4, "notes": 5,
+	})
+
+	for i := startRow; i < len(rows); i++ {
+		fields := rows[i]
+		if isBlankRow(fields) {
+			continue
+		}
+		result.Total++
+
+		// 日期格式的生日儲存格為 Excel 日期序號
+		birthday := getFieldByKey(fields, colMap, "birthday")
+		patient := PatientImport{
+			NationalID: getFieldByKey(fields, colMap, "national_id"),
+			Name:       getFieldByKey(fields, colMap, "name"),
+			Birthday:   ParseFlexibleDate(firstNonEmpty(excelSerialDate(birthday), birthday)),
+			Phone:      getFieldByKey(fields, colMap, "phone"),
+			Address:    getFieldByKey(fields, colMap, "address"),
+			Notes:      getFieldByKey(fields, colMap, "notes"),
+		}
+
+		if patient.NationalID == "" || patient.Name == "" {
+			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行缺少必要欄位", i+1))
+			continue
+		}
+
+		patients = append(patients, patient)
+		result.Success++
+	}
+
+	return result, patients
+}
+
+// ParseInventoryXLSX 解析庫存 Excel 檔案 (第一個工作表)
+// 以表頭關鍵字對應欄位；無法辨識表頭時沿用 CSV 欄位順序: 藥品代碼,藥品名稱,現有庫存,安全庫存,供應商,單價,備註
+func ParseInventoryXLSX(r io.Reader) (*ImportResult, []InventoryImport) {
+	result := &ImportResult{Errors: []string{}}
+	var items []InventoryImport
+
+	rows, err := readXLSXReader(r)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, items
+	}
+
+	colMap, startRow := xlsxColumnMap(rows, []string{"drug_code", "drug_name"}, map[string]int{
+		"drug_code": 0, "drug_name": 1, "current_stock": 2, "min_stock": 3, "supplier": 4, "unit_price": 5, "notes": 6,
+	})
+
+	for i := startRow; i < len(rows); i++ {
+		fields := rows[i]
+		if isBlankRow(fields) {
+			continue
+		}
+		result.Total++
+
+		item := InventoryImport{
+			DrugCode: getFieldByKey(fields, colMap, "drug_code"),
+			DrugName: getFieldByKey(fields, colMap, "drug_name"),
+			Supplier: getFieldByKey(fields, colMap, "supplier"),
+			Notes:    getFieldByKey(fields, colMap, "notes"),
+		}
+		item.CurrentStock, _ = strconv.ParseFloat(getFieldByKey(fields, colMap, "current_stock"), 64)
+		item.MinStock, _ = strconv.ParseFloat(getFieldByKey(fields, colMap, "min_stock"), 64)
+		item.UnitPrice, _ = strconv.ParseFloat(getFieldByKey(fields, colMap, "unit_price"), 64)
+
+		if item.DrugCode == "" || item.DrugName == "" {
+			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行缺少必要欄位", i+1))
+			continue
+		}
+
+		items = append(items, item)
+		result.Success++
+	}
+
+	return result, items
+}
+
+// readXLSXReader 讀取整份 XLSX 並回傳第一個工作表
+func readXLSXReader(r io.Reader) ([][]string, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
+	}
+	if !isZipContent(content) {
+		return nil, fmt.Errorf("不是有效的 XLSX 檔案: %w", ErrUnknownFormat)
+	}
+	return readXLSXFirstSheet(content)
+}
+
+// xlsxColumnMap 以第一列建立欄位對應；缺少必要欄位時視為無表頭並使用預設順序
+func xlsxColumnMap(rows [][]string, required []string, defaults map[string]int) (map[string]int, int) {
+	if len(rows) == 0 {
+		return defaults, 0
+	}
+	colMap, _ := buildColumnMapping(rows[0])
+	for _, key := range required {
+		if _, ok := colMap[key]; !ok {
+			return defaults, 0
+		}
+	}
+	return colMap, 1
+}
+
+// isBlankRow 判斷是否為空白列
+func isBlankRow(fields []string) bool {
+	for _, f := range fields {
+		if sanitizeField(f) != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -3,9 +3,13 @@
 package parser
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 )
 
 // HISVendor 支援的 HIS 廠商
@@ -17,6 +21,9 @@ const (
 	VendorYaosheng HISVendor = "yaosheng" // 耀聖
 	VendorVision   HISVendor = "vision"   // 展望
 	VendorDrMaster HISVendor = "drmaster" // 看診大師
+	VendorYukon    HISVendor = "yukon"    // 宇康
+	VendorICCard   HISVendor = "iccard"   // 健保 IC 卡就醫上傳檔
+	VendorHL7      HISVendor = "hl7"      // HL7 v2 藥囑訊息
 	VendorGeneric  HISVendor = "generic"  // 通用格式
 )
 
@@ -26,173 +33,393 @@ type VendorInfo struct {
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
 	Formats     []string  `json:"formats"` // 支援的格式
-}
 
-// GetSupportedVendors 取得支援的廠商列表
-func GetSupportedVendors() []VendorInfo {
-	return []VendorInfo{
-		{
-			Code:        VendorAuto,
-			Name:        "自動偵測",
-			Description: "系統自動判斷檔案格式與來源",
-			Formats:     []string{"xml", "csv", "txt", "dat"},
-		},
-		{
-			Code:        VendorNHI,
-			Name:        "健保署標準",
-			Description: "健保署每日上傳 XML / 月申報 CSV",
-			Formats:     []string{"xml", "csv"},
-		},
-		{
-			Code:        VendorYaosheng,
-			Name:        "耀聖 HIS",
-			Description: "耀聖資訊 HIS 系統匯出檔案",
-			Formats:     []string{"xml", "csv", "dat", "txt"},
-		},
-		{
-			Code:        VendorVision,
-			Name:        "展望 HIS",
-			Description: "展望亞洲 HIS 系統匯出檔案",
-			Formats:     []string{"xml", "csv"},
-		},
-		{
-			Code:        VendorDrMaster,
-			Name:        "看診大師",
-			Description: "看診大師 HIS 系統匯出檔案",
-			Formats:     []string{"xml", "csv", "txt"},
-		},
-		{
-			Code:        VendorGeneric,
-			Name:        "通用格式",
-			Description: "標準 CSV 格式（自動欄位對應）",
-			Formats:     []string{"csv", "txt"},
-		},
-	}
+	// Detect 自動偵測時的比對函數 (可省略)，回傳 0-100 的信心分數與比對到的特徵說明，0 表示不符
+	Detect VendorMatcher `json:"-"`
 }
 
-// ParseHISFileByVendor 根據指定廠商解析 HIS 檔案
-func ParseHISFileByVendor(r io.Reader, filename string, vendor HISVendor) (*HISImportResult, error) {
-	switch vendor {
-	case VendorYaosheng:
-		return ParseYaoshengFile(r, filename)
+// VendorMatcher 自訂廠商的自動偵測函數，content 為檔案內容 (UTF-16 已轉為 UTF-8)
+type VendorMatcher func(content []byte, filename string) (confidence int, reason string)
 
-	case VendorVision:
-		return ParseVisionFile(r, filename)
+// vendorParseFunc 廠商解析器 (內容已讀入記憶體，選項由 ParseWithOptions 傳入)
+type vendorParseFunc func(content []byte, filename string, o *ParseOptions) (*HISImportResult, error)
 
-	case VendorDrMaster:
-		return ParseDrMasterFile(r, filename)
+// vendorEntry 註冊表中的一個廠商
+type vendorEntry struct {
+	info  VendorInfo
+	parse vendorParseFunc
+}
 
-	case VendorNHI:
-		return ParseHISFile(r, filename) // 使用原有的健保署標準解析器
+var (
+	vendorRegistry   = make(map[HISVendor]*vendorEntry)
+	vendorOrder      []HISVendor // 註冊順序，GetSupportedVendors 依此排列
+	vendorRegistryMu sync.RWMutex
+)
 
-	case VendorGeneric:
-		content, err := io.ReadAll(r)
-		if err != nil {
-			return nil, err
+// autoVendorInfo 自動偵測 (不對應解析器，不列入註冊表)
+var autoVendorInfo = VendorInfo{
+	Code:        VendorAuto,
+	Name:        "自動偵測",
+	Description: "系統自動判斷檔案格式與來源",
+	Formats:     []string{"xml", "csv", "txt", "dat", "dbf", "xlsx"},
+}
+
+func init() {
+	registerVendor(VendorInfo{
+		Code:        VendorNHI,
+		Name:        "健保署標準",
+		Description: "健保署每日上傳 XML / 月申報 CSV",
+		Formats:     []string{"xml", "csv"},
+	}, func(content []byte, _ string, o *ParseOptions) (*HISImportResult, error) {
+		return parseHISContent(content, o) // 使用原有的健保署標準解析器
+	})
+	registerVendor(VendorInfo{
+		Code:        VendorYaosheng,
+		Name:        "耀聖 HIS",
+		Description: "耀聖資訊 HIS 系統匯出檔案",
+		Formats:     []string{"xml", "csv", "dat", "txt"},
+	}, parseYaoshengContent)
+	registerVendor(VendorInfo{
+		Code:        VendorVision,
+		Name:        "展望 HIS",
+		Description: "展望亞洲 HIS 系統匯出檔案",
+		Formats:     []string{"xml", "csv"},
+	}, parseVisionContent)
+	registerVendor(VendorInfo{
+		Code:        VendorDrMaster,
+		Name:        "看診大師",
+		Description: "看診大師 HIS 系統匯出檔案",
+		Formats:     []string{"xml", "csv", "txt", "dbf"},
+	}, parseDrMasterContent)
+	registerVendor(VendorInfo{
+		Code:        VendorYukon,
+		Name:        "宇康",
+		Description: "宇康藥局系統匯出檔案 (分號分隔)",
+		Formats:     []string{"txt"},
+	}, parseYukonContent)
+	registerVendor(VendorInfo{
+		Code:        VendorICCard,
+		Name:        "健保 IC 卡",
+		Description: "IC 卡讀卡機就醫上傳檔 (定長區段格式)",
+		Formats:     []string{"txt"},
+	}, func(content []byte, _ string, o *ParseOptions) (*HISImportResult, error) {
+		return parseICCardContent(content, o)
+	})
+	registerVendor(VendorInfo{
+		Code:        VendorHL7,
+		Name:        "HL7 v2",
+		Description: "醫院 HIS 藥囑訊息 (RDE^O11 / ORM^O01)",
+		Formats:     []string{"hl7", "txt"},
+	}, func(content []byte, _ string, o *ParseOptions) (*HISImportResult, error) {
+		return parseHL7Content(content, o)
+	})
+	registerVendor(VendorInfo{
+		Code:        VendorGeneric,
+		Name:        "通用格式",
+		Description: "標準 CSV / Excel 格式（自動欄位對應）",
+		Formats:     []string{"csv", "txt", "xlsx"},
+	}, func(content []byte, _ string, o *ParseOptions) (*HISImportResult, error) {
+		if isZipContent(content) {
+			return parseGenericXLSX(o.context(), content, o.ColumnMapping, o.progress)
 		}
-		return parseGenericCSV(strings.NewReader(string(content)), detectBig5(content))
+		return parseGenericCSVWithMapping(o.context(), strings.NewReader(o.decodeText(content)), false, 0, o.ColumnMapping, o.progress)
+	})
+}
 
-	case VendorAuto:
-		fallthrough
-	default:
-		// 自動偵測
-		return ParseHISFileAuto(r, filename)
+// RegisterVendor 註冊自訂廠商解析器，註冊後 ParseHISFileByVendor、GetSupportedVendors 與自動偵測 (需設定 info.Detect) 皆可使用
+// 重複註冊同一代碼時取代既有解析器 (可覆寫內建廠商)；code 為空、VendorAuto 或 parser 為 nil 時 panic。
+// parser 收到的是已讀入的完整內容，解析後仍會套用 ParseOption (如 MaxRecords、Strict)
+func RegisterVendor(code HISVendor, info VendorInfo, parser func(io.Reader, string) (*HISImportResult, error)) {
+	if code == "" || code == VendorAuto {
+		panic(fmt.Sprintf("parser: RegisterVendor 廠商代碼無效: %q", code))
 	}
+	if parser == nil {
+		panic(fmt.Sprintf("parser: RegisterVendor 廠商 %s 的解析器為 nil", code))
+	}
+	info.Code = code
+	if info.Name == "" {
+		info.Name = string(code)
+	}
+	registerVendor(info, func(content []byte, filename string, _ *ParseOptions) (*HISImportResult, error) {
+		return parser(bytes.NewReader(content), filename)
+	})
 }
 
-// ParseHISFileAuto 自動偵測廠商並解析
-func ParseHISFileAuto(r io.Reader, filename string) (*HISImportResult, error) {
+// registerVendor 將廠商加入註冊表 (已存在時保留原順序)
+func registerVendor(info VendorInfo, parse vendorParseFunc) {
+	vendorRegistryMu.Lock()
+	defer vendorRegistryMu.Unlock()
+	if _, ok := vendorRegistry[info.Code]; !ok {
+		vendorOrder = append(vendorOrder, info.Code)
+	}
+	vendorRegistry[info.Code] = &vendorEntry{info: info, parse: parse}
+}
+
+// lookupVendor 查詢已註冊的廠商
+func lookupVendor(vendor HISVendor) (*vendorEntry, bool) {
+	vendorRegistryMu.RLock()
+	defer vendorRegistryMu.RUnlock()
+	entry, ok := vendorRegistry[vendor]
+	return entry, ok
+}
+
+// GetSupportedVendors 取得支援的廠商列表 (自動偵測在前，其餘依註冊順序)
+func GetSupportedVendors() []VendorInfo {
+	vendorRegistryMu.RLock()
+	defer vendorRegistryMu.RUnlock()
+
+	vendors := make([]VendorInfo, 0, len(vendorOrder)+1)
+	vendors = append(vendors, autoVendorInfo)
+	for _, code := range vendorOrder {
+		vendors = append(vendors, vendorRegistry[code].info)
+	}
+	return vendors
+}
+
+// ParseWithOptions 解析 HIS 檔案 (所有解析入口的共用實作)
+// vendor 為 VendorAuto 時自動偵測廠商；選項零值即為預設行為
+func ParseWithOptions(r io.Reader, filename string, vendor HISVendor, opts ...ParseOption) (*HISImportResult, error) {
+	o := newParseOptions(opts...)
+	if err := ValidateColumnMapping(o.ColumnMapping); err != nil {
+		return nil, err
+	}
+
 	content, err := io.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("讀取檔案失敗: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
+	}
+	if err := o.err(); err != nil {
+		return nil, err
+	}
+	if isBlankContent(content, o) {
+		return emptyFileResult(nil)
 	}
 
-	// 偵測廠商
-	vendor := detectVendor(content, filename)
+	// 壓縮檔 (.gz / 非 Excel 的 .zip) 先解壓再解析
+	if isArchiveContent(content) {
+		return parseArchive(content, filename, vendor, opts...)
+	}
+	if ext := strings.ToLower(path.Ext(filename)); (ext == ".gz" || ext == ".zip") && !isZipContent(content) {
+		return nil, fmt.Errorf("副檔名為 %s 但內容不是有效的壓縮檔: %w", ext, ErrUnknownFormat)
+	}
 
-	// 使用偵測到的廠商進行解析
-	return ParseHISFileByVendor(strings.NewReader(string(content)), filename, vendor)
+	// 自動偵測或未知廠商代碼時依內容判斷
+	var candidates []VendorMatch
+	entry, ok := lookupVendor(vendor)
+	if !ok {
+		// UTF-16 內容需先轉為 UTF-8 才能比對特徵字串
+		sample := content
+		if !isZipContent(content) {
+			if enc := o.encodingOf(content); enc == EncodingUTF16LE || enc == EncodingUTF16BE {
+				sample = []byte(o.decodeText(content))
+			}
+		}
+		candidates = DetectVendorWithConfidence(sample, filename)
+		if entry, ok = lookupVendor(candidates[0].Vendor); !ok {
+			entry, _ = lookupVendor(VendorGeneric)
+		}
+	}
+
+	result, err := entry.parse(content, filename, o)
+
+	// 已取消時捨棄解析到一半的結果，避免呼叫端誤用不完整的資料
+	if ctxErr := o.err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if result != nil {
+		result.VendorCandidates = candidates
+		o.progress.report(result.Total, result.Total)
+	}
+	if err != nil {
+		return result, err
+	}
+	return result, o.apply(result)
 }
 
-// detectVendor 偵測 HIS 廠商
-func detectVendor(content []byte, filename string) HISVendor {
+// ParseHISFileByVendor 根據指定廠商解析 HIS 檔案
+func ParseHISFileByVendor(r io.Reader, filename string, vendor HISVendor) (*HISImportResult, error) {
+	return ParseWithOptions(r, filename, vendor)
+}
+
+// ParseHISFileAuto 自動偵測廠商並解析
+func ParseHISFileAuto(r io.Reader, filename string) (*HISImportResult, error) {
+	return ParseWithOptions(r, filename, VendorAuto)
+}
+
+// VendorMatch 廠商偵測候選結果
+type VendorMatch struct {
+	Vendor     HISVendor `json:"vendor"`
+	Name       string    `json:"name"`       // 廠商中文名稱
+	Confidence int       `json:"confidence"` // 信心分數 (0-100)
+	Reasons    []string  `json:"reasons"`    // 比對到的特徵說明
+}
+
+// DetectVendorWithConfidence 偵測 HIS 廠商並回傳依信心排序的候選清單 (至少含通用格式)
+// 每個特徵依判斷優先順序給分，同分時先比對到者在前；第一筆即為自動偵測採用的廠商
+func DetectVendorWithConfidence(content []byte, filename string) []VendorMatch {
 	contentStr := string(content)
 	lowerFilename := strings.ToLower(filename)
 
-	// 根據檔名判斷
-	if strings.Contains(lowerFilename, "yaosheng") ||
-	   strings.Contains(lowerFilename, "耀聖") ||
-	   strings.Contains(lowerFilename, "ys_") {
-		return VendorYaosheng
+	var matches []*VendorMatch
+	byVendor := make(map[HISVendor]*VendorMatch)
+	add := func(vendor HISVendor, confidence int, reason string) {
+		m, ok := byVendor[vendor]
+		if !ok {
+			m = &VendorMatch{Vendor: vendor, Name: GetVendorName(vendor)}
+			byVendor[vendor] = m
+			matches = append(matches, m)
+		}
+		if confidence > m.Confidence {
+			m.Confidence = confidence
+		}
+		m.Reasons = append(m.Reasons, reason)
+	}
+	filenameHas := func(keywords ...string) string {
+		for _, k := range keywords {
+			if strings.Contains(lowerFilename, k) {
+				return k
+			}
+		}
+		return ""
 	}
 
-	if strings.Contains(lowerFilename, "vision") ||
-	   strings.Contains(lowerFilename, "展望") ||
-	   strings.Contains(lowerFilename, "vs_") {
-		return VendorVision
+	// Excel 檔案一律使用通用欄位對應
+	if isZipContent(content) || strings.HasSuffix(lowerFilename, ".xlsx") {
+		add(VendorGeneric, 100, "Excel 檔案")
 	}
 
-	if strings.Contains(lowerFilename, "drmaster") ||
-	   strings.Contains(lowerFilename, "看診大師") ||
-	   strings.Contains(lowerFilename, "dm_") {
-		return VendorDrMaster
+	// 根據檔名判斷
+	if k := filenameHas("yaosheng", "耀聖", "ys_"); k != "" {
+		add(VendorYaosheng, 95, "檔名含 "+k)
+	}
+	if k := filenameHas("vision", "展望", "vs_"); k != "" {
+		add(VendorVision, 95, "檔名含 "+k)
+	}
+	if k := filenameHas("drmaster", "看診大師", "dm_"); k != "" {
+		add(VendorDrMaster, 95, "檔名含 "+k)
+	}
+	if k := filenameHas("yukon", "宇康"); k != "" {
+		add(VendorYukon, 95, "檔名含 "+k)
+	}
+	// yk_ 過於簡短，僅在內容也符合宇康格式時採用
+	if filenameHas("yk_") != "" && isYukonContent(contentStr) {
+		add(VendorYukon, 95, "檔名含 yk_ 且為 ; 分隔格式")
+	}
+	if k := filenameHas("iccard", "健保卡"); k != "" {
+		add(VendorICCard, 95, "檔名含 "+k)
+	}
+	if strings.HasSuffix(lowerFilename, ".hl7") {
+		add(VendorHL7, 95, "副檔名 .hl7")
 	}
 
 	// 根據內容特徵判斷
+	// HL7 v2 訊息 (MSH| 開頭，需在看診大師的 | 分隔判斷之前)
+	if isHL7Content(contentStr) {
+		add(VendorHL7, 90, "內容以 MSH| 開頭")
+	}
+
 	// DAT 格式 (耀聖特有)
 	if strings.HasSuffix(lowerFilename, ".dat") {
-		return VendorYaosheng
+		add(VendorYaosheng, 80, "副檔名 .dat")
+	}
+
+	// DBF 格式 (看診大師舊版)
+	if strings.HasSuffix(lowerFilename, ".dbf") {
+		add(VendorDrMaster, 80, "副檔名 .dbf")
+	}
+
+	// IC 卡上傳檔 (01/02/03 段別開頭的定長格式)
+	if isICCardContent(contentStr) {
+		add(VendorICCard, 80, "IC 卡段別格式")
+	}
+
+	// 宇康使用 ; 分隔符 (# 開頭的表頭行)
+	if isYukonContent(contentStr) {
+		add(VendorYukon, 80, "; 分隔且 # 開頭表頭")
 	}
 
 	// 看診大師使用 | 分隔符
 	if strings.Contains(contentStr, "|") && !strings.Contains(contentStr, ",") {
-		return VendorDrMaster
+		add(VendorDrMaster, 60, "| 分隔")
 	}
 
 	// XML 格式檢查
-	if strings.Contains(contentStr, "<?xml") || strings.Contains(contentStr, "<RECS>") {
+	if isNHIXMLContent(contentStr) {
 		// 檢查是否有廠商特有欄位
 		if strings.Contains(contentStr, "<d23>") || strings.Contains(contentStr, "<d24>") {
 			// d23=手機, d24=緊急聯絡人 為看診大師特有
-			return VendorDrMaster
+			add(VendorDrMaster, 60, "XML 含 d23/d24 欄位")
 		}
 		if strings.Contains(contentStr, "<d22>") {
 			// d22=地址 為展望特有
-			return VendorVision
+			add(VendorVision, 55, "XML 含 d22 欄位")
 		}
-		// 預設使用健保署標準格式
-		return VendorNHI
+		// 無廠商特有欄位時使用健保署標準格式
+		add(VendorNHI, 50, "健保署 XML 格式")
 	}
 
 	// CSV 格式
 	if strings.Contains(contentStr, ",") {
-		// 檢查是否為健保申報格式 (T/D/P 記錄類型)
+		// 檢查是否為健保申報格式 (T/H 記錄類型開頭)
 		firstLine := strings.Split(contentStr, "\n")[0]
-		firstChar := strings.TrimSpace(firstLine)
+		firstChar := sanitizeField(firstLine)
 		if len(firstChar) > 0 {
 			switch strings.ToUpper(string(firstChar[0])) {
-			case "T":
-				return VendorNHI
+			case "T", "H":
+				add(VendorNHI, 50, "申報 CSV 記錄類型")
 			}
 		}
 
 		// 檢查標題行特徵
-		if strings.Contains(strings.ToLower(firstLine), "yaosheng") ||
-		   strings.Contains(firstLine, "耀聖") {
-			return VendorYaosheng
+		lowerFirstLine := strings.ToLower(firstLine)
+		if strings.Contains(lowerFirstLine, "yaosheng") || strings.Contains(firstLine, "耀聖") {
+			add(VendorYaosheng, 45, "標題行含耀聖")
 		}
-		if strings.Contains(strings.ToLower(firstLine), "vision") ||
-		   strings.Contains(firstLine, "展望") {
-			return VendorVision
+		if strings.Contains(lowerFirstLine, "vision") || strings.Contains(firstLine, "展望") {
+			add(VendorVision, 45, "標題行含展望")
 		}
-		if strings.Contains(strings.ToLower(firstLine), "drmaster") ||
-		   strings.Contains(firstLine, "看診大師") {
-			return VendorDrMaster
+		if strings.Contains(lowerFirstLine, "drmaster") || strings.Contains(firstLine, "看診大師") {
+			add(VendorDrMaster, 45, "標題行含看診大師")
 		}
 	}
 
-	// 預設使用通用解析器
-	return VendorGeneric
+	// 自訂廠商的比對函數
+	vendorRegistryMu.RLock()
+	var matchers []VendorInfo
+	for _, code := range vendorOrder {
+		if info := vendorRegistry[code].info; info.Detect != nil {
+			matchers = append(matchers, info)
+		}
+	}
+	vendorRegistryMu.RUnlock()
+	for _, info := range matchers {
+		if confidence, reason := info.Detect(content, filename); confidence > 0 {
+			if confidence > 100 {
+				confidence = 100
+			}
+			if reason == "" {
+				reason = "自訂比對"
+			}
+			add(info.Code, confidence, reason)
+		}
+	}
+
+	// 通用解析器永遠可用
+	add(VendorGeneric, 10, "通用欄位對應")
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Confidence > matches[j].Confidence
+	})
+	result := make([]VendorMatch, len(matches))
+	for i, m := range matches {
+		result[i] = *m
+	}
+	return result
+}
+
+// detectVendor 偵測 HIS 廠商 (取信心最高的候選)
+func detectVendor(content []byte, filename string) HISVendor {
+	return DetectVendorWithConfidence(content, filename)[0].Vendor
 }
 
 // GetVendorName 取得廠商中文名稱
@@ -204,6 +431,12 @@ func GetVendorName(vendor HISVendor) string {
 		return "展望"
 	case VendorDrMaster:
 		return "看診大師"
+	case VendorYukon:
+		return "宇康"
+	case VendorICCard:
+		return "健保 IC 卡"
+	case VendorHL7:
+		return "HL7 v2"
 	case VendorNHI:
 		return "健保署標準"
 	case VendorGeneric:
@@ -211,6 +444,9 @@ func GetVendorName(vendor HISVendor) string {
 	case VendorAuto:
 		return "自動偵測"
 	default:
+		if entry, ok := lookupVendor(vendor); ok {
+			return entry.info.Name
+		}
 		return string(vendor)
 	}
 }
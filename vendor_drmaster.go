@@ -3,12 +3,15 @@
 package parser
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/text/encoding/traditionalchinese"
 	"golang.org/x/text/transform"
@@ -22,10 +25,10 @@ import (
 type DrMasterExportType string
 
 const (
-	DrMasterXML  DrMasterExportType = "xml"  // 健保每日上傳 XML
-	DrMasterCSV  DrMasterExportType = "csv"  // 月申報 CSV
-	DrMasterTXT  DrMasterExportType = "txt"  // 文字報表
-	DrMasterDBF  DrMasterExportType = "dbf"  // dBASE 格式 (較舊版本)
+	DrMasterXML DrMasterExportType = "xml" // 健保每日上傳 XML
+	DrMasterCSV DrMasterExportType = "csv" // 月申報 CSV
+	DrMasterTXT DrMasterExportType = "txt" // 文字報表
+	DrMasterDBF DrMasterExportType = "dbf" // dBASE 格式 (較舊版本)
 )
 
 // DrMasterXMLRoot 看診大師 XML 根元素
@@ -53,6 +56,7 @@ type DrMasterRec struct {
 		A14 string `xml:"A14"` // 原處方醫院
 		A17 string `xml:"A17"` // 就診日期時間
 		A18 string `xml:"A18"` // 就醫序號
+		A54 string `xml:"A54"` // 就醫識別碼 (新制)
 		A23 string `xml:"A23"` // 就醫類別
 		D19 string `xml:"d19"` // 診斷碼
 		D20 string `xml:"d20"` // 病患姓名
@@ -61,6 +65,7 @@ type DrMasterRec struct {
 		D24 string `xml:"d24"` // 緊急聯絡人 (看診大師特有)
 		D31 string `xml:"d31"` // 藥師身分證
 		D32 string `xml:"d32"` // 藥師姓名
+		D37 string `xml:"d37"` // 連處總次數 (看診大師特有)
 	} `xml:"MB1"`
 
 	// MB2 醫令明細
@@ -79,6 +84,7 @@ type DrMasterRec struct {
 		D29 string `xml:"d29"` // 單位 (看診大師特有)
 		D36 string `xml:"d36"` // 慢箋次數
 		D37 string `xml:"d37"` // 連處總次數 (看診大師特有)
+		P10 string `xml:"p10"` // 自費註記
 	} `xml:"MB2"`
 }
 
@@ -108,103 +114,105 @@ type DrMasterTXTRecord struct {
 func ParseDrMasterFile(r io.Reader, filename string) (*HISImportResult, error) {
 	content, err := io.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("讀取檔案失敗: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
 	}
 
-	// 偵測編碼並轉換
-	isBig5 := detectBig5(content)
-	var contentStr string
-	if isBig5 {
-		decoded, _, err := transform.Bytes(traditionalchinese.Big5.NewDecoder(), content)
-		if err == nil {
-			contentStr = string(decoded)
-		} else {
-			contentStr = string(content)
-		}
-	} else {
-		contentStr = string(content)
+	o := newParseOptions()
+	if isBlankContent(content, o) {
+		return emptyFileResult(nil)
 	}
+	return parseDrMasterContent(content, filename, o)
+}
 
+// parseDrMasterContent 依解析選項解碼並解析看診大師檔案內容
+func parseDrMasterContent(content []byte, filename string, o *ParseOptions) (*HISImportResult, error) {
 	lowerFilename := strings.ToLower(filename)
 
+	// DBF 格式 (二進位檔，需使用原始位元組)
+	if strings.HasSuffix(lowerFilename, ".dbf") {
+		return parseDrMasterDBF(o.context(), content)
+	}
+
+	// 偵測編碼並轉換
+	contentStr := o.decodeText(content)
+
 	// XML 格式
 	if strings.HasSuffix(lowerFilename, ".xml") ||
-	   strings.Contains(contentStr, "<?xml") ||
-	   strings.Contains(contentStr, "<RECS>") {
-		return parseDrMasterXML(contentStr)
+		isNHIXMLContent(contentStr) {
+		return parseDrMasterXML(o.context(), contentStr, o.progress)
 	}
 
 	// TXT 格式 (使用 | 分隔)
 	if strings.Contains(contentStr, "|") {
-		return parseDrMasterTXT(contentStr)
+		return parseDrMasterTXT(o.context(), contentStr)
 	}
 
 	// CSV 格式
-	return parseDrMasterCSV(contentStr)
+	return parseDrMasterCSV(o.context(), contentStr)
 }
 
 // parseDrMasterXML 解析看診大師 XML 格式
-func parseDrMasterXML(content string) (*HISImportResult, error) {
+func parseDrMasterXML(ctx context.Context, content string, progress *progressReporter) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "xml",
 		SourceVendor: "drmaster",
 	}
 
-	var xmlData DrMasterXMLRoot
-	if err := xml.Unmarshal([]byte(content), &xmlData); err != nil {
-		result.Errors = append(result.Errors, "XML 解析失敗: "+err.Error())
-		return result, err
-	}
-
-	result.Total = len(xmlData.Records)
 	patientMap := make(map[string]*HISPatient)
 
-	for i, rec := range xmlData.Records {
+	// 逐筆串流解析 REC，單筆損壞時略過並繼續
+	err := streamXMLRecords(strings.NewReader(content), true, func(i int, chunk xmlRecordChunk, recErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.report(result.Total, 0)
+		result.Total++
+		var rec DrMasterRec
+		if recErr == nil {
+			recErr = decodeXMLRecord(chunk, &rec)
+		}
+		if recErr != nil {
+			addXMLRecordError(result, i, chunk, recErr)
+			return nil
+		}
+		addXMLRecordWarning(result, i, chunk)
+		checkMSHProviderCode(result, i, rec.MSH.H1)
+
 		// 提取病患
 		if rec.MB1.A12 != "" {
 			patient := &HISPatient{
-				NationalID: strings.TrimSpace(rec.MB1.A12),
-				Name:       strings.TrimSpace(rec.MB1.D20),
-				CardNumber: strings.TrimSpace(rec.MB1.A11),
+				NationalID: sanitizeField(rec.MB1.A12),
+				Name:       sanitizeField(rec.MB1.D20),
+				CardNumber: sanitizeField(rec.MB1.A11),
 			}
 
-			// 電話：優先使用手機
-			phone := strings.TrimSpace(rec.MB1.D23)
-			if phone == "" {
-				phone = strings.TrimSpace(rec.MB1.D21)
-			}
-			patient.Phone = phone
+			// 市話 D21 與手機 D23 分欄保存
+			patient.Phone, _ = NormalizePhone(rec.MB1.D21)
+			patient.Mobile, _ = NormalizePhone(rec.MB1.D23)
 
-			if rec.MB1.A13 != "" && len(rec.MB1.A13) >= 7 {
-				patient.Birthday = convertROCDate(rec.MB1.A13[:7])
-			}
-			if _, exists := patientMap[patient.NationalID]; !exists {
-				patientMap[patient.NationalID] = patient
-			}
+			patient.Birthday = ParseFlexibleDate(rec.MB1.A13)
+			upsertPatient(patientMap, patient)
 		}
 
 		// 提取處方
 		rx := &HISPrescription{
-			PatientID:      strings.TrimSpace(rec.MB1.A12),
-			ProviderCode:   strings.TrimSpace(rec.MB1.A14),
-			VisitType:      strings.TrimSpace(rec.MB1.A23),
-			VisitSequence:  strings.TrimSpace(rec.MB1.A18),
-			DiagnosisCode:  strings.TrimSpace(rec.MB1.D19),
-			PharmacistID:   strings.TrimSpace(rec.MB1.D31),
-			PharmacistName: strings.TrimSpace(rec.MB1.D32),
-			DataFormat:     strings.TrimSpace(rec.MB1.A01),
+			PatientID:      sanitizeField(rec.MB1.A12),
+			ProviderCode:   sanitizeField(rec.MB1.A14),
+			VisitType:      sanitizeField(rec.MB1.A23),
+			VisitSequence:  sanitizeField(rec.MB1.A18),
+			VisitID:        sanitizeField(rec.MB1.A54),
+			DiagnosisCode:  sanitizeField(rec.MB1.D19),
+			PharmacistID:   sanitizeField(rec.MB1.D31),
+			PharmacistName: sanitizeField(rec.MB1.D32),
+			DataFormat:     sanitizeField(rec.MB1.A01),
 		}
+		rx.SourceIndex = i
 
 		// 解析就診日期時間
-		if rec.MB1.A17 != "" && len(rec.MB1.A17) >= 7 {
-			rx.DispenseDate = convertROCDate(rec.MB1.A17[:7])
-			if len(rec.MB1.A17) >= 13 {
-				rx.DispenseTime = rec.MB1.A17[7:9] + ":" + rec.MB1.A17[9:11] + ":" + rec.MB1.A17[11:13]
-			}
-		}
+		rx.DispenseDate, rx.DispenseTime = splitROCDateTime(rec.MB1.A17)
 
 		// 生成處方序號 (看診大師前綴 DM)
-		rx.PrescriptionNo = fmt.Sprintf("DM-%s-%s-%s", rx.ProviderCode, rx.DispenseDate, rx.VisitSequence)
+		setGeneratedPrescriptionNo(rx, fmt.Sprintf("DM-%s-%s-%s", rx.ProviderCode, rx.DispenseDate, visitKey(rx)), visitKey(rx))
 
 		// 解析慢箋次數
 		if strings.HasPrefix(rx.VisitSequence, "IC") && len(rx.VisitSequence) >= 4 {
@@ -213,23 +221,34 @@ func parseDrMasterXML(content string) (*HISImportResult, error) {
 			}
 		}
 
+		// 新制就醫識別碼取代就醫序號時 A18 可能為空，改由醫令的連處次數 (d36) 判斷
+		if rx.ChronicRefillNo == 0 && len(rec.MB2s) > 0 {
+			rx.ChronicRefillNo, _ = strconv.Atoi(sanitizeField(rec.MB2s[0].D36))
+		}
+		rx.TotalRefills, _ = strconv.Atoi(sanitizeField(rec.MB1.D37))
+
 		// 解析藥品項目
 		for _, mb2 := range rec.MB2s {
 			item := HISPrescriptionItem{
-				OrderType: strings.TrimSpace(mb2.P1),
-				DrugCode:  strings.TrimSpace(mb2.P2),
-				DrugName:  strings.TrimSpace(mb2.P3),
-				Frequency: strings.TrimSpace(mb2.P5),
-				Route:     strings.TrimSpace(mb2.P6),
+				OrderType: sanitizeField(mb2.P1),
+				DrugCode:  sanitizeField(mb2.P2),
+				DrugName:  sanitizeField(mb2.P3),
+				Frequency: sanitizeField(mb2.P5),
+				Route:     sanitizeField(mb2.P6),
+				IsSelfPay: parseSelfPayFlag(mb2.P10),
 			}
 			if mb2.P7 != "" {
-				item.Quantity, _ = strconv.ParseFloat(strings.TrimSpace(mb2.P7), 64)
+				item.Quantity, _ = strconv.ParseFloat(sanitizeField(mb2.P7), 64)
 			}
 			if mb2.P8 != "" {
-				item.UnitPrice, _ = strconv.ParseFloat(strings.TrimSpace(mb2.P8), 64)
+				item.UnitPrice, _ = strconv.ParseFloat(sanitizeField(mb2.P8), 64)
 			}
 			if mb2.D27 != "" {
-				item.DaysSupply, _ = strconv.Atoi(strings.TrimSpace(mb2.D27))
+				item.DaysSupply, _ = strconv.Atoi(sanitizeField(mb2.D27))
+			}
+			item.DosePerTime, item.Unit = parseDosePerTime(mb2.D28)
+			if unit := sanitizeField(mb2.D29); unit != "" {
+				item.Unit = unit
 			}
 			rx.Items = append(rx.Items, item)
 		}
@@ -238,35 +257,53 @@ func parseDrMasterXML(content string) (*HISImportResult, error) {
 			result.Prescriptions = append(result.Prescriptions, *rx)
 			result.Imported++
 		} else {
-			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 筆記錄無有效資料", i+1))
+			result.addLineError(fmt.Sprintf("第 %d 筆記錄無有效資料", i), i, chunk.Data, "", "無有效資料")
 			result.Failed++
 		}
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		result.Errors = append(result.Errors, err.Error())
+		return result, err
 	}
 
 	for _, p := range patientMap {
 		result.Patients = append(result.Patients, *p)
 	}
 
+	// 同一處方被拆成多筆 REC 時合併
+	mergeSplitPrescriptions(result)
+
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
 
+// drMasterDFields 看診大師 D 行欄位名稱
+var drMasterDFields = []string{"記錄類型", "身分證", "姓名", "生日", "電話", "就診日", "就醫類別"}
+
 // parseDrMasterTXT 解析看診大師 TXT 格式 (使用 | 分隔)
-func parseDrMasterTXT(content string) (*HISImportResult, error) {
+func parseDrMasterTXT(ctx context.Context, content string) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "txt",
 		SourceVendor: "drmaster",
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner := newLineScanner(strings.NewReader(content))
 	patientMap := make(map[string]*HISPatient)
 	rxMap := make(map[string]*HISPrescription)
 	lineNum := 0
 	var currentRxKey string
 
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+		line := sanitizeField(scanner.Text())
 		if line == "" {
 			continue
 		}
@@ -277,7 +314,7 @@ func parseDrMasterTXT(content string) (*HISImportResult, error) {
 			continue
 		}
 
-		recordType := strings.ToUpper(strings.TrimSpace(fields[0]))
+		recordType := strings.ToUpper(sanitizeField(fields[0]))
 
 		switch recordType {
 		case "H":
@@ -289,37 +326,32 @@ func parseDrMasterTXT(content string) (*HISImportResult, error) {
 			result.Total++
 
 			if len(fields) < 7 {
-				result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行欄位不足", lineNum))
+				result.addLineError(fmt.Sprintf("第 %d 行欄位不足", lineNum),
+					lineNum, line, missingFieldName(drMasterDFields, len(fields)), "欄位不足")
 				result.Failed++
 				continue
 			}
 
 			// 看診大師 D 行格式: D|身分證|姓名|生日|電話|就診日|就醫類別
-			nationalID := strings.TrimSpace(fields[1])
-			name := strings.TrimSpace(fields[2])
-			birthday := strings.TrimSpace(fields[3])
-			phone := strings.TrimSpace(fields[4])
-			visitDate := strings.TrimSpace(fields[5])
+			nationalID := sanitizeField(fields[1])
+			name := sanitizeField(fields[2])
+			birthday := normalizeROCDateTime(fields[3])
+			phone := sanitizeField(fields[4])
+			visitDate := normalizeROCDateTime(fields[5])
 			visitType := ""
 			if len(fields) > 6 {
-				visitType = strings.TrimSpace(fields[6])
+				visitType = sanitizeField(fields[6])
 			}
 
 			// 建立病患
 			if nationalID != "" {
-				if _, exists := patientMap[nationalID]; !exists {
-					patient := &HISPatient{
-						NationalID: nationalID,
-						Name:       name,
-						Phone:      phone,
-					}
-					if len(birthday) == 7 {
-						patient.Birthday = convertROCDate(birthday)
-					} else {
-						patient.Birthday = birthday
-					}
-					patientMap[nationalID] = patient
+				patient := &HISPatient{
+					NationalID: nationalID,
+					Name:       name,
+					Phone:      phone,
 				}
+				patient.Birthday = ParseFlexibleDate(birthday)
+				upsertPatient(patientMap, patient)
 			}
 
 			// 建立處方
@@ -332,11 +364,12 @@ func parseDrMasterTXT(content string) (*HISImportResult, error) {
 			}
 
 			rxMap[rxKey] = &HISPrescription{
-				PatientID:      nationalID,
-				PrescriptionNo: fmt.Sprintf("DM-%s-%s", nationalID, visitDate),
-				DispenseDate:   dispenseDate,
-				VisitType:      visitType,
+				PatientID:    nationalID,
+				DispenseDate: dispenseDate,
+				VisitType:    visitType,
 			}
+			rxMap[rxKey].SourceIndex = lineNum
+			setGeneratedPrescriptionNo(rxMap[rxKey], fmt.Sprintf("DM-%s-%s", nationalID, visitDate), "")
 
 			// 慢箋判斷
 			if visitType == "08" {
@@ -356,8 +389,8 @@ func parseDrMasterTXT(content string) (*HISImportResult, error) {
 			}
 
 			// 看診大師 M 行格式: M|藥品代碼|藥品名稱|數量|天數|頻率
-			drugCode := strings.TrimSpace(fields[1])
-			drugName := strings.TrimSpace(fields[2])
+			drugCode := sanitizeField(fields[1])
+			drugName := sanitizeField(fields[2])
 			qtyStr := fields[3]
 			daysStr := ""
 			frequency := ""
@@ -365,11 +398,11 @@ func parseDrMasterTXT(content string) (*HISImportResult, error) {
 				daysStr = fields[4]
 			}
 			if len(fields) > 5 {
-				frequency = strings.TrimSpace(fields[5])
+				frequency = sanitizeField(fields[5])
 			}
 
-			qty, _ := strconv.ParseFloat(strings.TrimSpace(qtyStr), 64)
-			days, _ := strconv.Atoi(strings.TrimSpace(daysStr))
+			qty, _ := strconv.ParseFloat(sanitizeField(qtyStr), 64)
+			days, _ := strconv.Atoi(sanitizeField(daysStr))
 
 			item := HISPrescriptionItem{
 				OrderType:  "1",
@@ -391,6 +424,8 @@ func parseDrMasterTXT(content string) (*HISImportResult, error) {
 		}
 	}
 
+	result.addScanError(scanner.Err(), lineNum)
+
 	for _, p := range patientMap {
 		result.Patients = append(result.Patients, *p)
 	}
@@ -398,18 +433,19 @@ func parseDrMasterTXT(content string) (*HISImportResult, error) {
 		result.Prescriptions = append(result.Prescriptions, *rx)
 	}
 
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
 
 // parseDrMasterCSV 解析看診大師 CSV 格式
-func parseDrMasterCSV(content string) (*HISImportResult, error) {
+func parseDrMasterCSV(ctx context.Context, content string) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "csv",
 		SourceVendor: "drmaster",
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner := newCSVScanner(strings.NewReader(content))
 	patientMap := make(map[string]*HISPatient)
 	rxMap := make(map[string]*HISPrescription)
 	lineNum := 0
@@ -417,13 +453,16 @@ func parseDrMasterCSV(content string) (*HISImportResult, error) {
 	colMap := make(map[string]int)
 
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+		line := sanitizeField(scanner.Text())
 		if line == "" {
 			continue
 		}
 
-		fields := parseCSVLine(line)
+		fields := parseCSVLine(line, ',')
 
 		// 第一行可能是標題
 		if lineNum == 1 {
@@ -436,78 +475,51 @@ func parseDrMasterCSV(content string) (*HISImportResult, error) {
 		}
 
 		result.Total++
+		addDrMasterRow(fields, colMap, lineNum, patientMap, rxMap)
+		result.Imported++
+	}
 
-		// 提取資料
-		nationalID := getFieldByKey(fields, colMap, "national_id")
-		name := getFieldByKey(fields, colMap, "name")
-		birthday := getFieldByKey(fields, colMap, "birthday")
-		phone := getFieldByKey(fields, colMap, "phone")
-		visitDate := getFieldByKey(fields, colMap, "visit_date")
-		drugCode := getFieldByKey(fields, colMap, "drug_code")
-		drugName := getFieldByKey(fields, colMap, "drug_name")
-		qtyStr := getFieldByKey(fields, colMap, "quantity")
-		daysStr := getFieldByKey(fields, colMap, "days")
-		visitType := getFieldByKey(fields, colMap, "visit_type")
-		frequency := getFieldByKey(fields, colMap, "frequency")
-
-		// 建立病患
-		if nationalID != "" {
-			if _, exists := patientMap[nationalID]; !exists {
-				patient := &HISPatient{
-					NationalID: nationalID,
-					Name:       name,
-					Phone:      phone,
-				}
-				if len(birthday) == 7 {
-					patient.Birthday = convertROCDate(birthday)
-				} else if birthday != "" {
-					patient.Birthday = birthday
-				}
-				patientMap[nationalID] = patient
-			}
-		}
+	result.addScanError(scanner.Err(), lineNum)
 
-		// 建立處方
-		if nationalID != "" && visitDate != "" {
-			rxKey := nationalID + "-" + visitDate
-			if _, exists := rxMap[rxKey]; !exists {
-				dispenseDate := visitDate
-				if len(visitDate) == 7 {
-					dispenseDate = convertROCDate(visitDate)
-				}
-				rxMap[rxKey] = &HISPrescription{
-					PatientID:      nationalID,
-					PrescriptionNo: fmt.Sprintf("DM-%s-%s", nationalID, visitDate),
-					DispenseDate:   dispenseDate,
-					VisitType:      visitType,
-				}
+	for _, p := range patientMap {
+		result.Patients = append(result.Patients, *p)
+	}
+	for _, rx := range rxMap {
+		result.Prescriptions = append(result.Prescriptions, *rx)
+	}
 
-				if visitType == "08" {
-					rxMap[rxKey].ChronicRefillNo = 1
-				}
-			}
+	finalizeResult(result)
+	result.Success = result.Failed == 0
+	return result, nil
+}
 
-			// 加入藥品項目
-			if drugCode != "" {
-				qty, _ := strconv.ParseFloat(qtyStr, 64)
-				days, _ := strconv.Atoi(daysStr)
-				rxMap[rxKey].Items = append(rxMap[rxKey].Items, HISPrescriptionItem{
-					OrderType:  "1",
-					DrugCode:   drugCode,
-					DrugName:   drugName,
-					Quantity:   qty,
-					DaysSupply: days,
-					Frequency:  frequency,
-				})
-
-				if days >= 28 && rxMap[rxKey].ChronicRefillNo == 0 {
-					rxMap[rxKey].ChronicRefillNo = 1
-				}
-			}
-		}
+// parseDrMasterDBF 解析看診大師 DBF (dBASE III/IV) 格式
+// 欄位名稱沿用 CSV 的關鍵字對應，字元欄位為 Big5 編碼
+func parseDrMasterDBF(ctx context.Context, content []byte) (*HISImportResult, error) {
+	result := &HISImportResult{
+		SourceType:   "dbf",
+		SourceVendor: "drmaster",
+	}
 
+	table, err := readDBF(content)
+	if err != nil {
+		result.Errors = append(result.Errors, "DBF 解析失敗: "+err.Error())
+		return result, err
+	}
+
+	colMap := buildDrMasterColumnMapping(table.FieldNames)
+	patientMap := make(map[string]*HISPatient)
+	rxMap := make(map[string]*HISPrescription)
+
+	for i, fields := range table.Records {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		result.Total++
+		addDrMasterRow(fields, colMap, i+1, patientMap, rxMap)
 		result.Imported++
 	}
+	result.Skipped = table.Deleted
 
 	for _, p := range patientMap {
 		result.Patients = append(result.Patients, *p)
@@ -516,10 +528,177 @@ func parseDrMasterCSV(content string) (*HISImportResult, error) {
 		result.Prescriptions = append(result.Prescriptions, *rx)
 	}
 
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
 
+// dbfTable DBF 表格內容
+type dbfTable struct {
+	FieldNames []string
+	Records    [][]string
+	Deleted    int // 被標記刪除 (0x2A) 而略過的記錄數
+}
+
+// dbfField DBF 欄位描述
+type dbfField struct {
+	Name   string
+	Type   byte // C=字元, N=數值, D=日期 (YYYYMMDD), L=邏輯
+	Length int
+}
+
+// readDBF 讀取 dBASE III/IV 檔頭與記錄
+func readDBF(content []byte) (*dbfTable, error) {
+	if len(content) < 32 {
+		return nil, fmt.Errorf("檔案長度不足: %w", ErrUnknownFormat)
+	}
+
+	numRecords := int(binary.LittleEndian.Uint32(content[4:8]))
+	headerLen := int(binary.LittleEndian.Uint16(content[8:10]))
+	recordLen := int(binary.LittleEndian.Uint16(content[10:12]))
+	if headerLen < 33 || headerLen > len(content) || recordLen < 1 {
+		return nil, fmt.Errorf("檔頭格式錯誤: %w", ErrUnknownFormat)
+	}
+
+	// 欄位描述區: 每 32 bytes 一欄，以 0x0D 結尾
+	var fields []dbfField
+	for pos := 32; pos+32 <= headerLen && content[pos] != 0x0D; pos += 32 {
+		desc := content[pos : pos+32]
+		name := desc[:11]
+		if idx := bytes.IndexByte(name, 0); idx >= 0 {
+			name = name[:idx]
+		}
+		fields = append(fields, dbfField{
+			Name:   decodeDBFString(name),
+			Type:   desc[11],
+			Length: int(desc[16]),
+		})
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("找不到欄位定義: %w", ErrUnknownFormat)
+	}
+
+	table := &dbfTable{}
+	for _, f := range fields {
+		table.FieldNames = append(table.FieldNames, f.Name)
+	}
+
+	for i := 0; i < numRecords; i++ {
+		start := headerLen + i*recordLen
+		if start+recordLen > len(content) || content[start] == 0x1A {
+			break
+		}
+		rec := content[start : start+recordLen]
+
+		// 刪除旗標: 0x20=有效, 0x2A=已刪除
+		if rec[0] == 0x2A {
+			table.Deleted++
+			continue
+		}
+
+		values := make([]string, 0, len(fields))
+		offset := 1
+		for _, f := range fields {
+			end := offset + f.Length
+			if end > len(rec) {
+				end = len(rec)
+			}
+			raw := rec[offset:end]
+			offset = end
+
+			value := sanitizeField(decodeDBFString(raw))
+			if f.Type == 'D' && len(value) == 8 {
+				// dBASE 日期為西元 YYYYMMDD
+				value = value[:4] + "-" + value[4:6] + "-" + value[6:8]
+			}
+			values = append(values, value)
+		}
+		table.Records = append(table.Records, values)
+	}
+
+	return table, nil
+}
+
+// decodeDBFString 解碼 DBF 字元欄位 (Big5 或 ASCII)
+func decodeDBFString(raw []byte) string {
+	raw = bytes.TrimRight(raw, "\x00 ")
+	if utf8.Valid(raw) {
+		return string(raw)
+	}
+	decoded, _, err := transform.Bytes(traditionalchinese.Big5.NewDecoder(), raw)
+	if err != nil {
+		return string(raw)
+	}
+	return string(decoded)
+}
+
+// addDrMasterRow 將一列表格資料 (CSV 或 DBF 記錄) 併入病患與處方，sourceIndex 為行號或記錄序號
+func addDrMasterRow(fields []string, colMap map[string]int, sourceIndex int, patientMap map[string]*HISPatient, rxMap map[string]*HISPrescription) {
+	// 提取資料
+	nationalID := getFieldByKey(fields, colMap, "national_id")
+	name := getFieldByKey(fields, colMap, "name")
+	birthday := normalizeROCDateTime(getFieldByKey(fields, colMap, "birthday"))
+	phone := getFieldByKey(fields, colMap, "phone")
+	visitDate := normalizeROCDateTime(getFieldByKey(fields, colMap, "visit_date"))
+	drugCode := getFieldByKey(fields, colMap, "drug_code")
+	drugName := getFieldByKey(fields, colMap, "drug_name")
+	qtyStr := getFieldByKey(fields, colMap, "quantity")
+	daysStr := getFieldByKey(fields, colMap, "days")
+	visitType := getFieldByKey(fields, colMap, "visit_type")
+	frequency := getFieldByKey(fields, colMap, "frequency")
+
+	// 建立病患
+	if nationalID != "" {
+		patient := &HISPatient{
+			NationalID: nationalID,
+			Name:       name,
+			Phone:      phone,
+		}
+		patient.Birthday = ParseFlexibleDate(birthday)
+		upsertPatient(patientMap, patient)
+	}
+
+	// 建立處方
+	if nationalID != "" && visitDate != "" {
+		rxKey := nationalID + "-" + visitDate
+		if _, exists := rxMap[rxKey]; !exists {
+			dispenseDate := visitDate
+			if len(visitDate) == 7 {
+				dispenseDate = convertROCDate(visitDate)
+			}
+			rxMap[rxKey] = &HISPrescription{
+				PatientID:    nationalID,
+				DispenseDate: dispenseDate,
+				VisitType:    visitType,
+			}
+			rxMap[rxKey].SourceIndex = sourceIndex
+			setGeneratedPrescriptionNo(rxMap[rxKey], fmt.Sprintf("DM-%s-%s", nationalID, visitDate), "")
+
+			if visitType == "08" {
+				rxMap[rxKey].ChronicRefillNo = 1
+			}
+		}
+
+		// 加入藥品項目
+		if drugCode != "" {
+			qty, _ := strconv.ParseFloat(qtyStr, 64)
+			days, _ := strconv.Atoi(daysStr)
+			rxMap[rxKey].Items = append(rxMap[rxKey].Items, HISPrescriptionItem{
+				OrderType:  "1",
+				DrugCode:   drugCode,
+				DrugName:   drugName,
+				Quantity:   qty,
+				DaysSupply: days,
+				Frequency:  frequency,
+			})
+
+			if days >= 28 && rxMap[rxKey].ChronicRefillNo == 0 {
+				rxMap[rxKey].ChronicRefillNo = 1
+			}
+		}
+	}
+}
+
 // ============================================================================
 // 輔助函數
 // ============================================================================
@@ -553,8 +732,8 @@ func buildDrMasterColumnMapping(headers []string) map[string]int {
 	patterns := map[string][]string{
 		"national_id": {"身分證", "身份證", "ID", "pid"},
 		"name":        {"姓名", "name", "patient"},
-		"birthday":    {"生日", "出生", "birthday"},
-		"phone":       {"電話", "手機", "phone", "mobile"},
+		"birthday":    {"生日", "出生", "birthday", "birth"},
+		"phone":       {"電話", "手機", "phone", "mobile", "tel"},
 		"visit_date":  {"就診日", "調劑日", "日期", "date"},
 		"drug_code":   {"藥品代碼", "藥碼", "健保碼", "code"},
 		"drug_name":   {"藥品名稱", "藥名", "drug"},
@@ -565,7 +744,7 @@ func buildDrMasterColumnMapping(headers []string) map[string]int {
 	}
 
 	for i, h := range headers {
-		h = strings.ToLower(strings.TrimSpace(h))
+		h = strings.ToLower(sanitizeField(h))
 		for key, variants := range patterns {
 			for _, v := range variants {
 				if strings.Contains(h, strings.ToLower(v)) {
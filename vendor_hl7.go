@@ -0,0 +1,376 @@
+// Package parser HL7 v2 藥囑訊息解析器
+// 醫院 HIS 以 HL7 v2 (RDE^O11、ORM^O01) 傳送處方：MSH 為訊息開頭，PID 為病患，ORC/RXE/RXO 為藥囑
+package parser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// hl7Delimiters HL7 分隔符 (由 MSH-1、MSH-2 宣告，預設 |^~\&)
+type hl7Delimiters struct {
+	field, component, repetition, escape, subcomponent byte
+}
+
+// defaultHL7Delimiters HL7 標準預設分隔符
+var defaultHL7Delimiters = hl7Delimiters{'|', '^', '~', '\\', '&'}
+
+// hl7Segment 已切分欄位的區段 (fields[0] 為區段名稱，fields[n] 即第 n 欄；MSH 已對齊編號)
+type hl7Segment struct {
+	name   string
+	fields []string
+	delims hl7Delimiters
+}
+
+// field 取得第 n 欄 (1 起算)，不存在時回傳空字串
+func (s hl7Segment) field(n int) string {
+	if n <= 0 || n >= len(s.fields) {
+		return ""
+	}
+	return s.fields[n]
+}
+
+// component 取得第 n 欄第一個重複的第 c 個組件 (皆 1 起算)，已解除跳脫字元
+func (s hl7Segment) component(n, c int) string {
+	return hl7Component(s.field(n), c, s.delims)
+}
+
+// hl7Component 取得欄位值第一個重複的第 c 個組件並解除跳脫
+func hl7Component(value string, c int, d hl7Delimiters) string {
+	if idx := strings.IndexByte(value, d.repetition); idx >= 0 {
+		value = value[:idx]
+	}
+	parts := strings.Split(value, string(d.component))
+	if c <= 0 || c > len(parts) {
+		return ""
+	}
+	part := parts[c-1]
+	if idx := strings.IndexByte(part, d.subcomponent); idx >= 0 {
+		part = part[:idx]
+	}
+	return sanitizeField(unescapeHL7(part, d))
+}
+
+// unescapeHL7 解除 HL7 跳脫序列 (\F\ \S\ \T\ \R\ \E\)
+func unescapeHL7(s string, d hl7Delimiters) string {
+	esc := string(d.escape)
+	if !strings.Contains(s, esc) {
+		return s
+	}
+	return strings.NewReplacer(
+		esc+"F"+esc, string(d.field),
+		esc+"S"+esc, string(d.component),
+		esc+"T"+esc, string(d.subcomponent),
+		esc+"R"+esc, string(d.repetition),
+		esc+"E"+esc, esc,
+	).Replace(s)
+}
+
+// ============================================================================
+// HL7 解析器
+// ============================================================================
+
+// ParseHL7Message 解析 HL7 v2 藥囑訊息 (RDE^O11、ORM^O01，可多筆訊息串接)
+// 每個 MSH 開始一筆訊息並轉為一張處方：PID 對應病患，RXE (或 RXO) 對應藥品項目，RXR 為給藥途徑；
+// 處方序號取 ORC-2 (placer order number)，未提供時使用 MSH-10 訊息控制碼
+func ParseHL7Message(r io.Reader) (*HISImportResult, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
+	}
+
+	o := newParseOptions()
+	if isBlankContent(content, o) {
+		return emptyFileResult(nil)
+	}
+	return parseHL7Content(content, o)
+}
+
+// parseHL7Content 依解析選項解碼並解析 HL7 內容
+func parseHL7Content(content []byte, o *ParseOptions) (*HISImportResult, error) {
+	return parseHL7Text(o.context(), o.decodeText(content))
+}
+
+// parseHL7Text 解析已轉為 UTF-8 的 HL7 內容 (區段以 CR、LF 或 CRLF 分隔)
+func parseHL7Text(ctx context.Context, content string) (*HISImportResult, error) {
+	result := &HISImportResult{
+		SourceType:   "hl7",
+		SourceVendor: "hl7",
+	}
+
+	patientMap := make(map[string]*HISPatient)
+	var patientOrder []string
+	var currentRx *HISPrescription
+	var currentItem *HISPrescriptionItem
+	msgNo := 0
+	hasPatient := false
+	delims := defaultHL7Delimiters
+
+	flush := func() {
+		if currentRx == nil {
+			return
+		}
+		switch {
+		case !hasPatient:
+			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 筆訊息缺少 PID 區段", msgNo))
+			result.Failed++
+		case len(currentRx.Items) == 0:
+			result.Warnings = append(result.Warnings, fmt.Sprintf("第 %d 筆訊息沒有藥囑 (RXE/RXO)", msgNo))
+			fallthrough
+		default:
+			result.Prescriptions = append(result.Prescriptions, *currentRx)
+		}
+		currentRx, currentItem, hasPatient = nil, nil, false
+	}
+
+	lines := strings.FieldsFunc(content, func(r rune) bool { return r == '\r' || r == '\n' })
+	for lineNum, line := range lines {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		line = sanitizeField(line)
+		if len(line) < 4 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "MSH") {
+			flush()
+			msgNo++
+			result.Total++
+			delims = parseHL7Delimiters(line)
+		}
+		seg := splitHL7Segment(line, delims)
+
+		if currentRx == nil && seg.name != "MSH" {
+			result.addLineError(fmt.Sprintf("第 %d 行 %s 區段前沒有 MSH", lineNum+1, seg.name), lineNum+1, line, "MSH", "缺少訊息表頭")
+			continue
+		}
+
+		switch seg.name {
+		case "MSH":
+			currentRx = &HISPrescription{
+				PrescriptionNo: seg.field(10),
+				ProviderCode:   seg.component(4, 1),
+				DataFormat:     "1",
+			}
+			currentRx.SourceIndex = lineNum + 1
+			currentRx.DispenseDate, currentRx.DispenseTime = splitHL7DateTime(seg.component(7, 1))
+
+		case "PID":
+			patient := hl7Patient(seg)
+			if patient.NationalID == "" {
+				result.addLineError(fmt.Sprintf("第 %d 行 PID 缺少病患識別碼", lineNum+1), lineNum+1, line, "PID-3", "缺少必要欄位")
+				continue
+			}
+			if upsertPatient(patientMap, patient) {
+				patientOrder = append(patientOrder, patient.NationalID)
+			}
+			currentRx.PatientID = patient.NationalID
+			hasPatient = true
+
+		case "ORC":
+			if placer := seg.component(2, 1); placer != "" && len(currentRx.Items) == 0 {
+				currentRx.PrescriptionNo = placer
+			}
+			if date, clock := splitHL7DateTime(seg.component(9, 1)); date != "" {
+				currentRx.DispenseDate, currentRx.DispenseTime = date, clock
+			}
+
+		case "RXE":
+			// RXE-1 數量/時程 (^頻率^期間)、RXE-2 給藥代碼、RXE-3 每次劑量、RXE-10 調劑總量
+			item := HISPrescriptionItem{
+				OrderType:  OrderTypeDrug,
+				DrugCode:   seg.component(2, 1),
+				DrugName:   seg.component(2, 2),
+				Frequency:  seg.component(1, 2),
+				DaysSupply: hl7DurationDays(seg.component(1, 3)),
+			}
+			item.Quantity = parseHL7Number(firstNonEmpty(seg.component(10, 1), seg.component(3, 1)))
+			if existing := findHL7Item(currentRx, item.DrugCode); existing != nil {
+				// RDE 訊息的 RXO 先描述同一藥品，以 RXE 的頻率、期間與數量補足
+				mergeHL7Item(existing, item)
+				currentItem = existing
+			} else {
+				currentItem = appendHL7Item(currentRx, item)
+			}
+
+		case "RXO":
+			// RXO 僅在沒有 RXE 時使用 (ORM 訊息)：RXO-1 藥品代碼、RXO-2 每次劑量、RXO-11 調劑總量
+			item := HISPrescriptionItem{
+				OrderType: OrderTypeDrug,
+				DrugCode:  seg.component(1, 1),
+				DrugName:  seg.component(1, 2),
+			}
+			item.Quantity = parseHL7Number(firstNonEmpty(seg.component(11, 1), seg.component(2, 1)))
+			if findHL7Item(currentRx, item.DrugCode) == nil {
+				currentItem = appendHL7Item(currentRx, item)
+			}
+
+		case "RXR":
+			if currentItem != nil && currentItem.Route == "" {
+				currentItem.Route = seg.component(1, 1)
+			}
+		}
+	}
+	flush()
+
+	for _, id := range patientOrder {
+		result.Patients = append(result.Patients, *patientMap[id])
+	}
+
+	result.Imported = len(result.Prescriptions)
+	finalizeResult(result)
+	result.Success = result.Failed == 0
+	return result, nil
+}
+
+// hl7Patient 由 PID 區段取出病患資料
+// PID-3 有多個重複時優先使用類型為 NI (國民身分證) 或符合身分證格式者
+func hl7Patient(seg hl7Segment) *HISPatient {
+	d := seg.delims
+	nationalID := ""
+	for i, rep := range strings.Split(seg.field(3), string(d.repetition)) {
+		id := strings.ToUpper(hl7Component(rep, 1, d))
+		idType := strings.ToUpper(hl7Component(rep, 5, d))
+		if i == 0 || idType == "NI" || ValidateNationalID(id) {
+			nationalID = id
+		}
+		if idType == "NI" || ValidateNationalID(id) {
+			break
+		}
+	}
+
+	// PID-5 姓名: 姓^名 (中文姓名直接串接)
+	name := seg.component(5, 1) + seg.component(5, 2)
+	patient := &HISPatient{
+		NationalID: nationalID,
+		Name:       name,
+		Phone:      seg.component(13, 1),
+	}
+	patient.Birthday, _ = splitHL7DateTime(seg.component(7, 1))
+	switch strings.ToUpper(seg.component(8, 1)) {
+	case "M":
+		patient.Gender = "M"
+	case "F":
+		patient.Gender = "F"
+	}
+	return patient
+}
+
+// appendHL7Item 加入藥品項目並回傳其指標 (供後續 RXR 填入途徑)
+func appendHL7Item(rx *HISPrescription, item HISPrescriptionItem) *HISPrescriptionItem {
+	if item.DrugCode == "" {
+		return nil
+	}
+	rx.Items = append(rx.Items, item)
+	return &rx.Items[len(rx.Items)-1]
+}
+
+// findHL7Item 取得處方中相同藥品代碼的項目 (RDE 訊息的 RXO 與 RXE 重複描述同一藥品)，沒有時回傳 nil
+func findHL7Item(rx *HISPrescription, drugCode string) *HISPrescriptionItem {
+	if drugCode == "" {
+		return nil
+	}
+	for i := range rx.Items {
+		if rx.Items[i].DrugCode == drugCode {
+			return &rx.Items[i]
+		}
+	}
+	return nil
+}
+
+// mergeHL7Item 以 RXE 的內容補足 RXO 建立的項目：頻率、期間與數量以 RXE 為準，名稱僅在缺少時填入
+func mergeHL7Item(dst *HISPrescriptionItem, src HISPrescriptionItem) {
+	if dst.DrugName == "" {
+		dst.DrugName = src.DrugName
+	}
+	if src.Frequency != "" {
+		dst.Frequency = src.Frequency
+	}
+	if src.DaysSupply > 0 {
+		dst.DaysSupply = src.DaysSupply
+	}
+	if src.Quantity > 0 {
+		dst.Quantity = src.Quantity
+	}
+}
+
+// parseHL7Delimiters 由 MSH 開頭取得分隔符 (MSH|^~\&)
+func parseHL7Delimiters(line string) hl7Delimiters {
+	d := defaultHL7Delimiters
+	if len(line) < 4 {
+		return d
+	}
+	d.field = line[3]
+	enc := line[4:]
+	if idx := strings.IndexByte(enc, d.field); idx >= 0 {
+		enc = enc[:idx]
+	}
+	for i, p := range []*byte{&d.component, &d.repetition, &d.escape, &d.subcomponent} {
+		if i < len(enc) {
+			*p = enc[i]
+		}
+	}
+	return d
+}
+
+// splitHL7Segment 切分區段欄位；MSH 的 MSH-1 即為欄位分隔符，補上一欄使欄位編號一致
+func splitHL7Segment(line string, d hl7Delimiters) hl7Segment {
+	fields := strings.Split(line, string(d.field))
+	if fields[0] == "MSH" {
+		fields = append([]string{"MSH", string(d.field)}, fields[1:]...)
+	}
+	return hl7Segment{name: strings.ToUpper(fields[0]), fields: fields, delims: d}
+}
+
+// splitHL7DateTime 轉換 HL7 日期時間 (YYYYMMDD[HHMM[SS]]) 為 YYYY-MM-DD 與 HH:MM:SS
+func splitHL7DateTime(s string) (date, clock string) {
+	if len(s) < 8 {
+		return "", ""
+	}
+	if _, err := strconv.Atoi(s[:8]); err != nil {
+		return "", ""
+	}
+	date = s[:4] + "-" + s[4:6] + "-" + s[6:8]
+	switch {
+	case len(s) >= 14:
+		clock = s[8:10] + ":" + s[10:12] + ":" + s[12:14]
+	case len(s) >= 12:
+		clock = s[8:10] + ":" + s[10:12] + ":00"
+	}
+	return date, clock
+}
+
+// hl7DurationDays 解析 TQ 期間 (D7、7D、W2 等) 為天數
+func hl7DurationDays(s string) int {
+	s = strings.ToUpper(sanitizeField(s))
+	if s == "" {
+		return 0
+	}
+	unit := 1
+	switch {
+	case strings.HasPrefix(s, "W"), strings.HasSuffix(s, "W"):
+		unit = 7
+	case strings.HasPrefix(s, "D"), strings.HasSuffix(s, "D"):
+	default:
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	n, _ := strconv.Atoi(strings.Trim(s, "DW"))
+	return n * unit
+}
+
+// parseHL7Number 解析數值欄位，失敗時回傳 0
+func parseHL7Number(s string) float64 {
+	f, _ := strconv.ParseFloat(sanitizeField(s), 64)
+	return f
+}
+
+// isHL7Content 判斷內容是否為 HL7 v2 訊息 (以 MSH| 開頭)
+func isHL7Content(content string) bool {
+	s := strings.TrimLeft(strings.TrimPrefix(content, "\uFEFF"), " \t\r\n")
+	return strings.HasPrefix(s, "MSH|")
+}
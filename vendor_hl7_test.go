@@ -0,0 +1,29 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHL7RDEMergesRXOAndRXE(t *testing.T) {
+	msg := strings.Join([]string{
+		`MSH|^~\&|HIS|1101010010|PHARM|RX|20240105103000||RDE^O11|MSG0001|P|2.5`,
+		`PID|1||A123456789^^^^NI||王^小明||19850101|M`,
+		`ORC|NW|RX001`,
+		`RXO|A012345100^Amlodipine 5mg|1`,
+		`RXE|1^QD^D28|A012345100^Amlodipine 5mg|1|||||||28`,
+		`RXR|PO`,
+	}, "\r")
+
+	result, err := ParseHL7Message(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("ParseHL7Message: %v", err)
+	}
+	if len(result.Prescriptions) != 1 || len(result.Prescriptions[0].Items) != 1 {
+		t.Fatalf("prescriptions = %+v, want one prescription with one item", result.Prescriptions)
+	}
+	item := result.Prescriptions[0].Items[0]
+	if item.DrugCode != "A012345100" || item.Frequency != "QD" || item.Route != "PO" || item.Quantity != 28 || item.DaysSupply != 28 {
+		t.Errorf("item = %+v, want A012345100 QD PO quantity 28 for 28 days", item)
+	}
+}
@@ -0,0 +1,256 @@
+// Package parser 健保 IC 卡就醫上傳檔解析器
+// 讀卡機匯出的定長區段格式：每行前兩碼為段別 (01 基本資料、02 就醫資料、03 處方箋)
+package parser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IC 卡上傳檔段別
+const (
+	icSegmentCard  = "01" // 基本資料段
+	icSegmentVisit = "02" // 就醫資料段
+	icSegmentOrder = "03" // 處方箋段
+)
+
+// icMaxCardVisits IC 卡就醫序號上限 (IC01~IC06)，超過需更新卡片
+const icMaxCardVisits = 6
+
+// icCardLayout 基本資料段欄位位置 (Big5 位元組，含前兩碼段別)
+var icCardLayout = struct {
+	CardNumber DATField
+	Name       DATField
+	NationalID DATField
+	Birthday   DATField
+}{
+	CardNumber: DATField{2, 14},
+	Name:       DATField{14, 34},
+	NationalID: DATField{34, 44},
+	Birthday:   DATField{44, 51},
+}
+
+// icVisitLayout 就醫資料段欄位位置
+var icVisitLayout = struct {
+	VisitType     DATField
+	VisitSequence DATField
+	ProviderCode  DATField
+	VisitDateTime DATField
+	Diagnosis     DATField
+}{
+	VisitType:     DATField{2, 4},
+	VisitSequence: DATField{4, 8},
+	ProviderCode:  DATField{8, 18},
+	VisitDateTime: DATField{18, 31},
+	Diagnosis:     DATField{31, 41},
+}
+
+// icOrderLayout 處方箋段欄位位置
+var icOrderLayout = struct {
+	OrderType DATField
+	DrugCode  DATField
+	Frequency DATField
+	Days      DATField
+	Quantity  DATField
+	Route     DATField
+}{
+	OrderType: DATField{2, 3},
+	DrugCode:  DATField{3, 15},
+	Frequency: DATField{15, 33},
+	Days:      DATField{33, 35},
+	Quantity:  DATField{35, 42},
+	Route:     DATField{42, 46},
+}
+
+// ============================================================================
+// IC 卡上傳檔解析器
+// ============================================================================
+
+// ParseICCardUpload 解析健保 IC 卡就醫上傳檔 (Big5 或 UTF-8)
+// 就醫資料段歸屬於前一個基本資料段的卡片，處方箋段歸屬於前一個就醫資料段；
+// 病患的 CardVisitCount 為檔案中該卡的就醫次數，就醫序號超過 IC06 時加入警告
+func ParseICCardUpload(r io.Reader) (*HISImportResult, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
+	}
+
+	o := newParseOptions()
+	if isBlankContent(content, o) {
+		return emptyFileResult(nil)
+	}
+	return parseICCardContent(content, o)
+}
+
+// parseICCardContent 依解析選項解碼並解析 IC 卡上傳檔內容
+func parseICCardContent(content []byte, o *ParseOptions) (*HISImportResult, error) {
+	return parseICCardText(o.context(), o.decodeText(content))
+}
+
+// parseICCardText 解析已轉為 UTF-8 的 IC 卡上傳檔
+func parseICCardText(ctx context.Context, content string) (*HISImportResult, error) {
+	result := &HISImportResult{
+		SourceType:   "txt",
+		SourceVendor: "iccard",
+	}
+
+	scanner := newLineScanner(strings.NewReader(content))
+	patientMap := make(map[string]*HISPatient)
+	var patientOrder []string
+	var currentPatient *HISPatient
+	var currentRx *HISPrescription
+	lineNum := 0
+
+	flush := func() {
+		if currentRx != nil {
+			result.Prescriptions = append(result.Prescriptions, *currentRx)
+			currentRx = nil
+		}
+	}
+
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if sanitizeField(line) == "" {
+			continue
+		}
+		if len(line) < 2 {
+			result.addLineError(fmt.Sprintf("第 %d 行缺少段別", lineNum), lineNum, line, "段別", "行長度不足")
+			continue
+		}
+
+		switch segment := line[:2]; segment {
+		case icSegmentCard:
+			flush()
+			nationalID := strings.ToUpper(datSlice(line, icCardLayout.NationalID))
+			if nationalID == "" {
+				result.addLineError(fmt.Sprintf("第 %d 行基本資料段缺少身分證", lineNum), lineNum, line, "身分證", "缺少必要欄位")
+				result.Failed++
+				currentPatient = nil
+				continue
+			}
+
+			patient := &HISPatient{
+				NationalID: nationalID,
+				Name:       datSlice(line, icCardLayout.Name),
+				CardNumber: datSlice(line, icCardLayout.CardNumber),
+			}
+			patient.Birthday = ParseFlexibleDate(datSlice(line, icCardLayout.Birthday))
+			if upsertPatient(patientMap, patient) {
+				patientOrder = append(patientOrder, nationalID)
+			}
+			currentPatient = patientMap[nationalID]
+
+		case icSegmentVisit:
+			flush()
+			if currentPatient == nil {
+				result.addLineError(fmt.Sprintf("第 %d 行就醫資料段前沒有基本資料段", lineNum), lineNum, line, "段別", "缺少基本資料段")
+				result.Failed++
+				continue
+			}
+			result.Total++
+
+			seq := strings.ToUpper(datSlice(line, icVisitLayout.VisitSequence))
+			rx := &HISPrescription{
+				PatientID:     currentPatient.NationalID,
+				VisitType:     datSlice(line, icVisitLayout.VisitType),
+				VisitSequence: seq,
+				ProviderCode:  datSlice(line, icVisitLayout.ProviderCode),
+				DiagnosisCode: datSlice(line, icVisitLayout.Diagnosis),
+				DataFormat:    "1",
+			}
+			rx.SourceIndex = lineNum
+			rx.DispenseDate, rx.DispenseTime = splitROCDateTime(datSlice(line, icVisitLayout.VisitDateTime))
+			if rx.DispenseDate == "" {
+				result.addLineError(fmt.Sprintf("第 %d 行就醫日期無法解析", lineNum), lineNum, line, "就醫日期", "日期格式錯誤")
+				result.Failed++
+				continue
+			}
+			setGeneratedPrescriptionNo(rx, fmt.Sprintf("IC-%s-%s-%s", rx.PatientID, strings.ReplaceAll(rx.DispenseDate, "-", ""), seq), seq)
+
+			currentPatient.CardVisitCount++
+			if n, ok := icSequenceNumber(seq); ok && n > icMaxCardVisits {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("第 %d 行就醫序號 %s 超過 IC%02d，卡片可能需要更新", lineNum, seq, icMaxCardVisits))
+			}
+			currentRx = rx
+
+		case icSegmentOrder:
+			if currentRx == nil {
+				result.addLineError(fmt.Sprintf("第 %d 行處方箋段前沒有就醫資料段", lineNum), lineNum, line, "段別", "缺少就醫資料段")
+				continue
+			}
+			drugCode := datSlice(line, icOrderLayout.DrugCode)
+			if drugCode == "" {
+				result.addLineError(fmt.Sprintf("第 %d 行處方箋段缺少醫令代碼", lineNum), lineNum, line, "醫令代碼", "缺少必要欄位")
+				continue
+			}
+			qty, _ := strconv.ParseFloat(datSlice(line, icOrderLayout.Quantity), 64)
+			days, _ := strconv.Atoi(datSlice(line, icOrderLayout.Days))
+			currentRx.Items = append(currentRx.Items, HISPrescriptionItem{
+				OrderType:  firstNonEmpty(datSlice(line, icOrderLayout.OrderType), OrderTypeDrug),
+				DrugCode:   drugCode,
+				Frequency:  datSlice(line, icOrderLayout.Frequency),
+				Route:      datSlice(line, icOrderLayout.Route),
+				Quantity:   qty,
+				DaysSupply: days,
+			})
+
+		default:
+			result.addLineError(fmt.Sprintf("第 %d 行段別 %s 無法辨識", lineNum, segment), lineNum, line, "段別", "未知段別")
+		}
+	}
+	flush()
+
+	result.addScanError(scanner.Err(), lineNum)
+
+	for _, id := range patientOrder {
+		result.Patients = append(result.Patients, *patientMap[id])
+	}
+
+	result.Imported = len(result.Prescriptions)
+	finalizeResult(result)
+	result.Success = result.Failed == 0
+	return result, nil
+}
+
+// icSequenceNumber 取出 IC 卡就醫序號的次數 (IC03 -> 3)
+func icSequenceNumber(seq string) (int, bool) {
+	if !strings.HasPrefix(seq, "IC") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(seq[2:])
+	return n, err == nil
+}
+
+// isICCardContent 判斷內容是否為 IC 卡上傳檔 (開頭為基本資料段，且各行皆為已知段別)
+func isICCardContent(content string) bool {
+	lines := strings.SplitN(content, "\n", 21)
+	if len(lines) > 20 {
+		lines = lines[:20]
+	}
+
+	seen := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if sanitizeField(line) == "" {
+			continue
+		}
+		if strings.ContainsAny(line, ",;|\t<") {
+			return false
+		}
+		if seen == 0 && (!strings.HasPrefix(line, icSegmentCard) || datWidth(line) < icCardLayout.Birthday.End) {
+			return false
+		}
+		if !strings.HasPrefix(line, icSegmentCard) && !strings.HasPrefix(line, icSegmentVisit) && !strings.HasPrefix(line, icSegmentOrder) {
+			return false
+		}
+		seen++
+	}
+	return seen > 0
+}
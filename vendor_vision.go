@@ -3,15 +3,12 @@
 package parser
 
 import (
-	"bufio"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
-
-	"golang.org/x/text/encoding/traditionalchinese"
-	"golang.org/x/text/transform"
 )
 
 // ============================================================================
@@ -52,6 +49,7 @@ type VisionRec struct {
 		A14 string `xml:"A14"` // 原處方醫院
 		A17 string `xml:"A17"` // 就診日期時間
 		A18 string `xml:"A18"` // 就醫序號
+		A54 string `xml:"A54"` // 就醫識別碼 (新制)
 		A23 string `xml:"A23"` // 就醫類別
 		D19 string `xml:"d19"` // 診斷碼
 		D20 string `xml:"d20"` // 病患姓名
@@ -74,6 +72,7 @@ type VisionRec struct {
 		D27 string `xml:"d27"` // 給藥天數
 		D28 string `xml:"d28"` // 單次劑量 (展望特有)
 		D36 string `xml:"d36"` // 慢箋次數
+		P10 string `xml:"p10"` // 自費註記
 	} `xml:"MB2"`
 }
 
@@ -102,91 +101,91 @@ type VisionCSVRecord struct {
 func ParseVisionFile(r io.Reader, filename string) (*HISImportResult, error) {
 	content, err := io.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("讀取檔案失敗: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
 	}
 
-	// 偵測編碼並轉換
-	isBig5 := detectBig5(content)
-	var contentStr string
-	if isBig5 {
-		decoded, _, err := transform.Bytes(traditionalchinese.Big5.NewDecoder(), content)
-		if err == nil {
-			contentStr = string(decoded)
-		} else {
-			contentStr = string(content)
-		}
-	} else {
-		contentStr = string(content)
+	o := newParseOptions()
+	if isBlankContent(content, o) {
+		return emptyFileResult(nil)
 	}
+	return parseVisionContent(content, filename, o)
+}
+
+// parseVisionContent 依解析選項解碼並解析展望檔案內容
+func parseVisionContent(content []byte, filename string, o *ParseOptions) (*HISImportResult, error) {
+	// 偵測編碼並轉換
+	contentStr := o.decodeText(content)
 
 	lowerFilename := strings.ToLower(filename)
 
 	// XML 格式
 	if strings.HasSuffix(lowerFilename, ".xml") ||
-	   strings.Contains(contentStr, "<?xml") ||
-	   strings.Contains(contentStr, "<RECS>") {
-		return parseVisionXML(contentStr)
+	   isNHIXMLContent(contentStr) {
+		return parseVisionXML(o.context(), contentStr, o.progress)
 	}
 
 	// CSV 格式
-	return parseVisionCSV(contentStr)
+	return parseVisionCSV(o.context(), contentStr)
 }
 
 // parseVisionXML 解析展望 XML 格式
-func parseVisionXML(content string) (*HISImportResult, error) {
+func parseVisionXML(ctx context.Context, content string, progress *progressReporter) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "xml",
 		SourceVendor: "vision",
 	}
 
-	var xmlData VisionXMLRoot
-	if err := xml.Unmarshal([]byte(content), &xmlData); err != nil {
-		result.Errors = append(result.Errors, "XML 解析失敗: "+err.Error())
-		return result, err
-	}
-
-	result.Total = len(xmlData.Records)
 	patientMap := make(map[string]*HISPatient)
 
-	for i, rec := range xmlData.Records {
+	// 逐筆串流解析 REC，單筆損壞時略過並繼續
+	err := streamXMLRecords(strings.NewReader(content), true, func(i int, chunk xmlRecordChunk, recErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.report(result.Total, 0)
+		result.Total++
+		var rec VisionRec
+		if recErr == nil {
+			recErr = decodeXMLRecord(chunk, &rec)
+		}
+		if recErr != nil {
+			addXMLRecordError(result, i, chunk, recErr)
+			return nil
+		}
+		addXMLRecordWarning(result, i, chunk)
+		checkMSHProviderCode(result, i, rec.MSH.H1)
+
 		// 提取病患
 		if rec.MB1.A12 != "" {
 			patient := &HISPatient{
-				NationalID: strings.TrimSpace(rec.MB1.A12),
-				Name:       strings.TrimSpace(rec.MB1.D20),
-				CardNumber: strings.TrimSpace(rec.MB1.A11),
-				Phone:      strings.TrimSpace(rec.MB1.D21),
-			}
-			if rec.MB1.A13 != "" && len(rec.MB1.A13) >= 7 {
-				patient.Birthday = convertROCDate(rec.MB1.A13[:7])
-			}
-			if _, exists := patientMap[patient.NationalID]; !exists {
-				patientMap[patient.NationalID] = patient
+				NationalID: sanitizeField(rec.MB1.A12),
+				Name:       sanitizeField(rec.MB1.D20),
+				CardNumber: sanitizeField(rec.MB1.A11),
+				Phone:      sanitizeField(rec.MB1.D21),
 			}
+			patient.Birthday = ParseFlexibleDate(rec.MB1.A13)
+			upsertPatient(patientMap, patient)
 		}
 
 		// 提取處方
 		rx := &HISPrescription{
-			PatientID:      strings.TrimSpace(rec.MB1.A12),
-			ProviderCode:   strings.TrimSpace(rec.MB1.A14),
-			VisitType:      strings.TrimSpace(rec.MB1.A23),
-			VisitSequence:  strings.TrimSpace(rec.MB1.A18),
-			DiagnosisCode:  strings.TrimSpace(rec.MB1.D19),
-			PharmacistID:   strings.TrimSpace(rec.MB1.D31),
-			PharmacistName: strings.TrimSpace(rec.MB1.D32),
-			DataFormat:     strings.TrimSpace(rec.MB1.A01),
+			PatientID:      sanitizeField(rec.MB1.A12),
+			ProviderCode:   sanitizeField(rec.MB1.A14),
+			VisitType:      sanitizeField(rec.MB1.A23),
+			VisitSequence:  sanitizeField(rec.MB1.A18),
+			VisitID:        sanitizeField(rec.MB1.A54),
+			DiagnosisCode:  sanitizeField(rec.MB1.D19),
+			PharmacistID:   sanitizeField(rec.MB1.D31),
+			PharmacistName: sanitizeField(rec.MB1.D32),
+			DataFormat:     sanitizeField(rec.MB1.A01),
 		}
+		rx.SourceIndex = i
 
 		// 解析就診日期時間
-		if rec.MB1.A17 != "" && len(rec.MB1.A17) >= 7 {
-			rx.DispenseDate = convertROCDate(rec.MB1.A17[:7])
-			if len(rec.MB1.A17) >= 13 {
-				rx.DispenseTime = rec.MB1.A17[7:9] + ":" + rec.MB1.A17[9:11] + ":" + rec.MB1.A17[11:13]
-			}
-		}
+		rx.DispenseDate, rx.DispenseTime = splitROCDateTime(rec.MB1.A17)
 
 		// 生成處方序號 (展望前綴 VS)
-		rx.PrescriptionNo = fmt.Sprintf("VS-%s-%s-%s", rx.ProviderCode, rx.DispenseDate, rx.VisitSequence)
+		setGeneratedPrescriptionNo(rx, fmt.Sprintf("VS-%s-%s-%s", rx.ProviderCode, rx.DispenseDate, visitKey(rx)), visitKey(rx))
 
 		// 解析慢箋次數
 		if strings.HasPrefix(rx.VisitSequence, "IC") && len(rx.VisitSequence) >= 4 {
@@ -195,24 +194,31 @@ func parseVisionXML(content string) (*HISImportResult, error) {
 			}
 		}
 
+		// 新制就醫識別碼取代就醫序號時 A18 可能為空，改由醫令的連處次數 (d36) 判斷
+		if rx.ChronicRefillNo == 0 && len(rec.MB2s) > 0 {
+			rx.ChronicRefillNo, _ = strconv.Atoi(sanitizeField(rec.MB2s[0].D36))
+		}
+
 		// 解析藥品項目
 		for _, mb2 := range rec.MB2s {
 			item := HISPrescriptionItem{
-				OrderType: strings.TrimSpace(mb2.P1),
-				DrugCode:  strings.TrimSpace(mb2.P2),
-				DrugName:  strings.TrimSpace(mb2.P3),
-				Frequency: strings.TrimSpace(mb2.P5),
-				Route:     strings.TrimSpace(mb2.P6),
+				OrderType: sanitizeField(mb2.P1),
+				DrugCode:  sanitizeField(mb2.P2),
+				DrugName:  sanitizeField(mb2.P3),
+				Frequency: sanitizeField(mb2.P5),
+				Route:     sanitizeField(mb2.P6),
+				IsSelfPay: parseSelfPayFlag(mb2.P10),
 			}
 			if mb2.P7 != "" {
-				item.Quantity, _ = strconv.ParseFloat(strings.TrimSpace(mb2.P7), 64)
+				item.Quantity, _ = strconv.ParseFloat(sanitizeField(mb2.P7), 64)
 			}
 			if mb2.P8 != "" {
-				item.UnitPrice, _ = strconv.ParseFloat(strings.TrimSpace(mb2.P8), 64)
+				item.UnitPrice, _ = strconv.ParseFloat(sanitizeField(mb2.P8), 64)
 			}
 			if mb2.D27 != "" {
-				item.DaysSupply, _ = strconv.Atoi(strings.TrimSpace(mb2.D27))
+				item.DaysSupply, _ = strconv.Atoi(sanitizeField(mb2.D27))
 			}
+			item.DosePerTime, item.Unit = parseDosePerTime(mb2.D28)
 			rx.Items = append(rx.Items, item)
 		}
 
@@ -220,45 +226,63 @@ func parseVisionXML(content string) (*HISImportResult, error) {
 			result.Prescriptions = append(result.Prescriptions, *rx)
 			result.Imported++
 		} else {
-			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 筆記錄無有效資料", i+1))
+			result.addLineError(fmt.Sprintf("第 %d 筆記錄無有效資料", i), i, chunk.Data, "", "無有效資料")
 			result.Failed++
 		}
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		result.Errors = append(result.Errors, err.Error())
+		return result, err
 	}
 
 	for _, p := range patientMap {
 		result.Patients = append(result.Patients, *p)
 	}
 
+	// 同一處方被拆成多筆 REC 時合併
+	mergeSplitPrescriptions(result)
+
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
 
+// visionDFields 展望 D 行欄位名稱 (僅列出解析使用的前段欄位)
+var visionDFields = []string{"記錄類型", "案件", "流水號", "就診日", "身分證", "姓名"}
+
 // parseVisionCSV 解析展望 CSV 格式 (健保申報格式 T/D/P)
-func parseVisionCSV(content string) (*HISImportResult, error) {
+func parseVisionCSV(ctx context.Context, content string) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "csv",
 		SourceVendor: "vision",
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner := newCSVScanner(strings.NewReader(content))
 	patientMap := make(map[string]*HISPatient)
 	rxMap := make(map[string]*HISPrescription)
 	lineNum := 0
 	var currentRxKey string
 
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+		line := sanitizeField(scanner.Text())
 		if line == "" {
 			continue
 		}
 
-		fields := parseCSVLine(line)
+		fields := parseCSVLine(line, ',')
 		if len(fields) < 2 {
 			continue
 		}
 
-		recordType := strings.ToUpper(strings.TrimSpace(fields[0]))
+		recordType := strings.ToUpper(sanitizeField(fields[0]))
 
 		switch recordType {
 		case "T":
@@ -270,26 +294,25 @@ func parseVisionCSV(content string) (*HISImportResult, error) {
 			result.Total++
 
 			if len(fields) < 10 {
-				result.Errors = append(result.Errors, fmt.Sprintf("第 %d 行欄位不足", lineNum))
+				result.addLineError(fmt.Sprintf("第 %d 行欄位不足", lineNum),
+					lineNum, line, missingFieldName(visionDFields, len(fields)), "欄位不足")
 				result.Failed++
 				continue
 			}
 
 			// 展望 D 行格式: D,案件,流水號,就診日,身分證,姓名,...
-			caseType := strings.TrimSpace(getField(fields, 1))
-			seqNo := strings.TrimSpace(getField(fields, 2))
-			visitDate := strings.TrimSpace(getField(fields, 3))
-			nationalID := strings.TrimSpace(getField(fields, 4))
-			name := strings.TrimSpace(getField(fields, 5))
+			caseType := sanitizeField(getField(fields, 1))
+			seqNo := sanitizeField(getField(fields, 2))
+			visitDate := normalizeROCDateTime(getField(fields, 3))
+			nationalID := sanitizeField(getField(fields, 4))
+			name := sanitizeField(getField(fields, 5))
 
 			// 建立病患
 			if nationalID != "" {
-				if _, exists := patientMap[nationalID]; !exists {
-					patientMap[nationalID] = &HISPatient{
-						NationalID: nationalID,
-						Name:       name,
-					}
-				}
+				upsertPatient(patientMap, &HISPatient{
+					NationalID: nationalID,
+					Name:       name,
+				})
 			}
 
 			// 建立處方
@@ -302,11 +325,12 @@ func parseVisionCSV(content string) (*HISImportResult, error) {
 			}
 
 			rxMap[rxKey] = &HISPrescription{
-				PatientID:      nationalID,
-				PrescriptionNo: fmt.Sprintf("VS-%s", seqNo),
-				DispenseDate:   dispenseDate,
-				VisitType:      caseType,
+				PatientID:    nationalID,
+				DispenseDate: dispenseDate,
+				VisitType:    caseType,
 			}
+			rxMap[rxKey].SourceIndex = lineNum
+			setGeneratedPrescriptionNo(rxMap[rxKey], fmt.Sprintf("VS-%s", seqNo), seqNo)
 
 			// 慢箋判斷
 			if caseType == "08" {
@@ -315,10 +339,10 @@ func parseVisionCSV(content string) (*HISImportResult, error) {
 
 			// 總點數與部分負擔 (若有)
 			if len(fields) > 39 {
-				rxMap[rxKey].TotalPoints, _ = strconv.ParseFloat(strings.TrimSpace(fields[39]), 64)
+				rxMap[rxKey].TotalPoints, _ = strconv.ParseFloat(sanitizeField(fields[39]), 64)
 			}
 			if len(fields) > 40 {
-				rxMap[rxKey].Copay, _ = strconv.ParseFloat(strings.TrimSpace(fields[40]), 64)
+				rxMap[rxKey].Copay, _ = strconv.ParseFloat(sanitizeField(fields[40]), 64)
 			}
 
 			result.Imported++
@@ -334,9 +358,9 @@ func parseVisionCSV(content string) (*HISImportResult, error) {
 			}
 
 			// 展望 P 行格式: P,醫令類別,藥品代碼,藥品名稱,...,總量,單價
-			orderType := strings.TrimSpace(getField(fields, 1))
-			drugCode := strings.TrimSpace(getField(fields, 2))
-			drugName := strings.TrimSpace(getField(fields, 3))
+			orderType := sanitizeField(getField(fields, 1))
+			drugCode := sanitizeField(getField(fields, 2))
+			drugName := sanitizeField(getField(fields, 3))
 			qtyStr := getField(fields, 7)
 			priceStr := getField(fields, 8)
 
@@ -347,10 +371,10 @@ func parseVisionCSV(content string) (*HISImportResult, error) {
 			}
 
 			if qtyStr != "" {
-				item.Quantity, _ = strconv.ParseFloat(strings.TrimSpace(qtyStr), 64)
+				item.Quantity, _ = strconv.ParseFloat(sanitizeField(qtyStr), 64)
 			}
 			if priceStr != "" {
-				item.UnitPrice, _ = strconv.ParseFloat(strings.TrimSpace(priceStr), 64)
+				item.UnitPrice, _ = strconv.ParseFloat(sanitizeField(priceStr), 64)
 			}
 
 			if rx, exists := rxMap[currentRxKey]; exists {
@@ -359,6 +383,8 @@ func parseVisionCSV(content string) (*HISImportResult, error) {
 		}
 	}
 
+	result.addScanError(scanner.Err(), lineNum)
+
 	for _, p := range patientMap {
 		result.Patients = append(result.Patients, *p)
 	}
@@ -366,6 +392,7 @@ func parseVisionCSV(content string) (*HISImportResult, error) {
 		result.Prescriptions = append(result.Prescriptions, *rx)
 	}
 
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
@@ -3,15 +3,12 @@
 package parser
 
 import (
-	"bufio"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
-
-	"golang.org/x/text/encoding/traditionalchinese"
-	"golang.org/x/text/transform"
 )
 
 // ============================================================================
@@ -49,6 +46,7 @@ type YaoshengRec struct {
 	SourceHosp    string `xml:"A14"` // 原處方醫院
 	VisitDateTime string `xml:"A17"` // 就診日期時間
 	VisitSeq      string `xml:"A18"` // 就醫序號
+	VisitID       string `xml:"A54"` // 就醫識別碼 (新制)
 	VisitType     string `xml:"A23"` // 就醫類別
 
 	// 診斷與病患資訊
@@ -73,6 +71,7 @@ type YaoshengItem struct {
 	UnitPrice  string `xml:"p8"`  // 單價
 	DaysSupply string `xml:"d27"` // 給藥天數
 	RefillNo   string `xml:"d36"` // 慢箋次數
+	SelfPay    string `xml:"p10"` // 自費註記
 }
 
 // YaoshengDATRecord 耀聖 DAT 格式記錄 (固定欄位寬度)
@@ -89,6 +88,102 @@ type YaoshengDATRecord struct {
 	Days         string // 天數 (3 碼)
 }
 
+// DATField 固定寬度欄位位置 (以 Big5 位元組計，0 起算，End 不含)
+type DATField struct {
+	Start int
+	End   int
+}
+
+// DATLayout 耀聖 DAT 明細記錄 (記錄類型 2) 的欄位位置
+// 不同版本欄寬不同，遇到新版格式可自訂後以 WithDATLayout 傳入
+type DATLayout struct {
+	Name         string // 版本名稱
+	RecordLength int    // 明細記錄長度 (DetectDATLayout 依此推測版本)
+	HospitalCode DATField
+	NationalID   DATField
+	PatientName  DATField
+	Birthday     DATField
+	VisitDate    DATField
+	DrugCode     DATField
+	DrugName     DATField
+	Quantity     DATField
+	Days         DATField
+}
+
+// DefaultDATLayout 耀聖 DAT 預設欄位位置
+var DefaultDATLayout = DATLayout{
+	Name:         "default",
+	RecordLength: 118,
+	HospitalCode: DATField{1, 11},
+	NationalID:   DATField{11, 21},
+	PatientName:  DATField{21, 41},
+	Birthday:     DATField{41, 48},
+	VisitDate:    DATField{48, 55},
+	DrugCode:     DATField{55, 65},
+	DrugName:     DATField{65, 105},
+	Quantity:     DATField{105, 115},
+	Days:         DATField{115, 118},
+}
+
+// knownDATLayouts 已知的 DAT 版本 (依記錄長度由短到長)
+var knownDATLayouts = []*DATLayout{&DefaultDATLayout}
+
+// DetectDATLayout 依明細記錄長度推測 DAT 版本，無法判斷時回傳 nil
+// 部分匯出程式會去除行尾空白，因此取長度不小於最長記錄的最短版本
+func DetectDATLayout(firstLines []string) *DATLayout {
+	maxLen := 0
+	for _, line := range firstLines {
+		if strings.HasPrefix(line, "2") {
+			if n := datWidth(line); n > maxLen {
+				maxLen = n
+			}
+		}
+	}
+	if maxLen == 0 {
+		return nil
+	}
+
+	for _, layout := range knownDATLayouts {
+		if layout.RecordLength >= maxLen {
+			return layout
+		}
+	}
+	return nil
+}
+
+// datWidth 計算字串的 Big5 位元組寬度 (ASCII 為 1，其餘為 2)
+func datWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		if r < 0x80 {
+			n++
+		} else {
+			n += 2
+		}
+	}
+	return n
+}
+
+// datSlice 依 Big5 位元組位置取出欄位 (內容已轉為 UTF-8，中文字以 2 碼寬計算)
+func datSlice(line string, f DATField) string {
+	var sb strings.Builder
+	pos := 0
+	for _, r := range line {
+		w := 1
+		if r >= 0x80 {
+			w = 2
+		}
+		if pos >= f.End {
+			break
+		}
+		if pos >= f.Start {
+			sb.WriteRune(r)
+		}
+		pos += w
+	}
+	return sanitizeField(sb.String())
+}
+
 // ============================================================================
 // 耀聖解析器
 // ============================================================================
@@ -97,97 +192,97 @@ type YaoshengDATRecord struct {
 func ParseYaoshengFile(r io.Reader, filename string) (*HISImportResult, error) {
 	content, err := io.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("讀取檔案失敗: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
 	}
 
-	// 偵測編碼並轉換
-	isBig5 := detectBig5(content)
-	var contentStr string
-	if isBig5 {
-		decoded, _, err := transform.Bytes(traditionalchinese.Big5.NewDecoder(), content)
-		if err == nil {
-			contentStr = string(decoded)
-		} else {
-			contentStr = string(content)
-		}
-	} else {
-		contentStr = string(content)
+	o := newParseOptions()
+	if isBlankContent(content, o) {
+		return emptyFileResult(nil)
 	}
+	return parseYaoshengContent(content, filename, o)
+}
+
+// parseYaoshengContent 依解析選項解碼並解析耀聖檔案內容
+func parseYaoshengContent(content []byte, filename string, o *ParseOptions) (*HISImportResult, error) {
+	// 偵測編碼並轉換
+	contentStr := o.decodeText(content)
 
 	// 判斷格式
 	lowerFilename := strings.ToLower(filename)
 
 	// XML 格式
 	if strings.HasSuffix(lowerFilename, ".xml") ||
-	   strings.Contains(contentStr, "<?xml") ||
-	   strings.Contains(contentStr, "<RECS>") {
-		return parseYaoshengXML(contentStr)
+	   isNHIXMLContent(contentStr) {
+		return parseYaoshengXML(o.context(), contentStr, o.progress)
 	}
 
 	// DAT 格式 (固定寬度)
 	if strings.HasSuffix(lowerFilename, ".dat") {
-		return parseYaoshengDAT(contentStr)
+		return parseYaoshengDAT(o.context(), contentStr, o.DATLayout)
 	}
 
 	// CSV/TXT 格式
-	return parseYaoshengCSV(contentStr)
+	return parseYaoshengCSV(o.context(), contentStr)
 }
 
 // parseYaoshengXML 解析耀聖 XML 格式
-func parseYaoshengXML(content string) (*HISImportResult, error) {
+func parseYaoshengXML(ctx context.Context, content string, progress *progressReporter) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "xml",
 		SourceVendor: "yaosheng",
 	}
 
-	var xmlData YaoshengXMLRoot
-	if err := xml.Unmarshal([]byte(content), &xmlData); err != nil {
-		result.Errors = append(result.Errors, "XML 解析失敗: "+err.Error())
-		return result, err
-	}
-
-	result.Total = len(xmlData.Records)
 	patientMap := make(map[string]*HISPatient)
 
-	for i, rec := range xmlData.Records {
+	// 逐筆串流解析 REC，單筆損壞時略過並繼續
+	err := streamXMLRecords(strings.NewReader(content), true, func(i int, chunk xmlRecordChunk, recErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.report(result.Total, 0)
+		result.Total++
+		var rec YaoshengRec
+		if recErr == nil {
+			recErr = decodeXMLRecord(chunk, &rec)
+		}
+		if recErr != nil {
+			addXMLRecordError(result, i, chunk, recErr)
+			return nil
+		}
+		addXMLRecordWarning(result, i, chunk)
+		checkMSHProviderCode(result, i, rec.HospitalCode)
+
 		// 提取病患
 		if rec.NationalID != "" {
 			patient := &HISPatient{
-				NationalID: strings.TrimSpace(rec.NationalID),
-				Name:       strings.TrimSpace(rec.PatientName),
-				CardNumber: strings.TrimSpace(rec.CardNo),
-				Phone:      strings.TrimSpace(rec.PatientPhone),
-			}
-			if rec.Birthday != "" && len(rec.Birthday) >= 7 {
-				patient.Birthday = convertROCDate(rec.Birthday[:7])
-			}
-			if _, exists := patientMap[patient.NationalID]; !exists {
-				patientMap[patient.NationalID] = patient
+				NationalID: sanitizeField(rec.NationalID),
+				Name:       sanitizeField(rec.PatientName),
+				CardNumber: sanitizeField(rec.CardNo),
+				Phone:      sanitizeField(rec.PatientPhone),
 			}
+			patient.Birthday = ParseFlexibleDate(rec.Birthday)
+			upsertPatient(patientMap, patient)
 		}
 
 		// 提取處方
 		rx := &HISPrescription{
-			PatientID:      strings.TrimSpace(rec.NationalID),
-			ProviderCode:   strings.TrimSpace(rec.SourceHosp),
-			VisitType:      strings.TrimSpace(rec.VisitType),
-			VisitSequence:  strings.TrimSpace(rec.VisitSeq),
-			DiagnosisCode:  strings.TrimSpace(rec.DiagCode),
-			PharmacistID:   strings.TrimSpace(rec.PharmacistID),
-			PharmacistName: strings.TrimSpace(rec.PharmacistName),
-			DataFormat:     strings.TrimSpace(rec.DataFormat),
+			PatientID:      sanitizeField(rec.NationalID),
+			ProviderCode:   sanitizeField(rec.SourceHosp),
+			VisitType:      sanitizeField(rec.VisitType),
+			VisitSequence:  sanitizeField(rec.VisitSeq),
+			VisitID:        sanitizeField(rec.VisitID),
+			DiagnosisCode:  sanitizeField(rec.DiagCode),
+			PharmacistID:   sanitizeField(rec.PharmacistID),
+			PharmacistName: sanitizeField(rec.PharmacistName),
+			DataFormat:     sanitizeField(rec.DataFormat),
 		}
+		rx.SourceIndex = i
 
 		// 解析就診日期時間
-		if rec.VisitDateTime != "" && len(rec.VisitDateTime) >= 7 {
-			rx.DispenseDate = convertROCDate(rec.VisitDateTime[:7])
-			if len(rec.VisitDateTime) >= 13 {
-				rx.DispenseTime = rec.VisitDateTime[7:9] + ":" + rec.VisitDateTime[9:11] + ":" + rec.VisitDateTime[11:13]
-			}
-		}
+		rx.DispenseDate, rx.DispenseTime = splitROCDateTime(rec.VisitDateTime)
 
 		// 生成處方序號
-		rx.PrescriptionNo = fmt.Sprintf("YS-%s-%s-%s", rx.ProviderCode, rx.DispenseDate, rx.VisitSequence)
+		setGeneratedPrescriptionNo(rx, fmt.Sprintf("YS-%s-%s-%s", rx.ProviderCode, rx.DispenseDate, visitKey(rx)), visitKey(rx))
 
 		// 解析慢箋次數
 		if strings.HasPrefix(rx.VisitSequence, "IC") && len(rx.VisitSequence) >= 4 {
@@ -199,20 +294,21 @@ func parseYaoshengXML(content string) (*HISImportResult, error) {
 		// 解析藥品項目
 		for _, item := range rec.Items {
 			rxItem := HISPrescriptionItem{
-				OrderType: strings.TrimSpace(item.OrderType),
-				DrugCode:  strings.TrimSpace(item.DrugCode),
-				DrugName:  strings.TrimSpace(item.DrugName),
-				Frequency: strings.TrimSpace(item.Frequency),
-				Route:     strings.TrimSpace(item.Route),
+				OrderType: sanitizeField(item.OrderType),
+				DrugCode:  sanitizeField(item.DrugCode),
+				DrugName:  sanitizeField(item.DrugName),
+				Frequency: sanitizeField(item.Frequency),
+				Route:     sanitizeField(item.Route),
+				IsSelfPay: parseSelfPayFlag(item.SelfPay),
 			}
 			if item.Quantity != "" {
-				rxItem.Quantity, _ = strconv.ParseFloat(strings.TrimSpace(item.Quantity), 64)
+				rxItem.Quantity, _ = strconv.ParseFloat(sanitizeField(item.Quantity), 64)
 			}
 			if item.UnitPrice != "" {
-				rxItem.UnitPrice, _ = strconv.ParseFloat(strings.TrimSpace(item.UnitPrice), 64)
+				rxItem.UnitPrice, _ = strconv.ParseFloat(sanitizeField(item.UnitPrice), 64)
 			}
 			if item.DaysSupply != "" {
-				rxItem.DaysSupply, _ = strconv.Atoi(strings.TrimSpace(item.DaysSupply))
+				rxItem.DaysSupply, _ = strconv.Atoi(sanitizeField(item.DaysSupply))
 			}
 			rx.Items = append(rx.Items, rxItem)
 		}
@@ -221,90 +317,108 @@ func parseYaoshengXML(content string) (*HISImportResult, error) {
 			result.Prescriptions = append(result.Prescriptions, *rx)
 			result.Imported++
 		} else {
-			result.Errors = append(result.Errors, fmt.Sprintf("第 %d 筆記錄無有效資料", i+1))
+			result.addLineError(fmt.Sprintf("第 %d 筆記錄無有效資料", i), i, chunk.Data, "", "無有效資料")
 			result.Failed++
 		}
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		result.Errors = append(result.Errors, err.Error())
+		return result, err
 	}
 
 	for _, p := range patientMap {
 		result.Patients = append(result.Patients, *p)
 	}
 
+	// 同一處方被拆成多筆 REC 時合併
+	mergeSplitPrescriptions(result)
+
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
 
 // parseYaoshengDAT 解析耀聖 DAT 格式 (固定欄位寬度)
-func parseYaoshengDAT(content string) (*HISImportResult, error) {
+// layout 為 nil 時依記錄長度推測版本，無法判斷則使用 DefaultDATLayout
+func parseYaoshengDAT(ctx context.Context, content string, layout *DATLayout) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "dat",
 		SourceVendor: "yaosheng",
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(content))
+	if layout == nil {
+		lines := strings.SplitN(content, "\n", 51)
+		if len(lines) > 50 {
+			lines = lines[:50]
+		}
+		for i := range lines {
+			lines[i] = strings.TrimRight(lines[i], "\r")
+		}
+		if layout = DetectDATLayout(lines); layout == nil {
+			layout = &DefaultDATLayout
+		}
+	}
+
+	scanner := newLineScanner(strings.NewReader(content))
 	patientMap := make(map[string]*HISPatient)
 	rxMap := make(map[string]*HISPrescription)
 	lineNum := 0
 
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		lineNum++
 		line := scanner.Text()
 		if len(line) < 10 {
 			continue
 		}
 
-		// 耀聖 DAT 格式: 固定欄位寬度
-		// 位置 0-0: 記錄類型 (1=表頭, 2=明細, 9=表尾)
-		// 位置 1-10: 醫院代碼
-		// 位置 11-20: 身分證
-		// 位置 21-40: 姓名
-		// 位置 41-47: 生日
-		// 位置 48-54: 就診日期
-		// 位置 55-64: 藥品代碼
-		// 位置 65-104: 藥品名稱
-		// 位置 105-114: 數量
-		// 位置 115-117: 天數
+		// 耀聖 DAT 格式: 固定欄位寬度 (位置見 DATLayout)
+		// 位置 0: 記錄類型 (1=表頭, 2=明細, 9=表尾)
 
 		recordType := string(line[0])
 
 		if recordType == "2" { // 明細記錄
 			result.Total++
 
-			nationalID := strings.TrimSpace(safeSubstring(line, 11, 21))
-			name := strings.TrimSpace(safeSubstring(line, 21, 41))
-			birthday := strings.TrimSpace(safeSubstring(line, 41, 48))
-			visitDate := strings.TrimSpace(safeSubstring(line, 48, 55))
-			drugCode := strings.TrimSpace(safeSubstring(line, 55, 65))
-			drugName := strings.TrimSpace(safeSubstring(line, 65, 105))
-			qtyStr := strings.TrimSpace(safeSubstring(line, 105, 115))
-			daysStr := strings.TrimSpace(safeSubstring(line, 115, 118))
+			nationalID := datSlice(line, layout.NationalID)
+			name := datSlice(line, layout.PatientName)
+			birthday := datSlice(line, layout.Birthday)
+			visitDate := datSlice(line, layout.VisitDate)
+			drugCode := datSlice(line, layout.DrugCode)
+			drugName := datSlice(line, layout.DrugName)
+			qtyStr := datSlice(line, layout.Quantity)
+			daysStr := datSlice(line, layout.Days)
 
 			// 建立病患
 			if nationalID != "" {
-				if _, exists := patientMap[nationalID]; !exists {
-					patient := &HISPatient{
-						NationalID: nationalID,
-						Name:       name,
-					}
-					if len(birthday) >= 7 {
-						patient.Birthday = convertROCDate(birthday)
-					}
-					patientMap[nationalID] = patient
+				patient := &HISPatient{
+					NationalID: nationalID,
+					Name:       name,
 				}
+				patient.Birthday = ParseFlexibleDate(birthday)
+				upsertPatient(patientMap, patient)
 			}
 
 			// 建立處方
 			rxKey := nationalID + "-" + visitDate
 			if _, exists := rxMap[rxKey]; !exists {
 				dispenseDate := ""
-				if len(visitDate) >= 7 {
+				if len(visitDate) >= 6 {
 					dispenseDate = convertROCDate(visitDate)
 				}
 				rxMap[rxKey] = &HISPrescription{
-					PatientID:      nationalID,
-					PrescriptionNo: fmt.Sprintf("YS-%s-%s", nationalID, visitDate),
-					DispenseDate:   dispenseDate,
+					PatientID:    nationalID,
+					DispenseDate: dispenseDate,
+					ProviderCode: datSlice(line, layout.HospitalCode),
 				}
+				rxMap[rxKey].SourceIndex = lineNum
+				setGeneratedPrescriptionNo(rxMap[rxKey], fmt.Sprintf("YS-%s-%s", nationalID, visitDate), "")
 			}
 
 			// 加入藥品項目
@@ -324,6 +438,8 @@ func parseYaoshengDAT(content string) (*HISImportResult, error) {
 		}
 	}
 
+	result.addScanError(scanner.Err(), lineNum)
+
 	for _, p := range patientMap {
 		result.Patients = append(result.Patients, *p)
 	}
@@ -331,18 +447,19 @@ func parseYaoshengDAT(content string) (*HISImportResult, error) {
 		result.Prescriptions = append(result.Prescriptions, *rx)
 	}
 
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
 
 // parseYaoshengCSV 解析耀聖 CSV 格式
-func parseYaoshengCSV(content string) (*HISImportResult, error) {
+func parseYaoshengCSV(ctx context.Context, content string) (*HISImportResult, error) {
 	result := &HISImportResult{
 		SourceType:   "csv",
 		SourceVendor: "yaosheng",
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner := newCSVScanner(strings.NewReader(content))
 	patientMap := make(map[string]*HISPatient)
 	rxMap := make(map[string]*HISPrescription)
 	lineNum := 0
@@ -350,13 +467,16 @@ func parseYaoshengCSV(content string) (*HISImportResult, error) {
 	colMap := make(map[string]int)
 
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+		line := sanitizeField(scanner.Text())
 		if line == "" {
 			continue
 		}
 
-		fields := parseCSVLine(line)
+		fields := parseCSVLine(line, ',')
 
 		// 第一行可能是標題
 		if lineNum == 1 {
@@ -375,8 +495,8 @@ func parseYaoshengCSV(content string) (*HISImportResult, error) {
 		// 提取資料
 		nationalID := getFieldByKey(fields, colMap, "national_id")
 		name := getFieldByKey(fields, colMap, "name")
-		birthday := getFieldByKey(fields, colMap, "birthday")
-		visitDate := getFieldByKey(fields, colMap, "visit_date")
+		birthday := normalizeROCDateTime(getFieldByKey(fields, colMap, "birthday"))
+		visitDate := normalizeROCDateTime(getFieldByKey(fields, colMap, "visit_date"))
 		drugCode := getFieldByKey(fields, colMap, "drug_code")
 		drugName := getFieldByKey(fields, colMap, "drug_name")
 		qtyStr := getFieldByKey(fields, colMap, "quantity")
@@ -385,18 +505,12 @@ func parseYaoshengCSV(content string) (*HISImportResult, error) {
 
 		// 建立病患
 		if nationalID != "" {
-			if _, exists := patientMap[nationalID]; !exists {
-				patient := &HISPatient{
-					NationalID: nationalID,
-					Name:       name,
-				}
-				if len(birthday) >= 7 {
-					patient.Birthday = convertROCDate(birthday)
-				} else if birthday != "" {
-					patient.Birthday = birthday
-				}
-				patientMap[nationalID] = patient
+			patient := &HISPatient{
+				NationalID: nationalID,
+				Name:       name,
 			}
+			patient.Birthday = ParseFlexibleDate(birthday)
+			upsertPatient(patientMap, patient)
 		}
 
 		// 建立處方
@@ -408,11 +522,12 @@ func parseYaoshengCSV(content string) (*HISImportResult, error) {
 					dispenseDate = convertROCDate(visitDate)
 				}
 				rxMap[rxKey] = &HISPrescription{
-					PatientID:      nationalID,
-					PrescriptionNo: fmt.Sprintf("YS-%s-%s", nationalID, visitDate),
-					DispenseDate:   dispenseDate,
-					VisitType:      visitType,
+					PatientID:    nationalID,
+					DispenseDate: dispenseDate,
+					VisitType:    visitType,
 				}
+				rxMap[rxKey].SourceIndex = lineNum
+				setGeneratedPrescriptionNo(rxMap[rxKey], fmt.Sprintf("YS-%s-%s", nationalID, visitDate), "")
 
 				// 判斷慢箋
 				if visitType == "08" {
@@ -442,6 +557,8 @@ func parseYaoshengCSV(content string) (*HISImportResult, error) {
 		result.Imported++
 	}
 
+	result.addScanError(scanner.Err(), lineNum)
+
 	for _, p := range patientMap {
 		result.Patients = append(result.Patients, *p)
 	}
@@ -449,6 +566,7 @@ func parseYaoshengCSV(content string) (*HISImportResult, error) {
 		result.Prescriptions = append(result.Prescriptions, *rx)
 	}
 
+	finalizeResult(result)
 	result.Success = result.Failed == 0
 	return result, nil
 }
@@ -496,7 +614,7 @@ func buildYaoshengColumnMapping(headers []string) map[string]int {
 	}
 
 	for i, h := range headers {
-		h = strings.ToLower(strings.TrimSpace(h))
+		h = strings.ToLower(sanitizeField(h))
 		for key, variants := range patterns {
 			for _, v := range variants {
 				if strings.Contains(h, strings.ToLower(v)) {
@@ -528,22 +646,9 @@ func getYaoshengDefaultColumns() map[string]int {
 
 // getFieldByKey 透過 key 取得欄位值
 func getFieldByKey(fields []string, colMap map[string]int, key string) string {
-	if idx, ok := colMap[key]; ok && idx < len(fields) {
-		return strings.TrimSpace(fields[idx])
+	if idx, ok := colMap[key]; ok && idx >= 0 && idx < len(fields) {
+		return sanitizeField(fields[idx])
 	}
 	return ""
 }
 
-// safeSubstring 安全取子字串
-func safeSubstring(s string, start, end int) string {
-	if start < 0 {
-		start = 0
-	}
-	if end > len(s) {
-		end = len(s)
-	}
-	if start >= end {
-		return ""
-	}
-	return s[start:end]
-}
@@ -0,0 +1,219 @@
+// Package parser 宇康 (Yukon) HIS 解析器
+// 支援宇康藥局系統匯出的分號分隔 TXT (以 # 開頭的表頭行)
+package parser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// 宇康解析器
+// ============================================================================
+
+// ParseYukonFile 解析宇康 HIS 匯出檔案
+func ParseYukonFile(r io.Reader, filename string) (*HISImportResult, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadFailed, err)
+	}
+
+	o := newParseOptions()
+	if isBlankContent(content, o) {
+		return emptyFileResult(nil)
+	}
+	return parseYukonContent(content, filename, o)
+}
+
+// parseYukonContent 依解析選項解碼並解析宇康檔案內容
+func parseYukonContent(content []byte, filename string, o *ParseOptions) (*HISImportResult, error) {
+	return parseYukonTXT(o.context(), o.decodeText(content))
+}
+
+// parseYukonTXT 解析宇康 TXT 格式 (分號分隔，一列一藥品)
+// 第一個 # 開頭的行為欄位表頭，其餘 # 開頭的行視為註解；沒有表頭時使用預設欄位順序
+func parseYukonTXT(ctx context.Context, content string) (*HISImportResult, error) {
+	result := &HISImportResult{
+		SourceType:   "txt",
+		SourceVendor: "yukon",
+	}
+
+	scanner := newLineScanner(strings.NewReader(content))
+	patientMap := make(map[string]*HISPatient)
+	rxMap := make(map[string]*HISPrescription)
+	var patientOrder, rxOrder []string
+	lineNum := 0
+	var colMap map[string]int
+
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		lineNum++
+		line := sanitizeField(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		// 表頭與註解
+		if strings.HasPrefix(line, "#") {
+			if colMap == nil {
+				if header := strings.Split(strings.TrimPrefix(line, "#"), ";"); len(header) >= 3 {
+					colMap = buildYukonColumnMapping(header)
+				}
+			}
+			continue
+		}
+		if colMap == nil {
+			colMap = getYukonDefaultColumns()
+		}
+
+		fields := strings.Split(line, ";")
+		result.Total++
+
+		nationalID := getFieldByKey(fields, colMap, "national_id")
+		visitDate := normalizeROCDateTime(getFieldByKey(fields, colMap, "visit_date"))
+		if nationalID == "" || visitDate == "" {
+			field := "身分證"
+			if nationalID != "" {
+				field = "調劑日期"
+			}
+			result.addLineError(fmt.Sprintf("第 %d 行缺少%s", lineNum, field), lineNum, line, field, "缺少必要欄位")
+			result.Failed++
+			continue
+		}
+
+		// 建立病患
+		patient := &HISPatient{
+			NationalID: nationalID,
+			Name:       getFieldByKey(fields, colMap, "name"),
+			Phone:      getFieldByKey(fields, colMap, "phone"),
+		}
+		patient.Birthday = ParseFlexibleDate(getFieldByKey(fields, colMap, "birthday"))
+		if upsertPatient(patientMap, patient) {
+			patientOrder = append(patientOrder, nationalID)
+		}
+
+		// 建立處方 (有處方號時以處方號區分同日多張處方)
+		rxNo := getFieldByKey(fields, colMap, "prescription_no")
+		rxKey := nationalID + "-" + visitDate + "-" + rxNo
+		rx, exists := rxMap[rxKey]
+		if !exists {
+			dispenseDate := visitDate
+			if len(visitDate) >= 7 {
+				dispenseDate = convertROCDate(visitDate)
+			}
+			rx = &HISPrescription{
+				PatientID:    nationalID,
+				DispenseDate: dispenseDate,
+				VisitType:    getFieldByKey(fields, colMap, "visit_type"),
+				ProviderName: getFieldByKey(fields, colMap, "hospital"),
+			}
+			rx.SourceIndex = lineNum
+			setGeneratedPrescriptionNo(rx, fmt.Sprintf("YK-%s-%s", nationalID, visitDate), "")
+			if rxNo != "" {
+				setGeneratedPrescriptionNo(rx, "YK-"+rxNo, rxNo)
+			}
+			if rx.VisitType == "08" {
+				rx.ChronicRefillNo = 1
+			}
+			rxMap[rxKey] = rx
+			rxOrder = append(rxOrder, rxKey)
+		}
+
+		// 加入藥品項目
+		if drugCode := getFieldByKey(fields, colMap, "drug_code"); drugCode != "" {
+			item := HISPrescriptionItem{
+				OrderType: "1",
+				DrugCode:  drugCode,
+				DrugName:  getFieldByKey(fields, colMap, "drug_name"),
+				Frequency: getFieldByKey(fields, colMap, "frequency"),
+			}
+			item.Quantity, _ = strconv.ParseFloat(getFieldByKey(fields, colMap, "quantity"), 64)
+			item.DaysSupply, _ = strconv.Atoi(getFieldByKey(fields, colMap, "days"))
+			item.UnitPrice, _ = strconv.ParseFloat(getFieldByKey(fields, colMap, "unit_price"), 64)
+			rx.Items = append(rx.Items, item)
+
+			// 若天數 >= 28，視為慢箋
+			if item.DaysSupply >= 28 && rx.ChronicRefillNo == 0 {
+				rx.ChronicRefillNo = 1
+			}
+		}
+
+		result.Imported++
+	}
+
+	result.addScanError(scanner.Err(), lineNum)
+
+	for _, id := range patientOrder {
+		result.Patients = append(result.Patients, *patientMap[id])
+	}
+	for _, key := range rxOrder {
+		result.Prescriptions = append(result.Prescriptions, *rxMap[key])
+	}
+
+	finalizeResult(result)
+	result.Success = result.Failed == 0
+	return result, nil
+}
+
+// ============================================================================
+// 輔助函數
+// ============================================================================
+
+// yukonFrequencyAliases 宇康表頭中頻率欄的名稱 (通用欄位對應不含頻率)
+var yukonFrequencyAliases = []string{"頻率", "用法", "frequency", "freq"}
+
+// buildYukonColumnMapping 依宇康表頭建立欄位對應: 通用欄位對應再加上頻率欄
+func buildYukonColumnMapping(header []string) map[string]int {
+	colMap, _ := buildColumnMapping(header)
+	for i, h := range header {
+		h = strings.ToLower(sanitizeField(h))
+		for _, v := range yukonFrequencyAliases {
+			if strings.Contains(h, v) {
+				colMap["frequency"] = i
+				break
+			}
+		}
+	}
+	return colMap
+}
+
+// getYukonDefaultColumns 取得宇康預設欄位順序
+func getYukonDefaultColumns() map[string]int {
+	// 宇康常見匯出順序: 身分證;姓名;生日;電話;處方號;調劑日期;就醫類別;藥品代碼;藥品名稱;頻率;數量;天數;單價
+	return map[string]int{
+		"national_id":     0,
+		"name":            1,
+		"birthday":        2,
+		"phone":           3,
+		"prescription_no": 4,
+		"visit_date":      5,
+		"visit_type":      6,
+		"drug_code":       7,
+		"drug_name":       8,
+		"frequency":       9,
+		"quantity":        10,
+		"days":            11,
+		"unit_price":      12,
+	}
+}
+
+// isYukonContent 判斷內容是否為宇康分號分隔格式
+// 特徵: 第一個非空白行為 # 開頭且以分號分隔，或資料行以分號分隔且不含逗號與 |
+func isYukonContent(content string) bool {
+	for _, line := range strings.SplitN(content, "\n", 20) {
+		line = sanitizeField(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			return strings.Count(line, ";") >= 2
+		}
+		return strings.Count(line, ";") >= 3 && !strings.ContainsAny(line, ",|")
+	}
+	return false
+}
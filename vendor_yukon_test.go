@@ -0,0 +1,44 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+const yukonTXT = "#身分證;姓名;調劑日期;藥品代碼;用法;數量;天數\n" +
+	"A123456789;王小明;1130105;AC12345100;QD;28;28\n"
+
+func TestParseYukonFrequency(t *testing.T) {
+	result, err := ParseWithOptions(strings.NewReader(yukonTXT), "export.txt", VendorAuto)
+	if err != nil {
+		t.Fatalf("ParseWithOptions: %v", err)
+	}
+	if result.SourceVendor != "yukon" {
+		t.Fatalf("SourceVendor = %q, want yukon", result.SourceVendor)
+	}
+	if len(result.Prescriptions) != 1 || result.Prescriptions[0].Items[0].Frequency != "QD" {
+		t.Errorf("prescriptions = %+v, want one item with frequency QD", result.Prescriptions)
+	}
+
+	// 通用欄位對應不含頻率
+	if colMap, _ := buildColumnMapping([]string{"身分證", "用法"}); len(colMap) != 1 {
+		t.Errorf("generic mapping = %v, want only national_id", colMap)
+	}
+}
+
+func TestDetectVendorYukonFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		content  string
+		want     HISVendor
+	}{
+		{"yk_0105.txt", yukonTXT, VendorYukon},
+		{"yukon.csv", genericMappingCSV, VendorYukon},
+		{"daily_yk_0105.csv", genericMappingCSV, VendorGeneric},
+	}
+	for _, tt := range tests {
+		if got := detectVendor([]byte(tt.content), tt.filename); got != tt.want {
+			t.Errorf("detectVendor(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}